@@ -0,0 +1,760 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"sowing/internal/audit"
+	"sowing/internal/auth"
+	"sowing/internal/export"
+	"sowing/internal/models"
+	"sowing/internal/page"
+	"sowing/internal/settings"
+	"sowing/internal/silo"
+)
+
+// handleAdminCommands runs "sowing admin <command>" and exits, or returns if
+// no admin command was given.
+func handleAdminCommands(db *sql.DB) {
+	args := flag.Args()
+	if len(args) == 0 || args[0] != "admin" {
+		return
+	}
+
+	// Shift args to remove "admin"
+	args = args[1:]
+
+	if len(args) == 0 {
+		fmt.Println("Usage: sowing admin <command> [flags]")
+		fmt.Println()
+		fmt.Println("Users:  create-user, list-users, disable-user, delete-user, reset-password,")
+		fmt.Println("        reset-2fa, unlock-user, login-attempts, grant, revoke")
+		fmt.Println("Silos:  create-silo, list-silos, rename-silo, archive-silo, delete-silo,")
+		fmt.Println("        list-pages, export-silo, import-org")
+		fmt.Println("Access: list-tokens, revoke-sessions, set-registration")
+		fmt.Println("Data:   backup, restore, migrate, git-sync, git-rebuild, git-import")
+		fmt.Println()
+		fmt.Println("Run sowing admin <command> -h to see a command's flags.")
+		os.Exit(1)
+	}
+
+	// Changes made here are recorded in the audit log alongside those made
+	// in the web admin console.
+	auditLog := audit.NewRepository(db)
+
+	// set-admin was replaced by grant and revoke, but still works for the
+	// scripts that use it.
+	if args[0] == "set-admin" {
+		args = setAdminArgs(args[1:])
+	}
+
+	switch args[0] {
+	case "create-user":
+		createCmd := flag.NewFlagSet("create-user", flag.ExitOnError)
+		username := createCmd.String("username", "", "The username for the new user.")
+		displayName := createCmd.String("display-name", "", "The display name for the new user.")
+		password := createCmd.String("password", "", "The password for the new user.")
+		email := createCmd.String("email", "", "The email address of the new user.")
+		isAdmin := createCmd.Bool("admin", false, "Make the new user an administrator.")
+		createCmd.Parse(args[1:])
+
+		if *username == "" || *displayName == "" || *password == "" {
+			fmt.Println("Username, display name, and password are required.")
+			os.Exit(1)
+		}
+
+		passwordHash, err := auth.HashPassword(*password, *username)
+		if err != nil {
+			log.Fatalf("Error hashing password: %v", err)
+		}
+
+		authRepo := auth.NewRepository(db)
+		user := &models.User{
+			Username:    *username,
+			DisplayName: *displayName,
+			Email:       *email,
+			IsAdmin:     *isAdmin,
+		}
+		identity := &models.Identity{
+			Provider:       "local",
+			ProviderUserID: *username,
+			PasswordHash:   &passwordHash,
+		}
+
+		if err := authRepo.CreateUser(user, identity); err != nil {
+			log.Fatalf("Error creating user: %v", err)
+		}
+
+		auditLog.RecordCLI("user.create", user.Username, "")
+		fmt.Println("User created successfully.")
+		os.Exit(0)
+	case "create-silo":
+		siloCmd := flag.NewFlagSet("create-silo", flag.ExitOnError)
+		name := siloCmd.String("name", "", "The name of the new silo.")
+		slug := siloCmd.String("slug", "", "The slug for the new silo.")
+		owner := siloCmd.String("owner", "", "The username of the silo's owner, who is also recorded as the author of its home page.")
+		siloCmd.Parse(args[1:])
+
+		if *name == "" || *slug == "" || *owner == "" {
+			fmt.Println("Name, slug and owner are required.")
+			os.Exit(1)
+		}
+		if err := silo.ValidateSlug(*slug); err != nil {
+			fmt.Println("Invalid slug:", err)
+			os.Exit(1)
+		}
+
+		user := mustFindUser(auth.NewRepository(db), *owner)
+
+		siloRepo := silo.NewRepository(db)
+		err := siloRepo.Create(*name, *slug, nil, user.ID)
+		if err != nil {
+			log.Fatalf("Error creating silo: %v", err)
+		}
+
+		auditLog.RecordCLI("silo.create", *slug, *owner)
+		fmt.Println("Silo created successfully.")
+		os.Exit(0)
+	case "list-tokens":
+		listCmd := flag.NewFlagSet("list-tokens", flag.ExitOnError)
+		username := listCmd.String("username", "", "Only list tokens belonging to this user.")
+		format := listCmd.String("format", "table", "The output format: table or json.")
+		listCmd.Parse(args[1:])
+
+		authRepo := auth.NewRepository(db)
+
+		var tokens []models.APIToken
+		var err error
+		if *username != "" {
+			user := mustFindUser(authRepo, *username)
+			tokens, err = authRepo.ListAPITokensByUser(user.ID)
+		} else {
+			tokens, err = authRepo.ListAPITokens()
+		}
+		if err != nil {
+			log.Fatalf("Error listing tokens: %v", err)
+		}
+
+		type tokenOutput struct {
+			ID         int        `json:"id"`
+			Username   string     `json:"username"`
+			Name       string     `json:"name"`
+			Scopes     []string   `json:"scopes"`
+			CreatedAt  time.Time  `json:"created_at"`
+			ExpiresAt  *time.Time `json:"expires_at"`
+			LastUsedAt *time.Time `json:"last_used_at"`
+		}
+		var output []tokenOutput
+		var rows [][]string
+		usernames := make(map[int]string)
+		for _, token := range tokens {
+			if _, ok := usernames[token.UserID]; !ok {
+				if user, err := authRepo.FindUserByID(token.UserID); err == nil {
+					usernames[token.UserID] = user.Username
+				}
+			}
+			output = append(output, tokenOutput{token.ID, usernames[token.UserID], token.Name, token.Scopes, token.CreatedAt, token.ExpiresAt, token.LastUsedAt})
+			rows = append(rows, []string{
+				strconv.Itoa(token.ID),
+				usernames[token.UserID],
+				token.Name,
+				strings.Join(token.Scopes, ","),
+				token.CreatedAt.Format("2006-01-02"),
+				formatOptionalTime(token.ExpiresAt, "never"),
+				formatOptionalTime(token.LastUsedAt, "never"),
+			})
+		}
+		printOutput(*format, output, []string{"ID", "USER", "NAME", "SCOPES", "CREATED", "EXPIRES", "LAST USED"}, rows)
+		os.Exit(0)
+	case "reset-2fa":
+		resetCmd := flag.NewFlagSet("reset-2fa", flag.ExitOnError)
+		username := resetCmd.String("username", "", "The user whose two-factor authentication should be reset.")
+		resetCmd.Parse(args[1:])
+
+		if *username == "" {
+			fmt.Println("Username is required.")
+			os.Exit(1)
+		}
+
+		authRepo := auth.NewRepository(db)
+		user := mustFindUser(authRepo, *username)
+
+		if err := authRepo.DeleteTOTP(user.ID); err != nil {
+			log.Fatalf("Error resetting two-factor authentication: %v", err)
+		}
+
+		auditLog.RecordCLI("user.reset_2fa", user.Username, "")
+		fmt.Println("Two-factor authentication reset. The user can now log in with their password alone.")
+		os.Exit(0)
+	case "revoke-sessions":
+		revokeCmd := flag.NewFlagSet("revoke-sessions", flag.ExitOnError)
+		username := revokeCmd.String("username", "", "The user whose sessions should be revoked.")
+		all := revokeCmd.Bool("all", false, "Revoke the sessions of all users.")
+		revokeCmd.Parse(args[1:])
+
+		if (*username == "") == !*all {
+			fmt.Println("Either -username or -all is required.")
+			os.Exit(1)
+		}
+
+		authRepo := auth.NewRepository(db)
+
+		var revoked int64
+		var err error
+		if *all {
+			revoked, err = authRepo.DeleteAllSessions()
+		} else {
+			user, findErr := authRepo.FindUserByUsername(*username)
+			if findErr != nil {
+				log.Fatalf("Error finding user: %v", findErr)
+			}
+			revoked, err = authRepo.DeleteUserSessions(user.ID, "")
+		}
+		if err != nil {
+			log.Fatalf("Error revoking sessions: %v", err)
+		}
+
+		target := *username
+		if *all {
+			target = "all users"
+		}
+		auditLog.RecordCLI("user.revoke_sessions", target, fmt.Sprintf("%d sessions", revoked))
+		fmt.Printf("Revoked %d sessions.\n", revoked)
+		os.Exit(0)
+	case "login-attempts":
+		attemptsCmd := flag.NewFlagSet("login-attempts", flag.ExitOnError)
+		username := attemptsCmd.String("username", "", "Only list attempts for this username.")
+		limit := attemptsCmd.Int("limit", 50, "The maximum number of attempts to list.")
+		format := attemptsCmd.String("format", "table", "The output format: table or json.")
+		attemptsCmd.Parse(args[1:])
+
+		authRepo := auth.NewRepository(db)
+		attempts, err := authRepo.ListLoginAttempts(*username, *limit)
+		if err != nil {
+			log.Fatalf("Error listing login attempts: %v", err)
+		}
+
+		type attemptOutput struct {
+			Time      time.Time `json:"time"`
+			Username  string    `json:"username"`
+			IP        string    `json:"ip"`
+			Succeeded bool      `json:"succeeded"`
+			Reason    string    `json:"reason,omitempty"`
+		}
+		var output []attemptOutput
+		var rows [][]string
+		for _, attempt := range attempts {
+			result := "ok"
+			if !attempt.Succeeded {
+				result = "failed (" + attempt.Reason + ")"
+			}
+			output = append(output, attemptOutput{attempt.CreatedAt, attempt.Username, attempt.IP, attempt.Succeeded, attempt.Reason})
+			rows = append(rows, []string{
+				attempt.CreatedAt.Format("2006-01-02 15:04:05"),
+				attempt.Username,
+				attempt.IP,
+				result,
+			})
+		}
+		printOutput(*format, output, []string{"TIME", "USERNAME", "IP", "RESULT"}, rows)
+		os.Exit(0)
+	case "unlock-user":
+		unlockCmd := flag.NewFlagSet("unlock-user", flag.ExitOnError)
+		username := unlockCmd.String("username", "", "The user to unlock.")
+		unlockCmd.Parse(args[1:])
+
+		if *username == "" {
+			fmt.Println("Username is required.")
+			os.Exit(1)
+		}
+
+		authRepo := auth.NewRepository(db)
+		if err := authRepo.DeleteLockout(*username); err != nil {
+			log.Fatalf("Error unlocking user: %v", err)
+		}
+
+		auditLog.RecordCLI("user.unlock", *username, "")
+		fmt.Println("User unlocked. Their failed login count has been reset.")
+		os.Exit(0)
+	case "reset-password":
+		resetCmd := flag.NewFlagSet("reset-password", flag.ExitOnError)
+		username := resetCmd.String("username", "", "The user whose password should be reset.")
+		baseURL := resetCmd.String("base-url", "http://localhost:8080", "The address users reach Sowing at.")
+		validFor := resetCmd.Duration("valid-for", 24*time.Hour, "How long the reset link can be used.")
+		resetCmd.Parse(args[1:])
+
+		if *username == "" {
+			fmt.Println("Username is required.")
+			os.Exit(1)
+		}
+
+		authService := auth.NewService(auth.NewRepository(db), settings.NewRepository(db))
+		user, err := authService.Repo.FindUserByUsername(*username)
+		if err != nil {
+			log.Fatalf("Error finding user: %v", err)
+		}
+		token, err := authService.CreatePasswordReset(user.ID, *validFor)
+		if err != nil {
+			log.Fatalf("Error creating password reset: %v", err)
+		}
+
+		auditLog.RecordCLI("user.reset_password", user.Username, "")
+		fmt.Printf("Send this link to %s. It can be used once, within %s:\n", user.Username, *validFor)
+		fmt.Printf("%s/reset-password?token=%s\n", strings.TrimSuffix(*baseURL, "/"), token)
+		os.Exit(0)
+	case "set-registration":
+		registrationCmd := flag.NewFlagSet("set-registration", flag.ExitOnError)
+		mode := registrationCmd.String("mode", "", "Who may register: "+strings.Join(auth.RegistrationModes, ", ")+".")
+		domains := registrationCmd.String("domains", "", "Comma separated email domains allowed to register in domain mode.")
+		registrationCmd.Parse(args[1:])
+
+		authService := auth.NewService(auth.NewRepository(db), settings.NewRepository(db))
+		policy := auth.RegistrationPolicy{Mode: *mode, AllowedDomains: auth.ParseDomains(*domains)}
+		if err := authService.SetRegistrationPolicy(policy); err != nil {
+			log.Fatalf("Error updating registration policy: %v", err)
+		}
+
+		auditLog.RecordCLI("registration.policy", policy.Mode, strings.Join(policy.AllowedDomains, ", "))
+		fmt.Println("Registration policy updated.")
+		os.Exit(0)
+	case "list-users":
+		listCmd := flag.NewFlagSet("list-users", flag.ExitOnError)
+		status := listCmd.String("status", "", "Only list users with this status: active, pending or disabled.")
+		format := listCmd.String("format", "table", "The output format: table or json.")
+		listCmd.Parse(args[1:])
+
+		authRepo := auth.NewRepository(db)
+		var users []models.User
+		var err error
+		if *status != "" {
+			users, err = authRepo.ListUsersByStatus(*status)
+		} else {
+			users, err = authRepo.ListUsers()
+		}
+		if err != nil {
+			log.Fatalf("Error listing users: %v", err)
+		}
+
+		type userOutput struct {
+			ID          int    `json:"id"`
+			Username    string `json:"username"`
+			DisplayName string `json:"display_name"`
+			Email       string `json:"email"`
+			Status      string `json:"status"`
+			Admin       bool   `json:"admin"`
+		}
+		var output []userOutput
+		var rows [][]string
+		for _, user := range users {
+			output = append(output, userOutput{user.ID, user.Username, user.DisplayName, user.Email, user.Status, user.IsAdmin})
+			rows = append(rows, []string{
+				strconv.Itoa(user.ID),
+				user.Username,
+				user.DisplayName,
+				user.Email,
+				user.Status,
+				formatBool(user.IsAdmin),
+			})
+		}
+		printOutput(*format, output, []string{"ID", "USERNAME", "DISPLAY NAME", "EMAIL", "STATUS", "ADMIN"}, rows)
+		os.Exit(0)
+	case "disable-user":
+		disableCmd := flag.NewFlagSet("disable-user", flag.ExitOnError)
+		username := disableCmd.String("username", "", "The user to disable.")
+		enable := disableCmd.Bool("enable", false, "Enable the user again instead.")
+		disableCmd.Parse(args[1:])
+
+		if *username == "" {
+			fmt.Println("Username is required.")
+			os.Exit(1)
+		}
+
+		authService := auth.NewService(auth.NewRepository(db), settings.NewRepository(db))
+		user := mustFindUser(authService.Repo, *username)
+
+		if *enable {
+			if err := authService.EnableUser(user.ID); err != nil {
+				log.Fatalf("Error enabling user: %v", err)
+			}
+			auditLog.RecordCLI("user.enable", user.Username, "")
+			fmt.Println("User enabled.")
+			os.Exit(0)
+		}
+
+		if err := authService.DisableUser(user.ID); err != nil {
+			log.Fatalf("Error disabling user: %v", err)
+		}
+		auditLog.RecordCLI("user.disable", user.Username, "")
+		fmt.Println("User disabled and logged out everywhere.")
+		os.Exit(0)
+	case "delete-user":
+		deleteCmd := flag.NewFlagSet("delete-user", flag.ExitOnError)
+		username := deleteCmd.String("username", "", "The user to delete.")
+		reassignTo := deleteCmd.String("reassign-to", "", "The user who becomes the author of the deleted user's revisions.")
+		deleteCmd.Parse(args[1:])
+
+		if *username == "" || *reassignTo == "" {
+			fmt.Println("Username and the user to reassign authorship to are required.")
+			os.Exit(1)
+		}
+
+		authRepo := auth.NewRepository(db)
+		user := mustFindUser(authRepo, *username)
+		heir := mustFindUser(authRepo, *reassignTo)
+
+		if err := authRepo.DeleteUser(user.ID, heir.ID); err != nil {
+			log.Fatalf("Error deleting user: %v", err)
+		}
+
+		auditLog.RecordCLI("user.delete", user.Username, "reassigned to "+heir.Username)
+		fmt.Printf("User deleted. Their revisions now belong to %s.\n", heir.Username)
+		os.Exit(0)
+	case "list-silos":
+		listCmd := flag.NewFlagSet("list-silos", flag.ExitOnError)
+		format := listCmd.String("format", "table", "The output format: table or json.")
+		listCmd.Parse(args[1:])
+
+		siloRepo := silo.NewRepository(db)
+		authRepo := auth.NewRepository(db)
+		silos, err := siloRepo.ListAll()
+		if err != nil {
+			log.Fatalf("Error listing silos: %v", err)
+		}
+
+		type siloOutput struct {
+			ID         int        `json:"id"`
+			Slug       string     `json:"slug"`
+			Name       string     `json:"name"`
+			ArchivedAt *time.Time `json:"archived_at"`
+			Owners     []string   `json:"owners"`
+		}
+		var output []siloOutput
+		var rows [][]string
+		for _, s := range silos {
+			roles, err := siloRepo.ListRoles(s.ID)
+			if err != nil {
+				log.Fatalf("Error listing silo roles: %v", err)
+			}
+			owners := []string{}
+			for _, role := range roles {
+				if user, err := authRepo.FindUserByID(role.UserID); err == nil && role.Role == models.RoleOwner {
+					owners = append(owners, user.Username)
+				}
+			}
+			output = append(output, siloOutput{s.ID, s.Slug, s.Name, s.ArchivedAt, owners})
+			rows = append(rows, []string{
+				strconv.Itoa(s.ID),
+				s.Slug,
+				s.Name,
+				strings.Join(owners, ","),
+				formatOptionalTime(s.ArchivedAt, "-"),
+			})
+		}
+		printOutput(*format, output, []string{"ID", "SLUG", "NAME", "OWNERS", "ARCHIVED"}, rows)
+		os.Exit(0)
+	case "rename-silo":
+		renameCmd := flag.NewFlagSet("rename-silo", flag.ExitOnError)
+		slug := renameCmd.String("slug", "", "The slug of the silo to rename.")
+		name := renameCmd.String("name", "", "The new name of the silo.")
+		newSlug := renameCmd.String("new-slug", "", "The new slug of the silo. Leave empty to keep the current one.")
+		renameCmd.Parse(args[1:])
+
+		if *slug == "" || (*name == "" && *newSlug == "") {
+			fmt.Println("Slug and a new name or slug are required.")
+			os.Exit(1)
+		}
+
+		siloRepo := silo.NewRepository(db)
+		s := mustFindSilo(siloRepo, *slug)
+		if *name == "" {
+			*name = s.Name
+		}
+		if *newSlug == "" {
+			*newSlug = s.Slug
+		} else if err := silo.ValidateSlug(*newSlug); err != nil {
+			fmt.Println("Invalid slug:", err)
+			os.Exit(1)
+		}
+
+		if err := siloRepo.Rename(s.ID, *name, *newSlug); err != nil {
+			log.Fatalf("Error renaming silo: %v", err)
+		}
+
+		auditLog.RecordCLI("silo.rename", *slug, *name+" ("+*newSlug+")")
+		fmt.Println("Silo renamed.")
+		os.Exit(0)
+	case "archive-silo":
+		archiveCmd := flag.NewFlagSet("archive-silo", flag.ExitOnError)
+		slug := archiveCmd.String("slug", "", "The slug of the silo to archive.")
+		unarchive := archiveCmd.Bool("unarchive", false, "Unarchive the silo instead.")
+		archiveCmd.Parse(args[1:])
+
+		if *slug == "" {
+			fmt.Println("Slug is required.")
+			os.Exit(1)
+		}
+
+		siloRepo := silo.NewRepository(db)
+		s := mustFindSilo(siloRepo, *slug)
+		if err := siloRepo.SetArchived(s.ID, !*unarchive); err != nil {
+			log.Fatalf("Error archiving silo: %v", err)
+		}
+
+		if *unarchive {
+			auditLog.RecordCLI("silo.unarchive", s.Slug, "")
+			fmt.Println("Silo unarchived.")
+		} else {
+			auditLog.RecordCLI("silo.archive", s.Slug, "")
+			fmt.Println("Silo archived.")
+		}
+		os.Exit(0)
+	case "delete-silo":
+		deleteCmd := flag.NewFlagSet("delete-silo", flag.ExitOnError)
+		slug := deleteCmd.String("slug", "", "The slug of the silo to delete.")
+		confirm := deleteCmd.String("confirm", "", "Repeat the slug to confirm that the silo and all its pages should be deleted.")
+		deleteCmd.Parse(args[1:])
+
+		if *slug == "" || *confirm != *slug {
+			fmt.Println("Slug is required, and must be repeated with -confirm.")
+			os.Exit(1)
+		}
+
+		siloRepo := silo.NewRepository(db)
+		s := mustFindSilo(siloRepo, *slug)
+		files, err := siloRepo.Delete(s.ID)
+		if err != nil {
+			log.Fatalf("Error deleting silo: %v", err)
+		}
+		for _, name := range files {
+			if err := os.Remove(filepath.Join("uploads", filepath.Base(name))); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error removing upload: %v", err)
+			}
+		}
+
+		auditLog.RecordCLI("silo.delete", s.Slug, s.Name)
+		fmt.Printf("Silo deleted, along with %d uploaded files.\n", len(files))
+		os.Exit(0)
+	case "grant", "revoke":
+		grantCmd := flag.NewFlagSet(args[0], flag.ExitOnError)
+		username := grantCmd.String("username", "", "The user whose role changes.")
+		role := grantCmd.String("role", "", "The role: admin, or one of the silo roles ("+strings.Join(models.SiloRoles, ", ")+").")
+		slug := grantCmd.String("silo", "", "The slug of the silo, for silo roles.")
+		grantCmd.Parse(args[1:])
+
+		if *username == "" || *role == "" {
+			fmt.Println("Username and role are required.")
+			os.Exit(1)
+		}
+
+		authRepo := auth.NewRepository(db)
+		user := mustFindUser(authRepo, *username)
+		grant := args[0] == "grant"
+
+		if *role == "admin" {
+			if err := authRepo.SetUserAdmin(user.ID, grant); err != nil {
+				log.Fatalf("Error updating user: %v", err)
+			}
+		} else {
+			if !slices.Contains(models.SiloRoles, *role) {
+				fmt.Println("Unknown role:", *role)
+				os.Exit(1)
+			}
+			if *slug == "" {
+				fmt.Println("Silo roles require -silo.")
+				os.Exit(1)
+			}
+
+			siloRepo := silo.NewRepository(db)
+			s := mustFindSilo(siloRepo, *slug)
+			var err error
+			if grant {
+				err = siloRepo.GrantRole(s.ID, user.ID, *role)
+			} else {
+				err = siloRepo.RevokeRole(s.ID, user.ID)
+			}
+			if err != nil {
+				log.Fatalf("Error updating silo role: %v", err)
+			}
+		}
+
+		if grant {
+			auditLog.RecordCLI("grant", user.Username, strings.TrimSpace(*role+" "+*slug))
+			fmt.Printf("Granted %s to %s.\n", *role, user.Username)
+		} else {
+			auditLog.RecordCLI("revoke", user.Username, strings.TrimSpace(*role+" "+*slug))
+			fmt.Printf("Revoked %s from %s.\n", *role, user.Username)
+		}
+		os.Exit(0)
+	case "export-silo":
+		exportCmd := flag.NewFlagSet("export-silo", flag.ExitOnError)
+		slug := exportCmd.String("slug", "", "The slug of the silo to export.")
+		out := exportCmd.String("out", "", "The directory to write the .org files to. It must not exist yet, or be empty.")
+		exportCmd.Parse(args[1:])
+
+		if *slug == "" || *out == "" {
+			fmt.Println("Slug and out are required.")
+			os.Exit(1)
+		}
+		if entries, err := os.ReadDir(*out); err == nil && len(entries) > 0 {
+			fmt.Printf("%s is not empty.\n", *out)
+			os.Exit(1)
+		}
+
+		s := mustFindSilo(silo.NewRepository(db), *slug)
+		summary, err := export.Silo(page.NewRepository(db), s, "uploads", export.ToDir(*out))
+		if err != nil {
+			log.Fatalf("Error exporting silo: %v", err)
+		}
+
+		for _, name := range summary.Missing {
+			fmt.Printf("Warning: %s is linked to but missing, and was not exported.\n", name)
+		}
+		fmt.Printf("Exported %d pages and %d attachments to %s.\n", summary.Pages, summary.Attachments, *out)
+		os.Exit(0)
+	case "import-org":
+		importCommand(db, auditLog, args[1:])
+		os.Exit(0)
+	case "git-sync", "git-rebuild", "git-import":
+		gitCommand(db, auditLog, args[0], args[1:])
+		os.Exit(0)
+	case "backup":
+		backupCommand(db, auditLog, args[1:])
+		os.Exit(0)
+	case "list-pages":
+		listCmd := flag.NewFlagSet("list-pages", flag.ExitOnError)
+		slug := listCmd.String("silo", "", "The slug of the silo whose pages to list.")
+		format := listCmd.String("format", "table", "The output format: table or json.")
+		listCmd.Parse(args[1:])
+
+		if *slug == "" {
+			fmt.Println("Silo is required.")
+			os.Exit(1)
+		}
+
+		s := mustFindSilo(silo.NewRepository(db), *slug)
+		pages, err := page.NewRepository(db).ListBySilo(s.ID)
+		if err != nil {
+			log.Fatalf("Error listing pages: %v", err)
+		}
+
+		// Build each page's path from its ancestors' slugs.
+		byID := make(map[int]models.Page, len(pages))
+		for _, p := range pages {
+			byID[p.ID] = p
+		}
+		pagePath := func(p models.Page) string {
+			path := p.Slug
+			for p.ParentID != nil {
+				parent, ok := byID[*p.ParentID]
+				if !ok {
+					break
+				}
+				path = parent.Slug + "/" + path
+				p = parent
+			}
+			return path
+		}
+
+		type pageOutput struct {
+			ID    int    `json:"id"`
+			Path  string `json:"path"`
+			Title string `json:"title"`
+		}
+		var output []pageOutput
+		var rows [][]string
+		for _, p := range pages {
+			path := pagePath(p)
+			output = append(output, pageOutput{p.ID, path, p.Title})
+			rows = append(rows, []string{strconv.Itoa(p.ID), path, p.Title})
+		}
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i][1] < rows[j][1] })
+		sort.SliceStable(output, func(i, j int) bool { return output[i].Path < output[j].Path })
+		printOutput(*format, output, []string{"ID", "PATH", "TITLE"}, rows)
+		os.Exit(0)
+	default:
+		fmt.Println("Unknown admin command:", args[0])
+		os.Exit(1)
+	}
+}
+
+// formatOptionalTime formats t for command output, or returns fallback if t is nil.
+func formatOptionalTime(t *time.Time, fallback string) string {
+	if t == nil {
+		return fallback
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+// mustFindUser finds a user by username or exits with an error.
+func mustFindUser(authRepo *auth.Repository, username string) *models.User {
+	user, err := authRepo.FindUserByUsername(username)
+	if err != nil {
+		log.Fatalf("Error finding user %q: %v", username, err)
+	}
+	return user
+}
+
+// mustFindSilo finds a silo by slug or exits with an error.
+func mustFindSilo(siloRepo *silo.Repository, slug string) *models.Silo {
+	s, err := siloRepo.FindBySlug(slug)
+	if err != nil {
+		log.Fatalf("Error finding silo %q: %v", slug, err)
+	}
+	return s
+}
+
+// printOutput writes the rows as an aligned table, or the value as JSON if
+// the format is "json".
+func printOutput(format string, value any, header []string, rows [][]string) {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(value); err != nil {
+			log.Fatalf("Error encoding output: %v", err)
+		}
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		w.Flush()
+	default:
+		fmt.Println("Unknown format:", format)
+		os.Exit(1)
+	}
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// setAdminArgs turns the flags of "set-admin" into the arguments of the grant
+// or revoke command doing the same.
+func setAdminArgs(args []string) []string {
+	adminCmd := flag.NewFlagSet("set-admin", flag.ExitOnError)
+	username := adminCmd.String("username", "", "The user to make an administrator.")
+	revoke := adminCmd.Bool("revoke", false, "Revoke administrator rights instead of granting them.")
+	adminCmd.Parse(args)
+
+	command := "grant"
+	if *revoke {
+		command = "revoke"
+	}
+	return []string{command, "-username", *username, "-role", "admin"}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"sowing/internal/audit"
+	"sowing/internal/backup"
+)
+
+// backupCommand runs "sowing admin backup", writing the archive to a
+// temporary file first so that a failed backup never leaves a partial one.
+func backupCommand(db *sql.DB, auditLog *audit.Repository, args []string) {
+	backupCmd := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := backupCmd.String("out", "", "The archive to write. Defaults to sowing-<timestamp>.tar.gz.")
+	backupCmd.Parse(args)
+
+	if *out == "" {
+		*out = "sowing-" + time.Now().Format("20060102-150405") + ".tar.gz"
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(*out), ".sowing-backup-*")
+	if err != nil {
+		log.Fatalf("Error creating backup: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	manifest, err := backup.Create(db, "uploads", tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatalf("Error creating backup: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), *out); err != nil {
+		log.Fatalf("Error creating backup: %v", err)
+	}
+
+	for _, name := range manifest.Missing {
+		fmt.Printf("Warning: %s is referenced but missing, and was not backed up.\n", name)
+	}
+	auditLog.RecordCLI("system.backup", *out, "")
+	fmt.Printf("Backed up the database and %d uploaded files to %s.\n", len(manifest.Files)-1, *out)
+}
+
+// handleRestoreCommand runs "sowing admin restore" and exits, or returns if
+// another command was given. It runs before the database is opened, since it
+// creates a new one rather than using the one given by -dsn.
+func handleRestoreCommand() {
+	args := flag.Args()
+	if len(args) < 2 || args[0] != "admin" || args[1] != "restore" {
+		return
+	}
+
+	restoreCmd := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := restoreCmd.String("in", "", "The backup archive to restore.")
+	dir := restoreCmd.String("dir", "", "The data directory to restore into. It must not exist yet, or be empty.")
+	restoreCmd.Parse(args[2:])
+
+	if *in == "" || *dir == "" {
+		fmt.Println("Both -in and -dir are required.")
+		os.Exit(1)
+	}
+
+	f, err := os.Open(*in)
+	if err != nil {
+		log.Fatalf("Error opening backup: %v", err)
+	}
+	defer f.Close()
+
+	manifest, err := backup.Restore(f, *dir)
+	if err != nil {
+		log.Fatalf("Error restoring backup: %v", err)
+	}
+
+	fmt.Printf("Restored the backup of %s, with %d uploaded files, into %s.\n",
+		manifest.CreatedAt.Local().Format("2006-01-02 15:04:05"), len(manifest.Files)-1, *dir)
+	fmt.Printf("Run Sowing from %s to use it; it finds sowing.db and the uploads there.\n", *dir)
+	os.Exit(0)
+}
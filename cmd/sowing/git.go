@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"sowing/internal/audit"
+	"sowing/internal/auth"
+	"sowing/internal/gitmirror"
+	"sowing/internal/page"
+)
+
+// gitCommand runs the commands that manage the git mirror: "git-sync" brings
+// it up to date, "git-rebuild" recreates its history from scratch, and
+// "git-import" turns changes pushed to it into revisions.
+func gitCommand(db *sql.DB, auditLog *audit.Repository, name string, args []string) {
+	gitCmd := flag.NewFlagSet(name, flag.ExitOnError)
+	repo := gitCmd.String("repo", "", "The git mirror's bare repository. It is created if it doesn't exist.")
+	force := false
+	author := ""
+	switch name {
+	case "git-rebuild":
+		gitCmd.BoolVar(&force, "force", false, "Rebuild even if pushed changes haven't been imported, discarding them.")
+	case "git-import":
+		gitCmd.StringVar(&author, "author", "", "The username to credit with changes whose author doesn't match a user.")
+	}
+	gitCmd.Parse(args)
+
+	if *repo == "" {
+		fmt.Println("Repo is required.")
+		os.Exit(1)
+	}
+	mirror, err := gitmirror.Open(db, *repo)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch name {
+	case "git-sync":
+		commits, err := mirror.Sync()
+		if err != nil {
+			log.Fatalf("Error syncing git mirror: %v", err)
+		}
+		fmt.Printf("Made %d commits.\n", commits)
+	case "git-rebuild":
+		commits, err := mirror.Rebuild(force)
+		if errors.Is(err, gitmirror.ErrUnimported) {
+			fmt.Println("The repository has pushed changes that haven't been imported. Run git-import first, or pass -force to discard them.")
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Fatalf("Error rebuilding git mirror: %v", err)
+		}
+		auditLog.RecordCLI("system.git_rebuild", *repo, "")
+		fmt.Printf("Rebuilt the history of %s with %d commits.\n", gitmirror.Branch, commits)
+	case "git-import":
+		defaultAuthorID := 0
+		if author != "" {
+			defaultAuthorID = mustFindUser(auth.NewRepository(db), author).ID
+		}
+		report, err := mirror.Import(context.Background(), page.NewRepository(db), defaultAuthorID)
+		if err != nil {
+			log.Fatalf("Error importing from git mirror: %v", err)
+		}
+		for _, skipped := range report.Skipped {
+			fmt.Printf("Skipped %s\n", skipped)
+		}
+		if report.Revisions > 0 || report.Pages > 0 {
+			auditLog.RecordCLI("system.git_import", *repo, fmt.Sprintf("%d revisions, %d pages", report.Revisions, report.Pages))
+		}
+		fmt.Printf("Imported %d revisions and %d new pages.\n", report.Revisions, report.Pages)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"sowing/internal/attachment"
+	"sowing/internal/audit"
+	"sowing/internal/auth"
+	"sowing/internal/importer"
+	"sowing/internal/page"
+	"sowing/internal/silo"
+)
+
+// importCommand runs "sowing admin import-org", which creates pages from a
+// directory of .org files, or with -dry-run reports what it would create.
+func importCommand(db *sql.DB, auditLog *audit.Repository, args []string) {
+	importCmd := flag.NewFlagSet("import-org", flag.ExitOnError)
+	slug := importCmd.String("slug", "", "The slug of the silo to import into.")
+	dir := importCmd.String("dir", "", "The directory of .org files to import.")
+	author := importCmd.String("author", "", "The username recorded as the author of the imported pages.")
+	dryRun := importCmd.Bool("dry-run", false, "Report what would be imported without changing anything.")
+	importCmd.Parse(args)
+
+	if *slug == "" || *dir == "" || *author == "" {
+		fmt.Println("Slug, dir and author are required.")
+		os.Exit(1)
+	}
+	if info, err := os.Stat(*dir); err != nil || !info.IsDir() {
+		fmt.Printf("%s is not a directory.\n", *dir)
+		os.Exit(1)
+	}
+
+	s := mustFindSilo(silo.NewRepository(db), *slug)
+	user := mustFindUser(auth.NewRepository(db), *author)
+
+	report, err := importer.Dir(context.Background(), page.NewRepository(db), attachment.NewRepository(db), s, *dir, importer.Options{
+		AuthorID:    user.ID,
+		UploadsRoot: "uploads",
+		DryRun:      *dryRun,
+	})
+	if err != nil {
+		log.Fatalf("Error importing %s: %v", *dir, err)
+	}
+
+	if *dryRun {
+		fmt.Printf("Would create %d pages in %s:\n", len(report.Pages), s.Slug)
+		for _, p := range report.Pages {
+			fmt.Printf("  %-40s %q from %s\n", p.Path, p.Title, p.Source)
+		}
+		if len(report.Attachments) > 0 {
+			fmt.Printf("Would upload %d attachments:\n  %s\n", len(report.Attachments), strings.Join(report.Attachments, "\n  "))
+		}
+		fmt.Printf("Would rewrite %d links.\n", report.Links)
+	}
+	if len(report.Unresolved) > 0 {
+		fmt.Printf("%d links point outside the import and are left as they are:\n  %s\n", len(report.Unresolved), strings.Join(report.Unresolved, "\n  "))
+	}
+	if *dryRun {
+		return
+	}
+
+	auditLog.RecordCLI("silo.import", s.Slug, *dir)
+	fmt.Printf("Imported %d pages and %d attachments into %s.\n", len(report.Pages), len(report.Attachments), s.Slug)
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,25 +9,52 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"sowing/internal/auth"
 	"sowing/internal/database"
+	"sowing/internal/events"
+	"sowing/internal/gitmirror"
+	"sowing/internal/mailer"
 	"sowing/internal/models"
-	"sowing/internal/silo"
+	"sowing/internal/notification"
+	"sowing/internal/watch"
 	"sowing/internal/web"
-
-	"golang.org/x/crypto/bcrypt"
+	"sowing/internal/web/renderer"
+	"sowing/internal/webhook"
 )
 
 func main() {
-	var dsn = flag.String("dsn", "sowing.db", "The database connection string.")
+	var dsn = flag.String("dsn", "sowing.db", "The database connection string: a SQLite file name, or a postgres:// URL.")
+	var gitMirror = flag.String("git-mirror", "", "A bare git repository to mirror page history to. It is created if it doesn't exist.")
+	var baseURL = flag.String("base-url", "http://localhost:8080", "The address users reach Sowing at, such as https://wiki.example.com, used for links sent outside the site.")
+	var webhookAllowPrivate = flag.Bool("webhook-allow-private", false, "Let webhooks be sent to loopback and private network addresses, such as services on the same network.")
+	var trustedProxies = flag.String("trusted-proxies", "", "Comma separated addresses and CIDR ranges of reverse proxies whose X-Forwarded-For headers are believed, such as 127.0.0.1.")
+	var smtpAddr = flag.String("smtp-addr", "", "The host:port of the mail server to send email through. Email is off if it isn't set.")
+	var smtpFrom = flag.String("smtp-from", "Sowing <sowing@localhost>", "The From address of emails.")
+	var smtpUsername = flag.String("smtp-username", "", "The user name to sign in to the mail server with, if it needs one. The password is read from SOWING_SMTP_PASSWORD.")
+	var emailBatch = flag.Duration("email-batch", 2*time.Minute, "How long to wait for more changes before emailing a watcher who isn't sent a digest.")
 	flag.Parse()
 
+	handleRestoreCommand()
+
+	proxies, err := auth.ParseTrustedProxies(*trustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	auth.TrustedProxies = proxies
+
 	db, err := database.New(*dsn)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if err := database.CheckIntegrity(db); err != nil {
+		log.Fatal(err)
+	}
+
+	handleMigrateCommand(db)
+
 	if err := database.Migrate(db); err != nil {
 		log.Fatal(err)
 	}
@@ -52,13 +79,15 @@ func main() {
 	}
 
 	// Initialize the session store
-	if err := auth.InitSessionStore(sessionKey); err != nil {
+	if err := auth.InitSessionStore(auth.NewRepository(db), sessionKey); err != nil {
 		log.Fatal(err)
 	}
 
 	// Create a map to hold the different, isolated template sets.
 	templates := make(map[string]*template.Template)
 
+	notifications := notification.NewRepository(db)
+
 	// Create a FuncMap to add helper functions to the templates.
 	// The "dict" function allows passing multiple, named values to a template,
 	// which is perfect for complex or recursive templates.
@@ -77,150 +106,127 @@ func main() {
 			}
 			return dict, nil
 		},
+		// "bytes" formats a size in bytes for display, e.g. 1.5 MB.
+		"bytes": func(n int64) string {
+			const unit = 1024
+			if n < unit {
+				return fmt.Sprintf("%d B", n)
+			}
+			div, exp := int64(unit), 0
+			for m := n / unit; m >= unit; m /= unit {
+				div *= unit
+				exp++
+			}
+			return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+		},
+		// "mentions" escapes a revision comment, linking the @mentions in it
+		// to the profiles of the users mentioned.
+		"mentions": func(comment string) template.HTML {
+			mentioned, err := notifications.MentionedUsers(comment)
+			if err != nil {
+				log.Println(err)
+			}
+			return renderer.LinkMentions(comment, mentioned)
+		},
+		// "unreadNotifications" counts the notifications a user hasn't read,
+		// for the badge in the navigation bar.
+		"unreadNotifications": func(user *models.User) int {
+			if user == nil {
+				return 0
+			}
+			count, err := notifications.CountUnread(user.ID)
+			if err != nil {
+				log.Println(err)
+			}
+			return count
+		},
 	}
 
-	// Create a template set for the index page, including the new FuncMap.
-	templates["index.html"] = template.Must(template.New("layout.html").Funcs(funcMap).ParseFiles(
-		"internal/web/templates/layout.html",
-		"internal/web/templates/index.html",
-		"internal/web/templates/sidebar.html",
-		"internal/web/templates/navbar.html",
-	))
-
-	// Create a separate template set for the wiki view page, also with the FuncMap.
-	templates["view.html"] = template.Must(template.New("layout.html").Funcs(funcMap).ParseFiles(
-		"internal/web/templates/layout.html",
-		"internal/web/templates/view.html",
-		"internal/web/templates/sidebar.html",
-		"internal/web/templates/navbar.html",
-	))
-
-	// Create a template set for the wiki edit page.
-	templates["edit.html"] = template.Must(template.New("layout.html").Funcs(funcMap).ParseFiles(
-		"internal/web/templates/layout.html",
-		"internal/web/templates/edit.html",
-		"internal/web/templates/sidebar.html",
-		"internal/web/templates/navbar.html",
-	))
-
-	// Create a template set for the new wiki page.
-	templates["new.html"] = template.Must(template.New("layout.html").Funcs(funcMap).ParseFiles(
-		"internal/web/templates/layout.html",
-		"internal/web/templates/new.html",
-		"internal/web/templates/sidebar.html",
-		"internal/web/templates/navbar.html",
-	))
-
-	// Create a template set for the login page.
-	templates["login.html"] = template.Must(template.New("layout.html").Funcs(funcMap).ParseFiles(
-		"internal/web/templates/layout.html",
-		"internal/web/templates/login.html",
-		"internal/web/templates/sidebar.html",
-		"internal/web/templates/navbar.html",
-	))
-
-	// Create a template set for the register page.
-	templates["register.html"] = template.Must(template.New("layout.html").Funcs(funcMap).ParseFiles(
-		"internal/web/templates/layout.html",
-		"internal/web/templates/register.html",
-		"internal/web/templates/sidebar.html",
-		"internal/web/templates/navbar.html",
-	))
-
-	// Create a template set for the history page.
-	templates["history.html"] = template.Must(template.New("layout.html").Funcs(funcMap).ParseFiles(
-		"internal/web/templates/layout.html",
-		"internal/web/templates/history.html",
-		"internal/web/templates/sidebar.html",
-		"internal/web/templates/navbar.html",
-	))
-
-	// Create a template set for the diff page.
-	templates["diff.html"] = template.Must(template.New("layout.html").Funcs(funcMap).ParseFiles(
-		"internal/web/templates/layout.html",
-		"internal/web/templates/diff.html",
-		"internal/web/templates/sidebar.html",
-		"internal/web/templates/navbar.html",
-	))
-
-	server := web.NewServer(db, templates)
-
-	if err := http.ListenAndServe(":8080", server); err != nil {
-		log.Fatal(err)
-	}
-
-}
-func handleAdminCommands(db *sql.DB) {
-	args := flag.Args()
-	if len(args) == 0 || args[0] != "admin" {
-		return
+	// Each page gets its own template set so that their "content" blocks
+	// don't collide. The FuncMap is shared by all of them.
+	pages := []string{
+		"index.html",
+		"view.html",
+		"edit.html",
+		"new.html",
+		"login.html",
+		"register.html",
+		"history.html",
+		"search.html",
+		"diff.html",
+		"tokens.html",
+		"two_factor.html",
+		"sessions.html",
+		"forbidden.html",
+		"login_2fa.html",
+		"invitations.html",
+		"admin_registrations.html",
+		"admin_users.html",
+		"admin_user.html",
+		"admin_silos.html",
+		"admin_sessions.html",
+		"admin_storage.html",
+		"admin_audit.html",
+		"profile.html",
+		"reset_password.html",
+		"silo_settings.html",
+		"silo_webhooks.html",
+		"silo_webhook.html",
+		"changes.html",
+		"watches.html",
+		"unsubscribe.html",
+		"notifications.html",
+		"user.html",
 	}
-
-	// Shift args to remove "admin"
-	args = args[1:]
-
-	if len(args) == 0 {
-		fmt.Println("Usage: sowing admin <command>")
-		os.Exit(1)
+	for _, page := range pages {
+		templates[page] = template.Must(template.New("layout.html").Funcs(funcMap).ParseFiles(
+			"internal/web/templates/layout.html",
+			"internal/web/templates/"+page,
+			"internal/web/templates/sidebar.html",
+			"internal/web/templates/navbar.html",
+			"internal/web/templates/settings_nav.html",
+			"internal/web/templates/admin_nav.html",
+		))
 	}
 
-	switch args[0] {
-	case "create-user":
-		createCmd := flag.NewFlagSet("create-user", flag.ExitOnError)
-		username := createCmd.String("username", "", "The username for the new user.")
-		displayName := createCmd.String("display-name", "", "The display name for the new user.")
-		password := createCmd.String("password", "", "The password for the new user.")
-		createCmd.Parse(args[1:])
-
-		if *username == "" || *displayName == "" || *password == "" {
-			fmt.Println("Username, display name, and password are required.")
-			os.Exit(1)
-		}
+	bus := events.NewBus()
 
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(*password), bcrypt.DefaultCost)
+	// The git mirror, if enabled, commits every revision as it is saved.
+	if *gitMirror != "" {
+		m, err := gitmirror.Open(db, *gitMirror)
 		if err != nil {
-			log.Fatalf("Error hashing password: %v", err)
-		}
-		passwordHash := string(hashedPassword)
-
-		authRepo := auth.NewRepository(db)
-		user := &models.User{
-			Username:    *username,
-			DisplayName: *displayName,
-		}
-		identity := &models.Identity{
-			Provider:       "local",
-			ProviderUserID: *username,
-			PasswordHash:   &passwordHash,
-		}
-
-		if err := authRepo.CreateUser(user, identity); err != nil {
-			log.Fatalf("Error creating user: %v", err)
+			log.Fatal(err)
 		}
+		go m.Run(context.Background(), time.Minute)
+		bus.Subscribe(func(events.Event) { m.Notify() })
+	}
 
-		fmt.Println("User created successfully.")
-		os.Exit(0)
-	case "create-silo":
-		siloCmd := flag.NewFlagSet("create-silo", flag.ExitOnError)
-		name := siloCmd.String("name", "", "The name of the new silo.")
-		slug := siloCmd.String("slug", "", "The slug for the new silo.")
-		siloCmd.Parse(args[1:])
-
-		if *name == "" || *slug == "" {
-			fmt.Println("Name and slug are required.")
-			os.Exit(1)
+	// Users mentioned in a new revision are notified in the app.
+	bus.Subscribe(notification.NewNotifier(db).Handle)
+
+	dispatcher := webhook.NewDispatcher(db, *baseURL, webhook.Guard{AllowPrivate: *webhookAllowPrivate})
+	bus.Subscribe(dispatcher.Handle)
+	go dispatcher.Run(context.Background())
+
+	// Email, such as to watchers about changes, is sent only if there is a
+	// mail server to send through.
+	var mail *mailer.Config
+	if *smtpAddr != "" {
+		mail = &mailer.Config{
+			Addr:     *smtpAddr,
+			From:     *smtpFrom,
+			Username: *smtpUsername,
+			Password: os.Getenv("SOWING_SMTP_PASSWORD"),
 		}
+		notifier := watch.NewNotifier(db, *mail, *baseURL, *emailBatch)
+		bus.Subscribe(notifier.Handle)
+		go notifier.Run(context.Background())
+	}
 
-		siloRepo := silo.NewRepository(db)
-		err := siloRepo.Create(*name, *slug, nil)
-		if err != nil {
-			log.Fatalf("Error creating silo: %v", err)
-		}
+	server := web.NewServer(db, templates, bus, dispatcher, *baseURL, mail)
 
-		fmt.Println("Silo created successfully.")
-		os.Exit(0)
-	default:
-		fmt.Println("Unknown admin command:", args[0])
-		os.Exit(1)
+	if err := http.ListenAndServe(":8080", server); err != nil {
+		log.Fatal(err)
 	}
+
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"sowing/internal/database"
+)
+
+// handleMigrateCommand runs "sowing admin migrate" and exits, or returns if
+// another command was given. It runs before the schema is migrated on
+// startup, so the schema can be inspected or upgraded one step at a time.
+func handleMigrateCommand(db *sql.DB) {
+	args := flag.Args()
+	if len(args) < 2 || args[0] != "admin" || args[1] != "migrate" {
+		return
+	}
+
+	migrateCmd := flag.NewFlagSet("migrate", flag.ExitOnError)
+	status := migrateCmd.Bool("status", false, "List the migrations and whether they have been applied, without applying any.")
+	to := migrateCmd.Int("to", 0, "Apply migrations up to and including this version, rather than all of them.")
+	migrateCmd.Parse(args[2:])
+
+	if *status {
+		migrations, err := database.Status(db)
+		if err != nil {
+			log.Fatalf("Error reading schema version: %v", err)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, m := range migrations {
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", m.Version, m.Name, formatOptionalTime(m.AppliedAt, "pending"))
+		}
+		tw.Flush()
+		os.Exit(0)
+	}
+
+	var err error
+	if *to > 0 {
+		err = database.MigrateTo(db, *to)
+	} else {
+		err = database.Migrate(db)
+	}
+	if err != nil {
+		log.Fatalf("Error migrating database: %v", err)
+	}
+
+	version, err := database.Version(db)
+	if err != nil {
+		log.Fatalf("Error reading schema version: %v", err)
+	}
+	fmt.Printf("Database is at schema version %d.\n", version)
+	os.Exit(0)
+}
@@ -1,13 +1,21 @@
 package attachment
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sowing/internal/events"
 	"sowing/internal/models"
+	"time"
 )
 
 // Repository provides access to the attachment storage.
 type Repository struct {
 	DB *sql.DB
+	// Events, if set, is told whenever an attachment is uploaded.
+	Events *events.Bus
 }
 
 // NewRepository creates a new attachment repository.
@@ -15,10 +23,43 @@ func NewRepository(db *sql.DB) *Repository {
 	return &Repository{DB: db}
 }
 
-// Create inserts a new attachment record into the database.
-func (r *Repository) Create(attachment *models.Attachment) error {
-	_, err := r.DB.Exec(
-		"INSERT INTO attachments (filename, unique_filename, mime_type, size) VALUES (?, ?, ?, ?)",
-		attachment.Filename, attachment.UniqueFilename, attachment.MimeType, attachment.Size)
-	return err
+// UniqueFilename returns the name an uploaded file is stored under, derived
+// from its content so that names don't collide, and keeping its extension.
+func UniqueFilename(data []byte, filename string) string {
+	hash := sha256.Sum256(data)
+	return fmt.Sprintf("%s-%d%s", hex.EncodeToString(hash[:16]), time.Now().Unix(), filepath.Ext(filename))
+}
+
+// Create inserts a new attachment record into the database, uploaded by the
+// user actorID. It returns sql.ErrNoRows if the attachment's page doesn't
+// exist.
+func (r *Repository) Create(attachment *models.Attachment, actorID int) error {
+	// Uploads only belong to a silo through the page they were made for.
+	e := events.Event{Type: events.AttachmentUploaded, ActorID: actorID}
+	if attachment.PageID != nil {
+		e.PageID = *attachment.PageID
+		if err := r.DB.QueryRow("SELECT silo_id FROM pages WHERE id = ?", e.PageID).Scan(&e.SiloID); err != nil {
+			return err
+		}
+	}
+
+	var id int64
+	err := r.DB.QueryRow(
+		"INSERT INTO attachments (page_id, filename, unique_filename, mime_type, size) VALUES (?, ?, ?, ?, ?) RETURNING id",
+		attachment.PageID, attachment.Filename, attachment.UniqueFilename, attachment.MimeType, attachment.Size).Scan(&id)
+	if err != nil {
+		return err
+	}
+	attachment.ID = int(id)
+	e.AttachmentID = attachment.ID
+	r.Events.Publish(e)
+	return nil
+}
+
+// Usage returns the number of attachments and their total size in bytes.
+func (r *Repository) Usage() (int, int64, error) {
+	var count int
+	var size int64
+	err := r.DB.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM attachments").Scan(&count, &size)
+	return count, size, err
 }
@@ -0,0 +1,81 @@
+package audit
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"sowing/internal/auth"
+	"sowing/internal/models"
+)
+
+// Repository provides access to the audit log.
+type Repository struct {
+	DB *sql.DB
+}
+
+// NewRepository creates a new audit log repository.
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{DB: db}
+}
+
+// Record adds an entry to the audit log.
+func (r *Repository) Record(entry *models.AuditEntry) error {
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	_, err := r.DB.Exec("INSERT INTO audit_log (actor_id, actor, action, target, detail, ip, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		entry.ActorID, entry.Actor, entry.Action, entry.Target, entry.Detail, entry.IP, entry.CreatedAt)
+	return err
+}
+
+// RecordRequest records an action taken by the admin making the request.
+// Failures are logged rather than returned, since the action already happened.
+func (r *Repository) RecordRequest(req *http.Request, action, target, detail string) {
+	entry := &models.AuditEntry{
+		Action: action,
+		Target: target,
+		Detail: detail,
+		IP:     auth.ClientIP(req),
+	}
+	if user, _ := req.Context().Value("user").(*models.User); user != nil {
+		entry.ActorID = &user.ID
+		entry.Actor = user.Username
+	}
+	if err := r.Record(entry); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+}
+
+// RecordCLI records an action taken with the admin command line.
+func (r *Repository) RecordCLI(action, target, detail string) {
+	entry := &models.AuditEntry{
+		Actor:  "cli",
+		Action: action,
+		Target: target,
+		Detail: detail,
+	}
+	if err := r.Record(entry); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+}
+
+// List lists the most recent audit entries, newest first.
+func (r *Repository) List(limit int) ([]models.AuditEntry, error) {
+	rows, err := r.DB.Query("SELECT id, actor_id, actor, action, target, detail, ip, created_at FROM audit_log ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []models.AuditEntry
+	for rows.Next() {
+		var entry models.AuditEntry
+		if err := rows.Scan(&entry.ID, &entry.ActorID, &entry.Actor, &entry.Action, &entry.Target, &entry.Detail, &entry.IP, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
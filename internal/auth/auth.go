@@ -2,118 +2,198 @@ package auth
 
 import (
 	"context"
-	"encoding/gob"
 	"errors"
+	"fmt"
 	"net/http"
-	
+	"sync"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"golang.org/x/crypto/bcrypt"
 	"sowing/internal/models"
+	"sowing/internal/settings"
 )
 
+// secondFactorTimeout is how long a user has to enter their TOTP code after
+// entering their password.
+const secondFactorTimeout = 5 * time.Minute
+
+// ErrSessionNotSaved is returned by Login and CompleteSecondFactor when the
+// signed-in session couldn't be stored. The user isn't signed in.
+var ErrSessionNotSaved = errors.New("session could not be saved")
+
 // Store will hold the session store.
-var Store *sessions.CookieStore
+var Store *DBStore
 
-func InitSessionStore(sessionKey string) error {
+func InitSessionStore(repo *Repository, sessionKey string) error {
 	if len(sessionKey) < 32 {
 		return errors.New("session key must be at least 32 characters long")
 	}
-	Store = sessions.NewCookieStore([]byte(sessionKey))
+	Store = NewDBStore(repo, []byte(sessionKey))
 	Store.Options.HttpOnly = true
 	Store.Options.Path = "/"
 	Store.Options.SameSite = http.SameSiteLaxMode // Protect against CSRF
 	return nil
 }
 
-func init() {
-	gob.Register(&models.User{})
-}
-
 // Service provides authentication-related services.
 type Service struct {
-	Repo *Repository
+	Repo     *Repository
+	Settings *settings.Repository
+	limiter  *ipLimiter
+
+	pruneMu  sync.Mutex
+	prunedAt time.Time // When old login failures were last deleted
 }
 
 // NewService creates a new authentication service.
-func NewService(repo *Repository) *Service {
-	return &Service{Repo: repo}
+func NewService(repo *Repository, settingsRepo *settings.Repository) *Service {
+	return &Service{Repo: repo, Settings: settingsRepo, limiter: newIPLimiter()}
 }
 
-// RegisterUser creates a new user.
-func (s *Service) RegisterUser(w http.ResponseWriter, r *http.Request, username, displayName, password string) (*models.User, error) {
-	// Check if user already exists
-	if _, err := s.Repo.FindUserByUsername(username); err == nil {
-		return nil, errors.New("user already exists")
+// Login authenticates a user and creates a session.
+// Failed attempts are recorded, and repeated failures for the same account or
+// from the same address are throttled with a *ThrottledError.
+func (s *Service) Login(w http.ResponseWriter, r *http.Request, username, password string) (*models.User, error) {
+	ip := ClientIP(r)
+	if err := s.checkThrottle(username, ip); err != nil {
+		return nil, err
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	user, err := s.Repo.FindUserByUsername(username)
 	if err != nil {
+		s.loginFailed(username, ip, "unknown_user")
 		return nil, err
 	}
-	passwordHash := string(hashedPassword)
 
-	user := &models.User{
-		Username:    username,
-		DisplayName: displayName,
+	identity, err := s.Repo.FindIdentityByProvider("local", username)
+	if err != nil {
+		s.loginFailed(username, ip, "no_identity")
+		return nil, err
 	}
-	identity := &models.Identity{
-		Provider:       "local",
-		ProviderUserID: username,
-		PasswordHash:   &passwordHash,
+
+	if identity.PasswordHash == nil {
+		s.loginFailed(username, ip, "no_password")
+		return nil, errors.New("user has no password set")
 	}
 
-	err = s.Repo.CreateUser(user, identity)
-	if err != nil {
+	if err := bcrypt.CompareHashAndPassword([]byte(*identity.PasswordHash), []byte(password)); err != nil {
+		s.loginFailed(username, ip, "bad_password")
 		return nil, err
 	}
 
-	// Retrieve the full user model with the ID
-	createdUser, err := s.Repo.FindUserByUsername(username)
-	if err != nil {
+	// Only tell people their account can't be used once they have proven who they are.
+	switch user.Status {
+	case models.UserStatusActive:
+	case models.UserStatusPending:
+		s.recordAttempt(username, ip, false, "account_pending")
+		return nil, ErrAccountPending
+	case models.UserStatusUnverified:
+		// The user is returned so that a new verification link can be sent.
+		s.recordAttempt(username, ip, false, "email_unverified")
+		return user, ErrEmailNotVerified
+	default:
+		s.recordAttempt(username, ip, false, "account_disabled")
+		return nil, ErrAccountDisabled
+	}
+
+	session, _ := Store.Get(r, "sowing-session")
+
+	// Set Secure flag based on request scheme or X-Forwarded-Proto header
+	// This is crucial for correct behavior behind reverse proxies.
+	session.Options.Secure = r.URL.Scheme == "https" || r.Header.Get("X-Forwarded-Proto") == "https"
+
+	// Users with two-factor authentication only get a pending login here.
+	// The session's user is set once CompleteSecondFactor accepts their code.
+	if s.TOTPEnabled(user.ID) {
+		session.Values["pending_user_id"] = user.ID
+		session.Values["pending_since"] = time.Now().Unix()
+		session.Save(r, w)
+		return user, ErrSecondFactorRequired
+	}
+
+	if err := startSession(w, r, session, user.ID); err != nil {
 		return nil, err
 	}
+	s.loginSucceeded(username, ip)
+
+	return user, nil
+}
 
-	return createdUser, nil
+// startSession signs a user in to a session under a new ID, so that an ID
+// known before signing in can't be used to hijack it.
+func startSession(w http.ResponseWriter, r *http.Request, session *sessions.Session, userID int) error {
+	if err := Store.Renew(session); err != nil {
+		return fmt.Errorf("%w: %v", ErrSessionNotSaved, err)
+	}
+	delete(session.Values, "csrf_token")
+	session.Values["user_id"] = userID
+	if err := session.Save(r, w); err != nil {
+		return fmt.Errorf("%w: %v", ErrSessionNotSaved, err)
+	}
+	return nil
 }
 
+// HasPendingSecondFactor reports whether the session belongs to a user who
+// has passed the password check and still needs to enter a second factor.
+func (s *Service) HasPendingSecondFactor(r *http.Request) bool {
+	_, ok := s.pendingUserID(r)
+	return ok
+}
 
-// Login authenticates a user and creates a session.
-func (s *Service) Login(w http.ResponseWriter, r *http.Request, username, password string) (*models.User, error) {
-	user, err := s.Repo.FindUserByUsername(username)
-	if err != nil {
-		return nil, err
+// CompleteSecondFactor finishes a login started by Login once the user has
+// entered a valid TOTP or recovery code.
+func (s *Service) CompleteSecondFactor(w http.ResponseWriter, r *http.Request, code string) (*models.User, error) {
+	userID, ok := s.pendingUserID(r)
+	if !ok {
+		return nil, errors.New("no login in progress")
 	}
 
-	identity, err := s.Repo.FindIdentityByProvider("local", username)
+	user, err := s.Repo.FindUserByID(userID)
 	if err != nil {
 		return nil, err
 	}
 
-	if identity.PasswordHash == nil {
-		return nil, errors.New("user has no password set")
+	// Codes are short, so guessing them is throttled just like passwords.
+	ip := ClientIP(r)
+	if err := s.checkThrottle(user.Username, ip); err != nil {
+		return nil, err
 	}
-
-	if err := bcrypt.CompareHashAndPassword([]byte(*identity.PasswordHash), []byte(password)); err != nil {
+	if err := s.VerifySecondFactor(userID, code); err != nil {
+		s.loginFailed(user.Username, ip, "bad_second_factor")
 		return nil, err
 	}
 
 	session, _ := Store.Get(r, "sowing-session")
-	session.Values["user"] = user
-
-	// Set Secure flag based on request scheme or X-Forwarded-Proto header
-	// This is crucial for correct behavior behind reverse proxies.
+	delete(session.Values, "pending_user_id")
+	delete(session.Values, "pending_since")
 	session.Options.Secure = r.URL.Scheme == "https" || r.Header.Get("X-Forwarded-Proto") == "https"
-
-	session.Save(r, w)
+	if err := startSession(w, r, session, user.ID); err != nil {
+		return nil, err
+	}
+	s.loginSucceeded(user.Username, ip)
 
 	return user, nil
 }
 
+// pendingUserID returns the user awaiting a second factor, if the login is recent enough.
+func (s *Service) pendingUserID(r *http.Request) (int, bool) {
+	session, _ := Store.Get(r, "sowing-session")
+	userID, ok := session.Values["pending_user_id"].(int)
+	if !ok {
+		return 0, false
+	}
+	since, _ := session.Values["pending_since"].(int64)
+	if time.Since(time.Unix(since, 0)) > secondFactorTimeout {
+		return 0, false
+	}
+	return userID, true
+}
+
 // Logout destroys a user's session.
 func (s *Service) Logout(w http.ResponseWriter, r *http.Request) {
 	session, _ := Store.Get(r, "sowing-session")
-	delete(session.Values, "user")
+	session.Options.MaxAge = -1
 
 	// Ensure Secure flag is set correctly for logout cookie as well
 	session.Options.Secure = r.URL.Scheme == "https" || r.Header.Get("X-Forwarded-Proto") == "https"
@@ -121,19 +201,49 @@ func (s *Service) Logout(w http.ResponseWriter, r *http.Request) {
 	session.Save(r, w)
 }
 
-// GetCurrentUser returns the currently logged-in user.
+// GetCurrentUser returns the currently logged-in user. The user is loaded
+// from the database on every request so that changes take effect immediately.
 func (s *Service) GetCurrentUser(r *http.Request) *models.User {
 	session, _ := Store.Get(r, "sowing-session")
-	if user, ok := session.Values["user"].(*models.User); ok {
-		return user
+	userID, ok := session.Values["user_id"].(int)
+	if !ok {
+		return nil
 	}
-	return nil
+	user, err := s.Repo.FindUserByID(userID)
+	if err != nil || user.Status != models.UserStatusActive {
+		return nil
+	}
+	return user
+}
+
+// CurrentSessionHash returns the hash identifying the request's session in
+// the sessions table, or "" if the request has no stored session.
+func (s *Service) CurrentSessionHash(r *http.Request) string {
+	session, _ := Store.Get(r, "sowing-session")
+	if session.ID == "" {
+		return ""
+	}
+	return hashToken(session.ID)
+}
+
+// DisableUser stops a user from logging in and ends all of their sessions.
+func (s *Service) DisableUser(userID int) error {
+	if err := s.Repo.SetUserStatus(userID, models.UserStatusDisabled); err != nil {
+		return err
+	}
+	_, err := s.Repo.DeleteUserSessions(userID, "")
+	return err
+}
+
+// EnableUser lets a disabled or pending user log in again.
+func (s *Service) EnableUser(userID int) error {
+	return s.Repo.SetUserStatus(userID, models.UserStatusActive)
 }
 
 // Middleware to protect routes that require authentication.
 func (s *Service) RequireLogin(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if s.GetCurrentUser(r) == nil {
+		if user, _ := r.Context().Value("user").(*models.User); user == nil {
 			http.Redirect(w, r, "/login", http.StatusFound)
 			return
 		}
@@ -141,11 +251,30 @@ func (s *Service) RequireLogin(next http.Handler) http.Handler {
 	})
 }
 
+// RequireAdmin protects routes that only site administrators may use. Admin
+// pages are not available to API tokens.
+func (s *Service) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := r.Context().Value("user").(*models.User)
+		_, usedToken := r.Context().Value("api_token").(*models.APIToken)
+		if user == nil || !user.IsAdmin || usedToken {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // WithUser adds the current user to the request context.
+// A user already authenticated by an API token takes precedence over the session.
 func (s *Service) WithUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, _ := r.Context().Value("user").(*models.User); user != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
 		user := s.GetCurrentUser(r)
 		ctx := context.WithValue(r.Context(), "user", user)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
-}
\ No newline at end of file
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+// csrfCookie holds the CSRF token of visitors without a session, such as
+// those on the login page, so that a session isn't stored for every visitor.
+const csrfCookie = "sowing-csrf"
+
+// CSRFToken returns the synchronizer token stored in the request's session,
+// generating and saving a new one if the session doesn't have one yet.
+// Requests without a session get the token in a cookie of its own instead.
+func (s *Service) CSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	session, _ := Store.Get(r, "sowing-session")
+	if token, ok := session.Values["csrf_token"].(string); ok {
+		return token, nil
+	}
+	if session.IsNew {
+		if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+			return cookie.Value, nil
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	secure := r.URL.Scheme == "https" || r.Header.Get("X-Forwarded-Proto") == "https"
+
+	if session.IsNew {
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   secure,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return token, nil
+	}
+
+	session.Values["csrf_token"] = token
+	session.Options.Secure = secure
+	if err := session.Save(r, w); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ValidCSRFToken reports whether token matches the one stored in the request's
+// session, or in the CSRF cookie if the request has no session.
+func (s *Service) ValidCSRFToken(r *http.Request, token string) bool {
+	session, _ := Store.Get(r, "sowing-session")
+	expected, ok := session.Values["csrf_token"].(string)
+	if !ok && session.IsNew {
+		if cookie, err := r.Cookie(csrfCookie); err == nil {
+			expected, ok = cookie.Value, cookie.Value != ""
+		}
+	}
+	if !ok || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
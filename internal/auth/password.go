@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password requirements. bcrypt ignores everything after 72 bytes, so longer
+// passwords are refused rather than silently truncated.
+const (
+	minPasswordLength = 8
+	maxPasswordBytes  = 72
+)
+
+// passwordResetValidity is how long a reset link works when no other
+// validity is given.
+const passwordResetValidity = 24 * time.Hour
+
+// commonPasswords are refused outright, however long they are.
+var commonPasswords = []string{
+	"password", "password1", "password123", "12345678", "123456789", "1234567890",
+	"qwertyuiop", "iloveyou", "sunshine", "princess", "football", "baseball",
+	"welcome1", "admin123", "letmein1", "trustno1", "changeme", "abc12345",
+}
+
+var (
+	// ErrWeakPassword is wrapped by the errors returned from ValidatePassword.
+	ErrWeakPassword = errors.New("password is too weak")
+	// ErrWrongPassword is returned when the current password given to change it is wrong.
+	ErrWrongPassword = errors.New("current password is incorrect")
+	// ErrInvalidPasswordReset is returned for unknown, expired or used reset links.
+	ErrInvalidPasswordReset = errors.New("the password reset link is invalid, expired or already used")
+)
+
+// ValidatePassword checks that a password is acceptable for the given user.
+func ValidatePassword(password, username string) error {
+	switch {
+	case utf8.RuneCountInString(password) < minPasswordLength:
+		return fmt.Errorf("%w: it must be at least %d characters long", ErrWeakPassword, minPasswordLength)
+	case len(password) > maxPasswordBytes:
+		return fmt.Errorf("%w: it must be at most %d bytes long", ErrWeakPassword, maxPasswordBytes)
+	case strings.TrimSpace(password) == "":
+		return fmt.Errorf("%w: it must not be blank", ErrWeakPassword)
+	case username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)):
+		return fmt.Errorf("%w: it must not contain your username", ErrWeakPassword)
+	case isCommonPassword(password):
+		return fmt.Errorf("%w: it is too common", ErrWeakPassword)
+	}
+	return nil
+}
+
+func isCommonPassword(password string) bool {
+	password = strings.ToLower(password)
+	for _, common := range commonPasswords {
+		if password == common {
+			return true
+		}
+	}
+	// Passwords made of a single repeated character, like "aaaaaaaa".
+	return strings.Count(password, password[:1]) == len(password)
+}
+
+// hashPassword hashes a password for storage in an identity.
+func hashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+// HashPassword validates a password and hashes it for storage in an identity.
+func HashPassword(password, username string) (string, error) {
+	if err := ValidatePassword(password, username); err != nil {
+		return "", err
+	}
+	return hashPassword(password)
+}
+
+// ChangePassword sets a new password after checking the current one. All of
+// the user's other sessions are logged out, and their API tokens are revoked
+// if revokeTokens is set. Wrong current passwords count as failed logins from
+// ip, so guessing them is throttled with a *ThrottledError like logging in.
+func (s *Service) ChangePassword(userID int, currentPassword, newPassword, currentSessionHash, ip string, revokeTokens bool) error {
+	user, err := s.Repo.FindUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkThrottle(user.Username, ip); err != nil {
+		return err
+	}
+	identity, err := s.Repo.FindIdentityByProvider("local", user.Username)
+	if err != nil {
+		return err
+	}
+	if identity.PasswordHash == nil || bcrypt.CompareHashAndPassword([]byte(*identity.PasswordHash), []byte(currentPassword)) != nil {
+		s.loginFailed(user.Username, ip, "bad_current_password")
+		return ErrWrongPassword
+	}
+
+	passwordHash, err := HashPassword(newPassword, user.Username)
+	if err != nil {
+		return err
+	}
+	if err := s.Repo.UpdatePassword(userID, passwordHash); err != nil {
+		return err
+	}
+	if _, err := s.Repo.DeleteUserSessions(userID, currentSessionHash); err != nil {
+		return err
+	}
+	if revokeTokens {
+		if _, err := s.Repo.DeleteAPITokens(userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreatePasswordReset issues a one-time password reset token for a user and
+// returns its plaintext value. A validity of zero uses the default of a day.
+func (s *Service) CreatePasswordReset(userID int, validFor time.Duration) (string, error) {
+	if validFor <= 0 {
+		validFor = passwordResetValidity
+	}
+
+	raw, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	if err := s.Repo.CreatePasswordReset(userID, hashToken(raw), time.Now().Add(validFor)); err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// FindPasswordReset returns the user ID a reset token belongs to if it can still be used.
+func (s *Service) FindPasswordReset(raw string) (int, error) {
+	reset, err := s.Repo.FindPasswordResetByHash(hashToken(raw))
+	if err != nil || reset.UsedAt != nil || time.Now().After(reset.ExpiresAt) {
+		return 0, ErrInvalidPasswordReset
+	}
+	return reset.UserID, nil
+}
+
+// ResetPassword sets a new password using a reset token. The token is used up,
+// all of the user's sessions are logged out and any lockout is lifted.
+func (s *Service) ResetPassword(raw, newPassword string) error {
+	userID, err := s.FindPasswordReset(raw)
+	if err != nil {
+		return err
+	}
+	user, err := s.Repo.FindUserByID(userID)
+	if err != nil {
+		return err
+	}
+
+	passwordHash, err := HashPassword(newPassword, user.Username)
+	if err != nil {
+		return err
+	}
+	if err := s.Repo.ResetPassword(hashToken(raw), userID, passwordHash); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrInvalidPasswordReset
+		}
+		return err
+	}
+
+	if _, err := s.Repo.DeleteUserSessions(userID, ""); err != nil {
+		return err
+	}
+	return s.Repo.DeleteLockout(user.Username)
+}
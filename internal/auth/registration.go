@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+
+	"sowing/internal/models"
+)
+
+// Registration modes control who may create an account through /register.
+const (
+	RegistrationOpen     = "open"     // Anyone may register
+	RegistrationDisabled = "disabled" // Nobody may register; admins create users
+	RegistrationInvite   = "invite"   // Only people with an invitation may register
+	RegistrationDomain   = "domain"   // Only people with an email address on an allowed domain
+	RegistrationApproval = "approval" // Anyone may register, but an admin must approve the account
+)
+
+// RegistrationModes lists the valid registration modes.
+var RegistrationModes = []string{RegistrationOpen, RegistrationDisabled, RegistrationInvite, RegistrationDomain, RegistrationApproval}
+
+// Setting keys of the registration policy.
+const (
+	settingRegistrationMode    = "registration_mode"
+	settingRegistrationDomains = "registration_domains"
+)
+
+// defaultRegistrationMode keeps registration open on sites that never chose a policy.
+const defaultRegistrationMode = RegistrationOpen
+
+// emailVerificationValidity is how long the link confirming a new user's
+// email address works.
+const emailVerificationValidity = 48 * time.Hour
+
+var (
+	ErrUserExists          = errors.New("user already exists")
+	ErrInvalidRegistration = errors.New("username, display name and password are required")
+	ErrInvalidEmail        = errors.New("the email address is invalid")
+	ErrRegistrationClosed  = errors.New("registration is closed")
+	ErrInvitationRequired  = errors.New("registration requires an invitation")
+	ErrInvalidInvitation   = errors.New("the invitation is invalid, expired or already used")
+	ErrEmailNotAllowed     = errors.New("registration is not open to this email address")
+	// ErrAccountPending is returned by Login for users awaiting approval.
+	ErrAccountPending = errors.New("your account is awaiting approval by an administrator")
+	// ErrAccountDisabled is returned by Login for users disabled by an admin.
+	ErrAccountDisabled = errors.New("your account has been disabled")
+	// ErrEmailNotVerified is returned by Login, with the user, for users who
+	// haven't confirmed their email address yet.
+	ErrEmailNotVerified = errors.New("your email address has not been confirmed")
+	// ErrInvalidEmailVerification is returned for unknown, expired or used
+	// email verification links.
+	ErrInvalidEmailVerification = errors.New("the confirmation link is invalid, expired or already used")
+)
+
+// RegistrationPolicy decides who may register.
+type RegistrationPolicy struct {
+	Mode           string
+	AllowedDomains []string // Used by RegistrationDomain
+}
+
+// Registration holds the details a person entered on the registration form.
+type Registration struct {
+	Username    string
+	DisplayName string
+	Email       string
+	Password    string
+	Invitation  string // The plaintext invitation token, if any
+}
+
+// RegistrationPolicy returns the current registration policy.
+func (s *Service) RegistrationPolicy() (RegistrationPolicy, error) {
+	mode, err := s.Settings.Get(settingRegistrationMode, defaultRegistrationMode)
+	if err != nil {
+		return RegistrationPolicy{}, err
+	}
+	domains, err := s.Settings.Get(settingRegistrationDomains, "")
+	if err != nil {
+		return RegistrationPolicy{}, err
+	}
+	return RegistrationPolicy{Mode: mode, AllowedDomains: ParseDomains(domains)}, nil
+}
+
+// SetRegistrationPolicy validates and stores a new registration policy.
+func (s *Service) SetRegistrationPolicy(policy RegistrationPolicy) error {
+	if !slices.Contains(RegistrationModes, policy.Mode) {
+		return fmt.Errorf("unknown registration mode %q", policy.Mode)
+	}
+	if policy.Mode == RegistrationDomain && len(policy.AllowedDomains) == 0 {
+		return errors.New("at least one allowed domain is required")
+	}
+	if err := s.Settings.Set(settingRegistrationMode, policy.Mode); err != nil {
+		return err
+	}
+	return s.Settings.Set(settingRegistrationDomains, strings.Join(policy.AllowedDomains, ","))
+}
+
+// ParseDomains splits a comma or whitespace separated list of email domains.
+func ParseDomains(list string) []string {
+	var domains []string
+	for _, domain := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t' }) {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "@"))
+		if domain != "" && !slices.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// domainAllowed reports whether an email address belongs to one of the domains.
+func domainAllowed(email string, domains []string) bool {
+	_, domain, ok := strings.Cut(strings.ToLower(email), "@")
+	return ok && slices.Contains(domains, domain)
+}
+
+// CreateInvitation generates a new invitation and returns its plaintext token.
+// The token is only available now; only its hash is stored.
+func (s *Service) CreateInvitation(createdBy int, email string, siloID *int, validFor time.Duration) (string, *models.Invitation, error) {
+	email = strings.TrimSpace(email)
+	if email != "" {
+		if _, err := mail.ParseAddress(email); err != nil {
+			return "", nil, ErrInvalidEmail
+		}
+	}
+	if validFor <= 0 {
+		return "", nil, errors.New("invitations must expire")
+	}
+
+	raw, err := newSessionID()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	invitation := &models.Invitation{
+		TokenHash: hashToken(raw),
+		Email:     email,
+		SiloID:    siloID,
+		CreatedBy: createdBy,
+		ExpiresAt: now.Add(validFor),
+		CreatedAt: now,
+	}
+	if err := s.Repo.CreateInvitation(invitation); err != nil {
+		return "", nil, err
+	}
+	return raw, invitation, nil
+}
+
+// FindInvitation returns the invitation for a plaintext token if it can still be used.
+func (s *Service) FindInvitation(raw string) (*models.Invitation, error) {
+	invitation, err := s.Repo.FindInvitationByHash(hashToken(raw))
+	if err != nil {
+		return nil, ErrInvalidInvitation
+	}
+	if invitation.UsedAt != nil || time.Now().After(invitation.ExpiresAt) {
+		return nil, ErrInvalidInvitation
+	}
+	return invitation, nil
+}
+
+// RegisterUser creates a new user if the registration policy allows it.
+// Users registering while admin approval is required are created as pending
+// and cannot log in until approved. Users let in by the domain of their email
+// address are created as unverified, and cannot log in until they follow a
+// link from CreateEmailVerification sent to that address.
+func (s *Service) RegisterUser(reg Registration) (*models.User, error) {
+	reg.Username = strings.TrimSpace(reg.Username)
+	reg.DisplayName = strings.TrimSpace(reg.DisplayName)
+	reg.Email = strings.TrimSpace(reg.Email)
+	if reg.Username == "" || reg.DisplayName == "" || reg.Password == "" {
+		return nil, ErrInvalidRegistration
+	}
+	if reg.Email != "" {
+		if _, err := mail.ParseAddress(reg.Email); err != nil {
+			return nil, ErrInvalidEmail
+		}
+	}
+
+	policy, err := s.RegistrationPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	user := &models.User{
+		Username:    reg.Username,
+		DisplayName: reg.DisplayName,
+		Email:       reg.Email,
+		Status:      models.UserStatusActive,
+	}
+
+	// An invitation lets someone in whatever the mode, unless registration
+	// has been switched off altogether.
+	var invitation *models.Invitation
+	if reg.Invitation != "" && policy.Mode != RegistrationDisabled {
+		invitation, err = s.FindInvitation(reg.Invitation)
+		if err != nil {
+			return nil, err
+		}
+		if invitation.Email != "" && !strings.EqualFold(invitation.Email, reg.Email) {
+			return nil, fmt.Errorf("%w: the invitation was sent to a different address", ErrEmailNotAllowed)
+		}
+	} else {
+		switch policy.Mode {
+		case RegistrationOpen:
+		case RegistrationApproval:
+			user.Status = models.UserStatusPending
+		case RegistrationDomain:
+			if !domainAllowed(reg.Email, policy.AllowedDomains) {
+				return nil, ErrEmailNotAllowed
+			}
+			user.Status = models.UserStatusUnverified
+		case RegistrationInvite:
+			return nil, ErrInvitationRequired
+		default:
+			return nil, ErrRegistrationClosed
+		}
+	}
+
+	if _, err := s.Repo.FindUserByUsername(reg.Username); err == nil {
+		return nil, ErrUserExists
+	}
+
+	passwordHash, err := HashPassword(reg.Password, reg.Username)
+	if err != nil {
+		return nil, err
+	}
+	identity := &models.Identity{
+		Provider:       "local",
+		ProviderUserID: reg.Username,
+		PasswordHash:   &passwordHash,
+	}
+
+	if invitation != nil {
+		if err := s.Repo.CreateInvitedUser(user, identity, invitation.ID); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, ErrInvalidInvitation
+			}
+			return nil, err
+		}
+	} else if err := s.Repo.CreateUser(user, identity); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// CreateEmailVerification issues a token confirming an unverified user's email
+// address and returns its plaintext value, to be sent to the address.
+func (s *Service) CreateEmailVerification(userID int) (string, error) {
+	raw, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	if err := s.Repo.CreateEmailVerification(userID, hashToken(raw), time.Now().Add(emailVerificationValidity)); err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// VerifyEmail uses up an email verification token and activates the user it
+// was sent to.
+func (s *Service) VerifyEmail(raw string) error {
+	if _, err := s.Repo.VerifyEmail(hashToken(raw)); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrInvalidEmailVerification
+		}
+		return err
+	}
+	return nil
+}
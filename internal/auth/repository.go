@@ -2,7 +2,11 @@ package auth
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"sowing/internal/models"
+	"strings"
+	"time"
 )
 
 // Repository provides access to the authentication storage.
@@ -15,13 +19,55 @@ func NewRepository(db *sql.DB) *Repository {
 	return &Repository{DB: db}
 }
 
+const userColumns = "id, username, display_name, email, status, is_admin"
+
 // FindUserByUsername finds a user by their username.
 func (r *Repository) FindUserByUsername(username string) (*models.User, error) {
-	var user models.User
-	err := r.DB.QueryRow("SELECT id, username, display_name FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username, &user.DisplayName)
+	return scanUser(r.DB.QueryRow("SELECT "+userColumns+" FROM users WHERE username = ?", username))
+}
+
+// FindUserByID finds a user by their ID.
+func (r *Repository) FindUserByID(id int) (*models.User, error) {
+	return scanUser(r.DB.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+}
+
+// ListUsers lists all users, oldest first.
+func (r *Repository) ListUsers() ([]models.User, error) {
+	rows, err := r.DB.Query("SELECT " + userColumns + " FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUsers(rows)
+}
+
+// ListUsersByStatus lists the users with the given status, oldest first.
+func (r *Repository) ListUsersByStatus(status string) ([]models.User, error) {
+	rows, err := r.DB.Query("SELECT "+userColumns+" FROM users WHERE status = ? ORDER BY id", status)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+	return scanUsers(rows)
+}
+
+func scanUsers(rows *sql.Rows) ([]models.User, error) {
+	var users []models.User
+	for rows.Next() {
+		var user models.User
+		if err := rows.Scan(&user.ID, &user.Username, &user.DisplayName, &user.Email, &user.Status, &user.IsAdmin); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func scanUser(row *sql.Row) (*models.User, error) {
+	var user models.User
+	if err := row.Scan(&user.ID, &user.Username, &user.DisplayName, &user.Email, &user.Status, &user.IsAdmin); err != nil {
+		return nil, err
+	}
 	return &user, nil
 }
 
@@ -35,32 +81,756 @@ func (r *Repository) FindIdentityByProvider(provider, providerUserID string) (*m
 	return &identity, nil
 }
 
+// ListIdentitiesByUser lists the ways a user can authenticate.
+func (r *Repository) ListIdentitiesByUser(userID int) ([]models.Identity, error) {
+	rows, err := r.DB.Query("SELECT id, user_id, provider, provider_user_id, password_hash FROM identities WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []models.Identity
+	for rows.Next() {
+		var identity models.Identity
+		if err := rows.Scan(&identity.ID, &identity.UserID, &identity.Provider, &identity.ProviderUserID, &identity.PasswordHash); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
 // CreateUser creates a new user and a corresponding identity.
 func (r *Repository) CreateUser(user *models.User, identity *models.Identity) error {
 	tx, err := r.DB.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	if err := createUser(tx, user, identity); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	res, err := tx.Exec("INSERT INTO users (username, display_name) VALUES (?, ?)", user.Username, user.DisplayName)
+// CreateInvitedUser creates a new user and marks the invitation they used as
+// spent. It fails with sql.ErrNoRows if the invitation was already used.
+func (r *Repository) CreateInvitedUser(user *models.User, identity *models.Identity, invitationID int) error {
+	tx, err := r.DB.Begin()
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
+	defer tx.Rollback()
 
-	userID, err := res.LastInsertId()
+	if err := createUser(tx, user, identity); err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("UPDATE invitations SET used_at = ?, used_by = ? WHERE id = ? AND used_at IS NULL", time.Now(), user.ID, invitationID)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
 
-	identity.UserID = int(userID)
+func createUser(tx *sql.Tx, user *models.User, identity *models.Identity) error {
+	if user.Status == "" {
+		user.Status = models.UserStatusActive
+	}
+
+	err := tx.QueryRow("INSERT INTO users (username, display_name, email, status, is_admin) VALUES (?, ?, ?, ?, ?) RETURNING id",
+		user.Username, user.DisplayName, user.Email, user.Status, user.IsAdmin).Scan(&user.ID)
+	if err != nil {
+		return err
+	}
+
+	identity.UserID = user.ID
 
 	_, err = tx.Exec("INSERT INTO identities (user_id, provider, provider_user_id, password_hash) VALUES (?, ?, ?, ?)", identity.UserID, identity.Provider, identity.ProviderUserID, identity.PasswordHash)
+	return err
+}
+
+// UpdateProfile changes a user's display name and email address.
+func (r *Repository) UpdateProfile(userID int, displayName, email string) error {
+	_, err := r.DB.Exec("UPDATE users SET display_name = ?, email = ? WHERE id = ?", displayName, email, userID)
+	return err
+}
+
+// UpdatePassword replaces the password hash of a user's local identity.
+func (r *Repository) UpdatePassword(userID int, passwordHash string) error {
+	res, err := r.DB.Exec("UPDATE identities SET password_hash = ? WHERE user_id = ? AND provider = 'local'", passwordHash, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetUserStatus changes the status of a user.
+func (r *Repository) SetUserStatus(userID int, status string) error {
+	res, err := r.DB.Exec("UPDATE users SET status = ? WHERE id = ?", status, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetUserAdmin grants or revokes a user's administrator rights.
+func (r *Repository) SetUserAdmin(userID int, isAdmin bool) error {
+	res, err := r.DB.Exec("UPDATE users SET is_admin = ? WHERE id = ?", isAdmin, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteUser deletes a user and everything that only exists for them. Their
+// revisions, and the invitations they sent, are reassigned to another user so
+// that page history stays intact.
+func (r *Repository) DeleteUser(userID, reassignTo int) error {
+	if userID == reassignTo {
+		return errors.New("cannot reassign a user's content to themselves")
+	}
+
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var username string
+	if err := tx.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username); err != nil {
+		return err
+	}
+	var exists int
+	if err := tx.QueryRow("SELECT 1 FROM users WHERE id = ?", reassignTo).Scan(&exists); err != nil {
+		return fmt.Errorf("error finding user to reassign content to: %w", err)
+	}
+
+	if _, err := tx.Exec("UPDATE revisions SET author_id = ? WHERE author_id = ?", reassignTo, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE invitations SET created_by = ? WHERE created_by = ?", reassignTo, userID); err != nil {
+		return err
+	}
+	if err := deleteUser(tx, userID, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeletePendingUser deletes a user whose registration is still awaiting
+// approval. Such users cannot have authored anything, so only their identities
+// and the like have to go with them. A user who isn't pending yields
+// sql.ErrNoRows.
+func (r *Repository) DeletePendingUser(userID int) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var username, status string
+	if err := tx.QueryRow("SELECT username, status FROM users WHERE id = ?", userID).Scan(&username, &status); err != nil {
+		return err
+	}
+	if status != models.UserStatusPending {
+		return sql.ErrNoRows
+	}
+	if err := deleteUser(tx, userID, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteUser deletes a user and the rows that belong to them, before the user
+// row itself so that foreign keys hold. Their revisions and the invitations
+// they created must already have been given to someone else.
+func deleteUser(tx *sql.Tx, userID int, username string) error {
+	statements := []struct {
+		query string
+		args  []any
+	}{
+		{"UPDATE invitations SET used_by = NULL WHERE used_by = ?", []any{userID}},
+		{"UPDATE audit_log SET actor_id = NULL WHERE actor_id = ?", []any{userID}},
+		{"DELETE FROM silo_roles WHERE user_id = ?", []any{userID}},
+		{"DELETE FROM api_tokens WHERE user_id = ?", []any{userID}},
+		{"DELETE FROM recovery_codes WHERE user_id = ?", []any{userID}},
+		{"DELETE FROM user_totp WHERE user_id = ?", []any{userID}},
+		{"DELETE FROM sessions WHERE user_id = ?", []any{userID}},
+		{"DELETE FROM password_resets WHERE user_id = ?", []any{userID}},
+		{"DELETE FROM email_verifications WHERE user_id = ?", []any{userID}},
+		{"DELETE FROM account_lockouts WHERE username = ?", []any{username}},
+		{"DELETE FROM identities WHERE user_id = ?", []any{userID}},
+		{"DELETE FROM watch_emails WHERE user_id = ?", []any{userID}},
+		{"DELETE FROM watches WHERE user_id = ?", []any{userID}},
+		{"DELETE FROM watch_preferences WHERE user_id = ?", []any{userID}},
+		{"DELETE FROM notifications WHERE user_id = ?", []any{userID}},
+		{"DELETE FROM users WHERE id = ?", []any{userID}},
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateAPIToken stores a new API token.
+func (r *Repository) CreateAPIToken(token *models.APIToken) error {
+	return r.DB.QueryRow("INSERT INTO api_tokens (user_id, name, token_hash, scopes, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?) RETURNING id",
+		token.UserID, token.Name, token.TokenHash, strings.Join(token.Scopes, ","), token.ExpiresAt, token.CreatedAt).Scan(&token.ID)
+}
+
+// FindAPITokenByHash finds an API token by the hash of its plaintext value.
+func (r *Repository) FindAPITokenByHash(hash string) (*models.APIToken, error) {
+	row := r.DB.QueryRow("SELECT id, user_id, name, token_hash, scopes, expires_at, last_used_at, created_at FROM api_tokens WHERE token_hash = ?", hash)
+	return scanAPIToken(row)
+}
+
+// ListAPITokensByUser lists all API tokens belonging to a user.
+func (r *Repository) ListAPITokensByUser(userID int) ([]models.APIToken, error) {
+	rows, err := r.DB.Query("SELECT id, user_id, name, token_hash, scopes, expires_at, last_used_at, created_at FROM api_tokens WHERE user_id = ? ORDER BY created_at DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanAPITokens(rows)
+}
+
+// ListAPITokens lists the API tokens of all users.
+func (r *Repository) ListAPITokens() ([]models.APIToken, error) {
+	rows, err := r.DB.Query("SELECT id, user_id, name, token_hash, scopes, expires_at, last_used_at, created_at FROM api_tokens ORDER BY user_id, created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanAPITokens(rows)
+}
+
+// DeleteAPITokens deletes all of a user's API tokens, returning how many there were.
+func (r *Repository) DeleteAPITokens(userID int) (int64, error) {
+	res, err := r.DB.Exec("DELETE FROM api_tokens WHERE user_id = ?", userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// TouchAPIToken records when an API token was last used.
+func (r *Repository) TouchAPIToken(id int, usedAt time.Time) error {
+	_, err := r.DB.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", usedAt, id)
+	return err
+}
+
+// DeleteAPIToken deletes an API token owned by the given user.
+func (r *Repository) DeleteAPIToken(userID, id int) error {
+	res, err := r.DB.Exec("DELETE FROM api_tokens WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func scanAPIToken(row *sql.Row) (*models.APIToken, error) {
+	var token models.APIToken
+	var scopes string
+	if err := row.Scan(&token.ID, &token.UserID, &token.Name, &token.TokenHash, &scopes, &token.ExpiresAt, &token.LastUsedAt, &token.CreatedAt); err != nil {
+		return nil, err
+	}
+	token.Scopes = splitScopes(scopes)
+	return &token, nil
+}
+
+func scanAPITokens(rows *sql.Rows) ([]models.APIToken, error) {
+	var tokens []models.APIToken
+	for rows.Next() {
+		var token models.APIToken
+		var scopes string
+		if err := rows.Scan(&token.ID, &token.UserID, &token.Name, &token.TokenHash, &scopes, &token.ExpiresAt, &token.LastUsedAt, &token.CreatedAt); err != nil {
+			return nil, err
+		}
+		token.Scopes = splitScopes(scopes)
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func splitScopes(scopes string) []string {
+	if scopes == "" {
+		return nil
+	}
+	return strings.Split(scopes, ",")
+}
+
+// FindTOTP finds the TOTP enrolment of a user.
+func (r *Repository) FindTOTP(userID int) (*models.UserTOTP, error) {
+	var totp models.UserTOTP
+	err := r.DB.QueryRow("SELECT user_id, secret, last_used_step, enabled_at, created_at FROM user_totp WHERE user_id = ?", userID).Scan(&totp.UserID, &totp.Secret, &totp.LastUsedStep, &totp.EnabledAt, &totp.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &totp, nil
+}
+
+// SavePendingTOTP stores a new, not yet enabled, TOTP secret for a user,
+// replacing any previous pending enrolment.
+func (r *Repository) SavePendingTOTP(userID int, secret string) error {
+	_, err := r.DB.Exec(`
+		INSERT INTO user_totp (user_id, secret, created_at) VALUES (?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET secret = excluded.secret, last_used_step = 0, enabled_at = NULL, created_at = excluded.created_at
+		WHERE user_totp.enabled_at IS NULL
+	`, userID, secret, time.Now())
+	return err
+}
+
+// EnableTOTP marks a user's TOTP enrolment as confirmed and replaces their recovery codes.
+func (r *Repository) EnableTOTP(userID int, step int64, recoveryCodeHashes []string) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE user_totp SET enabled_at = ?, last_used_step = ? WHERE user_id = ?", time.Now(), step, userID); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records an accepted time step. It fails with sql.ErrNoRows if the
+// step is not newer than the last accepted one, so each code works only once.
+func (r *Repository) UseTOTPStep(userID int, step int64) error {
+	res, err := r.DB.Exec("UPDATE user_totp SET last_used_step = ? WHERE user_id = ? AND last_used_step < ?", step, userID, step)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteTOTP removes a user's TOTP enrolment and recovery codes.
+func (r *Repository) DeleteTOTP(userID int) error {
+	tx, err := r.DB.Begin()
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
+	defer tx.Rollback()
 
+	if _, err := tx.Exec("DELETE FROM user_totp WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
+
+// ReplaceRecoveryCodes replaces all recovery codes of a user.
+func (r *Repository) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int, codeHashes []string) error {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode marks an unused recovery code as used. It returns
+// sql.ErrNoRows if the code does not exist or was already used.
+func (r *Repository) UseRecoveryCode(userID int, codeHash string) error {
+	res, err := r.DB.Exec("UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL", time.Now(), userID, codeHash)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CountRecoveryCodes counts the unused recovery codes of a user.
+func (r *Repository) CountRecoveryCodes(userID int) (int, error) {
+	var count int
+	err := r.DB.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&count)
+	return count, err
+}
+
+// FindSessionByTokenHash finds an unexpired session by the hash of its ID.
+func (r *Repository) FindSessionByTokenHash(hash string) (*models.Session, error) {
+	var session models.Session
+	err := r.DB.QueryRow("SELECT id, token_hash, user_id, data, user_agent, ip, created_at, last_seen_at, expires_at FROM sessions WHERE token_hash = ? AND expires_at > ?", hash, time.Now()).Scan(
+		&session.ID, &session.TokenHash, &session.UserID, &session.Data, &session.UserAgent, &session.IP, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// SaveSession inserts a session or updates the existing one with the same token hash.
+func (r *Repository) SaveSession(session *models.Session) error {
+	_, err := r.DB.Exec(`
+		INSERT INTO sessions (token_hash, user_id, data, user_agent, ip, created_at, last_seen_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(token_hash) DO UPDATE SET
+			user_id = excluded.user_id,
+			data = excluded.data,
+			user_agent = excluded.user_agent,
+			ip = excluded.ip,
+			last_seen_at = excluded.last_seen_at,
+			expires_at = excluded.expires_at
+	`, session.TokenHash, session.UserID, session.Data, session.UserAgent, session.IP, session.CreatedAt, session.LastSeenAt, session.ExpiresAt)
+	return err
+}
+
+// TouchSession records activity on a session.
+func (r *Repository) TouchSession(id int, seenAt time.Time) error {
+	_, err := r.DB.Exec("UPDATE sessions SET last_seen_at = ? WHERE id = ?", seenAt, id)
+	return err
+}
+
+// ListSessionsByUser lists the unexpired sessions of a user, most recently used first.
+func (r *Repository) ListSessionsByUser(userID int) ([]models.Session, error) {
+	rows, err := r.DB.Query("SELECT id, token_hash, user_id, user_agent, ip, created_at, last_seen_at, expires_at FROM sessions WHERE user_id = ? AND expires_at > ? ORDER BY last_seen_at DESC", userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSessions(rows)
+}
+
+// ListSessions lists the unexpired sessions of all logged in users.
+func (r *Repository) ListSessions() ([]models.Session, error) {
+	rows, err := r.DB.Query("SELECT id, token_hash, user_id, user_agent, ip, created_at, last_seen_at, expires_at FROM sessions WHERE user_id IS NOT NULL AND expires_at > ? ORDER BY last_seen_at DESC", time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSessions(rows)
+}
+
+func scanSessions(rows *sql.Rows) ([]models.Session, error) {
+	var sessions []models.Session
+	for rows.Next() {
+		var session models.Session
+		if err := rows.Scan(&session.ID, &session.TokenHash, &session.UserID, &session.UserAgent, &session.IP, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteSessionByTokenHash deletes a session by the hash of its ID.
+func (r *Repository) DeleteSessionByTokenHash(hash string) error {
+	_, err := r.DB.Exec("DELETE FROM sessions WHERE token_hash = ?", hash)
+	return err
+}
+
+// DeleteUserSession deletes one session belonging to a user.
+func (r *Repository) DeleteUserSession(userID, id int) error {
+	res, err := r.DB.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteSession deletes a session by its ID.
+func (r *Repository) DeleteSession(id int) error {
+	res, err := r.DB.Exec("DELETE FROM sessions WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteUserSessions deletes all sessions of a user except the one with the
+// given token hash, which may be empty to delete them all.
+func (r *Repository) DeleteUserSessions(userID int, exceptTokenHash string) (int64, error) {
+	res, err := r.DB.Exec("DELETE FROM sessions WHERE user_id = ? AND token_hash != ?", userID, exceptTokenHash)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteAllSessions deletes every session, logging out all users.
+func (r *Repository) DeleteAllSessions() (int64, error) {
+	res, err := r.DB.Exec("DELETE FROM sessions")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteExpiredSessions removes sessions past their expiry time.
+func (r *Repository) DeleteExpiredSessions() error {
+	_, err := r.DB.Exec("DELETE FROM sessions WHERE expires_at <= ?", time.Now())
+	return err
+}
+
+// RecordLoginAttempt adds an entry to the login audit trail.
+func (r *Repository) RecordLoginAttempt(attempt *models.LoginAttempt) error {
+	_, err := r.DB.Exec("INSERT INTO login_attempts (username, ip, succeeded, reason, created_at) VALUES (?, ?, ?, ?, ?)",
+		attempt.Username, attempt.IP, attempt.Succeeded, attempt.Reason, attempt.CreatedAt)
+	return err
+}
+
+// ListLoginAttempts lists the most recent login attempts, optionally only those for one username.
+func (r *Repository) ListLoginAttempts(username string, limit int) ([]models.LoginAttempt, error) {
+	query := "SELECT id, username, ip, succeeded, reason, created_at FROM login_attempts"
+	var args []any
+	if username != "" {
+		query += " WHERE username = ?"
+		args = append(args, username)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := r.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []models.LoginAttempt
+	for rows.Next() {
+		var attempt models.LoginAttempt
+		if err := rows.Scan(&attempt.ID, &attempt.Username, &attempt.IP, &attempt.Succeeded, &attempt.Reason, &attempt.CreatedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, attempt)
+	}
+	return attempts, rows.Err()
+}
+
+// FindLockout finds the lockout state of a username. A username without
+// failed logins has no row and yields sql.ErrNoRows.
+func (r *Repository) FindLockout(username string) (*models.AccountLockout, error) {
+	var lockout models.AccountLockout
+	err := r.DB.QueryRow("SELECT username, failed_count, locked_until FROM account_lockouts WHERE username = ?", username).Scan(&lockout.Username, &lockout.FailedCount, &lockout.LockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	return &lockout, nil
+}
+
+// AddFailedLogin counts a failed login of a username, returning how many
+// there have been since the last successful one. The count is updated in one
+// statement so that failures made at the same time are all counted.
+func (r *Repository) AddFailedLogin(username string) (int, error) {
+	var count int
+	err := r.DB.QueryRow(`
+		INSERT INTO account_lockouts (username, failed_count, last_failed_at) VALUES (?, 1, ?)
+		ON CONFLICT(username) DO UPDATE SET failed_count = account_lockouts.failed_count + 1, last_failed_at = excluded.last_failed_at
+		RETURNING failed_count
+	`, username, time.Now()).Scan(&count)
+	return count, err
+}
+
+// LockUntil locks a username until the given time, unless it is already
+// locked for longer.
+func (r *Repository) LockUntil(username string, until time.Time) error {
+	_, err := r.DB.Exec("UPDATE account_lockouts SET locked_until = ? WHERE username = ? AND (locked_until IS NULL OR locked_until < ?)", until, username, until)
+	return err
+}
+
+// DeleteLockout clears the failed login count and any lockout of a username.
+func (r *Repository) DeleteLockout(username string) error {
+	_, err := r.DB.Exec("DELETE FROM account_lockouts WHERE username = ?", username)
+	return err
+}
+
+// DeleteStaleLockouts forgets the failed logins of usernames that haven't
+// failed since before, unless they are still locked.
+func (r *Repository) DeleteStaleLockouts(before time.Time) error {
+	_, err := r.DB.Exec("DELETE FROM account_lockouts WHERE (last_failed_at IS NULL OR last_failed_at < ?) AND (locked_until IS NULL OR locked_until < ?)",
+		before, time.Now())
+	return err
+}
+
+// DeleteLoginAttemptsBefore removes login attempts made before a time.
+func (r *Repository) DeleteLoginAttemptsBefore(before time.Time) error {
+	_, err := r.DB.Exec("DELETE FROM login_attempts WHERE created_at < ?", before)
+	return err
+}
+
+const invitationColumns = "id, token_hash, email, silo_id, created_by, expires_at, used_at, used_by, created_at"
+
+// CreateInvitation stores a new invitation.
+func (r *Repository) CreateInvitation(invitation *models.Invitation) error {
+	return r.DB.QueryRow("INSERT INTO invitations (token_hash, email, silo_id, created_by, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?) RETURNING id",
+		invitation.TokenHash, invitation.Email, invitation.SiloID, invitation.CreatedBy, invitation.ExpiresAt, invitation.CreatedAt).Scan(&invitation.ID)
+}
+
+// FindInvitationByHash finds an invitation by the hash of its token.
+func (r *Repository) FindInvitationByHash(hash string) (*models.Invitation, error) {
+	var invitation models.Invitation
+	err := r.DB.QueryRow("SELECT "+invitationColumns+" FROM invitations WHERE token_hash = ?", hash).Scan(
+		&invitation.ID, &invitation.TokenHash, &invitation.Email, &invitation.SiloID, &invitation.CreatedBy,
+		&invitation.ExpiresAt, &invitation.UsedAt, &invitation.UsedBy, &invitation.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+// ListInvitations lists the invitations created by a user, newest first.
+// A createdBy of 0 lists the invitations of all users.
+func (r *Repository) ListInvitations(createdBy int) ([]models.Invitation, error) {
+	query := "SELECT " + invitationColumns + " FROM invitations"
+	var args []any
+	if createdBy != 0 {
+		query += " WHERE created_by = ?"
+		args = append(args, createdBy)
+	}
+	query += " ORDER BY id DESC"
+
+	rows, err := r.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invitations []models.Invitation
+	for rows.Next() {
+		var invitation models.Invitation
+		if err := rows.Scan(&invitation.ID, &invitation.TokenHash, &invitation.Email, &invitation.SiloID, &invitation.CreatedBy,
+			&invitation.ExpiresAt, &invitation.UsedAt, &invitation.UsedBy, &invitation.CreatedAt); err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+	return invitations, rows.Err()
+}
+
+// DeleteInvitation deletes an unused invitation. A createdBy of 0 allows
+// deleting the invitations of any user.
+func (r *Repository) DeleteInvitation(id, createdBy int) error {
+	query := "DELETE FROM invitations WHERE id = ? AND used_at IS NULL"
+	args := []any{id}
+	if createdBy != 0 {
+		query += " AND created_by = ?"
+		args = append(args, createdBy)
+	}
+
+	res, err := r.DB.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreatePasswordReset stores a new password reset token.
+func (r *Repository) CreatePasswordReset(userID int, tokenHash string, expiresAt time.Time) error {
+	_, err := r.DB.Exec("INSERT INTO password_resets (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)", userID, tokenHash, expiresAt, time.Now())
+	return err
+}
+
+// FindPasswordResetByHash finds a password reset by the hash of its token.
+func (r *Repository) FindPasswordResetByHash(hash string) (*models.PasswordReset, error) {
+	var reset models.PasswordReset
+	err := r.DB.QueryRow("SELECT id, user_id, token_hash, expires_at, used_at, created_at FROM password_resets WHERE token_hash = ?", hash).Scan(
+		&reset.ID, &reset.UserID, &reset.TokenHash, &reset.ExpiresAt, &reset.UsedAt, &reset.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &reset, nil
+}
+
+// ResetPassword uses up a password reset token and sets the new password hash
+// in one transaction. It fails with sql.ErrNoRows if the token was already used.
+func (r *Repository) ResetPassword(tokenHash string, userID int, passwordHash string) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE password_resets SET used_at = ? WHERE token_hash = ? AND user_id = ? AND used_at IS NULL", time.Now(), tokenHash, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	if _, err := tx.Exec("UPDATE identities SET password_hash = ? WHERE user_id = ? AND provider = 'local'", passwordHash, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateEmailVerification stores a new email verification token.
+func (r *Repository) CreateEmailVerification(userID int, tokenHash string, expiresAt time.Time) error {
+	_, err := r.DB.Exec("INSERT INTO email_verifications (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)", userID, tokenHash, expiresAt, time.Now())
+	return err
+}
+
+// VerifyEmail uses up an email verification token that hasn't expired and
+// activates its unverified user in one transaction, returning the user's ID.
+// It fails with sql.ErrNoRows if the token is unknown, used or expired.
+func (r *Repository) VerifyEmail(tokenHash string) (int, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var userID int
+	err = tx.QueryRow("UPDATE email_verifications SET used_at = ? WHERE token_hash = ? AND used_at IS NULL AND expires_at > ? RETURNING user_id", now, tokenHash, now).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE users SET status = ? WHERE id = ? AND status = ?", models.UserStatusActive, userID, models.UserStatusUnverified); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
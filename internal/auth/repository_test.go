@@ -0,0 +1,165 @@
+package auth_test
+
+import (
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	"sowing/internal/auth"
+	"sowing/internal/database/dbtest"
+	"sowing/internal/models"
+)
+
+func TestCreateUser(t *testing.T) {
+	repo := auth.NewRepository(dbtest.Open(t))
+
+	hash := "hash"
+	user := &models.User{Username: "alice", DisplayName: "Alice", Email: "alice@example.com", IsAdmin: true}
+	identity := &models.Identity{Provider: "local", ProviderUserID: "alice", PasswordHash: &hash}
+	if err := repo.CreateUser(user, identity); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID == 0 || identity.UserID != user.ID {
+		t.Fatalf("user ID %d, identity user ID %d", user.ID, identity.UserID)
+	}
+
+	found, err := repo.FindUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != user.ID || !found.IsAdmin || found.Status != models.UserStatusActive {
+		t.Errorf("found %+v", found)
+	}
+
+	if err := repo.SetUserAdmin(user.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := repo.FindUserByID(user.ID); err != nil || found.IsAdmin {
+		t.Errorf("after SetUserAdmin(false), IsAdmin = %v, %v", found.IsAdmin, err)
+	}
+}
+
+func TestAddFailedLogin(t *testing.T) {
+	repo := auth.NewRepository(dbtest.Open(t))
+
+	// Failures made at the same time must all be counted.
+	const attempts = 10
+	var wg sync.WaitGroup
+	for range attempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := repo.AddFailedLogin("alice"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	count, err := repo.AddFailedLogin("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != attempts+1 {
+		t.Errorf("count = %d, want %d", count, attempts+1)
+	}
+
+	until := time.Now().Add(time.Hour)
+	if err := repo.LockUntil("alice", until); err != nil {
+		t.Fatal(err)
+	}
+	// A shorter lock doesn't replace a longer one.
+	if err := repo.LockUntil("alice", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	lockout, err := repo.FindLockout("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockout.LockedUntil == nil || lockout.LockedUntil.Sub(until).Abs() > time.Second {
+		t.Errorf("locked until %v, want %v", lockout.LockedUntil, until)
+	}
+
+	if err := repo.DeleteLockout("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := repo.AddFailedLogin("alice"); err != nil || count != 1 {
+		t.Errorf("count after DeleteLockout = %d, %v, want 1", count, err)
+	}
+}
+
+func TestDeletePendingUser(t *testing.T) {
+	repo := auth.NewRepository(dbtest.Open(t))
+
+	create := func(username, status string) *models.User {
+		t.Helper()
+		hash := "hash"
+		user := &models.User{Username: username, DisplayName: username, Status: status}
+		if err := repo.CreateUser(user, &models.Identity{Provider: "local", ProviderUserID: username, PasswordHash: &hash}); err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	pending := create("bob", models.UserStatusPending)
+	active := create("carol", models.UserStatusActive)
+	if _, err := repo.AddFailedLogin("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.DeletePendingUser(active.ID); err != sql.ErrNoRows {
+		t.Errorf("DeletePendingUser(active user) = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := repo.FindUserByID(active.ID); err != nil {
+		t.Errorf("active user was deleted: %v", err)
+	}
+
+	if err := repo.DeletePendingUser(pending.ID); err != nil {
+		t.Fatalf("DeletePendingUser: %v", err)
+	}
+	if _, err := repo.FindUserByID(pending.ID); err != sql.ErrNoRows {
+		t.Errorf("FindUserByID after deleting = %v, want sql.ErrNoRows", err)
+	}
+	if identities, err := repo.ListIdentitiesByUser(pending.ID); err != nil || len(identities) != 0 {
+		t.Errorf("identities after deleting = %v, %v, want none", identities, err)
+	}
+}
+
+func TestPruneLoginFailures(t *testing.T) {
+	repo := auth.NewRepository(dbtest.Open(t))
+
+	for _, username := range []string{"stale", "locked", "recent"} {
+		if _, err := repo.AddFailedLogin(username); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.LockUntil("locked", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	cutoff := time.Now()
+	if _, err := repo.AddFailedLogin("recent"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.DeleteStaleLockouts(cutoff); err != nil {
+		t.Fatal(err)
+	}
+	for username, kept := range map[string]bool{"stale": false, "locked": true, "recent": true} {
+		if _, err := repo.FindLockout(username); (err == nil) != kept {
+			t.Errorf("FindLockout(%s) = %v, want kept = %v", username, err, kept)
+		}
+	}
+
+	for _, age := range []time.Duration{48 * time.Hour, time.Minute} {
+		attempt := &models.LoginAttempt{Username: "alice", IP: "192.0.2.1", CreatedAt: time.Now().Add(-age)}
+		if err := repo.RecordLoginAttempt(attempt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.DeleteLoginAttemptsBefore(time.Now().Add(-24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if attempts, err := repo.ListLoginAttempts("alice", 10); err != nil || len(attempts) != 1 {
+		t.Errorf("ListLoginAttempts after pruning = %d attempts, %v, want 1", len(attempts), err)
+	}
+}
@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"sowing/internal/models"
+)
+
+// touchInterval limits how often a session's last-seen time is written back.
+const touchInterval = time.Minute
+
+// DBStore is a sessions.Store that keeps session values in the database.
+// The cookie only carries a random session ID, signed with the session key,
+// so sessions can be listed and revoked on the server.
+type DBStore struct {
+	Repo    *Repository
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+// NewDBStore creates a new database-backed session store.
+func NewDBStore(repo *Repository, keyPairs ...[]byte) *DBStore {
+	return &DBStore{
+		Repo:   repo,
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+	}
+}
+
+// Get returns a cached session for the request, loading it on first access.
+func (s *DBStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named by the request's cookie. If there is no valid
+// cookie, or the session has expired or been revoked, a new empty session is returned.
+func (s *DBStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var id string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &id, s.Codecs...); err != nil {
+		return session, nil
+	}
+
+	stored, err := s.Repo.FindSessionByTokenHash(hashToken(id))
+	if err != nil {
+		return session, nil
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(stored.Data)).Decode(&session.Values); err != nil {
+		log.Printf("Error decoding session data: %v", err)
+		return session, nil
+	}
+
+	session.ID = id
+	session.IsNew = false
+
+	if time.Since(stored.LastSeenAt) > touchInterval {
+		if err := s.Repo.TouchSession(stored.ID, time.Now()); err != nil {
+			log.Printf("Error updating session last seen time: %v", err)
+		}
+	}
+
+	return session, nil
+}
+
+// Save writes the session to the database and sets the session cookie.
+// A negative MaxAge deletes the session.
+func (s *DBStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.Repo.DeleteSessionByTokenHash(hashToken(session.ID)); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	now := time.Now()
+	created := now
+	if session.ID == "" {
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+		session.ID = id
+
+		// New sessions are a convenient moment to clear out stale ones.
+		if err := s.Repo.DeleteExpiredSessions(); err != nil {
+			log.Printf("Error deleting expired sessions: %v", err)
+		}
+	} else if stored, err := s.Repo.FindSessionByTokenHash(hashToken(session.ID)); err == nil {
+		created = stored.CreatedAt
+	}
+
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(session.Values); err != nil {
+		return err
+	}
+
+	stored := &models.Session{
+		TokenHash:  hashToken(session.ID),
+		Data:       data.Bytes(),
+		UserAgent:  r.UserAgent(),
+		IP:         ClientIP(r),
+		CreatedAt:  created,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(time.Duration(session.Options.MaxAge) * time.Second),
+	}
+	if userID, ok := session.Values["user_id"].(int); ok {
+		stored.UserID = &userID
+	}
+	if err := s.Repo.SaveSession(stored); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Renew gives a session a new ID and deletes the old one, keeping its values.
+// This is done whenever a user logs in, to prevent session fixation.
+func (s *DBStore) Renew(session *sessions.Session) error {
+	if session.ID != "" {
+		if err := s.Repo.DeleteSessionByTokenHash(hashToken(session.ID)); err != nil {
+			return err
+		}
+	}
+	session.ID = ""
+	return nil
+}
+
+// newSessionID returns a random session ID.
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// TrustedProxies are the reverse proxies whose X-Forwarded-For headers are
+// believed. Anyone can send the header, so it is ignored on requests from
+// anywhere else.
+var TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a comma separated list of IP addresses and CIDR
+// ranges, such as "127.0.0.1, 10.0.0.0/8".
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %q", entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP address of the client. Requests from a trusted
+// proxy are taken to come from the last address in X-Forwarded-For that isn't
+// another trusted proxy, since only the entries the proxies added can be
+// believed.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		host = addr
+		if !isTrustedProxy(addr) {
+			break
+		}
+	}
+	return host
+}
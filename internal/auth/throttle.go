@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"sowing/internal/models"
+)
+
+// Login throttling parameters. Each address and each account gets a number of
+// free failures, after which every further failure doubles the wait.
+const (
+	accountFreeFailures = 5
+	accountBaseLockout  = time.Minute
+	accountMaxLockout   = time.Hour
+
+	ipFreeFailures = 20
+	ipBaseDelay    = time.Second
+	ipMaxDelay     = 15 * time.Minute
+	// ipForgetAfter is how long an address must stay quiet before its
+	// failures are forgotten.
+	ipForgetAfter = time.Hour
+
+	// accountForgetAfter is how long a username must go without failures
+	// before they are forgotten, and attemptRetention how long the login
+	// audit trail is kept. Both are pruned at most every pruneEvery, so that
+	// failures for made-up usernames can't fill the database.
+	accountForgetAfter = 24 * time.Hour
+	attemptRetention   = 90 * 24 * time.Hour
+	pruneEvery         = time.Hour
+)
+
+// ThrottledError is returned by Login when the account is locked or the
+// client's address has made too many failed attempts.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("too many failed login attempts, try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+// backoff returns the delay after the given number of failures: nothing for
+// the first free failures, then base doubling with each failure up to max.
+func backoff(failures, free int, base, max time.Duration) time.Duration {
+	if failures < free {
+		return 0
+	}
+	delay := base
+	for i := free; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	return min(delay, max)
+}
+
+// ipLimiter keeps per-address failure counts in memory. They don't need to
+// survive restarts; lockouts of accounts are recorded in the database instead.
+type ipLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*ipState
+}
+
+type ipState struct {
+	failures    int
+	lastFailure time.Time
+}
+
+func newIPLimiter() *ipLimiter {
+	return &ipLimiter{clients: make(map[string]*ipState)}
+}
+
+// wait returns how long the address must wait before its next attempt.
+func (l *ipLimiter) wait(ip string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	state, ok := l.clients[ip]
+	if !ok {
+		return 0
+	}
+	if now.Sub(state.lastFailure) > ipForgetAfter {
+		delete(l.clients, ip)
+		return 0
+	}
+	until := state.lastFailure.Add(backoff(state.failures, ipFreeFailures, ipBaseDelay, ipMaxDelay))
+	return max(until.Sub(now), 0)
+}
+
+// fail records a failed attempt from the address.
+func (l *ipLimiter) fail(ip string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Drop stale entries now and then so the map can't grow without bound.
+	if len(l.clients) > 10000 {
+		for addr, state := range l.clients {
+			if now.Sub(state.lastFailure) > ipForgetAfter {
+				delete(l.clients, addr)
+			}
+		}
+	}
+
+	state, ok := l.clients[ip]
+	if !ok {
+		state = &ipState{}
+		l.clients[ip] = state
+	}
+	state.failures++
+	state.lastFailure = now
+}
+
+// reset forgets the failures of the address.
+func (l *ipLimiter) reset(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.clients, ip)
+}
+
+// checkThrottle returns a ThrottledError if the address or account may not
+// attempt to log in right now.
+func (s *Service) checkThrottle(username, ip string) error {
+	now := time.Now()
+	if wait := s.limiter.wait(ip, now); wait > 0 {
+		s.recordAttempt(username, ip, false, "ip_throttled")
+		return &ThrottledError{RetryAfter: wait}
+	}
+
+	lockout, err := s.Repo.FindLockout(username)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error checking account lockout: %v", err)
+		}
+		return nil
+	}
+	if lockout.LockedUntil != nil && now.Before(*lockout.LockedUntil) {
+		s.recordAttempt(username, ip, false, "locked")
+		return &ThrottledError{RetryAfter: lockout.LockedUntil.Sub(now)}
+	}
+	return nil
+}
+
+// loginFailed records a failed attempt and locks the account once it has
+// used up its free failures.
+func (s *Service) loginFailed(username, ip, reason string) {
+	now := time.Now()
+	s.limiter.fail(ip, now)
+	s.recordAttempt(username, ip, false, reason)
+
+	s.prune(now)
+
+	count, err := s.Repo.AddFailedLogin(username)
+	if err != nil {
+		log.Printf("Error counting failed login: %v", err)
+		return
+	}
+	if delay := backoff(count, accountFreeFailures, accountBaseLockout, accountMaxLockout); delay > 0 {
+		if err := s.Repo.LockUntil(username, now.Add(delay)); err != nil {
+			log.Printf("Error saving account lockout: %v", err)
+		}
+	}
+}
+
+// prune deletes old failed login counts and login attempts, if it hasn't for
+// pruneEvery.
+func (s *Service) prune(now time.Time) {
+	s.pruneMu.Lock()
+	if now.Sub(s.prunedAt) < pruneEvery {
+		s.pruneMu.Unlock()
+		return
+	}
+	s.prunedAt = now
+	s.pruneMu.Unlock()
+
+	if err := s.Repo.DeleteStaleLockouts(now.Add(-accountForgetAfter)); err != nil {
+		log.Printf("Error deleting stale account lockouts: %v", err)
+	}
+	if err := s.Repo.DeleteLoginAttemptsBefore(now.Add(-attemptRetention)); err != nil {
+		log.Printf("Error deleting old login attempts: %v", err)
+	}
+}
+
+// loginSucceeded records a successful attempt and clears earlier failures.
+func (s *Service) loginSucceeded(username, ip string) {
+	s.limiter.reset(ip)
+	s.recordAttempt(username, ip, true, "")
+	if err := s.Repo.DeleteLockout(username); err != nil {
+		log.Printf("Error clearing account lockout: %v", err)
+	}
+}
+
+func (s *Service) recordAttempt(username, ip string, succeeded bool, reason string) {
+	attempt := &models.LoginAttempt{
+		Username:  username,
+		IP:        ip,
+		Succeeded: succeeded,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	}
+	if err := s.Repo.RecordLoginAttempt(attempt); err != nil {
+		log.Printf("Error recording login attempt: %v", err)
+	}
+}
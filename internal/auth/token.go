@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"sowing/internal/models"
+)
+
+// Scopes that can be granted to an API token.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// tokenPrefix makes sowing tokens easy to recognise, e.g. by secret scanners.
+const tokenPrefix = "sow_"
+
+// ErrInvalidToken is returned when an API token is unknown or expired.
+var ErrInvalidToken = errors.New("invalid or expired API token")
+
+// hashToken returns the hex-encoded SHA-256 of a plaintext token. Tokens are
+// long random strings, so a fast hash is sufficient to protect them at rest.
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIToken generates a new token for a user and returns its plaintext value.
+// The plaintext is not stored and cannot be recovered later.
+func (s *Service) CreateAPIToken(userID int, name string, scopes []string, expiresAt *time.Time) (string, *models.APIToken, error) {
+	if name == "" {
+		return "", nil, errors.New("token name is required")
+	}
+	if len(scopes) == 0 {
+		return "", nil, errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if scope != ScopeRead && scope != ScopeWrite {
+			return "", nil, errors.New("unknown scope: " + scope)
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	raw := tokenPrefix + hex.EncodeToString(b)
+
+	token := &models.APIToken{
+		UserID:    userID,
+		Name:      name,
+		TokenHash: hashToken(raw),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}
+	if err := s.Repo.CreateAPIToken(token); err != nil {
+		return "", nil, err
+	}
+	return raw, token, nil
+}
+
+// AuthenticateToken resolves a plaintext API token to its owner and records its use.
+func (s *Service) AuthenticateToken(raw string) (*models.User, *models.APIToken, error) {
+	if !strings.HasPrefix(raw, tokenPrefix) {
+		return nil, nil, ErrInvalidToken
+	}
+
+	token, err := s.Repo.FindAPITokenByHash(hashToken(raw))
+	if err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+
+	now := time.Now()
+	if token.ExpiresAt != nil && now.After(*token.ExpiresAt) {
+		return nil, nil, ErrInvalidToken
+	}
+
+	user, err := s.Repo.FindUserByID(token.UserID)
+	if err != nil || user.Status != models.UserStatusActive {
+		return nil, nil, ErrInvalidToken
+	}
+
+	if err := s.Repo.TouchAPIToken(token.ID, now); err != nil {
+		log.Printf("Error updating API token last use: %v", err)
+	}
+
+	return user, token, nil
+}
+
+// TokenHasScope reports whether a token grants the given scope.
+// The write scope implies read access.
+func TokenHasScope(token *models.APIToken, scope string) bool {
+	if slices.Contains(token.Scopes, scope) {
+		return true
+	}
+	return scope == ScopeRead && slices.Contains(token.Scopes, ScopeWrite)
+}
+
+// WithAPIToken authenticates requests carrying an "Authorization: Bearer" header.
+// Safe methods require the read scope, everything else requires the write scope.
+// Requests without a bearer token are passed through untouched.
+func (s *Service) WithAPIToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, token, err := s.AuthenticateToken(strings.TrimSpace(raw))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Invalid API token", http.StatusUnauthorized)
+			return
+		}
+
+		scope := ScopeWrite
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			scope = ScopeRead
+		}
+		if !TokenHasScope(token, scope) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+			http.Error(w, "API token lacks the "+scope+" scope", http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "user", user)
+		ctx = context.WithValue(ctx, "api_token", token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireBasicToken authenticates requests with HTTP basic authentication,
+// taking an API token as the password, for clients such as WebDAV ones that
+// can't send bearer tokens. The username must be the token owner's. Methods
+// listed in readMethods require the read scope, everything else requires the
+// write scope. Unlike WithAPIToken, requests without credentials are refused.
+func (s *Service) RequireBasicToken(readMethods ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			username, raw, ok := r.BasicAuth()
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="sowing", charset="UTF-8"`)
+				http.Error(w, "Sign in with your username and an API token as the password", http.StatusUnauthorized)
+				return
+			}
+
+			user, token, err := s.AuthenticateToken(strings.TrimSpace(raw))
+			if err != nil || user.Username != username {
+				w.Header().Set("WWW-Authenticate", `Basic realm="sowing", charset="UTF-8"`)
+				http.Error(w, "Invalid username or API token", http.StatusUnauthorized)
+				return
+			}
+
+			scope := ScopeWrite
+			if slices.Contains(readMethods, r.Method) {
+				scope = ScopeRead
+			}
+			if !TokenHasScope(token, scope) {
+				http.Error(w, "API token lacks the "+scope+" scope", http.StatusForbidden)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), "user", user)
+			ctx = context.WithValue(ctx, "api_token", token)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequireLoginOrBasicToken lets signed-in users through and asks everyone
+// else for an API token as RequireBasicToken does, for pages such as feeds
+// that are read both in the browser and by clients that can't sign in.
+func (s *Service) RequireLoginOrBasicToken(readMethods ...string) func(http.Handler) http.Handler {
+	requireToken := s.RequireBasicToken(readMethods...)
+	return func(next http.Handler) http.Handler {
+		withToken := requireToken(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user, _ := r.Context().Value("user").(*models.User); user != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			withToken.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"sowing/internal/models"
+)
+
+// TOTP parameters as per RFC 6238. These are the defaults understood by all
+// common authenticator apps.
+const (
+	totpIssuer = "Sowing"
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is the number of time steps either side of now that are accepted,
+	// to tolerate clock drift between the server and the user's device.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+)
+
+var (
+	// ErrSecondFactorRequired is returned by Login when the password was correct
+	// but the user still has to provide a TOTP or recovery code.
+	ErrSecondFactorRequired = errors.New("second factor required")
+	// ErrInvalidCode is returned when a TOTP or recovery code is not accepted.
+	ErrInvalidCode = errors.New("invalid authentication code")
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret returns a random 160-bit secret encoded as base32.
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(b), nil
+}
+
+// totpCode computes the code for a secret at the given time step.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// validateTOTP checks a code against a secret and returns the matching time step.
+func validateTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPProvisioningURI returns the otpauth:// URI that authenticator apps use to
+// enrol a secret, usually by scanning it as a QR code.
+func TOTPProvisioningURI(username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("period", fmt.Sprint(totpPeriod))
+	v.Set("digits", fmt.Sprint(totpDigits))
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// generateRecoveryCodes returns a fresh set of plaintext recovery codes and their hashes.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashToken(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode accepts recovery codes with or without the dash and in any case.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// TOTPEnabled reports whether a user has a confirmed TOTP enrolment.
+func (s *Service) TOTPEnabled(userID int) bool {
+	totp, err := s.Repo.FindTOTP(userID)
+	return err == nil && totp.EnabledAt != nil
+}
+
+// BeginTOTPEnrolment returns the pending TOTP secret for a user, creating one
+// if needed. The secret only takes effect once confirmed with EnableTOTP.
+func (s *Service) BeginTOTPEnrolment(user *models.User) (string, error) {
+	if totp, err := s.Repo.FindTOTP(user.ID); err == nil {
+		if totp.EnabledAt != nil {
+			return "", errors.New("two-factor authentication is already enabled")
+		}
+		return totp.Secret, nil
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	if err := s.Repo.SavePendingTOTP(user.ID, secret); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// EnableTOTP confirms a pending enrolment with a code from the user's device and
+// returns a new set of recovery codes.
+func (s *Service) EnableTOTP(userID int, code string) ([]string, error) {
+	totp, err := s.Repo.FindTOTP(userID)
+	if err != nil {
+		return nil, errors.New("no two-factor enrolment in progress")
+	}
+	if totp.EnabledAt != nil {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+
+	step, ok := validateTOTP(totp.Secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Repo.EnableTOTP(userID, step, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes after verifying a second factor.
+func (s *Service) RegenerateRecoveryCodes(userID int, code string) ([]string, error) {
+	if err := s.VerifySecondFactor(userID, code); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Repo.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns off two-factor authentication after verifying a second factor.
+func (s *Service) DisableTOTP(userID int, code string) error {
+	if err := s.VerifySecondFactor(userID, code); err != nil {
+		return err
+	}
+	return s.Repo.DeleteTOTP(userID)
+}
+
+// VerifySecondFactor accepts either a current TOTP code or an unused recovery code.
+func (s *Service) VerifySecondFactor(userID int, code string) error {
+	totp, err := s.Repo.FindTOTP(userID)
+	if err != nil || totp.EnabledAt == nil {
+		return ErrInvalidCode
+	}
+
+	if step, ok := validateTOTP(totp.Secret, code, time.Now()); ok {
+		if err := s.Repo.UseTOTPStep(userID, step); err != nil {
+			return ErrInvalidCode
+		}
+		return nil
+	}
+
+	if err := s.Repo.UseRecoveryCode(userID, hashToken(normalizeRecoveryCode(code))); err != nil {
+		return ErrInvalidCode
+	}
+	return nil
+}
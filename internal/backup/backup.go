@@ -0,0 +1,347 @@
+// Package backup archives a Sowing instance, its database together with the
+// uploaded files it refers to, and restores such archives.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"sowing/internal/database"
+)
+
+// FormatVersion is the version of the archive layout. Restore refuses
+// archives of a version it doesn't know.
+const FormatVersion = 1
+
+const (
+	manifestName = "manifest.json"
+	databaseName = "sowing.db"
+	uploadsDir   = "uploads"
+)
+
+// Manifest describes the contents of a backup archive. It is the archive's
+// first entry, so a backup can be inspected without unpacking it.
+type Manifest struct {
+	Format        int       `json:"format"`
+	CreatedAt     time.Time `json:"created_at"`
+	SchemaVersion int       `json:"schema_version"`
+	Files         []File    `json:"files"`
+	// Missing lists uploads that the database refers to but that weren't
+	// found on disk when the backup was made.
+	Missing []string `json:"missing,omitempty"`
+}
+
+// File is a file in a backup archive.
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Create writes a backup of a live instance to w as a gzipped tar archive: a
+// snapshot of the database, the files in uploadsRoot that the snapshot refers
+// to, and a manifest with their checksums.
+func Create(db *sql.DB, uploadsRoot string, w io.Writer) (*Manifest, error) {
+	version, err := database.Version(db)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.MkdirTemp("", "sowing-backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	snapshot := filepath.Join(tmp, databaseName)
+	if err := database.Backup(db, snapshot); err != nil {
+		return nil, err
+	}
+
+	// The uploads to include are those the snapshot refers to, so that files
+	// uploaded or removed while the backup runs don't make it inconsistent.
+	uploads, err := referencedUploads(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{Format: FormatVersion, CreatedAt: time.Now().UTC(), SchemaVersion: version}
+	sources := map[string]string{databaseName: snapshot}
+	for _, name := range uploads {
+		sources[path.Join(uploadsDir, name)] = filepath.Join(uploadsRoot, name)
+	}
+
+	names := append([]string{databaseName}, prefixAll(uploadsDir+"/", uploads)...)
+	for _, name := range names {
+		file, err := describe(name, sources[name])
+		if err != nil {
+			if os.IsNotExist(err) && name != databaseName {
+				manifest.Missing = append(manifest.Missing, name)
+				continue
+			}
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeEntry(tw, manifestName, int64(len(manifestJSON)), strings.NewReader(string(manifestJSON))); err != nil {
+		return nil, err
+	}
+	for _, file := range manifest.Files {
+		if err := copyEntry(tw, file, sources[file.Path]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// referencedUploads lists the uploads a database file refers to: attachments
+// and silo cover images.
+func referencedUploads(path string) ([]string, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT unique_filename FROM attachments
+		UNION
+		SELECT SUBSTR(cover_image, LENGTH('/uploads/') + 1) FROM silos WHERE cover_image LIKE '/uploads/%'
+		ORDER BY 1`)
+	if err != nil {
+		return nil, fmt.Errorf("error listing uploads: %w", err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		// Names are generated by Sowing, but are checked anyway so that a
+		// tampered database can't pull other files into the backup.
+		if name != "" && name == filepath.Base(name) {
+			names = append(names, name)
+		}
+	}
+	return names, rows.Err()
+}
+
+// describe measures and checksums a file.
+func describe(name, source string) (File, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return File{}, err
+	}
+	return File{Path: name, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// copyEntry adds a file to the archive, failing if it changed after it was
+// described in the manifest.
+func copyEntry(tw *tar.Writer, file File, source string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if err := writeEntry(tw, file.Path, file.Size, io.TeeReader(f, hash)); err != nil {
+		return fmt.Errorf("error archiving %s: %w", file.Path, err)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != file.SHA256 {
+		return fmt.Errorf("%s changed while the backup was being made", file.Path)
+	}
+	return nil
+}
+
+func writeEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+func prefixAll(prefix string, names []string) []string {
+	prefixed := make([]string, len(names))
+	for i, name := range names {
+		prefixed[i] = prefix + name
+	}
+	return prefixed
+}
+
+// Restore unpacks a backup archive into dir, which must not exist yet or be
+// empty. Every file is checked against the manifest, and the database is
+// checked for corruption and for a schema this version of Sowing can run. If
+// anything is wrong, the files restored so far are removed.
+func Restore(r io.Reader, dir string) (manifest *Manifest, err error) {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("%s is not empty; restore into a fresh directory", dir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, uploadsDir), 0755); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(filepath.Join(dir, databaseName))
+			os.RemoveAll(filepath.Join(dir, uploadsDir))
+		}
+	}()
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a backup archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	manifest, err = readManifest(tr)
+	if err != nil {
+		return nil, err
+	}
+	expected := make(map[string]File, len(manifest.Files))
+	for _, file := range manifest.Files {
+		expected[file.Path] = file
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading archive: %w", err)
+		}
+
+		file, ok := expected[header.Name]
+		if !ok || header.Typeflag != tar.TypeReg || !validPath(header.Name) {
+			return nil, fmt.Errorf("unexpected entry %q in archive", header.Name)
+		}
+		delete(expected, header.Name)
+
+		if err := extract(tr, file, filepath.Join(dir, filepath.FromSlash(header.Name))); err != nil {
+			return nil, err
+		}
+	}
+	for name := range expected {
+		return nil, fmt.Errorf("%s is listed in the manifest but missing from the archive", name)
+	}
+
+	if err := checkDatabase(filepath.Join(dir, databaseName)); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func readManifest(tr *tar.Reader) (*Manifest, error) {
+	header, err := tr.Next()
+	if err != nil || header.Name != manifestName {
+		return nil, errors.New("not a backup archive: the manifest is missing")
+	}
+
+	var manifest Manifest
+	if err := json.NewDecoder(io.LimitReader(tr, 64<<20)).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	if manifest.Format != FormatVersion {
+		return nil, fmt.Errorf("unsupported backup format %d", manifest.Format)
+	}
+	hasDatabase := false
+	for _, file := range manifest.Files {
+		if !validPath(file.Path) {
+			return nil, fmt.Errorf("invalid path %q in manifest", file.Path)
+		}
+		hasDatabase = hasDatabase || file.Path == databaseName
+	}
+	if !hasDatabase {
+		return nil, errors.New("the backup doesn't contain a database")
+	}
+	return &manifest, nil
+}
+
+// validPath reports whether a path in an archive is one a backup contains:
+// the database, or a file directly in the uploads directory.
+func validPath(name string) bool {
+	if name == databaseName {
+		return true
+	}
+	dir, base := path.Split(name)
+	return dir == uploadsDir+"/" && base != "" && base != "." && base != ".."
+}
+
+// extract writes an archive entry to disk, verifying its size and checksum.
+func extract(r io.Reader, file File, dest string) error {
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error restoring %s: %w", file.Path, err)
+	}
+	if size != file.Size || hex.EncodeToString(hash.Sum(nil)) != file.SHA256 {
+		return fmt.Errorf("%s doesn't match its checksum; the backup is damaged", file.Path)
+	}
+	return nil
+}
+
+// checkDatabase verifies that a restored database is intact and can be run.
+func checkDatabase(path string) error {
+	db, err := database.New(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := database.CheckIntegrity(db); err != nil {
+		return err
+	}
+	_, err = database.Version(db)
+	return err
+}
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrBackupUnsupported is returned when backing up a PostgreSQL database,
+// which should be done with pg_dump instead.
+var ErrBackupUnsupported = errors.New("online backups are only supported for SQLite databases; use pg_dump for PostgreSQL")
+
+// Backup copies a live SQLite database into a new database file with SQLite's
+// online backup API. The copy is a consistent snapshot, taken on a read-only
+// connection so that writes carry on while it is made.
+func Backup(db *sql.DB, path string) error {
+	if DialectOf(db) != SQLite {
+		return ErrBackupUnsupported
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	dest, err := (&sqlite3.SQLiteDriver{}).Open(path)
+	if err != nil {
+		return fmt.Errorf("error creating backup database: %w", err)
+	}
+	defer dest.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		src := driverConn.(*sqliteConn).reader
+		backup, err := dest.(*sqlite3.SQLiteConn).Backup("main", src, "main")
+		if err != nil {
+			return fmt.Errorf("error starting backup: %w", err)
+		}
+		// Copying every page in one step holds a read transaction on the
+		// source throughout, which is what makes the copy consistent.
+		if _, err := backup.Step(-1); err != nil {
+			backup.Finish()
+			return fmt.Errorf("error copying database: %w", err)
+		}
+		return backup.Finish()
+	})
+}
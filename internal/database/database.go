@@ -2,11 +2,22 @@ package database
 
 import (
 	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
 )
 
+// New opens the database named by dsn: a PostgreSQL database for a
+// postgres:// URL, or otherwise a SQLite database file.
+//
+// SQLite connections are tuned for a server: WAL mode, foreign keys, a busy
+// timeout and NORMAL synchronisation, each of which the DSN can override, as
+// in "sowing.db?_synchronous=FULL".
 func New(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", dsn)
+	var db *sql.DB
+	var err error
+	if dialectOfDSN(dsn) == Postgres {
+		db, err = sql.Open(string(Postgres), dsn)
+	} else {
+		db, err = openSQLite(dsn)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -18,74 +29,20 @@ func New(dsn string) (*sql.DB, error) {
 	return db, nil
 }
 
-func Migrate(db *sql.DB) error {
-	_, err := db.Exec(`
--- SOWING Database Schema
-
--- Silos are the top-level content areas.
-CREATE TABLE IF NOT EXISTS silos (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    slug TEXT UNIQUE NOT NULL,
-    name TEXT NOT NULL,
-    archived_at TIMESTAMP,
-    cover_image TEXT
-);
-
--- Users are the authors of content.
-CREATE TABLE IF NOT EXISTS users (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    username TEXT UNIQUE NOT NULL,
-    display_name TEXT NOT NULL
-);
-
--- Identities provide a way for users to authenticate.
-CREATE TABLE IF NOT EXISTS identities (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    user_id INTEGER NOT NULL,
-    provider TEXT NOT NULL,
-    provider_user_id TEXT NOT NULL,
-    password_hash TEXT,
-    FOREIGN KEY(user_id) REFERENCES users(id)
-);
-
--- Pages are the individual wiki pages.
-CREATE TABLE IF NOT EXISTS pages (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    silo_id INTEGER NOT NULL,
-    parent_id INTEGER,
-    slug TEXT NOT NULL,
-    title TEXT NOT NULL,
-    position INTEGER NOT NULL DEFAULT 0,
-    current_revision_id INTEGER NOT NULL,
-    archived_at TIMESTAMP,
-    FOREIGN KEY(silo_id) REFERENCES silos(id),
-    FOREIGN KEY(parent_id) REFERENCES pages(id),
-    UNIQUE (silo_id, parent_id, slug)
-);
-
--- Revisions are the history of a page.
-CREATE TABLE IF NOT EXISTS revisions (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    page_id INTEGER NOT NULL,
-    content TEXT NOT NULL,
-    author_id INTEGER NOT NULL,
-    comment TEXT,
-    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    FOREIGN KEY(page_id) REFERENCES pages(id),
-    FOREIGN KEY(author_id) REFERENCES users(id)
-);
+// Size returns the size of the database in bytes.
+func Size(db *sql.DB) (int64, error) {
+	if DialectOf(db) == Postgres {
+		var size int64
+		err := db.QueryRow("SELECT pg_database_size(current_database())").Scan(&size)
+		return size, err
+	}
 
--- Attachments are files uploaded by users.
-CREATE TABLE IF NOT EXISTS attachments (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    page_id INTEGER,
-    filename TEXT NOT NULL,
-    unique_filename TEXT UNIQUE NOT NULL,
-    mime_type TEXT NOT NULL,
-    size INTEGER NOT NULL,
-    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    FOREIGN KEY(page_id) REFERENCES pages(id)
-);
-`)
-	return err
+	var pageCount, pageSize int64
+	if err := db.QueryRow("PRAGMA page_count").Scan(&pageCount); err != nil {
+		return 0, err
+	}
+	if err := db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	return pageCount * pageSize, nil
 }
@@ -0,0 +1,143 @@
+package database_test
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"sowing/internal/database"
+	"sowing/internal/database/dbtest"
+)
+
+func TestMigrate(t *testing.T) {
+	db := dbtest.OpenEmpty(t)
+	migrations, err := database.Migrations(database.DialectOf(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations found")
+	}
+
+	if err := database.MigrateTo(db, 1); err != nil {
+		t.Fatalf("migrating to 1: %v", err)
+	}
+	if version, err := database.Version(db); err != nil || version != 1 {
+		t.Fatalf("Version() = %d, %v, want 1", version, err)
+	}
+
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	// Migrating an up to date database does nothing.
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrating again: %v", err)
+	}
+	status, err := database.Status(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if s.AppliedAt == nil {
+			t.Errorf("migration %d_%s not applied", s.Version, s.Name)
+		}
+	}
+
+	if err := database.MigrateTo(db, 1); err == nil {
+		t.Error("migrating down succeeded")
+	}
+	if err := database.MigrateTo(db, len(migrations)+1); err == nil {
+		t.Error("migrating to an unknown version succeeded")
+	}
+}
+
+func TestMigrateSchemaTooNew(t *testing.T) {
+	db := dbtest.Open(t)
+	migrations, err := database.Migrations(database.DialectOf(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, 'future', 'x', ?)", len(migrations)+1, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Migrate(db); !errors.Is(err, database.ErrSchemaTooNew) {
+		t.Errorf("Migrate() = %v, want ErrSchemaTooNew", err)
+	}
+}
+
+func TestReturningAndBooleans(t *testing.T) {
+	db := dbtest.Open(t)
+
+	var first, second int
+	if err := db.QueryRow("INSERT INTO users (username, display_name, is_admin) VALUES (?, ?, ?) RETURNING id", "alice", "Alice", true).Scan(&first); err != nil {
+		t.Fatalf("inserting with RETURNING: %v", err)
+	}
+	if err := db.QueryRow("INSERT INTO users (username, display_name, is_admin) VALUES (?, ?, ?) RETURNING id", "bob", "Bob", false).Scan(&second); err != nil {
+		t.Fatalf("inserting with RETURNING: %v", err)
+	}
+	if first == 0 || second == first {
+		t.Fatalf("RETURNING gave ids %d and %d", first, second)
+	}
+
+	var admins []string
+	rows, err := db.Query("SELECT username FROM users WHERE is_admin = ? ORDER BY username", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			t.Fatal(err)
+		}
+		admins = append(admins, username)
+	}
+	if len(admins) != 1 || admins[0] != "alice" {
+		t.Errorf("admins = %v, want [alice]", admins)
+	}
+
+	var isAdmin bool
+	if err := db.QueryRow("SELECT is_admin FROM users WHERE id = ?", second).Scan(&isAdmin); err != nil || isAdmin {
+		t.Errorf("is_admin of bob = %v, %v, want false", isAdmin, err)
+	}
+
+	// A boolean column left to its default reads back as false.
+	var siloID, pageID, revisionID int
+	if err := db.QueryRow("INSERT INTO silos (name, slug) VALUES (?, ?) RETURNING id", "Docs", "docs").Scan(&siloID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("INSERT INTO pages (silo_id, slug, title, current_revision_id) VALUES (?, 'home', 'Home', -1) RETURNING id", siloID).Scan(&pageID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("INSERT INTO revisions (page_id, author_id, content) VALUES (?, ?, ?) RETURNING id", pageID, first, "* Home").Scan(&revisionID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO notifications (user_id, revision_id) VALUES (?, ?)", first, revisionID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO notifications (user_id, revision_id, in_comment) VALUES (?, ?, ?)", second, revisionID, true); err != nil {
+		t.Fatal(err)
+	}
+	for userID, want := range map[int]bool{first: false, second: true} {
+		var inComment bool
+		if err := db.QueryRow("SELECT in_comment FROM notifications WHERE user_id = ?", userID).Scan(&inComment); err != nil || inComment != want {
+			t.Errorf("in_comment of user %d = %v, %v, want %v", userID, inComment, err, want)
+		}
+	}
+}
+
+func TestIsUniqueViolation(t *testing.T) {
+	db := dbtest.Open(t)
+	if _, err := db.Exec("INSERT INTO silos (name, slug) VALUES (?, ?)", "Docs", "docs"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Exec("INSERT INTO silos (name, slug) VALUES (?, ?)", "Other docs", "docs")
+	if !database.IsUniqueViolation(err) {
+		t.Errorf("IsUniqueViolation(%v) = false", err)
+	}
+	if database.IsUniqueViolation(sql.ErrNoRows) {
+		t.Error("IsUniqueViolation(sql.ErrNoRows) = true")
+	}
+}
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Dialect identifies the SQL database behind a connection. Repositories are
+// written in SQL that both dialects understand, with ? placeholders; the few
+// places that can't be use the dialect to choose their SQL.
+type Dialect string
+
+const (
+	SQLite   Dialect = "sqlite3"
+	Postgres Dialect = "postgres"
+)
+
+// DialectOf returns the dialect of an open database.
+func DialectOf(db *sql.DB) Dialect {
+	if _, ok := db.Driver().(*postgresDriver); ok {
+		return Postgres
+	}
+	return SQLite
+}
+
+// dialectOfDSN picks the dialect for a connection string: PostgreSQL for
+// postgres:// URLs, and SQLite for anything else, which is taken as a file name.
+func dialectOfDSN(dsn string) Dialect {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return Postgres
+	}
+	return SQLite
+}
+
+// IsUniqueViolation reports whether err is a UNIQUE constraint failing, in
+// either dialect.
+func IsUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "23505"
+	}
+	return false
+}
@@ -0,0 +1,343 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are numbered SQL files, applied in order and recorded in the
+// schema_migrations table. A migration must never be edited once released;
+// changes to the schema go in a new file. Each dialect has its own set, kept
+// in step so that a version means the same schema in both.
+//
+//go:embed migrations/sqlite/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+// ErrSchemaTooNew is returned when the database has migrations applied that
+// this binary doesn't know about, which means it was upgraded by a newer
+// version of Sowing.
+var ErrSchemaTooNew = errors.New("the database schema is newer than this version of Sowing supports")
+
+// Migration is a single step in the evolution of the schema.
+type Migration struct {
+	Version  int
+	Name     string
+	SQL      string
+	Checksum string // SHA-256 of the SQL, to detect edits after release
+}
+
+// MigrationStatus describes a known migration and whether it has been applied.
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrations returns the embedded migrations for a dialect in order.
+func Migrations(dialect Dialect) ([]Migration, error) {
+	dir := path.Join("migrations", migrationDir(dialect))
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		number, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(number)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.sql", entry.Name())
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(content)
+		migrations = append(migrations, Migration{
+			Version:  version,
+			Name:     name,
+			SQL:      string(content),
+			Checksum: hex.EncodeToString(sum[:]),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must be consecutive, found %d after %d", m.Version, i)
+		}
+	}
+	return migrations, nil
+}
+
+// Migrate brings the database up to the latest schema.
+func Migrate(db *sql.DB) error {
+	migrations, err := Migrations(DialectOf(db))
+	if err != nil {
+		return err
+	}
+	return MigrateTo(db, len(migrations))
+}
+
+// MigrateTo applies the pending migrations up to and including the given
+// version. Each migration runs in its own transaction. Migrations are never
+// undone, so asking for a version below the current one is an error.
+func MigrateTo(db *sql.DB, target int) error {
+	migrations, err := Migrations(DialectOf(db))
+	if err != nil {
+		return err
+	}
+	if target < 0 || target > len(migrations) {
+		return fmt.Errorf("unknown schema version %d, the latest is %d", target, len(migrations))
+	}
+
+	legacy, err := isLegacy(db)
+	if err != nil {
+		return err
+	}
+	timestamp := "TIMESTAMP"
+	if DialectOf(db) == Postgres {
+		timestamp = "TIMESTAMPTZ"
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    checksum TEXT NOT NULL,
+    applied_at ` + timestamp + ` NOT NULL
+)`); err != nil {
+		return fmt.Errorf("error creating schema_migrations: %w", err)
+	}
+
+	status, err := checkApplied(db, migrations)
+	if err != nil {
+		return err
+	}
+
+	current := 0
+	for _, s := range status {
+		if s.AppliedAt != nil {
+			current = s.Version
+		}
+	}
+	if target < current {
+		return fmt.Errorf("the database is at schema version %d, migrations can't be undone", current)
+	}
+
+	for _, m := range migrations[current:target] {
+		if err := apply(db, m, legacy && m.Version == 1); err != nil {
+			return fmt.Errorf("error applying migration %d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// Status lists all known migrations and when they were applied. It fails
+// with ErrSchemaTooNew or a checksum error just as migrating would.
+func Status(db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := Migrations(DialectOf(db))
+	if err != nil {
+		return nil, err
+	}
+	exists, err := tableExists(db, "schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		status := make([]MigrationStatus, len(migrations))
+		for i, m := range migrations {
+			status[i] = MigrationStatus{Migration: m}
+		}
+		return status, nil
+	}
+	return checkApplied(db, migrations)
+}
+
+// Version returns the schema version of the database, 0 if no migrations
+// have been applied.
+func Version(db *sql.DB) (int, error) {
+	status, err := Status(db)
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for _, s := range status {
+		if s.AppliedAt != nil {
+			version = s.Version
+		}
+	}
+	return version, nil
+}
+
+// checkApplied matches the applied migrations against the known ones,
+// verifying that none were edited and none are unknown.
+func checkApplied(db *sql.DB, migrations []Migration) ([]MigrationStatus, error) {
+	rows, err := db.Query("SELECT version, checksum, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	status := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		status[i] = MigrationStatus{Migration: m}
+	}
+	for rows.Next() {
+		var version int
+		var checksum string
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &checksum, &appliedAt); err != nil {
+			return nil, err
+		}
+		if version > len(migrations) {
+			return nil, fmt.Errorf("%w: the database is at version %d, this binary knows up to %d", ErrSchemaTooNew, version, len(migrations))
+		}
+		if m := migrations[version-1]; m.Checksum != checksum {
+			return nil, fmt.Errorf("migration %d_%s has changed since it was applied", m.Version, m.Name)
+		}
+		status[version-1].AppliedAt = &appliedAt
+	}
+	return status, rows.Err()
+}
+
+// apply runs a migration and records it, all in one transaction.
+func apply(db *sql.DB, m Migration, upgradeLegacy bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return err
+	}
+	if upgradeLegacy {
+		if err := upgradeLegacySchema(tx); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)", m.Version, m.Name, m.Checksum, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// isLegacy reports whether the database was created before versioned
+// migrations, when the schema was created in one go on every start. Only
+// SQLite databases are that old.
+func isLegacy(db *sql.DB) (bool, error) {
+	if DialectOf(db) != SQLite {
+		return false, nil
+	}
+	versioned, err := tableExists(db, "schema_migrations")
+	if err != nil || versioned {
+		return false, err
+	}
+	return tableExists(db, "silos")
+}
+
+// upgradeLegacySchema brings a database created before versioned migrations
+// up to the baseline schema. The baseline's CREATE TABLE IF NOT EXISTS
+// statements leave existing tables alone, so columns added since need adding.
+func upgradeLegacySchema(tx *sql.Tx) error {
+	columns := []struct{ table, column, definition string }{
+		{"users", "email", "TEXT NOT NULL DEFAULT ''"},
+		{"users", "status", "TEXT NOT NULL DEFAULT 'active'"},
+		{"users", "is_admin", "INTEGER NOT NULL DEFAULT 0"},
+		{"silos", "home_page_id", "INTEGER"},
+	}
+	for _, c := range columns {
+		if err := addColumn(tx, c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+
+	// Silos created before landing pages were configurable land on their
+	// top-level "home" page.
+	_, err := tx.Exec("UPDATE silos SET home_page_id = (SELECT id FROM pages WHERE pages.silo_id = silos.id AND parent_id IS NULL AND slug = 'home') WHERE home_page_id IS NULL")
+	if err != nil {
+		return err
+	}
+
+	// Silo owners used to be recorded in silos.owner_id.
+	if ok, err := hasColumn(tx, "silos", "owner_id"); err != nil {
+		return err
+	} else if ok {
+		_, err := tx.Exec("INSERT OR IGNORE INTO silo_roles (silo_id, user_id, role) SELECT id, owner_id, 'owner' FROM silos WHERE owner_id IS NOT NULL")
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("ALTER TABLE silos DROP COLUMN owner_id"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column to a table unless it already exists.
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	ok, err := hasColumn(tx, table, column)
+	if err != nil || ok {
+		return err
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("error adding column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// hasColumn reports whether a table has a column.
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name, typ  string
+			notNull    bool
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &defaultVal, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// tableExists reports whether a table exists.
+func tableExists(db *sql.DB, table string) (bool, error) {
+	query := "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)"
+	if DialectOf(db) == Postgres {
+		query = "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?)"
+	}
+
+	var exists bool
+	err := db.QueryRow(query, table).Scan(&exists)
+	return exists, err
+}
+
+// migrationDir names the directory holding a dialect's migrations.
+func migrationDir(dialect Dialect) string {
+	if dialect == Postgres {
+		return "postgres"
+	}
+	return "sqlite"
+}
@@ -0,0 +1,201 @@
+-- SOWING Database Schema
+--
+-- The baseline schema, translated from the SQLite one.
+
+-- Silos are the top-level content areas.
+CREATE TABLE IF NOT EXISTS silos (
+    id SERIAL PRIMARY KEY,
+    slug TEXT UNIQUE NOT NULL,
+    name TEXT NOT NULL,
+    archived_at TIMESTAMPTZ,
+    cover_image TEXT,
+    home_page_id INTEGER
+);
+
+-- Users are the authors of content.
+CREATE TABLE IF NOT EXISTS users (
+    id SERIAL PRIMARY KEY,
+    username TEXT UNIQUE NOT NULL,
+    display_name TEXT NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'active',
+    is_admin BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+-- Identities provide a way for users to authenticate.
+CREATE TABLE IF NOT EXISTS identities (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    provider TEXT NOT NULL,
+    provider_user_id TEXT NOT NULL,
+    password_hash TEXT,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+-- Pages are the individual wiki pages.
+CREATE TABLE IF NOT EXISTS pages (
+    id SERIAL PRIMARY KEY,
+    silo_id INTEGER NOT NULL,
+    parent_id INTEGER,
+    slug TEXT NOT NULL,
+    title TEXT NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    current_revision_id INTEGER NOT NULL,
+    archived_at TIMESTAMPTZ,
+    FOREIGN KEY(silo_id) REFERENCES silos(id),
+    FOREIGN KEY(parent_id) REFERENCES pages(id),
+    UNIQUE (silo_id, parent_id, slug)
+);
+
+-- Revisions are the history of a page.
+CREATE TABLE IF NOT EXISTS revisions (
+    id SERIAL PRIMARY KEY,
+    page_id INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    author_id INTEGER NOT NULL,
+    comment TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(page_id) REFERENCES pages(id),
+    FOREIGN KEY(author_id) REFERENCES users(id)
+);
+
+-- Attachments are files uploaded by users.
+CREATE TABLE IF NOT EXISTS attachments (
+    id SERIAL PRIMARY KEY,
+    page_id INTEGER,
+    filename TEXT NOT NULL,
+    unique_filename TEXT UNIQUE NOT NULL,
+    mime_type TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(page_id) REFERENCES pages(id)
+);
+
+-- API tokens allow scripted access on behalf of a user.
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    scopes TEXT NOT NULL,
+    expires_at TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+-- TOTP secrets for users who have enrolled in two-factor authentication.
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id INTEGER PRIMARY KEY,
+    secret TEXT NOT NULL,
+    last_used_step INTEGER NOT NULL DEFAULT 0,
+    enabled_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+-- Single-use recovery codes for when a user loses their TOTP device.
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMPTZ,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+-- Sessions hold the server-side state of browser sessions.
+CREATE TABLE IF NOT EXISTS sessions (
+    id SERIAL PRIMARY KEY,
+    token_hash TEXT UNIQUE NOT NULL,
+    user_id INTEGER,
+    data BYTEA NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
+
+-- Login attempts form an audit trail of who tried to log in, and from where.
+CREATE TABLE IF NOT EXISTS login_attempts (
+    id SERIAL PRIMARY KEY,
+    username TEXT NOT NULL,
+    ip TEXT NOT NULL,
+    succeeded BOOLEAN NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_login_attempts_username ON login_attempts(username);
+
+-- Account lockouts count consecutive failed logins per username.
+CREATE TABLE IF NOT EXISTS account_lockouts (
+    username TEXT PRIMARY KEY,
+    failed_count INTEGER NOT NULL DEFAULT 0,
+    locked_until TIMESTAMPTZ
+);
+
+-- Settings hold site-wide configuration as key/value pairs.
+CREATE TABLE IF NOT EXISTS settings (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL
+);
+
+-- Invitations let people register while registration is restricted.
+CREATE TABLE IF NOT EXISTS invitations (
+    id SERIAL PRIMARY KEY,
+    token_hash TEXT UNIQUE NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    silo_id INTEGER,
+    created_by INTEGER NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    used_by INTEGER,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(silo_id) REFERENCES silos(id),
+    FOREIGN KEY(created_by) REFERENCES users(id),
+    FOREIGN KEY(used_by) REFERENCES users(id)
+);
+
+-- Silo roles grant users roles, such as owner, in a silo.
+CREATE TABLE IF NOT EXISTS silo_roles (
+    silo_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    role TEXT NOT NULL,
+    PRIMARY KEY (silo_id, user_id),
+    FOREIGN KEY(silo_id) REFERENCES silos(id),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+-- Password resets are one-time links for setting a new password.
+CREATE TABLE IF NOT EXISTS password_resets (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+-- Silo redirects send links using a silo's old slug to its current one.
+CREATE TABLE IF NOT EXISTS silo_redirects (
+    old_slug TEXT PRIMARY KEY,
+    silo_id INTEGER NOT NULL,
+    FOREIGN KEY(silo_id) REFERENCES silos(id)
+);
+
+-- The audit log records administrative actions.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id SERIAL PRIMARY KEY,
+    actor_id INTEGER,
+    actor TEXT NOT NULL,
+    action TEXT NOT NULL,
+    target TEXT NOT NULL DEFAULT '',
+    detail TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(actor_id) REFERENCES users(id)
+);
@@ -0,0 +1,9 @@
+-- Indexes for the lookups made on every page view and in the admin console.
+
+CREATE INDEX IF NOT EXISTS idx_pages_silo_id ON pages(silo_id);
+CREATE INDEX IF NOT EXISTS idx_pages_parent_id ON pages(parent_id);
+CREATE INDEX IF NOT EXISTS idx_revisions_page_id ON revisions(page_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_page_id ON attachments(page_id);
+CREATE INDEX IF NOT EXISTS idx_silo_roles_user_id ON silo_roles(user_id);
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_identities_user_id ON identities(user_id);
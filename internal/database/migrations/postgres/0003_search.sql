@@ -0,0 +1,11 @@
+-- Full-text search over page titles and content. The search vectors are
+-- generated columns, so PostgreSQL keeps them up to date as pages are renamed
+-- and revised.
+
+ALTER TABLE pages ADD COLUMN search tsvector
+    GENERATED ALWAYS AS (to_tsvector('english', title)) STORED;
+ALTER TABLE revisions ADD COLUMN search tsvector
+    GENERATED ALWAYS AS (to_tsvector('english', content)) STORED;
+
+CREATE INDEX idx_pages_search ON pages USING GIN (search);
+CREATE INDEX idx_revisions_search ON revisions USING GIN (search);
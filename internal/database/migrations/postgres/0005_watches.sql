@@ -0,0 +1,38 @@
+-- Watches subscribe users to emails about new revisions in a whole silo
+-- (page_id is NULL), a page, or a page and the pages below it (subtree).
+-- The token identifies the watch in unsubscribe links.
+CREATE TABLE IF NOT EXISTS watches (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    silo_id INTEGER NOT NULL,
+    page_id INTEGER,
+    subtree BOOLEAN NOT NULL DEFAULT FALSE,
+    token TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id),
+    FOREIGN KEY(silo_id) REFERENCES silos(id),
+    FOREIGN KEY(page_id) REFERENCES pages(id)
+);
+CREATE INDEX IF NOT EXISTS idx_watches_silo_id ON watches(silo_id);
+CREATE INDEX IF NOT EXISTS idx_watches_user_id ON watches(user_id);
+
+-- Revisions waiting to be emailed to the users watching them.
+CREATE TABLE IF NOT EXISTS watch_emails (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    watch_id INTEGER NOT NULL,
+    revision_id INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id),
+    FOREIGN KEY(watch_id) REFERENCES watches(id),
+    FOREIGN KEY(revision_id) REFERENCES revisions(id)
+);
+CREATE INDEX IF NOT EXISTS idx_watch_emails_user_id ON watch_emails(user_id);
+
+-- How often each user wants to be emailed: 'immediate', 'hourly' or 'daily'.
+-- Users without a row are emailed immediately.
+CREATE TABLE IF NOT EXISTS watch_preferences (
+    user_id INTEGER PRIMARY KEY,
+    digest TEXT NOT NULL DEFAULT 'immediate',
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
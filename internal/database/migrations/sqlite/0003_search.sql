@@ -0,0 +1,2 @@
+-- Full-text search. SQLite searches page titles and content with LIKE, so
+-- there is nothing to create; this keeps the versions in step with PostgreSQL.
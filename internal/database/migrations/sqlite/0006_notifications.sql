@@ -0,0 +1,14 @@
+-- In-app notifications of users being mentioned in a revision's content
+-- (in_comment is false) or comment. read_at is NULL until they are seen.
+CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    revision_id INTEGER NOT NULL,
+    in_comment BOOLEAN NOT NULL DEFAULT FALSE,
+    read_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id),
+    FOREIGN KEY(revision_id) REFERENCES revisions(id),
+    UNIQUE(user_id, revision_id)
+);
+CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON notifications(user_id);
@@ -0,0 +1,5 @@
+-- Failed logins are forgotten after a while, so that attempts with made-up
+-- usernames can't fill the database. Lockouts record when the last failure
+-- was, and login attempts are deleted by age.
+ALTER TABLE account_lockouts ADD COLUMN last_failed_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS idx_login_attempts_created_at ON login_attempts(created_at);
@@ -0,0 +1,26 @@
+package database
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		name, query, want string
+	}{
+		{"no placeholders", "SELECT 1", "SELECT 1"},
+		{"placeholders", "SELECT * FROM pages WHERE silo_id = ? AND slug = ?", "SELECT * FROM pages WHERE silo_id = $1 AND slug = $2"},
+		{"string literal", "SELECT '?' FROM t WHERE a = ?", "SELECT '?' FROM t WHERE a = $1"},
+		{"escaped quote", "SELECT 'it''s ?' WHERE a = ?", "SELECT 'it''s ?' WHERE a = $1"},
+		{"quoted identifier", `SELECT "a?b" FROM t WHERE a = ?`, `SELECT "a?b" FROM t WHERE a = $1`},
+		{"line comment", "SELECT a -- why?\nFROM t WHERE a = ?", "SELECT a -- why?\nFROM t WHERE a = $1"},
+		{"block comment", "SELECT /* a? */ a FROM t WHERE a = ?", "SELECT /* a? */ a FROM t WHERE a = $1"},
+		{"unterminated literal", "SELECT ? WHERE a = 'x?", "SELECT $1 WHERE a = 'x?"},
+		{"like escape", `SELECT 1 WHERE a LIKE ? ESCAPE '\' OR b LIKE ? ESCAPE '\'`, `SELECT 1 WHERE a LIKE $1 ESCAPE '\' OR b LIKE $2 ESCAPE '\'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rebind(tt.query); got != tt.want {
+				t.Errorf("rebind(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
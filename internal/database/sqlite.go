@@ -0,0 +1,391 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteDefaults are the connection settings Sowing uses unless the DSN says
+// otherwise. WAL lets readers carry on while a write is in progress, SQLite
+// only enforces foreign keys when asked to, and NORMAL synchronisation is
+// safe in WAL mode. A setting's alias in the DSN counts as setting it.
+var sqliteDefaults = []struct{ key, alias, value string }{
+	{"_journal_mode", "_journal", "WAL"},
+	{"_foreign_keys", "_fk", "1"},
+	{"_busy_timeout", "_timeout", "5000"},
+	{"_synchronous", "_sync", "NORMAL"},
+	{"_txlock", "", "immediate"},
+}
+
+// errWriterBusy is returned when the writer connection stays taken for longer
+// than the busy timeout, as SQLite would if it were waiting on the lock itself.
+var errWriterBusy = errors.New("database is locked: timed out waiting for the writer connection")
+
+// openSQLite opens a SQLite database. SQLite allows one writer at a time, so
+// rather than have concurrent requests contend for the lock, every write goes
+// through a single connection while reads are spread over a pool of
+// read-only connections.
+func openSQLite(dsn string) (*sql.DB, error) {
+	connector, err := newSQLiteConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	db := sql.OpenDB(connector)
+	readers := max(4, runtime.NumCPU())
+	db.SetMaxOpenConns(readers)
+	db.SetMaxIdleConns(readers)
+	return db, nil
+}
+
+// sqliteConnector opens the read-only connections of the pool, and owns the
+// writer connection they share.
+type sqliteConnector struct {
+	readerDSN   string
+	writerDSN   string
+	busyTimeout time.Duration
+
+	mu     sync.Mutex // guards writer while it is being opened or closed
+	writer *sqlite3.SQLiteConn
+	lock   chan struct{} // held by whoever is using the writer
+}
+
+func newSQLiteConnector(dsn string) (*sqliteConnector, error) {
+	name, rawQuery, _ := strings.Cut(dsn, "?")
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing database options: %w", err)
+	}
+	for _, d := range sqliteDefaults {
+		if params.Has(d.key) || (d.alias != "" && params.Has(d.alias)) {
+			continue
+		}
+		params.Set(d.key, d.value)
+	}
+
+	timeout := params.Get("_busy_timeout")
+	if timeout == "" {
+		timeout = params.Get("_timeout")
+	}
+	ms, err := strconv.Atoi(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid busy timeout %q", timeout)
+	}
+
+	c := &sqliteConnector{
+		writerDSN:   name + "?" + params.Encode(),
+		busyTimeout: time.Duration(ms) * time.Millisecond,
+		lock:        make(chan struct{}, 1),
+	}
+	params.Set("_query_only", "1")
+	params.Set("_txlock", "deferred")
+	c.readerDSN = name + "?" + params.Encode()
+	return c, nil
+}
+
+// Connect opens a read-only connection for the pool. The writer is opened
+// first, the first time round, so that it is the one creating the database
+// file and switching it to WAL mode.
+func (c *sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	if c.writer == nil {
+		writer, err := (&sqlite3.SQLiteDriver{}).Open(c.writerDSN)
+		if err != nil {
+			c.mu.Unlock()
+			return nil, err
+		}
+		c.writer = writer.(*sqlite3.SQLiteConn)
+	}
+	c.mu.Unlock()
+
+	reader, err := (&sqlite3.SQLiteDriver{}).Open(c.readerDSN)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteConn{reader: reader.(*sqlite3.SQLiteConn), connector: c}, nil
+}
+
+func (c *sqliteConnector) Driver() driver.Driver {
+	return &sqlite3.SQLiteDriver{}
+}
+
+// Close closes the writer connection. It is called when the sql.DB is closed.
+func (c *sqliteConnector) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writer == nil {
+		return nil
+	}
+	err := c.writer.Close()
+	c.writer = nil
+	return err
+}
+
+// acquire takes the writer connection, waiting at most the busy timeout.
+func (c *sqliteConnector) acquire(ctx context.Context) error {
+	timer := time.NewTimer(c.busyTimeout)
+	defer timer.Stop()
+	select {
+	case c.lock <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errWriterBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *sqliteConnector) release() {
+	<-c.lock
+}
+
+// sqliteConn is a connection of the pool. It reads through its own read-only
+// connection, and writes through the shared writer. While a write transaction
+// is open, everything goes through the writer so the transaction sees its
+// own changes.
+type sqliteConn struct {
+	reader    *sqlite3.SQLiteConn
+	connector *sqliteConnector
+	inTx      bool
+}
+
+func (c *sqliteConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *sqliteConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if c.inTx {
+		return c.connector.writer.PrepareContext(ctx, query)
+	}
+	if isReadOnly(query) {
+		return c.reader.PrepareContext(ctx, query)
+	}
+
+	if err := c.connector.acquire(ctx); err != nil {
+		return nil, err
+	}
+	stmt, err := c.connector.writer.PrepareContext(ctx, query)
+	c.connector.release()
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteWriteStmt{Stmt: stmt, connector: c.connector}, nil
+}
+
+func (c *sqliteConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if c.inTx {
+		return c.connector.writer.ExecContext(ctx, query, args)
+	}
+
+	if err := c.connector.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.connector.release()
+	return c.connector.writer.ExecContext(ctx, query, args)
+}
+
+func (c *sqliteConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if c.inTx {
+		return c.connector.writer.QueryContext(ctx, query, args)
+	}
+	if isReadOnly(query) {
+		return c.reader.QueryContext(ctx, query, args)
+	}
+
+	// A write returning rows, such as INSERT ... RETURNING, keeps the writer
+	// until its rows are closed.
+	if err := c.connector.acquire(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := c.connector.writer.QueryContext(ctx, query, args)
+	if err != nil {
+		c.connector.release()
+		return nil, err
+	}
+	return &sqliteWriteRows{Rows: rows, release: c.connector.release}, nil
+}
+
+func (c *sqliteConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *sqliteConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if opts.ReadOnly {
+		return c.reader.BeginTx(ctx, opts)
+	}
+
+	if err := c.connector.acquire(ctx); err != nil {
+		return nil, err
+	}
+	tx, err := c.connector.writer.BeginTx(ctx, opts)
+	if err != nil {
+		c.connector.release()
+		return nil, err
+	}
+	c.inTx = true
+	return &sqliteWriteTx{Tx: tx, conn: c}, nil
+}
+
+func (c *sqliteConn) Ping(ctx context.Context) error {
+	return c.reader.Ping(ctx)
+}
+
+func (c *sqliteConn) Close() error {
+	return c.reader.Close()
+}
+
+// sqliteWriteTx is a transaction on the writer, which it gives back when it
+// is committed or rolled back.
+type sqliteWriteTx struct {
+	driver.Tx
+	conn *sqliteConn
+	once sync.Once
+}
+
+func (tx *sqliteWriteTx) Commit() error {
+	defer tx.done()
+	return tx.Tx.Commit()
+}
+
+func (tx *sqliteWriteTx) Rollback() error {
+	defer tx.done()
+	return tx.Tx.Rollback()
+}
+
+func (tx *sqliteWriteTx) done() {
+	tx.once.Do(func() {
+		tx.conn.inTx = false
+		tx.conn.connector.release()
+	})
+}
+
+// sqliteWriteStmt is a statement prepared on the writer, which takes the
+// writer each time it runs.
+type sqliteWriteStmt struct {
+	driver.Stmt
+	connector *sqliteConnector
+}
+
+func (s *sqliteWriteStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if err := s.connector.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer s.connector.release()
+	return s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+}
+
+func (s *sqliteWriteStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := s.connector.acquire(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	if err != nil {
+		s.connector.release()
+		return nil, err
+	}
+	return &sqliteWriteRows{Rows: rows, release: s.connector.release}, nil
+}
+
+// sqliteWriteRows are the rows of a write, which hold the writer until closed.
+type sqliteWriteRows struct {
+	driver.Rows
+	release func()
+	once    sync.Once
+}
+
+func (r *sqliteWriteRows) Close() error {
+	defer r.once.Do(r.release)
+	return r.Rows.Close()
+}
+
+// isReadOnly reports whether a statement only reads, and so can run on a
+// read-only connection. Anything it isn't sure about goes to the writer.
+func isReadOnly(query string) bool {
+	query = strings.TrimSpace(query)
+	for strings.HasPrefix(query, "--") || strings.HasPrefix(query, "/*") {
+		end := "\n"
+		if strings.HasPrefix(query, "/*") {
+			end = "*/"
+		}
+		i := strings.Index(query, end)
+		if i < 0 {
+			return false
+		}
+		query = strings.TrimSpace(query[i+len(end):])
+	}
+
+	keyword, _, _ := strings.Cut(query, " ")
+	switch strings.ToUpper(strings.TrimSpace(keyword)) {
+	case "SELECT", "EXPLAIN":
+		return true
+	case "PRAGMA":
+		// Pragmas that set something have an =, or a value in parentheses
+		// like PRAGMA wal_checkpoint(TRUNCATE).
+		return !strings.ContainsAny(query, "=(")
+	}
+	return false
+}
+
+// CheckIntegrity verifies that a SQLite database file isn't corrupt, and
+// logs any rows that break foreign keys, which were not enforced before.
+// PostgreSQL looks after itself, so it is not checked.
+func CheckIntegrity(db *sql.DB) error {
+	if DialectOf(db) != SQLite {
+		return nil
+	}
+
+	rows, err := db.Query("PRAGMA quick_check")
+	if err != nil {
+		return fmt.Errorf("error checking database integrity: %w", err)
+	}
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			rows.Close()
+			return err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("the database is corrupt:\n%s", strings.Join(problems, "\n"))
+	}
+
+	rows, err = db.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return fmt.Errorf("error checking foreign keys: %w", err)
+	}
+	defer rows.Close()
+	violations := make(map[string]int)
+	for rows.Next() {
+		var table, parent string
+		var rowID sql.NullInt64
+		var fkID int
+		if err := rows.Scan(&table, &rowID, &parent, &fkID); err != nil {
+			return err
+		}
+		violations[table+" -> "+parent]++
+	}
+	for reference, count := range violations {
+		log.Printf("warning: %d rows of %s refer to rows that don't exist", count, reference)
+	}
+	return rows.Err()
+}
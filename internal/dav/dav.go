@@ -0,0 +1,444 @@
+// Package dav exposes silos as a WebDAV file system: each silo is a folder,
+// each page an .org file, and a page's children are in a folder of the same
+// name next to it, as in an export. Saving a file adds a revision, making a
+// folder creates a page, moving renames one and deleting archives it.
+package dav
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"sowing/internal/models"
+	"sowing/internal/page"
+	"sowing/internal/silo"
+)
+
+// titlePattern matches a #+TITLE line, which names a page created by a save.
+var titlePattern = regexp.MustCompile(`(?im)^#\+title:[ \t]*(.+?)[ \t]*$`)
+
+// FileSystem implements webdav.FileSystem on top of the page storage. Writes
+// are made on behalf of the user in the request context.
+type FileSystem struct {
+	Pages *page.Repository
+	Silos *silo.Repository
+}
+
+// node is what a path refers to: the root, a silo, or a page's file or folder.
+type node struct {
+	silo *models.Silo
+	page *models.Page
+	file bool
+	// children are the pages in the node's folder.
+	children []*models.Page
+}
+
+func (n *node) isDir() bool {
+	return !n.file
+}
+
+// resolve finds what a path refers to, returning fs.ErrNotExist if nothing.
+func (fsys *FileSystem) resolve(name string) (*node, error) {
+	segments := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	if segments[0] == "" {
+		return &node{}, nil
+	}
+
+	s, err := fsys.Silos.FindBySlug(segments[0])
+	if err == sql.ErrNoRows || err == nil && s.ArchivedAt != nil {
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	pages, err := fsys.Pages.ListBySilo(s.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &node{silo: s, children: page.BuildTree(pages)}
+	for i, segment := range segments[1:] {
+		last := i == len(segments)-2
+		slug, isFile := strings.CutSuffix(segment, ".org")
+		if isFile && !last || n.file {
+			return nil, fs.ErrNotExist
+		}
+		var found *models.Page
+		for _, child := range n.children {
+			if child.Slug == slug {
+				found = child
+				break
+			}
+		}
+		if found == nil {
+			return nil, fs.ErrNotExist
+		}
+		n = &node{silo: s, page: found, file: isFile, children: found.Children}
+	}
+	return n, nil
+}
+
+// resolveNew checks that a page can be created at a path, returning the
+// folder it would go in and its slug.
+func (fsys *FileSystem) resolveNew(name string, file bool) (*node, string, error) {
+	parent, err := fsys.resolve(path.Dir(name))
+	if err != nil {
+		return nil, "", err
+	}
+	if parent.silo == nil || !parent.isDir() {
+		return nil, "", fs.ErrPermission
+	}
+
+	slug := path.Base(name)
+	if file {
+		var ok bool
+		if slug, ok = strings.CutSuffix(slug, ".org"); !ok {
+			return nil, "", fs.ErrPermission
+		}
+	}
+	// Only names that are valid slugs can be pages, which also keeps out the
+	// hidden and temporary files some clients and editors create.
+	if slug == "" || slug != page.Slugify(slug) {
+		return nil, "", fs.ErrPermission
+	}
+	return parent, slug, nil
+}
+
+func userFrom(ctx context.Context) (*models.User, error) {
+	user, _ := ctx.Value("user").(*models.User)
+	if user == nil {
+		return nil, fs.ErrPermission
+	}
+	return user, nil
+}
+
+// Mkdir creates a page with no content.
+func (fsys *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if _, err := fsys.resolve(name); err == nil {
+		return fs.ErrExist
+	}
+	parent, slug, err := fsys.resolveNew(name, false)
+	if err != nil {
+		return err
+	}
+	return fsys.create(ctx, parent, slug, "")
+}
+
+// create creates a page at the end of a folder.
+func (fsys *FileSystem) create(ctx context.Context, parent *node, slug, content string) error {
+	user, err := userFrom(ctx)
+	if err != nil {
+		return err
+	}
+
+	p := &models.Page{SiloID: parent.silo.ID, Slug: slug, Title: slug}
+	if parent.page != nil {
+		p.ParentID = &parent.page.ID
+	}
+	for _, sibling := range parent.children {
+		p.Position = max(p.Position, sibling.Position+1)
+	}
+	if m := titlePattern.FindStringSubmatch(content); m != nil {
+		p.Title = m[1]
+	}
+
+	comment := "Created over WebDAV"
+	revision := &models.Revision{AuthorID: user.ID, Comment: &comment, Content: content}
+
+	// Archived pages keep their slugs, so a page deleted and then saved
+	// again, as some editors do, is brought back rather than created anew.
+	archived, err := fsys.Pages.FindArchived(p.SiloID, p.ParentID, slug)
+	if err == nil {
+		title := archived.Title
+		if titlePattern.MatchString(content) {
+			title = p.Title
+		}
+		return fsys.Pages.Restore(ctx, archived.ID, title, revision)
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	_, err = fsys.Pages.Create(ctx, p, revision)
+	return err
+}
+
+// OpenFile opens a page's file or folder, or the folder of a silo or of all
+// silos. Opening a file for writing returns one that saves when it is closed.
+func (fsys *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	n, err := fsys.resolve(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if err != nil {
+			return nil, err
+		}
+		if n.isDir() {
+			return &dir{fsys: fsys, node: n, name: name}, nil
+		}
+		revision, err := fsys.Pages.GetRevision(n.page.CurrentRevisionID)
+		if err != nil {
+			return nil, err
+		}
+		return &file{info: fileInfoOf(n, revision), Reader: bytes.NewReader([]byte(revision.Content))}, nil
+	}
+
+	w := &writer{fsys: fsys, ctx: ctx, name: name}
+	switch {
+	case err != nil && flag&os.O_CREATE == 0:
+		return nil, err
+	case err != nil:
+		if w.parent, w.slug, err = fsys.resolveNew(name, true); err != nil {
+			return nil, err
+		}
+	case n.isDir():
+		return nil, fs.ErrPermission
+	default:
+		w.node = n
+		w.baseRevisionID = n.page.CurrentRevisionID
+		if flag&os.O_TRUNC == 0 {
+			content, err := fsys.Pages.GetRevisionContent(n.page.CurrentRevisionID)
+			if err != nil {
+				return nil, err
+			}
+			w.buf.WriteString(content)
+		}
+	}
+	return w, nil
+}
+
+// RemoveAll archives a page, which removes both its file and its folder.
+func (fsys *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	user, err := userFrom(ctx)
+	if err != nil {
+		return err
+	}
+	n, err := fsys.resolve(name)
+	if err != nil {
+		return err
+	}
+	if n.page == nil {
+		return fs.ErrPermission
+	}
+	return fsys.Pages.Delete(n.page.ID, user.ID)
+}
+
+// Rename moves a page to another folder of the same silo, or renames it.
+func (fsys *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	user, err := userFrom(ctx)
+	if err != nil {
+		return err
+	}
+	n, err := fsys.resolve(oldName)
+	if err != nil {
+		return err
+	}
+	if n.page == nil {
+		return fs.ErrPermission
+	}
+	parent, slug, err := fsys.resolveNew(newName, n.file)
+	if err != nil {
+		return err
+	}
+	if parent.silo.ID != n.silo.ID {
+		return fs.ErrPermission
+	}
+
+	var parentID *int
+	if parent.page != nil {
+		// A page can't be moved into its own folder, or below it.
+		if strings.HasPrefix(parent.page.Path+"/", n.page.Path+"/") {
+			return fs.ErrPermission
+		}
+		parentID = &parent.page.ID
+	}
+
+	// Moving over a file deletes it first, which archives its page but
+	// leaves it holding the slug, so it is moved out of the way.
+	archived, err := fsys.Pages.FindArchived(n.silo.ID, parentID, slug)
+	if err == nil {
+		err = fsys.Pages.MoveAside(archived.ID)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	return fsys.Pages.Move(n.page.ID, parentID, slug, user.ID)
+}
+
+// Stat describes a file or folder.
+func (fsys *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	n, err := fsys.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.stat(n)
+}
+
+func (fsys *FileSystem) stat(n *node) (os.FileInfo, error) {
+	if n.page == nil {
+		info := &fileInfo{name: "/", dir: true}
+		if n.silo != nil {
+			info.name = n.silo.Slug
+		}
+		return info, nil
+	}
+	revision, err := fsys.Pages.GetRevision(n.page.CurrentRevisionID)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfoOf(n, revision), nil
+}
+
+func fileInfoOf(n *node, revision *models.Revision) *fileInfo {
+	if n.file {
+		return &fileInfo{name: n.page.Slug + ".org", size: int64(len(revision.Content)), modTime: revision.CreatedAt}
+	}
+	return &fileInfo{name: n.page.Slug, dir: true, modTime: revision.CreatedAt}
+}
+
+// fileInfo describes a file or folder.
+type fileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() any           { return nil }
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// file is a page's file opened for reading.
+type file struct {
+	*bytes.Reader
+	info *fileInfo
+}
+
+func (f *file) Close() error                             { return nil }
+func (f *file) Stat() (fs.FileInfo, error)               { return f.info, nil }
+func (f *file) Readdir(count int) ([]fs.FileInfo, error) { return nil, fs.ErrInvalid }
+func (f *file) Write(p []byte) (int, error)              { return 0, fs.ErrPermission }
+
+// dir is a folder: the list of silos, a silo, or the children of a page.
+type dir struct {
+	fsys    *FileSystem
+	node    *node
+	name    string
+	entries []fs.FileInfo // Left to be read by Readdir
+	read    bool
+}
+
+func (d *dir) Close() error                                 { return nil }
+func (d *dir) Read(p []byte) (int, error)                   { return 0, fs.ErrInvalid }
+func (d *dir) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (d *dir) Write(p []byte) (int, error)                  { return 0, fs.ErrPermission }
+func (d *dir) Stat() (fs.FileInfo, error)                   { return d.fsys.stat(d.node) }
+
+// Readdir lists a folder: the silos at the root, and elsewhere every page
+// both as a file and as a folder, so that children can be added to any page.
+func (d *dir) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.read {
+		d.read = true
+		if d.node.silo == nil {
+			silos, err := d.fsys.Silos.List()
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range silos {
+				d.entries = append(d.entries, &fileInfo{name: s.Slug, dir: true})
+			}
+		}
+		for _, child := range d.node.children {
+			revision, err := d.fsys.Pages.GetRevision(child.CurrentRevisionID)
+			if err != nil {
+				return nil, err
+			}
+			n := &node{silo: d.node.silo, page: child}
+			d.entries = append(d.entries, fileInfoOf(&node{silo: n.silo, page: child, file: true}, revision), fileInfoOf(n, revision))
+		}
+	}
+
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	entries := d.entries[:min(count, len(d.entries))]
+	d.entries = d.entries[len(entries):]
+	return entries, nil
+}
+
+// writer is a page's file opened for writing. What is written is saved as a
+// new revision, or as a new page, when it is closed.
+type writer struct {
+	fsys *FileSystem
+	ctx  context.Context
+	name string
+	buf  bytes.Buffer
+	// node is the page being written, or nil for a new page, which is
+	// created in parent with slug.
+	node   *node
+	parent *node
+	slug   string
+	// baseRevisionID is the page's current revision when it was opened. The
+	// file isn't saved if the page has been edited since.
+	baseRevisionID int
+}
+
+func (w *writer) Write(p []byte) (int, error)                  { return w.buf.Write(p) }
+func (w *writer) Read(p []byte) (int, error)                   { return 0, fs.ErrInvalid }
+func (w *writer) Seek(offset int64, whence int) (int64, error) { return 0, fs.ErrInvalid }
+func (w *writer) Readdir(count int) ([]fs.FileInfo, error)     { return nil, fs.ErrInvalid }
+
+func (w *writer) Stat() (fs.FileInfo, error) {
+	return &fileInfo{name: path.Base(w.name), size: int64(w.buf.Len()), modTime: time.Now()}, nil
+}
+
+func (w *writer) Close() error {
+	if w.node == nil {
+		return w.fsys.create(w.ctx, w.parent, w.slug, w.buf.String())
+	}
+
+	user, err := userFrom(w.ctx)
+	if err != nil {
+		return err
+	}
+	current, err := w.fsys.Pages.GetRevisionContent(w.baseRevisionID)
+	if err != nil {
+		return err
+	}
+	if current == w.buf.String() {
+		return nil
+	}
+	comment := "Edited over WebDAV"
+	revision := &models.Revision{AuthorID: user.ID, Comment: &comment, Content: w.buf.String()}
+	err = w.fsys.Pages.CreateRevisionIf(w.ctx, revision, w.node.page.ID, w.baseRevisionID)
+	if errors.Is(err, page.ErrStaleRevision) {
+		return fmt.Errorf("%s was edited while it was being saved: %w", w.name, err)
+	}
+	return err
+}
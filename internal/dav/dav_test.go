@@ -0,0 +1,172 @@
+package dav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+
+	"sowing/internal/database/dbtest"
+	"sowing/internal/models"
+	"sowing/internal/page"
+	"sowing/internal/silo"
+)
+
+func TestWriteStalePage(t *testing.T) {
+	db := dbtest.Open(t)
+	user := &models.User{Username: "alice"}
+	if err := db.QueryRow("INSERT INTO users (username, display_name) VALUES (?, ?) RETURNING id", "alice", "Alice").Scan(&user.ID); err != nil {
+		t.Fatal(err)
+	}
+	silos := silo.NewRepository(db)
+	if err := silos.Create("Docs", "docs", nil, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	fsys := &FileSystem{Pages: page.NewRepository(db), Silos: silos}
+	ctx := context.WithValue(context.Background(), "user", user)
+
+	write := func(content string) (*writer, error) {
+		f, err := fsys.OpenFile(ctx, "/docs/home.org", os.O_WRONLY|os.O_TRUNC, 0)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.Write([]byte(content))
+		return f.(*writer), err
+	}
+
+	f, err := write("* First")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("saving the page: %v", err)
+	}
+
+	// The page is edited in the browser while the file is open.
+	f, err = write("* Over WebDAV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	home, err := fsys.Pages.FindByID(f.node.page.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fsys.Pages.CreateRevision(ctx, &models.Revision{AuthorID: user.ID, Content: "* In the browser"}, home.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); !errors.Is(err, page.ErrStaleRevision) {
+		t.Fatalf("Close() = %v, want ErrStaleRevision", err)
+	}
+
+	home, err = fsys.Pages.FindByID(home.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := fsys.Pages.GetRevisionContent(home.CurrentRevisionID)
+	if err != nil || content != "* In the browser" {
+		t.Errorf("content = %q, %v, want the browser's edit", content, err)
+	}
+}
+
+// davServer serves a silo over WebDAV to alice, as the router does.
+func davServer(t *testing.T) (*httptest.Server, *FileSystem) {
+	t.Helper()
+	db := dbtest.Open(t)
+	user := &models.User{Username: "alice"}
+	if err := db.QueryRow("INSERT INTO users (username, display_name) VALUES (?, ?) RETURNING id", "alice", "Alice").Scan(&user.ID); err != nil {
+		t.Fatal(err)
+	}
+	silos := silo.NewRepository(db)
+	if err := silos.Create("Docs", "docs", nil, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	fsys := &FileSystem{Pages: page.NewRepository(db), Silos: silos}
+	handler := &webdav.Handler{FileSystem: fsys, LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "user", user)))
+	}))
+	t.Cleanup(server.Close)
+	return server, fsys
+}
+
+func davRequest(t *testing.T, server *httptest.Server, method, name, body string, headers ...string) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+name, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		t.Fatalf("%s %s: %s", method, name, resp.Status)
+	}
+}
+
+func readPage(t *testing.T, fsys *FileSystem, name string) string {
+	t.Helper()
+	f, err := fsys.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("opening %s: %v", name, err)
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestSaveDeletedPage(t *testing.T) {
+	server, fsys := davServer(t)
+	davRequest(t, server, "MKCOL", "/docs/guide", "")
+	davRequest(t, server, "PUT", "/docs/guide/x.org", "* First")
+	before, err := fsys.resolve("/docs/guide/x.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Some editors save by deleting the file and writing it again.
+	davRequest(t, server, "DELETE", "/docs/guide/x.org", "")
+	davRequest(t, server, "PUT", "/docs/guide/x.org", "* Second")
+
+	if content := readPage(t, fsys, "/docs/guide/x.org"); content != "* Second" {
+		t.Errorf("content = %q, want the second save", content)
+	}
+	after, err := fsys.resolve("/docs/guide/x.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.page.ID != before.page.ID {
+		t.Errorf("saving created page %d, want page %d restored", after.page.ID, before.page.ID)
+	}
+}
+
+func TestMoveOverPage(t *testing.T) {
+	server, fsys := davServer(t)
+	davRequest(t, server, "MKCOL", "/docs/guide", "")
+	davRequest(t, server, "PUT", "/docs/guide/b.org", "* B")
+	davRequest(t, server, "PUT", "/docs/guide/c.org", "* C")
+
+	davRequest(t, server, "MOVE", "/docs/guide/c.org", "", "Destination", server.URL+"/docs/guide/b.org", "Overwrite", "T")
+
+	if content := readPage(t, fsys, "/docs/guide/b.org"); content != "* C" {
+		t.Errorf("b.org = %q, want c.org's content", content)
+	}
+	if _, err := fsys.resolve("/docs/guide/c.org"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("c.org is still there: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+// Package events lets parts of Sowing react to changes in the wiki, such as a
+// page being edited, without the code making the change knowing about them.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	PageCreated        = "page.created"
+	PageRevised        = "page.revised"
+	PageMoved          = "page.moved"
+	PageArchived       = "page.archived"
+	SiloCreated        = "silo.created"
+	AttachmentUploaded = "attachment.uploaded"
+)
+
+// Types lists the event types, in the order they are shown in.
+var Types = []string{PageCreated, PageRevised, PageMoved, PageArchived, SiloCreated, AttachmentUploaded}
+
+// Event is something that happened in the wiki. Only the IDs relevant to its
+// type are set.
+type Event struct {
+	Type         string
+	Time         time.Time
+	SiloID       int
+	ActorID      int // The user who caused it, or 0 if unknown
+	PageID       int
+	RevisionID   int
+	AttachmentID int
+}
+
+// Bus passes events to the handlers subscribed to it. A nil Bus drops them,
+// so that repositories used outside the server, such as by admin commands,
+// need none.
+type Bus struct {
+	mu       sync.RWMutex
+	handlers []func(Event)
+}
+
+// NewBus creates a bus without any subscribers.
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe adds a handler for every event published from now on. Handlers
+// are called in the goroutine publishing the event, usually while handling a
+// request, so they must return quickly and do slow work elsewhere.
+func (b *Bus) Subscribe(handler func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+// Publish passes an event to every handler. Its time is set if it isn't.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(e)
+	}
+}
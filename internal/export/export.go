@@ -0,0 +1,155 @@
+// Package export writes a silo out as a tree of plain .org files, so that its
+// content can be read, versioned and edited outside Sowing.
+package export
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"sowing/internal/models"
+	"sowing/internal/page"
+)
+
+// Summary counts what an export wrote.
+type Summary struct {
+	Pages       int
+	Attachments int
+	// Missing lists uploads that pages link to but that weren't found on disk.
+	Missing []string
+}
+
+// WriteFunc writes one file of an export, named by a slash-separated path
+// relative to the export's root.
+type WriteFunc func(name string, data []byte) error
+
+// linkPattern matches an org link, [[target]] or [[target][description]].
+var linkPattern = regexp.MustCompile(`\[\[([^\]]+)\](\[[^\]]*\])?\]`)
+
+// titlePattern matches a #+TITLE line, which the export replaces with its own.
+var titlePattern = regexp.MustCompile(`(?im)^#\+title:.*(\n|$)`)
+
+// Silo exports the current revision of every page in a silo. A page becomes
+// path/to/page.org, its children go in path/to/page/, and the uploads it uses
+// are copied alongside it. Links to other pages of the silo and to uploads are
+// rewritten as relative file: links, and each file starts with a header giving
+// the page's title and position.
+func Silo(pages *page.Repository, silo *models.Silo, uploadsRoot string, write WriteFunc) (*Summary, error) {
+	all, err := pages.ListBySilo(silo.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &exporter{
+		pages:       pages,
+		silo:        silo,
+		uploadsRoot: uploadsRoot,
+		write:       write,
+		written:     make(map[string]bool),
+	}
+	if err := e.exportTree(page.BuildTree(all)); err != nil {
+		return nil, err
+	}
+	return &e.summary, nil
+}
+
+// exporter holds the state of one export.
+type exporter struct {
+	pages       *page.Repository
+	silo        *models.Silo
+	uploadsRoot string
+	write       WriteFunc
+	written     map[string]bool // Uploads already written, which pages may share
+	summary     Summary
+}
+
+func (e *exporter) exportTree(nodes []*models.Page) error {
+	for _, node := range nodes {
+		if err := e.exportPage(node); err != nil {
+			return fmt.Errorf("error exporting %s: %w", node.Path, err)
+		}
+		if err := e.exportTree(node.Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *exporter) exportPage(node *models.Page) error {
+	content, err := e.pages.GetRevisionContent(node.CurrentRevisionID)
+	if err != nil {
+		return err
+	}
+
+	dir := path.Dir(node.Path)
+	wikiPrefix := "/" + e.silo.Slug + "/wiki/"
+	var uploads []string
+	content = linkPattern.ReplaceAllStringFunc(content, func(link string) string {
+		parts := linkPattern.FindStringSubmatch(link)
+		target, description := parts[1], parts[2]
+
+		switch {
+		case strings.HasPrefix(target, "/uploads/"):
+			name := path.Base(target)
+			uploads = append(uploads, name)
+			target = "file:" + name
+		case strings.HasPrefix(target, wikiPrefix):
+			linked, fragment, _ := strings.Cut(strings.TrimPrefix(target, wikiPrefix), "#")
+			relative, err := filepath.Rel(filepath.FromSlash("/"+dir), filepath.FromSlash("/"+strings.Trim(linked, "/")+".org"))
+			if err != nil {
+				return link
+			}
+			target = "file:" + filepath.ToSlash(relative)
+			if fragment != "" {
+				target += "::" + fragment
+			}
+		default:
+			return link
+		}
+		return "[[" + target + "]" + description + "]"
+	})
+
+	header := "#+TITLE: " + node.Title + "\n#+POSITION: " + strconv.Itoa(node.Position) + "\n\n"
+	content = header + strings.TrimLeft(titlePattern.ReplaceAllString(content, ""), "\n")
+	if err := e.write(node.Path+".org", []byte(content)); err != nil {
+		return err
+	}
+	e.summary.Pages++
+
+	for _, name := range uploads {
+		dest := path.Join(dir, name)
+		if e.written[dest] {
+			continue
+		}
+		e.written[dest] = true
+
+		data, err := os.ReadFile(filepath.Join(e.uploadsRoot, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				e.summary.Missing = append(e.summary.Missing, name)
+				continue
+			}
+			return err
+		}
+		if err := e.write(dest, data); err != nil {
+			return err
+		}
+		e.summary.Attachments++
+	}
+	return nil
+}
+
+// ToDir returns a WriteFunc that writes an export into a directory.
+func ToDir(root string) WriteFunc {
+	return func(name string, data []byte) error {
+		dest := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(dest, data, 0644)
+	}
+}
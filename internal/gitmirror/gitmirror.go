@@ -0,0 +1,483 @@
+// Package gitmirror keeps the wiki's page history in a git repository, with
+// a commit for every revision, and brings changes pushed to the repository
+// back into the wiki as revisions.
+package gitmirror
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Branch is the branch the mirror commits to.
+	Branch = "main"
+
+	branchRef = "refs/heads/" + Branch
+	// importedRef marks the last commit whose changes were imported, so
+	// that commits pushed since can be told apart.
+	importedRef = "refs/sowing/imported"
+	// revisionKey is the git config key holding the last revision mirrored.
+	revisionKey = "sowing.revision"
+	// trailer ends the messages of the mirror's own commits.
+	trailer = "Sowing-Revision: "
+	// pathsFile, in the repository's directory, records where each page was
+	// kept as of the last sync, so that the files of moved pages can follow.
+	pathsFile = "sowing-paths.json"
+)
+
+// ErrUnimported is returned by Rebuild when the branch has commits pushed to
+// it that haven't been imported, which rebuilding would discard.
+var ErrUnimported = errors.New("the repository has pushed changes that haven't been imported")
+
+// Mirror is a bare git repository holding a copy of the wiki: one .org file
+// per page, in a folder named after its silo, laid out as in an export.
+type Mirror struct {
+	DB  *sql.DB
+	Dir string
+
+	mu   sync.Mutex // held while the repository is being written to
+	wake chan struct{}
+}
+
+// Open opens the repository in dir, creating it if it doesn't exist.
+func Open(db *sql.DB, dir string) (*Mirror, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, errors.New("the git mirror needs git to be installed")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Mirror{DB: db, Dir: dir, wake: make(chan struct{}, 1)}
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); os.IsNotExist(err) {
+		if out, err := exec.Command("git", "init", "--quiet", "--bare", "--initial-branch="+Branch, dir).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("error creating git repository: %v: %s", err, bytes.TrimSpace(out))
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Notify asks the mirror to sync. It is subscribed to the event bus, so that
+// every change to pages is mirrored as it is made.
+func (m *Mirror) Notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run keeps the mirror up to date until ctx is done. It syncs whenever it is
+// notified of a change, and every interval to pick up changes made in other
+// ways, such as by admin commands.
+func (m *Mirror) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := m.Sync(); err != nil {
+			log.Printf("Error syncing git mirror: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync commits the revisions saved since the last sync, one commit per
+// revision, then moves the files of pages that were moved and of silos that
+// were renamed, and removes those of deleted pages. It returns the number of commits made.
+func (m *Mirror) Sync() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tip, err := m.resolve(branchRef)
+	if err != nil {
+		return 0, err
+	}
+	return m.sync(tip, false)
+}
+
+// Rebuild replaces the branch with a history rebuilt from every revision in
+// the database. Pushed changes that haven't been imported would be lost, so
+// unless force is set it returns ErrUnimported if there are any.
+func (m *Mirror) Rebuild(force bool) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tip, err := m.resolve(branchRef)
+	if err != nil {
+		return 0, err
+	}
+	if !force {
+		pushed, err := m.pushed(tip)
+		if err != nil {
+			return 0, err
+		}
+		if len(pushed) > 0 {
+			return 0, ErrUnimported
+		}
+	}
+	return m.sync(tip, true)
+}
+
+// sync does the work of Sync and Rebuild. tip is the current head of the
+// branch, which is only moved if it hasn't changed in the meantime.
+func (m *Mirror) sync(tip string, rebuild bool) (int, error) {
+	after, err := m.lastRevision()
+	if err != nil {
+		return 0, err
+	}
+	base := tip
+	if rebuild {
+		base, after = "", 0
+	}
+
+	files, err := m.pageFiles()
+	if err != nil {
+		return 0, err
+	}
+	paths := make(map[int]string)
+	if !rebuild {
+		if paths, err = m.loadPaths(); err != nil {
+			return 0, err
+		}
+	}
+	idx, err := m.newIndex(base)
+	if err != nil {
+		return 0, err
+	}
+	defer idx.close()
+
+	rows, err := m.DB.Query(`
+		SELECT r.id, r.page_id, r.content, r.comment, r.created_at, u.username, u.display_name, u.email
+		FROM revisions r
+		JOIN users u ON u.id = r.author_id
+		WHERE r.id > ?
+		ORDER BY r.id`, after)
+	if err != nil {
+		return 0, fmt.Errorf("error listing revisions: %w", err)
+	}
+	defer rows.Close()
+
+	head, commits, last := base, 0, after
+	for rows.Next() {
+		var rev revision
+		if err := rows.Scan(&rev.id, &rev.pageID, &rev.content, &rev.comment, &rev.createdAt, &rev.username, &rev.displayName, &rev.email); err != nil {
+			return 0, err
+		}
+		last = rev.id
+
+		// Revisions of deleted pages, and of pages in deleted silos, are left out.
+		f, ok := files[rev.pageID]
+		if !ok || !f.live {
+			continue
+		}
+		if err := idx.add(f.path, rev.content); err != nil {
+			return 0, err
+		}
+		commit, err := idx.commit(head, rev.author(), rev.createdAt, rev.message(f.title))
+		if err != nil {
+			return 0, err
+		}
+		if commit != "" {
+			head = commit
+			commits++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	changed, err := idx.reconcile(files, paths)
+	if err != nil {
+		return 0, err
+	}
+	if changed {
+		message := "Move renamed pages and silos and remove deleted pages\n\n" + trailer + strconv.Itoa(last)
+		commit, err := idx.commit(head, identity{"Sowing", "sowing"}, time.Now(), message)
+		if err != nil {
+			return 0, err
+		}
+		if commit != "" {
+			head = commit
+			commits++
+		}
+	}
+
+	if head != tip {
+		if err := m.updateRef(branchRef, head, tip); err != nil {
+			return 0, fmt.Errorf("the branch changed during the sync, which will be retried: %w", err)
+		}
+		// Keep the imported marker at the head of the branch unless there
+		// are pushed changes waiting to be imported.
+		imported, err := m.resolve(importedRef)
+		if err != nil {
+			return 0, err
+		}
+		if rebuild || imported == "" || imported == tip {
+			if err := m.updateRef(importedRef, head, imported); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if last != after || rebuild {
+		if _, err := m.git(nil, "", "config", revisionKey, strconv.Itoa(last)); err != nil {
+			return 0, err
+		}
+	}
+
+	entries, err := idx.entries()
+	if err != nil {
+		return 0, err
+	}
+	synced := make(map[int]string)
+	for id, f := range files {
+		if _, ok := entries[f.path]; ok && f.live {
+			synced[id] = f.path
+		}
+	}
+	if !maps.Equal(synced, paths) {
+		if err := m.savePaths(synced); err != nil {
+			return 0, err
+		}
+	}
+	return commits, nil
+}
+
+// loadPaths reads where pages were kept as of the last sync, by page ID.
+func (m *Mirror) loadPaths() (map[int]string, error) {
+	paths := make(map[int]string)
+	data, err := os.ReadFile(filepath.Join(m.Dir, pathsFile))
+	if os.IsNotExist(err) {
+		return paths, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &paths); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", pathsFile, err)
+	}
+	return paths, nil
+}
+
+// savePaths records where pages are kept, replacing the file atomically.
+func (m *Mirror) savePaths(paths map[int]string) error {
+	data, err := json.Marshal(paths)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(m.Dir, pathsFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(m.Dir, pathsFile))
+}
+
+// revision is a revision to be committed.
+type revision struct {
+	id          int
+	pageID      int
+	content     string
+	comment     sql.NullString
+	createdAt   time.Time
+	username    string
+	displayName string
+	email       string
+}
+
+func (r *revision) author() identity {
+	// Users without an email address are identified by their username, which
+	// is also what Import matches authors against.
+	email := r.email
+	if email == "" {
+		email = r.username
+	}
+	return identity{r.displayName, email}
+}
+
+func (r *revision) message(title string) string {
+	subject := strings.TrimSpace(r.comment.String)
+	if subject == "" {
+		subject = "Edit " + title
+	}
+	return subject + "\n\n" + trailer + strconv.Itoa(r.id)
+}
+
+// identity is the author of a commit.
+type identity struct {
+	name, email string
+}
+
+// pageFile is where a page is kept in the repository.
+type pageFile struct {
+	path  string
+	title string
+	live  bool
+	// old are the paths the page was kept at under its silo's former slugs.
+	old []string
+}
+
+// pageFiles works out where every page in the database is kept.
+func (m *Mirror) pageFiles() (map[int]*pageFile, error) {
+	rows, err := m.DB.Query(`
+		SELECT p.id, p.parent_id, p.slug, p.title, p.archived_at, s.id, s.slug
+		FROM pages p
+		JOIN silos s ON s.id = p.silo_id`)
+	if err != nil {
+		return nil, fmt.Errorf("error listing pages: %w", err)
+	}
+	defer rows.Close()
+
+	type row struct {
+		parentID   *int
+		slug       string
+		archivedAt *time.Time
+		siloID     int
+		siloSlug   string
+	}
+	all := make(map[int]row)
+	titles := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var r row
+		var title string
+		if err := rows.Scan(&id, &r.parentID, &r.slug, &title, &r.archivedAt, &r.siloID, &r.siloSlug); err != nil {
+			return nil, err
+		}
+		all[id] = r
+		titles[id] = title
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	oldSlugs, err := m.oldSlugs()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[int]*pageFile, len(all))
+	for id, r := range all {
+		// A page is deleted if it or any of its ancestors is.
+		path, live := r.slug, r.archivedAt == nil
+		for parentID := r.parentID; parentID != nil; {
+			parent, ok := all[*parentID]
+			if !ok {
+				break
+			}
+			path = parent.slug + "/" + path
+			live = live && parent.archivedAt == nil
+			parentID = parent.parentID
+		}
+
+		f := &pageFile{path: r.siloSlug + "/" + path + ".org", title: titles[id], live: live}
+		for _, slug := range oldSlugs[r.siloID] {
+			f.old = append(f.old, slug+"/"+path+".org")
+		}
+		files[id] = f
+	}
+	return files, nil
+}
+
+// oldSlugs lists the slugs silos used to have, by silo ID.
+func (m *Mirror) oldSlugs() (map[int][]string, error) {
+	rows, err := m.DB.Query("SELECT old_slug, silo_id FROM silo_redirects")
+	if err != nil {
+		return nil, fmt.Errorf("error listing silo redirects: %w", err)
+	}
+	defer rows.Close()
+
+	slugs := make(map[int][]string)
+	for rows.Next() {
+		var slug string
+		var siloID int
+		if err := rows.Scan(&slug, &siloID); err != nil {
+			return nil, err
+		}
+		slugs[siloID] = append(slugs[siloID], slug)
+	}
+	return slugs, rows.Err()
+}
+
+// pushed lists the commits on the branch, oldest first, that weren't made
+// by the mirror and haven't been imported.
+func (m *Mirror) pushed(tip string) ([]string, error) {
+	if tip == "" {
+		return nil, nil
+	}
+	imported, err := m.resolve(importedRef)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"rev-list", "--reverse", "--no-merges", "--invert-grep", "--grep=^" + trailer, tip}
+	if imported != "" {
+		args = append(args, "^"+imported)
+	}
+	out, err := m.git(nil, "", args...)
+	if err != nil || out == "" {
+		return nil, err
+	}
+	return strings.Split(out, "\n"), nil
+}
+
+func (m *Mirror) lastRevision() (int, error) {
+	out, err := m.git(nil, "", "config", "--default", "0", revisionKey)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(out)
+}
+
+// resolve returns the commit a ref points at, or "" if it doesn't exist.
+func (m *Mirror) resolve(ref string) (string, error) {
+	return m.git(nil, "", "for-each-ref", "--format=%(objectname)", ref)
+}
+
+// updateRef points a ref at a commit, if it still points at old. An empty
+// old means the ref must not exist yet.
+func (m *Mirror) updateRef(ref, commit, old string) error {
+	if old == "" {
+		old = strings.Repeat("0", len(commit))
+	}
+	_, err := m.git(nil, "", "update-ref", ref, commit, old)
+	return err
+}
+
+// git runs a git command on the repository, with extra environment variables
+// and input, and returns its output without the final newline.
+func (m *Mirror) git(env []string, input string, args ...string) (string, error) {
+	out, err := m.run(env, input, args...)
+	return strings.TrimSuffix(out, "\n"), err
+}
+
+// run is git, but returns the output as it is, for file contents.
+func (m *Mirror) run(env []string, input string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(append(os.Environ(), "GIT_DIR="+m.Dir), env...)
+	cmd.Stdin = strings.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,225 @@
+package gitmirror
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"sowing/internal/models"
+	"sowing/internal/page"
+)
+
+// ImportReport describes what Import brought into the wiki.
+type ImportReport struct {
+	Revisions int // Edits to existing pages
+	Pages     int // Pages created
+	// Skipped lists the changes that couldn't be imported, and why.
+	Skipped []string
+}
+
+// titlePattern matches a #+TITLE line, which names a page created by a push.
+var titlePattern = regexp.MustCompile(`(?im)^#\+title:[ \t]*(.+?)[ \t]*$`)
+
+// change is a file changed by pushed commits, and the last commit to do so.
+type change struct {
+	author  identity
+	subject string
+}
+
+// Import brings changes pushed to the repository into the wiki. Each .org
+// file a pushed commit changed becomes a new revision of its page, or a new
+// page if the file is new, with the file's content at the head of the branch
+// so that edits made in the wiki since aren't undone. The revision is
+// credited to the user whose email address or username matches the author of
+// the last commit to change the file, or else to defaultAuthorID, and its
+// comment is that commit's subject. Deleted files are reported, but don't
+// delete their pages, and keep the changes pending until they are restored.
+func (m *Mirror) Import(ctx context.Context, pages *page.Repository, defaultAuthorID int) (*ImportReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	report := &ImportReport{}
+	tip, err := m.resolve(branchRef)
+	if err != nil {
+		return nil, err
+	}
+	pushed, err := m.pushed(tip)
+	if err != nil || len(pushed) == 0 {
+		return report, err
+	}
+
+	changes := make(map[string]change)
+	for _, commit := range pushed {
+		out, err := m.git(nil, "", "show", "--no-patch", "--format=%an%x00%ae%x00%s", commit)
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.SplitN(out, "\x00", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected output from git show: %q", out)
+		}
+		c := change{author: identity{fields[0], fields[1]}, subject: fields[2]}
+
+		out, err = m.git(nil, "", "diff-tree", "-r", "--root", "--no-commit-id", "--name-only", "-z", commit)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range strings.Split(out, "\x00") {
+			if strings.HasSuffix(name, ".org") {
+				changes[name] = c
+			}
+		}
+	}
+
+	files, err := m.pageFiles()
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string]int)
+	for id, f := range files {
+		if f.live {
+			byPath[f.path] = id
+		}
+	}
+
+	// Parents come before their children, so that new pages can be created
+	// under pages that are new too.
+	names := make([]string, 0, len(changes))
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		di, dj := strings.Count(names[i], "/"), strings.Count(names[j], "/")
+		return di < dj || di == dj && names[i] < names[j]
+	})
+
+	for _, name := range names {
+		c := changes[name]
+		skip := func(reason string) {
+			report.Skipped = append(report.Skipped, name+": "+reason)
+		}
+
+		pageID, isPage := byPath[name]
+		content, err := m.run(nil, "", "cat-file", "blob", tip+":"+name)
+		if err != nil {
+			// Files that were added and removed again are of no interest.
+			if isPage {
+				skip("deleted in git; delete the page in the wiki instead")
+			}
+			continue
+		}
+		authorID, err := m.findUser(c.author, defaultAuthorID)
+		if err != nil {
+			return nil, err
+		}
+		if authorID == 0 {
+			skip(fmt.Sprintf("no user matches the author %s <%s>", c.author.name, c.author.email))
+			continue
+		}
+		comment := c.subject
+		revision := &models.Revision{AuthorID: authorID, Comment: &comment, Content: content}
+
+		if isPage {
+			current, err := m.currentContent(pageID)
+			if err != nil {
+				return nil, err
+			}
+			if current == content {
+				continue
+			}
+			if err := pages.CreateRevision(ctx, revision, pageID); err != nil {
+				return nil, err
+			}
+			report.Revisions++
+			continue
+		}
+
+		p, reason, err := m.newPage(name, content, byPath)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			skip(reason)
+			continue
+		}
+		id, err := pages.Create(ctx, p, revision)
+		if err != nil {
+			return nil, err
+		}
+		byPath[name] = int(id)
+		report.Pages++
+	}
+
+	// Skipped changes stay pending, so that once they are fixed, or given a
+	// default author, running Import again brings them in. Files imported
+	// already match their pages by then, and are left alone.
+	if len(report.Skipped) == 0 {
+		if _, err := m.git(nil, "", "update-ref", importedRef, tip); err != nil {
+			return nil, err
+		}
+	}
+
+	// The new revisions match the branch, so this only records them as
+	// mirrored rather than committing them again.
+	if _, err := m.sync(tip, false); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// newPage works out the page a new file becomes, or why it can't become one.
+func (m *Mirror) newPage(name, content string, byPath map[string]int) (*models.Page, string, error) {
+	siloSlug, pagePath, ok := strings.Cut(strings.TrimSuffix(name, ".org"), "/")
+	if !ok {
+		return nil, "not in a silo's folder", nil
+	}
+	var siloID int
+	err := m.DB.QueryRow("SELECT id FROM silos WHERE slug = ?", siloSlug).Scan(&siloID)
+	if err == sql.ErrNoRows {
+		return nil, "there is no silo " + siloSlug, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	slug := path.Base(pagePath)
+	if slug != page.Slugify(slug) {
+		return nil, "the file name isn't a valid page slug; use lowercase letters, digits and dashes", nil
+	}
+	p := &models.Page{SiloID: siloID, Slug: slug, Title: slug}
+	if dir := path.Dir(pagePath); dir != "." {
+		parentID, ok := byPath[siloSlug+"/"+dir+".org"]
+		if !ok {
+			return nil, "its parent page " + dir + " doesn't exist", nil
+		}
+		p.ParentID = &parentID
+	}
+	if m := titlePattern.FindStringSubmatch(content); m != nil {
+		p.Title = m[1]
+	}
+	return p, "", nil
+}
+
+// findUser finds the user matching a commit's author, by email address and
+// then by username, falling back to defaultID.
+func (m *Mirror) findUser(author identity, defaultID int) (int, error) {
+	var id int
+	err := m.DB.QueryRow("SELECT id FROM users WHERE email <> '' AND LOWER(email) = LOWER(?)", author.email).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = m.DB.QueryRow("SELECT id FROM users WHERE username = ? OR username = ?", author.email, author.name).Scan(&id)
+	}
+	if err == sql.ErrNoRows {
+		return defaultID, nil
+	}
+	return id, err
+}
+
+func (m *Mirror) currentContent(pageID int) (string, error) {
+	var content string
+	err := m.DB.QueryRow("SELECT r.content FROM pages p JOIN revisions r ON r.id = p.current_revision_id WHERE p.id = ?", pageID).Scan(&content)
+	return content, err
+}
@@ -0,0 +1,159 @@
+package gitmirror
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// index builds commits in a temporary git index, so that the repository
+// needs no working tree.
+type index struct {
+	m    *Mirror
+	dir  string
+	env  []string
+	tree string // The tree of the last commit
+}
+
+// newIndex creates an index holding the tree of a commit, or an empty one.
+func (m *Mirror) newIndex(commit string) (*index, error) {
+	dir, err := os.MkdirTemp("", "sowing-git-")
+	if err != nil {
+		return nil, err
+	}
+	idx := &index{m: m, dir: dir, env: []string{"GIT_INDEX_FILE=" + filepath.Join(dir, "index")}}
+
+	if commit == "" {
+		_, err = idx.git("", "read-tree", "--empty")
+	} else {
+		_, err = idx.git("", "read-tree", commit)
+		if err == nil {
+			idx.tree, err = idx.git("", "rev-parse", commit+"^{tree}")
+		}
+	}
+	if err != nil {
+		idx.close()
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (idx *index) close() {
+	os.RemoveAll(idx.dir)
+}
+
+func (idx *index) git(input string, args ...string) (string, error) {
+	return idx.m.git(idx.env, input, args...)
+}
+
+// add writes content to a file.
+func (idx *index) add(path, content string) error {
+	blob, err := idx.git(content, "hash-object", "-w", "--stdin")
+	if err != nil {
+		return err
+	}
+	return idx.set(path, blob)
+}
+
+func (idx *index) set(path, blob string) error {
+	_, err := idx.git("", "update-index", "--add", "--cacheinfo", "100644,"+blob+","+path)
+	return err
+}
+
+func (idx *index) remove(path string) error {
+	// A zero mode removes the entry; --force-remove would need a work tree.
+	_, err := idx.git("0 "+strings.Repeat("0", 40)+"\t"+path+"\n", "update-index", "--index-info")
+	return err
+}
+
+// entries returns the blob of every file, by path.
+func (idx *index) entries() (map[string]string, error) {
+	out, err := idx.git("", "ls-files", "--stage", "-z")
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]string)
+	for _, entry := range strings.Split(out, "\x00") {
+		// Each entry is "<mode> <blob> <stage>\t<path>".
+		info, path, ok := strings.Cut(entry, "\t")
+		if fields := strings.Fields(info); ok && len(fields) == 3 {
+			entries[path] = fields[1]
+		}
+	}
+	return entries, nil
+}
+
+// commit commits the index on top of parent, returning "" if nothing changed.
+func (idx *index) commit(parent string, author identity, when time.Time, message string) (string, error) {
+	tree, err := idx.git("", "write-tree")
+	if err != nil || tree == idx.tree {
+		return "", err
+	}
+
+	date := when.UTC().Format(time.RFC3339)
+	env := slices.Concat(idx.env, []string{
+		"GIT_AUTHOR_NAME=" + author.name, "GIT_AUTHOR_EMAIL=" + author.email, "GIT_AUTHOR_DATE=" + date,
+		"GIT_COMMITTER_NAME=Sowing", "GIT_COMMITTER_EMAIL=sowing", "GIT_COMMITTER_DATE=" + date,
+	})
+	args := []string{"commit-tree", tree, "-F", "-"}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	commit, err := idx.m.git(env, message, args...)
+	if err != nil {
+		return "", err
+	}
+	idx.tree = tree
+	return commit, nil
+}
+
+// reconcile moves the files of pages that were moved or renamed, or whose
+// silo was renamed, and removes those of deleted pages, reporting whether it
+// changed anything. paths are where pages were kept as of the last sync.
+// Files that don't belong to any page, such as ones added by a push, are
+// left alone.
+func (idx *index) reconcile(files map[int]*pageFile, paths map[int]string) (bool, error) {
+	entries, err := idx.entries()
+	if err != nil {
+		return false, err
+	}
+	live := make(map[string]bool)
+	for _, f := range files {
+		if f.live {
+			live[f.path] = true
+		}
+	}
+
+	changed := false
+	for id, f := range files {
+		stale := f.old
+		if path, ok := paths[id]; ok && path != f.path {
+			stale = append([]string{path}, stale...)
+		}
+		if !f.live {
+			stale = append([]string{f.path}, stale...)
+		}
+		for _, path := range stale {
+			blob, ok := entries[path]
+			if !ok || live[path] {
+				continue
+			}
+			if f.live {
+				if _, ok := entries[f.path]; !ok {
+					if err := idx.set(f.path, blob); err != nil {
+						return false, err
+					}
+					entries[f.path] = blob
+				}
+			}
+			if err := idx.remove(path); err != nil {
+				return false, err
+			}
+			delete(entries, path)
+			changed = true
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,441 @@
+// Package importer creates pages from a directory of .org files, such as a
+// folder of notes or an org-roam directory.
+package importer
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"sowing/internal/attachment"
+	"sowing/internal/models"
+	"sowing/internal/page"
+)
+
+// Options control an import.
+type Options struct {
+	// AuthorID is the user recorded as the author of the imported pages.
+	AuthorID int
+	// UploadsRoot is the directory attachments are stored in.
+	UploadsRoot string
+	// DryRun plans the import and reports what it would do, without
+	// creating any pages or attachments.
+	DryRun bool
+}
+
+// Report describes what an import did, or would do if it was a dry run.
+type Report struct {
+	Pages       []PlannedPage
+	Attachments []string // Files uploaded as attachments, relative to the imported directory
+	Links       int      // Links rewritten to point at imported pages or attachments
+	// Unresolved lists links to files or IDs that aren't part of the import,
+	// which are left as they are.
+	Unresolved []string
+}
+
+// PlannedPage is a page an import creates.
+type PlannedPage struct {
+	Path   string // The page's path in the silo
+	Title  string
+	Source string // The file it comes from, or the folder if it has no file of its own
+}
+
+var (
+	// linkPattern matches an org link, [[target]] or [[target][description]].
+	linkPattern = regexp.MustCompile(`\[\[([^\]]+)\](\[[^\]]*\])?\]`)
+	// keywordPattern matches the #+TITLE and #+POSITION lines of a file, which
+	// become the page's title and position rather than part of its content.
+	keywordPattern = regexp.MustCompile(`(?im)^#\+(title|position):[ \t]*(.*?)[ \t]*(\n|$)`)
+	// idPattern matches the :ID: property org-roam gives each note.
+	idPattern = regexp.MustCompile(`(?m)^[ \t]*:ID:[ \t]+(\S+)`)
+	// roamPrefix matches the timestamp org-roam puts in front of file names.
+	roamPrefix = regexp.MustCompile(`^\d{14}-`)
+)
+
+// node is a page to be created, from a file, a folder or both: notes.org and
+// notes/ become one page and its children.
+type node struct {
+	source   string // Relative path of the file or folder, without .org
+	hasFile  bool
+	slug     string
+	title    string
+	position int
+	content  string
+	path     string
+	children []*node
+	id       int // Set once the page is created
+	// uploads are the files first linked to from this page, which are
+	// stored as its attachments once it has been created.
+	uploads []upload
+}
+
+// upload is a file to be stored as an attachment.
+type upload struct {
+	source         string // Relative to the imported directory
+	uniqueFilename string
+}
+
+// importer holds the state of one import.
+type importer struct {
+	pages       *page.Repository
+	attachments *attachment.Repository
+	silo        *models.Silo
+	root        string
+	opts        Options
+	report      Report
+	bySource    map[string]*node
+	byID        map[string]*node
+	uploaded    map[string]string // Attachment URLs by source file
+	stored      map[string]bool   // Attachments planned, by unique file name
+}
+
+// Dir imports the .org files under root into a silo. Folders become pages
+// whose children are the files and folders in them, titles come from #+TITLE
+// or else the file name, and files an import links to, such as images, are
+// uploaded as attachments. Links between the imported files, by file: or by
+// org-roam id:, are rewritten as wiki links. The new pages go after the
+// silo's existing top-level pages, and are renamed if their slugs are taken.
+//
+// Pages are created one by one, so if an import fails part way the pages
+// created until then are kept; a dry run first shows what would happen.
+func Dir(ctx context.Context, pages *page.Repository, attachments *attachment.Repository, silo *models.Silo, root string, opts Options) (*Report, error) {
+	existing, err := pages.ListBySilo(silo.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	im := &importer{
+		pages:       pages,
+		attachments: attachments,
+		silo:        silo,
+		root:        root,
+		opts:        opts,
+		bySource:    make(map[string]*node),
+		byID:        make(map[string]*node),
+		uploaded:    make(map[string]string),
+		stored:      make(map[string]bool),
+	}
+	top := &node{}
+	if err := im.scan(top); err != nil {
+		return nil, err
+	}
+	top.children = prune(top.children)
+
+	taken := make(map[string]bool)
+	position := 0
+	for _, p := range existing {
+		if p.ParentID == nil {
+			taken[p.Slug] = true
+			position = max(position, p.Position+1)
+		}
+	}
+	im.assign(top.children, "", taken, position)
+
+	if err := im.create(ctx, top.children, nil); err != nil {
+		return nil, err
+	}
+	return &im.report, nil
+}
+
+// scan reads the directory into a tree of nodes under top.
+func (im *importer) scan(top *node) error {
+	err := filepath.WalkDir(im.root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(im.root, name)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		// Skip hidden files and folders, like .git, and editor lock files.
+		if base := path.Base(rel); strings.HasPrefix(base, ".") || strings.HasPrefix(base, "#") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			im.nodeFor(top, rel)
+			return nil
+		}
+		if !d.Type().IsRegular() || !strings.EqualFold(path.Ext(rel), ".org") {
+			return nil
+		}
+
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		n := im.nodeFor(top, strings.TrimSuffix(rel, path.Ext(rel)))
+		n.hasFile = true
+		n.content = string(data)
+		for _, m := range idPattern.FindAllStringSubmatch(n.content, -1) {
+			im.byID[m[1]] = n
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", im.root, err)
+	}
+	return nil
+}
+
+// prune drops folders with no .org files in them, such as a folder of images.
+func prune(nodes []*node) []*node {
+	var kept []*node
+	for _, n := range nodes {
+		n.children = prune(n.children)
+		if n.hasFile || len(n.children) > 0 {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
+
+// file returns the file or folder a node comes from, for reports.
+func (n *node) file() string {
+	if n.hasFile {
+		return n.source + ".org"
+	}
+	return n.source + "/"
+}
+
+// nodeFor returns the node for a source path, creating it and its parents.
+func (im *importer) nodeFor(top *node, source string) *node {
+	if n, ok := im.bySource[source]; ok {
+		return n
+	}
+	parent := top
+	if dir := path.Dir(source); dir != "." {
+		parent = im.nodeFor(top, dir)
+	}
+	n := &node{source: source}
+	parent.children = append(parent.children, n)
+	im.bySource[source] = n
+	return n
+}
+
+// assign gives nodes their titles, slugs, positions and paths, before any
+// content is rewritten, so that links can point at pages yet to be created.
+func (im *importer) assign(nodes []*node, parentPath string, taken map[string]bool, firstPosition int) {
+	sort.Slice(nodes, func(i, j int) bool { return strings.ToLower(nodes[i].source) < strings.ToLower(nodes[j].source) })
+
+	// Files keep the slug of their name where they can, so that a renamed
+	// file doesn't take the slug of one of its siblings.
+	names := make([]string, len(nodes))
+	claimed := make(map[string]bool)
+	for i, n := range nodes {
+		names[i] = roamPrefix.ReplaceAllString(path.Base(n.source), "")
+		n.slug = page.Slugify(names[i])
+		if n.slug == "" {
+			n.slug = "page"
+		}
+		if !taken[n.slug] && !claimed[n.slug] {
+			claimed[n.slug] = true
+		} else {
+			n.slug = ""
+		}
+	}
+
+	for i, n := range nodes {
+		name := names[i]
+		n.title = strings.TrimSpace(strings.NewReplacer("_", " ", "-", " ").Replace(name))
+		n.position = firstPosition + i
+		n.content = keywordPattern.ReplaceAllStringFunc(n.content, func(line string) string {
+			m := keywordPattern.FindStringSubmatch(line)
+			switch strings.ToLower(m[1]) {
+			case "title":
+				if m[2] != "" {
+					n.title = m[2]
+				}
+			case "position":
+				if position, err := strconv.Atoi(m[2]); err == nil {
+					n.position = firstPosition + position
+				}
+			}
+			return ""
+		})
+		n.content = strings.TrimLeft(n.content, "\n")
+		if n.title == "" {
+			n.title = name
+		}
+
+		if n.slug == "" {
+			slug := page.Slugify(name)
+			if slug == "" {
+				slug = "page"
+			}
+			n.slug = slug
+			for i := 2; taken[n.slug] || claimed[n.slug]; i++ {
+				n.slug = slug + "-" + strconv.Itoa(i)
+			}
+			claimed[n.slug] = true
+		}
+
+		n.path = n.slug
+		if parentPath != "" {
+			n.path = parentPath + "/" + n.slug
+		}
+		im.assign(n.children, n.path, nil, 0)
+	}
+}
+
+// create creates the pages, parents first, rewriting their links as it goes.
+// The files a page is first to link to are stored as its attachments.
+func (im *importer) create(ctx context.Context, nodes []*node, parentID *int) error {
+	for _, n := range nodes {
+		source := n.file()
+		im.report.Pages = append(im.report.Pages, PlannedPage{Path: n.path, Title: n.title, Source: source})
+
+		content, err := im.rewriteLinks(n)
+		if err != nil {
+			return fmt.Errorf("error importing %s: %w", source, err)
+		}
+
+		if !im.opts.DryRun {
+			comment := "Imported from " + source
+			p := &models.Page{SiloID: im.silo.ID, ParentID: parentID, Slug: n.slug, Title: n.title, Position: n.position}
+			revision := &models.Revision{AuthorID: im.opts.AuthorID, Comment: &comment, Content: content}
+			id, err := im.pages.Create(ctx, p, revision)
+			if err != nil {
+				return fmt.Errorf("error importing %s: %w", source, err)
+			}
+			n.id = int(id)
+
+			for _, u := range n.uploads {
+				if err := im.store(u, n.id); err != nil {
+					return fmt.Errorf("error importing %s: %w", u.source, err)
+				}
+			}
+		}
+
+		if err := im.create(ctx, n.children, &n.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteLinks points a page's links to other imported files at their pages,
+// and its links to other local files at attachments.
+func (im *importer) rewriteLinks(n *node) (string, error) {
+	var uploadErr error
+	wikiPrefix := "/" + im.silo.Slug + "/wiki/"
+	dir := path.Dir(n.source)
+
+	content := linkPattern.ReplaceAllStringFunc(n.content, func(link string) string {
+		parts := linkPattern.FindStringSubmatch(link)
+		target, description := parts[1], parts[2]
+
+		switch {
+		case strings.HasPrefix(target, "id:"):
+			linked, ok := im.byID[strings.TrimPrefix(target, "id:")]
+			if !ok {
+				im.report.Unresolved = append(im.report.Unresolved, n.file()+": "+target)
+				return link
+			}
+			target = wikiPrefix + linked.path
+		case strings.HasPrefix(target, "file:"), strings.HasPrefix(target, "./"), strings.HasPrefix(target, "../"):
+			file, search, _ := strings.Cut(strings.TrimPrefix(target, "file:"), "::")
+			rel := path.Clean(path.Join(dir, file))
+			if path.IsAbs(file) || rel == ".." || strings.HasPrefix(rel, "../") {
+				im.report.Unresolved = append(im.report.Unresolved, n.file()+": "+target)
+				return link
+			}
+
+			if strings.EqualFold(path.Ext(rel), ".org") {
+				linked, ok := im.bySource[strings.TrimSuffix(rel, path.Ext(rel))]
+				if !ok || !linked.hasFile {
+					im.report.Unresolved = append(im.report.Unresolved, n.file()+": "+target)
+					return link
+				}
+				target = wikiPrefix + linked.path
+				// Link to a heading by its custom ID or name, but not to an
+				// outline path, which has no equivalent in a URL.
+				if search = strings.TrimPrefix(search, "#"); search != "" && !strings.HasPrefix(search, "*") {
+					target += "#" + search
+				}
+				break
+			}
+
+			url, err := im.attach(n, rel)
+			if err != nil {
+				if os.IsNotExist(err) {
+					im.report.Unresolved = append(im.report.Unresolved, n.file()+": "+target)
+				} else if uploadErr == nil {
+					uploadErr = err
+				}
+				return link
+			}
+			target = url
+		default:
+			return link
+		}
+		im.report.Links++
+		return "[[" + target + "]" + description + "]"
+	})
+	return content, uploadErr
+}
+
+// attach plans to store a file from the imported directory as an attachment
+// of the page n, once however many pages link to it, and returns its URL.
+func (im *importer) attach(n *node, rel string) (string, error) {
+	if url, ok := im.uploaded[rel]; ok {
+		return url, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(im.root, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", err
+	}
+	uniqueFilename := attachment.UniqueFilename(data, rel)
+
+	// Copies of a file with the same content share an attachment.
+	if !im.stored[uniqueFilename] {
+		n.uploads = append(n.uploads, upload{source: rel, uniqueFilename: uniqueFilename})
+	}
+
+	url := "/uploads/" + uniqueFilename
+	im.uploaded[rel] = url
+	im.stored[uniqueFilename] = true
+	im.report.Attachments = append(im.report.Attachments, rel)
+	return url, nil
+}
+
+// store saves a planned attachment of a page that has been created.
+func (im *importer) store(u upload, pageID int) error {
+	data, err := os.ReadFile(filepath.Join(im.root, filepath.FromSlash(u.source)))
+	if err != nil {
+		return err
+	}
+	mimeType := mime.TypeByExtension(path.Ext(u.source))
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	if err := os.WriteFile(filepath.Join(im.opts.UploadsRoot, u.uniqueFilename), data, 0644); err != nil {
+		return err
+	}
+	err = im.attachments.Create(&models.Attachment{
+		PageID:         &pageID,
+		Filename:       path.Base(u.source),
+		UniqueFilename: u.uniqueFilename,
+		MimeType:       mimeType,
+		Size:           int64(len(data)),
+	}, im.opts.AuthorID)
+	if err != nil {
+		return fmt.Errorf("error saving attachment: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+// Package mailer writes plain text emails and sends them through an SMTP
+// server.
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Config is the mail server emails are sent through.
+type Config struct {
+	Addr     string // host:port
+	From     string // The From header, such as "Sowing <wiki@example.com>"
+	Username string // If set, the server is signed in to with PLAIN auth
+	Password string
+}
+
+// Message is a plain text email.
+type Message struct {
+	To      mail.Address
+	Subject string
+	Body    string      // Lines end in \n
+	Headers [][2]string // Extra headers, such as List-Unsubscribe
+}
+
+// Compose writes a message in the form it is sent in.
+func (c Config) Compose(m Message) ([]byte, error) {
+	from, err := mail.ParseAddress(c.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address: %w", err)
+	}
+	messageID := make([]byte, 16)
+	if _, err := rand.Read(messageID); err != nil {
+		return nil, err
+	}
+	_, domain, _ := strings.Cut(from.Address, "@")
+
+	var msg bytes.Buffer
+	headers := [][2]string{
+		{"From", from.String()},
+		{"To", m.To.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + hex.EncodeToString(messageID) + "@" + domain + ">"},
+		{"Auto-Submitted", "auto-generated"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	for _, h := range append(headers, m.Headers...) {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h[0], h[1])
+	}
+	msg.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&msg)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(m.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// RejectedError is returned when the mail server permanently refuses a
+// recipient or a message. Sending the same message to them again won't work.
+type RejectedError struct {
+	Err error
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("message rejected: %v", e.Err)
+}
+
+func (e *RejectedError) Unwrap() error {
+	return e.Err
+}
+
+// rejected wraps err in a RejectedError if it is a permanent (5xx) reply.
+// Temporary (4xx) replies and connection errors are returned as they are.
+func rejected(err error) error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return &RejectedError{Err: err}
+	}
+	return err
+}
+
+// Deliver sends a composed message through the mail server. If the server
+// permanently refuses the recipient or the message, the error is a
+// *RejectedError.
+func (c Config) Deliver(to string, msg []byte) error {
+	from, err := mail.ParseAddress(c.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address: %w", err)
+	}
+	host, _, _ := net.SplitHostPort(c.Addr)
+
+	client, err := smtp.Dial(c.Addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if c.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, host)); err != nil {
+			return err
+		}
+	}
+	// Refusing the sender is a problem with the configuration rather than
+	// with this message, so only what follows counts as a rejection.
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return rejected(err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return rejected(err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return rejected(err)
+	}
+	return client.Quit()
+}
+
+// Send composes a message and sends it.
+func (c Config) Send(m Message) error {
+	msg, err := c.Compose(m)
+	if err != nil {
+		return err
+	}
+	return c.Deliver(m.To.Address, msg)
+}
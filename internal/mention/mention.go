@@ -0,0 +1,42 @@
+// Package mention finds @username mentions of users in page content and
+// revision comments.
+package mention
+
+import "regexp"
+
+// pattern matches an @ that doesn't follow a letter, digit or one of a few
+// characters, so that email addresses and paths aren't taken for mentions,
+// and the name after it. Names may contain dots and hyphens, but don't end
+// with them, so that a mention can end a sentence.
+var pattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_@/.+-])@([\p{L}\p{N}_](?:[\p{L}\p{N}_.-]*[\p{L}\p{N}_])?)`)
+
+// Mention is a mention found in text. Start and End are the positions of the
+// @ and the end of the name.
+type Mention struct {
+	Username string
+	Start    int
+	End      int
+}
+
+// FindAll returns the mentions in text, in order.
+func FindAll(text string) []Mention {
+	var mentions []Mention
+	for _, m := range pattern.FindAllStringSubmatchIndex(text, -1) {
+		mentions = append(mentions, Mention{Username: text[m[2]:m[3]], Start: m[2] - 1, End: m[3]})
+	}
+	return mentions
+}
+
+// Usernames returns the usernames mentioned in text, each once, in the order
+// they are first mentioned.
+func Usernames(text string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, m := range FindAll(text) {
+		if !seen[m.Username] {
+			seen[m.Username] = true
+			names = append(names, m.Username)
+		}
+	}
+	return names
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// APIToken represents a personal access token used for scripted access.
+// Only a hash of the token is stored; the plaintext is shown once on creation.
+type APIToken struct {
+	ID         int
+	UserID     int
+	Name       string
+	TokenHash  string
+	Scopes     []string
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	CreatedAt  time.Time
+}
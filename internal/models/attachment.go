@@ -5,6 +5,7 @@ import "time"
 // Attachment represents an uploaded file.
 type Attachment struct {
 	ID             int
+	PageID         *int // The page it was uploaded for, if known
 	Filename       string
 	UniqueFilename string
 	MimeType       string
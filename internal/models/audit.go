@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// AuditEntry records an administrative action, taken on the admin pages or
+// with the admin command line.
+type AuditEntry struct {
+	ID        int
+	ActorID   *int   // The admin who acted, nil for the command line
+	Actor     string // The admin's username, or "cli"
+	Action    string // e.g. "user.disable" or "silo.rename"
+	Target    string // What the action was taken on, e.g. a username or silo slug
+	Detail    string
+	IP        string
+	CreatedAt time.Time
+}
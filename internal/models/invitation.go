@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Invitation lets someone register while registration is restricted.
+// Only a hash of the invitation token is stored.
+type Invitation struct {
+	ID        int
+	TokenHash string
+	Email     string // If set, the invitation can only be used with this address
+	SiloID    *int   // The silo whose owner sent the invitation, if any
+	CreatedBy int
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	UsedBy    *int
+	CreatedAt time.Time
+}
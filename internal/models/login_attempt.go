@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// LoginAttempt is an entry in the audit trail of login attempts.
+type LoginAttempt struct {
+	ID        int
+	Username  string
+	IP        string
+	Succeeded bool
+	Reason    string // Why the attempt failed, e.g. "bad_password" or "locked"
+	CreatedAt time.Time
+}
+
+// AccountLockout tracks consecutive failed logins for a username.
+type AccountLockout struct {
+	Username    string
+	FailedCount int
+	LockedUntil *time.Time
+}
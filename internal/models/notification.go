@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// Notification tells a user that they were mentioned in a revision.
+type Notification struct {
+	ID         int
+	UserID     int
+	RevisionID int
+	InComment  bool // Whether the mention was in the revision's comment rather than the page
+	ReadAt     *time.Time
+	CreatedAt  time.Time
+	// Set when listed, for display.
+	Actor     string // The display name of the revision's author
+	PageID    int
+	PageTitle string
+	PagePath  string
+	SiloSlug  string
+	SiloName  string
+	Comment   string
+}
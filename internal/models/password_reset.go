@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// PasswordReset is a one-time link that lets a user set a new password.
+// Only a hash of the token is stored.
+type PasswordReset struct {
+	ID        int
+	UserID    int
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
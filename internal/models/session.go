@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Session represents a login session stored on the server. The browser only
+// holds a random session ID, of which the database keeps a hash.
+type Session struct {
+	ID         int
+	TokenHash  string
+	UserID     *int
+	Data       []byte
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
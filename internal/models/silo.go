@@ -8,4 +8,20 @@ type Silo struct {
 	Name       string
 	ArchivedAt *time.Time
 	CoverImage *string
+	HomePageID *int // The landing page; nil falls back to the first top-level page
+}
+
+// Silo roles. Owners can invite people on behalf of their silo.
+const (
+	RoleOwner = "owner"
+)
+
+// SiloRoles lists the valid silo roles.
+var SiloRoles = []string{RoleOwner}
+
+// SiloRole grants a user a role in a silo.
+type SiloRole struct {
+	SiloID int
+	UserID int
+	Role   string
 }
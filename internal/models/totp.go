@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// UserTOTP holds a user's TOTP second factor. A row with a nil EnabledAt is an
+// enrolment that has been started but not yet confirmed.
+type UserTOTP struct {
+	UserID       int
+	Secret       string
+	LastUsedStep int64 // The last accepted time step, to prevent code reuse
+	EnabledAt    *time.Time
+	CreatedAt    time.Time
+}
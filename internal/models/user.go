@@ -1,8 +1,19 @@
 package models
 
+// User statuses. Only active users may log in.
+const (
+	UserStatusActive  = "active"
+	UserStatusPending  = "pending"  // Registered, awaiting approval by an admin
+	UserStatusUnverified = "unverified" // Registered, email address not yet confirmed
+	UserStatusDisabled = "disabled" // Switched off by an admin
+)
+
 // User represents a user of the application.
 type User struct {
 	ID          int
 	Username    string
 	DisplayName string
+	Email       string
+	Status      string
+	IsAdmin     bool
 }
@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// Watch subscribes a user to emails about new revisions in a silo, a page, or
+// a page and the pages below it.
+type Watch struct {
+	ID      int
+	UserID  int
+	SiloID  int
+	PageID  *int // nil to watch the whole silo
+	Subtree bool // Whether the pages below the page are watched too
+	Token   string
+	// Set when listed, for display.
+	SiloSlug  string
+	SiloName  string
+	PageTitle string
+	PagePath  string
+	CreatedAt time.Time
+}
+
+// Description names what a watch covers, such as "Setup in Docs and the
+// pages below it".
+func (w *Watch) Description() string {
+	switch {
+	case w.PageID == nil:
+		return "every page in " + w.SiloName
+	case w.Subtree:
+		return w.PageTitle + " in " + w.SiloName + " and the pages below it"
+	}
+	return w.PageTitle + " in " + w.SiloName
+}
+
+// Email digest settings: how often a user is emailed about the revisions
+// they watch.
+const (
+	DigestImmediate = "immediate"
+	DigestHourly    = "hourly"
+	DigestDaily     = "daily"
+)
+
+// Digests lists the email digest settings, in the order they are shown in.
+var Digests = []string{DigestImmediate, DigestHourly, DigestDaily}
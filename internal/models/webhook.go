@@ -0,0 +1,48 @@
+package models
+
+import (
+	"slices"
+	"time"
+)
+
+// Webhook POSTs a silo's events to a URL, signed with its secret.
+type Webhook struct {
+	ID     int
+	SiloID int
+	URL    string
+	Secret string
+	// Events are the event types it is sent; none means all of them.
+	Events    []string
+	Active    bool
+	CreatedAt time.Time
+}
+
+// Wants reports whether the webhook is sent events of a type.
+func (w *Webhook) Wants(eventType string) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, eventType)
+}
+
+// Delivery statuses. A delivery is pending until it succeeds or runs out of
+// attempts.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is an event sent, or to be sent, to a webhook, and the
+// outcome of the last attempt to send it.
+type WebhookDelivery struct {
+	ID            int
+	WebhookID     int
+	Event         string
+	Payload       string
+	Status        string
+	Attempts      int
+	NextAttemptAt *time.Time
+	ResponseCode  *int
+	ResponseBody  string
+	Error         string
+	CreatedAt     time.Time
+	DeliveredAt   *time.Time // When it was last attempted
+}
@@ -0,0 +1,96 @@
+// Package notification tells users in the app when they are @mentioned in a
+// page or a revision comment.
+package notification
+
+import (
+	"database/sql"
+	"log"
+	"slices"
+
+	"sowing/internal/events"
+	"sowing/internal/mention"
+	"sowing/internal/page"
+	"sowing/internal/web/renderer"
+)
+
+// maxMentions is how many users a revision can notify, so that pasting a
+// list of names doesn't notify everyone on the site.
+const maxMentions = 50
+
+// Notifier notifies the users mentioned in new revisions.
+type Notifier struct {
+	Notifications *Repository
+	Pages         *page.Repository
+}
+
+// NewNotifier creates a notifier. Its Handle method is subscribed to an event
+// bus.
+func NewNotifier(db *sql.DB) *Notifier {
+	return &Notifier{Notifications: NewRepository(db), Pages: page.NewRepository(db)}
+}
+
+// Handle notifies the users mentioned in a new revision's comment, or newly
+// mentioned in its page, so that editing a page that already mentions
+// someone doesn't notify them again. Authors aren't notified of mentioning
+// themselves.
+func (n *Notifier) Handle(e events.Event) {
+	if e.Type != events.PageCreated && e.Type != events.PageRevised {
+		return
+	}
+	if err := n.notify(e.PageID, e.RevisionID); err != nil {
+		log.Printf("Error notifying users mentioned in revision %d: %v", e.RevisionID, err)
+	}
+}
+
+func (n *Notifier) notify(pageID, revisionID int) error {
+	revision, err := n.Pages.GetRevision(revisionID)
+	if err != nil {
+		return err
+	}
+	previous, err := n.Notifications.previousContent(pageID, revisionID)
+	if err != nil {
+		return err
+	}
+
+	var inComment []string
+	if revision.Comment != nil {
+		inComment = mention.Usernames(*revision.Comment)
+	}
+	// Pages are searched for mentions as they are rendered, so that names in
+	// code and links, which aren't shown as mentions, don't notify anyone.
+	before, err := renderer.Mentions(previous)
+	if err != nil {
+		return err
+	}
+	inContent, err := renderer.Mentions(revision.Content)
+	if err != nil {
+		return err
+	}
+	mentionedBefore := make(map[string]bool, len(before))
+	for _, name := range before {
+		mentionedBefore[name] = true
+	}
+	names := slices.Clone(inComment[:min(len(inComment), maxMentions)])
+	for _, name := range inContent {
+		if len(names) == maxMentions {
+			break
+		}
+		if !mentionedBefore[name] && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	users, err := n.Notifications.FindUsers(names)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if u.ID == revision.AuthorID {
+			continue
+		}
+		if err := n.Notifications.Create(u.ID, revisionID, slices.Contains(inComment, u.Username)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
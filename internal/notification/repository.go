@@ -0,0 +1,183 @@
+package notification
+
+import (
+	"database/sql"
+	"fmt"
+	"sowing/internal/mention"
+	"sowing/internal/models"
+	"sowing/internal/page"
+	"strings"
+	"time"
+)
+
+// Repository provides access to the notification storage.
+type Repository struct {
+	DB    *sql.DB
+	Pages *page.Repository
+}
+
+// NewRepository creates a new notification repository.
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{DB: db, Pages: page.NewRepository(db)}
+}
+
+const notificationColumns = "n.id, n.user_id, n.revision_id, n.in_comment, n.read_at, n.created_at, u.display_name, p.id, p.title, s.slug, s.name, COALESCE(r.comment, '')"
+
+const notificationJoins = "FROM notifications n JOIN revisions r ON r.id = n.revision_id JOIN users u ON u.id = r.author_id JOIN pages p ON p.id = r.page_id JOIN silos s ON s.id = p.silo_id"
+
+// FindUsers finds the active users with the given usernames, which are the
+// users that can be mentioned. Names that aren't usernames are left out.
+func (r *Repository) FindUsers(usernames []string) ([]models.User, error) {
+	if len(usernames) == 0 {
+		return nil, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(usernames)), ", ")
+	args := []any{models.UserStatusActive}
+	for _, name := range usernames {
+		args = append(args, name)
+	}
+	rows, err := r.DB.Query("SELECT id, username, display_name FROM users WHERE status = ? AND username IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, fmt.Errorf("error finding mentioned users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []models.User
+	for rows.Next() {
+		var u models.User
+		if err := rows.Scan(&u.ID, &u.Username, &u.DisplayName); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// MentionedUsers returns the set of usernames mentioned in text that belong
+// to users who can be mentioned, for linking the mentions to their profiles.
+// Only the first maxMentions names are looked up.
+func (r *Repository) MentionedUsers(text string) (map[string]bool, error) {
+	names := mention.Usernames(text)
+	users, err := r.FindUsers(names[:min(len(names), maxMentions)])
+	if err != nil {
+		return nil, err
+	}
+	usernames := make(map[string]bool, len(users))
+	for _, u := range users {
+		usernames[u.Username] = true
+	}
+	return usernames, nil
+}
+
+// Create notifies a user that they were mentioned in a revision. A user is
+// notified of each revision once, so creating a notification again does
+// nothing.
+func (r *Repository) Create(userID, revisionID int, inComment bool) error {
+	_, err := r.DB.Exec("INSERT INTO notifications (user_id, revision_id, in_comment, created_at) VALUES (?, ?, ?, ?) ON CONFLICT(user_id, revision_id) DO NOTHING",
+		userID, revisionID, inComment, time.Now())
+	if err != nil {
+		return fmt.Errorf("error creating notification: %w", err)
+	}
+	return nil
+}
+
+// FindByID finds a notification by its ID.
+func (r *Repository) FindByID(id int) (*models.Notification, error) {
+	n, err := scanNotification(r.DB.QueryRow("SELECT "+notificationColumns+" "+notificationJoins+" WHERE n.id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+	if err := r.findPath(n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// ListByUser lists a user's most recent notifications, newest first.
+func (r *Repository) ListByUser(userID, limit int) ([]models.Notification, error) {
+	rows, err := r.DB.Query("SELECT "+notificationColumns+" "+notificationJoins+" WHERE n.user_id = ? ORDER BY n.created_at DESC, n.id DESC LIMIT ?", userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []models.Notification
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, *n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range notifications {
+		if err := r.findPath(&notifications[i]); err != nil {
+			return nil, err
+		}
+	}
+	return notifications, nil
+}
+
+// CountUnread counts the notifications a user hasn't read.
+func (r *Repository) CountUnread(userID int) (int, error) {
+	var count int
+	err := r.DB.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", userID).Scan(&count)
+	return count, err
+}
+
+// MarkRead marks a notification as read.
+func (r *Repository) MarkRead(id int) error {
+	_, err := r.DB.Exec("UPDATE notifications SET read_at = ? WHERE id = ? AND read_at IS NULL", time.Now(), id)
+	return err
+}
+
+// MarkAllRead marks all of a user's notifications as read.
+func (r *Repository) MarkAllRead(userID int) error {
+	_, err := r.DB.Exec("UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL", time.Now(), userID)
+	return err
+}
+
+// previousContent returns the content of the revision of a page before the
+// given one, or "" if it is the first.
+func (r *Repository) previousContent(pageID, revisionID int) (string, error) {
+	var content string
+	err := r.DB.QueryRow("SELECT content FROM revisions WHERE page_id = ? AND id < ? ORDER BY id DESC LIMIT 1", pageID, revisionID).Scan(&content)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return content, err
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanNotification(row scanner) (*models.Notification, error) {
+	var n models.Notification
+	var readAt sql.NullTime
+	err := row.Scan(&n.ID, &n.UserID, &n.RevisionID, &n.InComment, &readAt, &n.CreatedAt,
+		&n.Actor, &n.PageID, &n.PageTitle, &n.SiloSlug, &n.SiloName, &n.Comment)
+	if err != nil {
+		return nil, err
+	}
+	if readAt.Valid {
+		n.ReadAt = &readAt.Time
+	}
+	return &n, nil
+}
+
+// findPath sets the path of the page a notification is about. It isn't
+// scanned with the notification because finding it takes more queries.
+func (r *Repository) findPath(n *models.Notification) error {
+	path, err := r.Pages.GetPathByID(n.PageID)
+	if err != nil {
+		return fmt.Errorf("error finding mentioning page: %w", err)
+	}
+	n.PagePath = path
+	return nil
+}
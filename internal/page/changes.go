@@ -0,0 +1,70 @@
+package page
+
+import (
+	"database/sql"
+
+	"sowing/internal/web/viewmodels"
+)
+
+// RecentChanges lists the latest revisions, newest first, of the pages of a
+// silo, or of every silo that isn't archived if siloID is 0. If pageID isn't
+// 0 only that page's revisions are listed. Revisions of archived pages, and
+// of pages below them, are left out.
+func (r *Repository) RecentChanges(siloID, pageID, limit int) ([]viewmodels.ChangeViewModel, error) {
+	return r.recentChanges(siloID, pageID, 0, limit)
+}
+
+// RecentChangesByAuthor lists a user's latest revisions, newest first, in the
+// same way as RecentChanges lists every silo's.
+func (r *Repository) RecentChangesByAuthor(authorID, limit int) ([]viewmodels.ChangeViewModel, error) {
+	return r.recentChanges(0, 0, authorID, limit)
+}
+
+func (r *Repository) recentChanges(siloID, pageID, authorID, limit int) ([]viewmodels.ChangeViewModel, error) {
+	// visible walks down from the root pages to find the pages that can be
+	// reached, and their paths.
+	rows, err := r.DB.Query(`
+		WITH RECURSIVE visible (id, path) AS (
+			SELECT id, slug FROM pages
+			WHERE parent_id IS NULL AND archived_at IS NULL AND (silo_id = ? OR ? = 0)
+			UNION ALL
+			SELECT p.id, v.path || '/' || p.slug
+			FROM pages p
+			JOIN visible v ON p.parent_id = v.id
+			WHERE p.archived_at IS NULL
+		)
+		SELECT r.id, (SELECT MAX(id) FROM revisions WHERE page_id = r.page_id AND id < r.id),
+			r.page_id, p.title, v.path, s.slug, s.name, u.display_name, u.username, r.comment, r.created_at
+		FROM revisions r
+		JOIN visible v ON v.id = r.page_id
+		JOIN pages p ON p.id = r.page_id
+		JOIN silos s ON s.id = p.silo_id
+		JOIN users u ON u.id = r.author_id
+		WHERE (s.id = ? OR ? = 0 AND s.archived_at IS NULL) AND (r.page_id = ? OR ? = 0)
+			AND (r.author_id = ? OR ? = 0)
+		ORDER BY r.created_at DESC, r.id DESC
+		LIMIT ?
+	`, siloID, siloID, siloID, siloID, pageID, pageID, authorID, authorID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []viewmodels.ChangeViewModel
+	for rows.Next() {
+		var change viewmodels.ChangeViewModel
+		var previous sql.NullInt64
+		var comment sql.NullString
+		err := rows.Scan(&change.RevisionID, &previous, &change.PageID, &change.Title, &change.Path,
+			&change.SiloSlug, &change.SiloName, &change.Author, &change.AuthorUsername, &comment, &change.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		change.PreviousRevisionID = int(previous.Int64)
+		if comment.Valid {
+			change.Comment = &comment.String
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
@@ -0,0 +1,50 @@
+package page
+
+import (
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// DiffSummary counts the lines a revision added and removed, with the first
+// of them prefixed by + or -.
+type DiffSummary struct {
+	Added   int
+	Removed int
+	Lines   []string
+}
+
+// SummariseDiff compares two revisions' content line by line, keeping at most
+// maxLines of the changed lines. An ellipsis follows them if there are more.
+func SummariseDiff(from, to string, maxLines int) DiffSummary {
+	dmp := diffmatchpatch.New()
+	a, b, lines := dmp.DiffLinesToChars(from, to)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(a, b, false), lines)
+
+	var summary DiffSummary
+	for _, d := range diffs {
+		prefix := "+ "
+		switch d.Type {
+		case diffmatchpatch.DiffEqual:
+			continue
+		case diffmatchpatch.DiffDelete:
+			prefix = "- "
+		}
+		for _, line := range strings.SplitAfter(d.Text, "\n") {
+			if line == "" {
+				continue
+			}
+			if d.Type == diffmatchpatch.DiffInsert {
+				summary.Added++
+			} else {
+				summary.Removed++
+			}
+			if len(summary.Lines) < maxLines {
+				summary.Lines = append(summary.Lines, prefix+strings.TrimSuffix(line, "\n"))
+			} else if len(summary.Lines) == maxLines {
+				summary.Lines = append(summary.Lines, "…")
+			}
+		}
+	}
+	return summary
+}
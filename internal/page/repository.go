@@ -3,15 +3,22 @@ package page
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log"
+	"sowing/internal/events"
 	"sowing/internal/models"
 	"sowing/internal/web/viewmodels"
+	"strings"
 	"time"
 )
 
 // Repository provides access to the page storage.
 type Repository struct {
 	DB *sql.DB
+	// Events, if set, is told whenever a page is created, edited, moved or
+	// archived.
+	Events *events.Bus
 }
 
 // NewRepository creates a new page repository.
@@ -49,6 +56,14 @@ func (r *Repository) FindByPath(siloID int, path []string) (models.Page, error)
 	return page, nil
 }
 
+// FindByID finds a page that hasn't been archived by its ID.
+func (r *Repository) FindByID(pageID int) (models.Page, error) {
+	var page models.Page
+	err := r.DB.QueryRow("SELECT id, silo_id, title, current_revision_id, slug, parent_id, position FROM pages WHERE id = ? AND archived_at IS NULL", pageID).
+		Scan(&page.ID, &page.SiloID, &page.Title, &page.CurrentRevisionID, &page.Slug, &page.ParentID, &page.Position)
+	return page, err
+}
+
 // GetRevisionContent gets the content of a specific revision.
 func (r *Repository) GetRevisionContent(revisionID int) (string, error) {
 	var content string
@@ -56,9 +71,48 @@ func (r *Repository) GetRevisionContent(revisionID int) (string, error) {
 	return content, err
 }
 
+// GetRevisionContents gets the content of several revisions, keyed by their
+// IDs. Revisions that don't exist are left out.
+func (r *Repository) GetRevisionContents(revisionIDs []int) (map[int]string, error) {
+	contents := make(map[int]string, len(revisionIDs))
+	if len(revisionIDs) == 0 {
+		return contents, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(revisionIDs)), ", ")
+	args := make([]any, len(revisionIDs))
+	for i, id := range revisionIDs {
+		args[i] = id
+	}
+	rows, err := r.DB.Query("SELECT id, content FROM revisions WHERE id IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var content string
+		if err := rows.Scan(&id, &content); err != nil {
+			return nil, err
+		}
+		contents[id] = content
+	}
+	return contents, rows.Err()
+}
+
+// GetRevision gets a revision by ID.
+func (r *Repository) GetRevision(revisionID int) (*models.Revision, error) {
+	var revision models.Revision
+	err := r.DB.QueryRow("SELECT id, page_id, content, author_id, comment, created_at FROM revisions WHERE id = ?", revisionID).
+		Scan(&revision.ID, &revision.PageID, &revision.Content, &revision.AuthorID, &revision.Comment, &revision.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
 // ListBySilo lists all non-archived pages for a given silo.
 func (r *Repository) ListBySilo(siloID int) ([]models.Page, error) {
-	rows, err := r.DB.Query("SELECT id, slug, title, parent_id, position FROM pages WHERE silo_id = ? AND archived_at IS NULL ORDER BY position ASC", siloID)
+	rows, err := r.DB.Query("SELECT id, slug, title, parent_id, position, current_revision_id FROM pages WHERE silo_id = ? AND archived_at IS NULL ORDER BY position ASC", siloID)
 	if err != nil {
 		return nil, err
 	}
@@ -67,7 +121,7 @@ func (r *Repository) ListBySilo(siloID int) ([]models.Page, error) {
 	var allSiloPages []models.Page
 	for rows.Next() {
 		var page models.Page
-		if err := rows.Scan(&page.ID, &page.Slug, &page.Title, &page.ParentID, &page.Position); err != nil {
+		if err := rows.Scan(&page.ID, &page.Slug, &page.Title, &page.ParentID, &page.Position, &page.CurrentRevisionID); err != nil {
 			return nil, err
 		}
 		allSiloPages = append(allSiloPages, page)
@@ -75,6 +129,29 @@ func (r *Repository) ListBySilo(siloID int) ([]models.Page, error) {
 	return allSiloPages, nil
 }
 
+// LandingPath returns the path of the page a silo's visitors land on: its
+// configured home page, or its first top-level page if that isn't set or has
+// been deleted. It returns sql.ErrNoRows if the silo has no pages.
+func (r *Repository) LandingPath(silo *models.Silo) (string, error) {
+	if silo.HomePageID != nil {
+		var archived bool
+		err := r.DB.QueryRow("SELECT archived_at IS NOT NULL FROM pages WHERE id = ? AND silo_id = ?", *silo.HomePageID, silo.ID).Scan(&archived)
+		if err == nil && !archived {
+			return r.GetPathByID(*silo.HomePageID)
+		}
+		if err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+
+	var pageID int
+	err := r.DB.QueryRow("SELECT id FROM pages WHERE silo_id = ? AND parent_id IS NULL AND archived_at IS NULL ORDER BY position, id LIMIT 1", silo.ID).Scan(&pageID)
+	if err != nil {
+		return "", err
+	}
+	return r.GetPathByID(pageID)
+}
+
 // Create creates a new page and its initial revision in a transaction.
 func (r *Repository) Create(ctx context.Context, page *models.Page, revision *models.Revision) (int64, error) {
 	tx, err := r.DB.BeginTx(ctx, nil)
@@ -88,18 +165,18 @@ func (r *Repository) Create(ctx context.Context, page *models.Page, revision *mo
 		parentIDPtr = page.ParentID
 	}
 
-	res, err := tx.ExecContext(ctx, "INSERT INTO pages (silo_id, parent_id, slug, title, current_revision_id) VALUES (?, ?, ?, ?, -1)", page.SiloID, parentIDPtr, page.Slug, page.Title)
+	var pageID int64
+	err = tx.QueryRowContext(ctx, "INSERT INTO pages (silo_id, parent_id, slug, title, position, current_revision_id) VALUES (?, ?, ?, ?, ?, -1) RETURNING id", page.SiloID, parentIDPtr, page.Slug, page.Title, page.Position).Scan(&pageID)
 	if err != nil {
 		return 0, fmt.Errorf("error creating page: %w", err)
 	}
-	pageID, _ := res.LastInsertId()
 	page.ID = int(pageID)
 
-	res, err = tx.ExecContext(ctx, "INSERT INTO revisions (page_id, author_id, comment, content) VALUES (?, ?, ?, ?)", page.ID, revision.AuthorID, revision.Comment, revision.Content)
+	var revisionID int64
+	err = tx.QueryRowContext(ctx, "INSERT INTO revisions (page_id, author_id, comment, content) VALUES (?, ?, ?, ?) RETURNING id", page.ID, revision.AuthorID, revision.Comment, revision.Content).Scan(&revisionID)
 	if err != nil {
 		return 0, fmt.Errorf("error creating revision: %w", err)
 	}
-	revisionID, _ := res.LastInsertId()
 
 	_, err = tx.ExecContext(ctx, "UPDATE pages SET current_revision_id = ? WHERE id = ?", revisionID, page.ID)
 	if err != nil {
@@ -109,6 +186,7 @@ func (r *Repository) Create(ctx context.Context, page *models.Page, revision *mo
 	if err := tx.Commit(); err != nil {
 		return 0, fmt.Errorf("error committing transaction: %w", err)
 	}
+	r.publish(events.Event{Type: events.PageCreated, SiloID: page.SiloID, ActorID: revision.AuthorID, PageID: page.ID, RevisionID: int(revisionID)})
 	return pageID, nil
 }
 
@@ -133,42 +211,165 @@ func (r *Repository) GetPathByID(pageID int) (string, error) {
 	return parentPath + "/" + slug, nil
 }
 
+// ErrStaleRevision is returned by CreateRevisionIf when the page has been
+// edited since the revision the new one was based on.
+var ErrStaleRevision = errors.New("the page has changed since that revision")
+
 // CreateRevision creates a new revision for a page and updates the page's current_revision_id.
 func (r *Repository) CreateRevision(ctx context.Context, revision *models.Revision, pageID int) error {
+	return r.createRevision(ctx, revision, pageID, nil)
+}
+
+// CreateRevisionIf creates a new revision for a page only if its current
+// revision is still baseRevisionID, and returns ErrStaleRevision otherwise.
+func (r *Repository) CreateRevisionIf(ctx context.Context, revision *models.Revision, pageID, baseRevisionID int) error {
+	return r.createRevision(ctx, revision, pageID, &baseRevisionID)
+}
+
+func (r *Repository) createRevision(ctx context.Context, revision *models.Revision, pageID int, baseRevisionID *int) error {
 	tx, err := r.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("error starting transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	res, err := tx.ExecContext(ctx, "INSERT INTO revisions (page_id, author_id, comment, content) VALUES (?, ?, ?, ?)", pageID, revision.AuthorID, revision.Comment, revision.Content)
+	var revisionID int64
+	err = tx.QueryRowContext(ctx, "INSERT INTO revisions (page_id, author_id, comment, content) VALUES (?, ?, ?, ?) RETURNING id", pageID, revision.AuthorID, revision.Comment, revision.Content).Scan(&revisionID)
 	if err != nil {
 		return fmt.Errorf("error creating revision: %w", err)
 	}
-	revisionID, _ := res.LastInsertId()
 
-	_, err = tx.ExecContext(ctx, "UPDATE pages SET current_revision_id = ? WHERE id = ?", revisionID, pageID)
+	query, args := "UPDATE pages SET current_revision_id = ? WHERE id = ?", []any{revisionID, pageID}
+	if baseRevisionID != nil {
+		query, args = query+" AND current_revision_id = ?", append(args, *baseRevisionID)
+	}
+	result, err := tx.ExecContext(ctx, query, args...)
 	if err != nil {
 		return fmt.Errorf("error updating page with revision ID: %w", err)
 	}
+	if baseRevisionID != nil {
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrStaleRevision
+		}
+	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	revision.ID = int(revisionID)
+	r.publish(events.Event{Type: events.PageRevised, ActorID: revision.AuthorID, PageID: pageID, RevisionID: revision.ID})
+	return nil
 }
 
-// Delete archives a page.
-func (r *Repository) Delete(pageID int) error {
+// Move gives a page a new parent and slug on behalf of a user. A nil
+// parentID moves it to the top level of its silo.
+func (r *Repository) Move(pageID int, parentID *int, slug string, actorID int) error {
+	_, err := r.DB.Exec("UPDATE pages SET parent_id = ?, slug = ? WHERE id = ?", parentID, slug, pageID)
+	if err != nil {
+		return fmt.Errorf("error moving page: %w", err)
+	}
+	r.publish(events.Event{Type: events.PageMoved, ActorID: actorID, PageID: pageID})
+	return nil
+}
+
+// FindArchived finds the most recently archived page with a slug under
+// parentID, or at the top level of its silo if parentID is nil. Archived
+// pages keep their slugs, so one found here keeps a new page from taking it.
+func (r *Repository) FindArchived(siloID int, parentID *int, slug string) (models.Page, error) {
+	query, args := "SELECT id, silo_id, title, current_revision_id, slug, parent_id, position FROM pages WHERE silo_id = ? AND slug = ? AND archived_at IS NOT NULL", []any{siloID, slug}
+	if parentID == nil {
+		query += " AND parent_id IS NULL"
+	} else {
+		query, args = query+" AND parent_id = ?", append(args, *parentID)
+	}
+	var page models.Page
+	err := r.DB.QueryRow(query+" ORDER BY archived_at DESC LIMIT 1", args...).
+		Scan(&page.ID, &page.SiloID, &page.Title, &page.CurrentRevisionID, &page.Slug, &page.ParentID, &page.Position)
+	return page, err
+}
+
+// Restore brings an archived page back with a new title and revision, for
+// when a page is created where it was. The pages below it come back too.
+func (r *Repository) Restore(ctx context.Context, pageID int, title string, revision *models.Revision) error {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var revisionID int64
+	err = tx.QueryRowContext(ctx, "INSERT INTO revisions (page_id, author_id, comment, content) VALUES (?, ?, ?, ?) RETURNING id", pageID, revision.AuthorID, revision.Comment, revision.Content).Scan(&revisionID)
+	if err != nil {
+		return fmt.Errorf("error creating revision: %w", err)
+	}
+	result, err := tx.ExecContext(ctx, "UPDATE pages SET archived_at = NULL, title = ?, current_revision_id = ? WHERE id = ? AND archived_at IS NOT NULL", title, revisionID, pageID)
+	if err != nil {
+		return fmt.Errorf("error restoring page: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	revision.ID = int(revisionID)
+	r.publish(events.Event{Type: events.PageRevised, ActorID: revision.AuthorID, PageID: pageID, RevisionID: revision.ID})
+	return nil
+}
+
+// MoveAside gives an archived page a slug no other page can have, so that
+// its own can be used by another. It stays archived, with its history.
+func (r *Repository) MoveAside(pageID int) error {
+	// Slugs are made of letters, digits and hyphens, so no page is ever
+	// given one with a tilde.
+	result, err := r.DB.Exec("UPDATE pages SET slug = slug || '~' || CAST(id AS TEXT) WHERE id = ? AND archived_at IS NOT NULL", pageID)
+	if err != nil {
+		return fmt.Errorf("error moving archived page aside: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Delete archives a page on behalf of a user.
+func (r *Repository) Delete(pageID int, actorID int) error {
 	_, err := r.DB.Exec("UPDATE pages SET archived_at = ? WHERE id = ?", time.Now(), pageID)
+	if err == nil {
+		r.publish(events.Event{Type: events.PageArchived, ActorID: actorID, PageID: pageID})
+	}
 	return err
 }
 
+// publish publishes an event about a page, looking up its silo if needed.
+func (r *Repository) publish(e events.Event) {
+	if r.Events == nil {
+		return
+	}
+	if e.SiloID == 0 {
+		if err := r.DB.QueryRow("SELECT silo_id FROM pages WHERE id = ?", e.PageID).Scan(&e.SiloID); err != nil {
+			log.Printf("Error publishing %s event: %v", e.Type, err)
+			return
+		}
+	}
+	r.Events.Publish(e)
+}
+
 // ListRevisionsByPage lists all revisions for a given page.
 func (r *Repository) ListRevisionsByPage(pageID int) ([]viewmodels.RevisionViewModel, error) {
 	rows, err := r.DB.Query(`
-		SELECT r.id, r.created_at, r.comment, u.display_name
+		SELECT r.id, r.created_at, r.comment, u.display_name, u.username
 		FROM revisions r
 		JOIN users u ON r.author_id = u.id
 		WHERE r.page_id = ?
-		ORDER BY r.created_at DESC
+		ORDER BY r.created_at DESC, r.id DESC
 	`, pageID)
 	if err != nil {
 		return nil, err
@@ -179,7 +380,7 @@ func (r *Repository) ListRevisionsByPage(pageID int) ([]viewmodels.RevisionViewM
 	for rows.Next() {
 		var revision viewmodels.RevisionViewModel
 		var comment sql.NullString
-		if err := rows.Scan(&revision.ID, &revision.CreatedAt, &comment, &revision.Author); err != nil {
+		if err := rows.Scan(&revision.ID, &revision.CreatedAt, &comment, &revision.Author, &revision.AuthorUsername); err != nil {
 			return nil, err
 		}
 		if comment.Valid {
@@ -189,3 +390,35 @@ func (r *Repository) ListRevisionsByPage(pageID int) ([]viewmodels.RevisionViewM
 	}
 	return revisions, nil
 }
+
+// SiloUsage counts the pages and revisions of a silo.
+type SiloUsage struct {
+	SiloID       int
+	Pages        int
+	Revisions    int
+	ContentBytes int64 // The size of all revisions' content
+}
+
+// UsageBySilo returns the page and revision counts of every silo, keyed by silo ID.
+func (r *Repository) UsageBySilo() (map[int]SiloUsage, error) {
+	rows, err := r.DB.Query(`
+		SELECT p.silo_id, COUNT(DISTINCT p.id), COUNT(r.id), COALESCE(SUM(LENGTH(r.content)), 0)
+		FROM pages p
+		LEFT JOIN revisions r ON r.page_id = p.id
+		GROUP BY p.silo_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := make(map[int]SiloUsage)
+	for rows.Next() {
+		var u SiloUsage
+		if err := rows.Scan(&u.SiloID, &u.Pages, &u.Revisions, &u.ContentBytes); err != nil {
+			return nil, err
+		}
+		usage[u.SiloID] = u
+	}
+	return usage, rows.Err()
+}
@@ -0,0 +1,146 @@
+package page
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"sowing/internal/database"
+	"sowing/internal/web/viewmodels"
+)
+
+// snippetRadius is how many bytes of content are shown either side of the
+// first match in a search result.
+const snippetRadius = 80
+
+// Search finds the pages of a silo whose title or current content match a
+// query, best matches first. PostgreSQL ranks pages with its full-text search;
+// SQLite matches the query as a substring, case-insensitively.
+func (r *Repository) Search(siloID int, query string, limit int) ([]viewmodels.SearchResultViewModel, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, nil
+	}
+
+	var sqlQuery string
+	var args []any
+	if database.DialectOf(r.DB) == database.Postgres {
+		sqlQuery = `
+			SELECT p.id, p.title, r.content
+			FROM pages p
+			JOIN revisions r ON r.id = p.current_revision_id
+			CROSS JOIN websearch_to_tsquery('english', ?) q
+			WHERE p.silo_id = ? AND p.archived_at IS NULL AND (p.search @@ q OR r.search @@ q)
+			ORDER BY ts_rank(p.search, q) * 2 + ts_rank(r.search, q) DESC, p.title
+			LIMIT ?`
+		args = []any{query, siloID, limit}
+	} else {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+		sqlQuery = `
+			SELECT p.id, p.title, r.content
+			FROM pages p
+			JOIN revisions r ON r.id = p.current_revision_id
+			WHERE p.silo_id = ? AND p.archived_at IS NULL
+				AND (p.title LIKE ? ESCAPE '\' OR r.content LIKE ? ESCAPE '\')
+			ORDER BY p.title LIKE ? ESCAPE '\' DESC, p.title
+			LIMIT ?`
+		args = []any{siloID, pattern, pattern, pattern, limit}
+	}
+
+	rows, err := r.DB.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []viewmodels.SearchResultViewModel
+	for rows.Next() {
+		var result viewmodels.SearchResultViewModel
+		var content string
+		if err := rows.Scan(&result.PageID, &result.Title, &content); err != nil {
+			return nil, err
+		}
+		result.Snippet = snippet(content, query)
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		if results[i].Path, err = r.GetPathByID(results[i].PageID); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// snippet returns the part of content around the first word of the query
+// found in it, or its beginning if none is found.
+func snippet(content, query string) string {
+	at := -1
+	for _, word := range strings.FieldsFunc(strings.Map(unicode.ToLower, query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if i := indexFold(content, word); i >= 0 && (at < 0 || i < at) {
+			at = i
+		}
+	}
+
+	start, end := 0, len(content)
+	if at > snippetRadius {
+		start = at - snippetRadius
+	}
+	if at < 0 {
+		at = 0
+	}
+	if at+snippetRadius < end {
+		end = at + snippetRadius
+	}
+	// Don't cut a character in half.
+	for start > 0 && !isRuneStart(content[start]) {
+		start--
+	}
+	for end < len(content) && !isRuneStart(content[end]) {
+		end++
+	}
+
+	text := strings.Join(strings.Fields(content[start:end]), " ")
+	if start > 0 {
+		text = "…" + text
+	}
+	if end < len(content) {
+		text += "…"
+	}
+	return text
+}
+
+// indexFold returns where word, which is in lower case, first appears in s
+// regardless of case, or -1. It compares s rune by rune rather than searching
+// a lower case copy, as some characters' lower case forms are a different
+// length in bytes, which would put the offset in the wrong place.
+func indexFold(s, word string) int {
+	for i := range s {
+		if hasPrefixFold(s[i:], word) {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasPrefixFold reports whether s begins with word, which is in lower case,
+// regardless of case.
+func hasPrefixFold(s, word string) bool {
+	for _, want := range word {
+		r, size := utf8.DecodeRuneInString(s)
+		if size == 0 || unicode.ToLower(r) != want {
+			return false
+		}
+		s = s[size:]
+	}
+	return true
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
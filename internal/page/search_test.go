@@ -0,0 +1,84 @@
+package page_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"sowing/internal/database/dbtest"
+	"sowing/internal/models"
+	"sowing/internal/page"
+	"sowing/internal/silo"
+)
+
+func TestSearch(t *testing.T) {
+	db := dbtest.Open(t)
+	var authorID int
+	if err := db.QueryRow("INSERT INTO users (username, display_name) VALUES (?, ?) RETURNING id", "alice", "Alice").Scan(&authorID); err != nil {
+		t.Fatal(err)
+	}
+	silos := silo.NewRepository(db)
+	for _, slug := range []string{"docs", "other"} {
+		if err := silos.Create(slug, slug, nil, authorID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	docs, _ := silos.FindBySlug("docs")
+	other, _ := silos.FindBySlug("other")
+
+	pages := page.NewRepository(db)
+	create := func(siloID int, parentID *int, slug, title, content string) int {
+		t.Helper()
+		p := &models.Page{SiloID: siloID, ParentID: parentID, Slug: slug, Title: title}
+		id, err := pages.Create(context.Background(), p, &models.Revision{AuthorID: authorID, Content: content})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(id)
+	}
+	deployment := create(docs.ID, nil, "deployment", "Deployment", "* Deployment\nWe deploy with Kubernetes clusters in two regions.")
+	kubernetes := create(docs.ID, &deployment, "kubernetes", "Kubernetes", "* Notes\nCluster upgrades happen monthly.")
+	create(docs.ID, nil, "cooking", "Cooking", "* Recipes\nBread and soup.")
+	archived := create(docs.ID, nil, "old-kubernetes", "Old Kubernetes", "* Gone")
+	if err := pages.Delete(archived, authorID); err != nil {
+		t.Fatal(err)
+	}
+	create(other.ID, nil, "kubernetes", "Kubernetes", "* Another silo")
+
+	results, err := pages.Search(docs.ID, "kubernetes", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range results {
+		got = append(got, r.Path)
+	}
+	if strings.Join(got, " ") != "deployment/kubernetes deployment" {
+		t.Fatalf("Search(kubernetes) paths = %v, want [deployment/kubernetes deployment]", got)
+	}
+	if results[0].PageID != kubernetes {
+		t.Errorf("first result is page %d, want %d", results[0].PageID, kubernetes)
+	}
+	if !strings.Contains(results[1].Snippet, "Kubernetes clusters") {
+		t.Errorf("snippet %q doesn't show the match", results[1].Snippet)
+	}
+
+	if results, err := pages.Search(docs.ID, "kubernetes", 1); err != nil || len(results) != 1 {
+		t.Errorf("Search with limit 1 = %d results, %v", len(results), err)
+	}
+	// Lower-casing these characters makes them longer, which mustn't move
+	// the snippet past the match, or past the end of the content.
+	create(other.ID, nil, "long-lower", "Long lower", strings.Repeat("Ⱥ", 200)+" needle İİ")
+	if results, err := pages.Search(other.ID, "needle", 10); err != nil || len(results) != 1 {
+		t.Errorf("Search(needle) = %d results, %v, want 1", len(results), err)
+	} else if !strings.HasSuffix(results[0].Snippet, "Ⱥ needle İİ") {
+		t.Errorf("snippet %q doesn't show the match", results[0].Snippet)
+	}
+
+	// Wildcards in the query match themselves, not everything.
+	for _, query := range []string{"%", "_", "  "} {
+		if results, err := pages.Search(docs.ID, query, 10); err != nil || len(results) != 0 {
+			t.Errorf("Search(%q) = %d results, %v, want none", query, len(results), err)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package page
+
+import "strings"
+
+// Slugify turns a title or file name into a page slug: lowercase letters and
+// digits, with everything else collapsed into single dashes.
+func Slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(s) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(c)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,44 @@
+package page
+
+import "sowing/internal/models"
+
+// BuildTree takes a flat list of pages (already sorted by position)
+// and organizes them into a hierarchical tree.
+func BuildTree(pages []models.Page) []*models.Page {
+	pageMap := make(map[int]*models.Page)
+	for i := range pages {
+		p := pages[i]
+		pageMap[p.ID] = &p
+	}
+
+	var rootPages []*models.Page
+	for _, p := range pages {
+		pageNode := pageMap[p.ID]
+		if pageNode.ParentID == nil {
+			rootPages = append(rootPages, pageNode)
+		} else {
+			parent, ok := pageMap[*pageNode.ParentID]
+			if ok {
+				parent.Children = append(parent.Children, pageNode)
+			}
+		}
+	}
+
+	var constructPath func(pages []*models.Page, basePath string)
+	constructPath = func(pages []*models.Page, basePath string) {
+		for _, page := range pages {
+			if basePath == "" {
+				page.Path = page.Slug
+			} else {
+				page.Path = basePath + "/" + page.Slug
+			}
+			if len(page.Children) > 0 {
+				constructPath(page.Children, page.Path)
+			}
+		}
+	}
+
+	constructPath(rootPages, "")
+
+	return rootPages
+}
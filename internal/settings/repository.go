@@ -0,0 +1,34 @@
+package settings
+
+import (
+	"database/sql"
+)
+
+// Repository provides access to the site-wide settings.
+type Repository struct {
+	DB *sql.DB
+}
+
+// NewRepository creates a new settings repository.
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{DB: db}
+}
+
+// Get returns the value of a setting, or fallback if it has not been set.
+func (r *Repository) Get(key, fallback string) (string, error) {
+	var value string
+	err := r.DB.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return fallback, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// Set stores the value of a setting.
+func (r *Repository) Set(key, value string) error {
+	_, err := r.DB.Exec("INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value", key, value)
+	return err
+}
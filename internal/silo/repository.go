@@ -4,12 +4,18 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sowing/internal/database"
+	"sowing/internal/events"
 	"sowing/internal/models"
+	"strings"
+	"time"
 )
 
 // Repository provides access to the silo storage.
 type Repository struct {
 	DB *sql.DB
+	// Events, if set, is told whenever a silo is created.
+	Events *events.Bus
 }
 
 // NewRepository creates a new silo repository.
@@ -17,37 +23,293 @@ func NewRepository(db *sql.DB) *Repository {
 	return &Repository{DB: db}
 }
 
+const siloColumns = "id, slug, name, archived_at, cover_image, home_page_id"
+
 // FindBySlug finds a silo by its slug.
 func (r *Repository) FindBySlug(slug string) (*models.Silo, error) {
-	var silo models.Silo
-	err := r.DB.QueryRow("SELECT id, slug, name FROM silos WHERE slug = ?", slug).Scan(&silo.ID, &silo.Slug, &silo.Name)
+	return scanSilo(r.DB.QueryRow("SELECT "+siloColumns+" FROM silos WHERE slug = ?", slug))
+}
+
+// FindByID finds a silo by its ID.
+func (r *Repository) FindByID(id int) (*models.Silo, error) {
+	return scanSilo(r.DB.QueryRow("SELECT "+siloColumns+" FROM silos WHERE id = ?", id))
+}
+
+// List lists all non-archived silos.
+func (r *Repository) List() ([]models.Silo, error) {
+	rows, err := r.DB.Query("SELECT " + siloColumns + " FROM silos WHERE archived_at IS NULL")
 	if err != nil {
 		return nil, err
 	}
-	return &silo, nil
+	defer rows.Close()
+	return scanSilos(rows)
 }
 
-// List lists all non-archived silos.
-func (r *Repository) List() ([]models.Silo, error) {
-	rows, err := r.DB.Query("SELECT id, slug, name, archived_at, cover_image FROM silos WHERE archived_at IS NULL")
+// ListAll lists all silos, including archived ones.
+func (r *Repository) ListAll() ([]models.Silo, error) {
+	rows, err := r.DB.Query("SELECT " + siloColumns + " FROM silos ORDER BY slug")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	return scanSilos(rows)
+}
 
+// ListOwnedBy lists the non-archived silos owned by a user.
+func (r *Repository) ListOwnedBy(userID int) ([]models.Silo, error) {
+	rows, err := r.DB.Query(`
+		SELECT s.id, s.slug, s.name, s.archived_at, s.cover_image, s.home_page_id
+		FROM silos s
+		JOIN silo_roles sr ON sr.silo_id = s.id
+		WHERE s.archived_at IS NULL AND sr.user_id = ? AND sr.role = ?`, userID, models.RoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSilos(rows)
+}
+
+func scanSilo(row *sql.Row) (*models.Silo, error) {
+	var silo models.Silo
+	if err := row.Scan(&silo.ID, &silo.Slug, &silo.Name, &silo.ArchivedAt, &silo.CoverImage, &silo.HomePageID); err != nil {
+		return nil, err
+	}
+	return &silo, nil
+}
+
+func scanSilos(rows *sql.Rows) ([]models.Silo, error) {
 	var silos []models.Silo
 	for rows.Next() {
 		var silo models.Silo
-		if err := rows.Scan(&silo.ID, &silo.Slug, &silo.Name, &silo.ArchivedAt, &silo.CoverImage); err != nil {
+		if err := rows.Scan(&silo.ID, &silo.Slug, &silo.Name, &silo.ArchivedAt, &silo.CoverImage, &silo.HomePageID); err != nil {
 			return nil, err
 		}
 		silos = append(silos, silo)
 	}
-	return silos, nil
+	return silos, rows.Err()
+}
+
+// Rename changes the name and slug of a silo. When the slug changes, the old
+// one is kept as a redirect so that existing links keep working.
+func (r *Repository) Rename(siloID int, name, slug string) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var oldSlug string
+	if err := tx.QueryRow("SELECT slug FROM silos WHERE id = ?", siloID).Scan(&oldSlug); err != nil {
+		return err
+	}
+	if slug != oldSlug {
+		if err := checkSlugFree(tx, slug); err != nil {
+			return err
+		}
+	}
+
+	// Another silo can still take the slug between the check and the update
+	// on PostgreSQL, where the transaction doesn't lock the table.
+	if _, err := tx.Exec("UPDATE silos SET name = ?, slug = ? WHERE id = ?", name, slug, siloID); err != nil {
+		if database.IsUniqueViolation(err) {
+			return ErrSlugTaken
+		}
+		return fmt.Errorf("error renaming silo: %w", err)
+	}
+	if slug != oldSlug {
+		// A redirect from the new slug would now be shadowed by the silo itself.
+		if _, err := tx.Exec("DELETE FROM silo_redirects WHERE old_slug = ?", slug); err != nil {
+			return fmt.Errorf("error removing redirect: %w", err)
+		}
+		if _, err := tx.Exec("INSERT INTO silo_redirects (old_slug, silo_id) VALUES (?, ?) ON CONFLICT(old_slug) DO UPDATE SET silo_id = excluded.silo_id", oldSlug, siloID); err != nil {
+			return fmt.Errorf("error recording redirect: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// FindRedirect finds the silo that used to be reachable under a slug.
+func (r *Repository) FindRedirect(oldSlug string) (*models.Silo, error) {
+	var siloID int
+	if err := r.DB.QueryRow("SELECT silo_id FROM silo_redirects WHERE old_slug = ?", oldSlug).Scan(&siloID); err != nil {
+		return nil, err
+	}
+	return r.FindByID(siloID)
+}
+
+// checkSlugFree returns ErrSlugTaken if a silo already uses the slug.
+func checkSlugFree(tx *sql.Tx, slug string) error {
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM silos WHERE slug = ?)", slug).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrSlugTaken
+	}
+	return nil
+}
+
+// SetHomePage makes a page the landing page of a silo. The page must belong
+// to the silo.
+func (r *Repository) SetHomePage(siloID, pageID int) error {
+	res, err := r.DB.Exec("UPDATE silos SET home_page_id = ? WHERE id = ? AND EXISTS (SELECT 1 FROM pages WHERE id = ? AND silo_id = ?)", pageID, siloID, pageID, siloID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetCoverImage replaces the cover image of a silo. A nil URL removes it.
+func (r *Repository) SetCoverImage(siloID int, coverImageURL *string) error {
+	_, err := r.DB.Exec("UPDATE silos SET cover_image = ? WHERE id = ?", coverImageURL, siloID)
+	return err
+}
+
+// Delete permanently deletes a silo with all of its pages, revisions,
+// attachments, roles, redirects, webhooks, watches and notifications. It
+// returns the names of the uploaded files that belonged to the silo, which the
+// caller should remove from disk.
+func (r *Repository) Delete(siloID int) ([]string, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var files []string
+	var coverImage sql.NullString
+	if err := tx.QueryRow("SELECT cover_image FROM silos WHERE id = ?", siloID).Scan(&coverImage); err != nil {
+		return nil, err
+	}
+	if coverImage.Valid {
+		files = append(files, strings.TrimPrefix(coverImage.String, "/uploads/"))
+	}
+
+	rows, err := tx.Query("SELECT unique_filename FROM attachments WHERE page_id IN (SELECT id FROM pages WHERE silo_id = ?)", siloID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		files = append(files, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statements := []string{
+		"DELETE FROM watch_emails WHERE watch_id IN (SELECT id FROM watches WHERE silo_id = ?)",
+		"DELETE FROM watches WHERE silo_id = ?",
+		"DELETE FROM notifications WHERE revision_id IN (SELECT r.id FROM revisions r JOIN pages p ON p.id = r.page_id WHERE p.silo_id = ?)",
+		"DELETE FROM attachments WHERE page_id IN (SELECT id FROM pages WHERE silo_id = ?)",
+		"DELETE FROM revisions WHERE page_id IN (SELECT id FROM pages WHERE silo_id = ?)",
+		// Pages refer to their parents, so unlink them before deleting.
+		"UPDATE pages SET parent_id = NULL WHERE silo_id = ?",
+		"DELETE FROM pages WHERE silo_id = ?",
+		"UPDATE invitations SET silo_id = NULL WHERE silo_id = ?",
+		"DELETE FROM silo_roles WHERE silo_id = ?",
+		"DELETE FROM silo_redirects WHERE silo_id = ?",
+		"DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE silo_id = ?)",
+		"DELETE FROM webhooks WHERE silo_id = ?",
+		"DELETE FROM silos WHERE id = ?",
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, siloID); err != nil {
+			return nil, fmt.Errorf("error deleting silo: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// HasRole reports whether a user holds a role in a silo.
+func (r *Repository) HasRole(siloID, userID int, role string) (bool, error) {
+	var exists bool
+	err := r.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM silo_roles WHERE silo_id = ? AND user_id = ? AND role = ?)", siloID, userID, role).Scan(&exists)
+	return exists, err
+}
+
+// SetArchived archives or unarchives a silo. Archived silos are hidden from the silo list.
+func (r *Repository) SetArchived(siloID int, archived bool) error {
+	var archivedAt *time.Time
+	if archived {
+		now := time.Now()
+		archivedAt = &now
+	}
+	_, err := r.DB.Exec("UPDATE silos SET archived_at = ? WHERE id = ?", archivedAt, siloID)
+	return err
+}
+
+// GrantRole gives a user a role in a silo, replacing any role they had.
+func (r *Repository) GrantRole(siloID, userID int, role string) error {
+	_, err := r.DB.Exec("INSERT INTO silo_roles (silo_id, user_id, role) VALUES (?, ?, ?) ON CONFLICT(silo_id, user_id) DO UPDATE SET role = excluded.role", siloID, userID, role)
+	return err
+}
+
+// RevokeRole removes a user's role in a silo.
+func (r *Repository) RevokeRole(siloID, userID int) error {
+	res, err := r.DB.Exec("DELETE FROM silo_roles WHERE silo_id = ? AND user_id = ?", siloID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListRoles lists the roles granted in a silo.
+func (r *Repository) ListRoles(siloID int) ([]models.SiloRole, error) {
+	rows, err := r.DB.Query("SELECT silo_id, user_id, role FROM silo_roles WHERE silo_id = ? ORDER BY user_id", siloID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []models.SiloRole
+	for rows.Next() {
+		var role models.SiloRole
+		if err := rows.Scan(&role.SiloID, &role.UserID, &role.Role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// ListRolesByUser lists the roles a user holds across all silos.
+func (r *Repository) ListRolesByUser(userID int) ([]models.SiloRole, error) {
+	rows, err := r.DB.Query("SELECT silo_id, user_id, role FROM silo_roles WHERE user_id = ? ORDER BY silo_id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []models.SiloRole
+	for rows.Next() {
+		var role models.SiloRole
+		if err := rows.Scan(&role.SiloID, &role.UserID, &role.Role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
 }
 
 // Create creates a new silo, a home page, and an initial revision in a transaction.
-func (r *Repository) Create(name, slug string, coverImageURL *string) error {
+// The creator becomes the silo's owner and the author of its home page.
+func (r *Repository) Create(name, slug string, coverImageURL *string, creatorID int) error {
 	ctx := context.Background()
 	tx, err := r.DB.BeginTx(ctx, nil)
 	if err != nil {
@@ -55,30 +317,53 @@ func (r *Repository) Create(name, slug string, coverImageURL *string) error {
 	}
 	defer tx.Rollback()
 
-	res, err := tx.ExecContext(ctx, "INSERT INTO silos (name, slug, cover_image) VALUES (?, ?, ?)", name, slug, coverImageURL)
+	if err := checkSlugFree(tx, slug); err != nil {
+		return err
+	}
+
+	var siloID int64
+	err = tx.QueryRowContext(ctx, "INSERT INTO silos (name, slug, cover_image) VALUES (?, ?, ?) RETURNING id", name, slug, coverImageURL).Scan(&siloID)
 	if err != nil {
+		if database.IsUniqueViolation(err) {
+			return ErrSlugTaken
+		}
 		return fmt.Errorf("error creating silo: %w", err)
 	}
-	siloID, _ := res.LastInsertId()
 
-	res, err = tx.ExecContext(ctx, "INSERT INTO pages (silo_id, slug, title, current_revision_id) VALUES (?, 'home', 'Home', -1)", siloID)
+	if _, err := tx.ExecContext(ctx, "DELETE FROM silo_redirects WHERE old_slug = ?", slug); err != nil {
+		return fmt.Errorf("error removing redirect: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO silo_roles (silo_id, user_id, role) VALUES (?, ?, ?)", siloID, creatorID, models.RoleOwner); err != nil {
+		return fmt.Errorf("error recording silo owner: %w", err)
+	}
+
+	var pageID int64
+	err = tx.QueryRowContext(ctx, "INSERT INTO pages (silo_id, slug, title, current_revision_id) VALUES (?, 'home', 'Home', -1) RETURNING id", siloID).Scan(&pageID)
 	if err != nil {
 		return fmt.Errorf("error creating home page: %w", err)
 	}
-	pageID, _ := res.LastInsertId()
 
 	initialContent := fmt.Sprintf("* Welcome to the %s Silo!", name)
-	// Assuming author_id 1 for system/initial creation
-	res, err = tx.ExecContext(ctx, "INSERT INTO revisions (page_id, author_id, comment, content) VALUES (?, 1, 'Initial creation', ?)", pageID, initialContent)
+	var revisionID int64
+	err = tx.QueryRowContext(ctx, "INSERT INTO revisions (page_id, author_id, comment, content) VALUES (?, ?, 'Initial creation', ?) RETURNING id", pageID, creatorID, initialContent).Scan(&revisionID)
 	if err != nil {
 		return fmt.Errorf("error creating initial revision: %w", err)
 	}
-	revisionID, _ := res.LastInsertId()
 
 	_, err = tx.ExecContext(ctx, "UPDATE pages SET current_revision_id = ? WHERE id = ?", revisionID, pageID)
 	if err != nil {
 		return fmt.Errorf("error updating page with revision ID: %w", err)
 	}
 
-	return tx.Commit()
+	_, err = tx.ExecContext(ctx, "UPDATE silos SET home_page_id = ? WHERE id = ?", pageID, siloID)
+	if err != nil {
+		return fmt.Errorf("error setting home page: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	r.Events.Publish(events.Event{Type: events.SiloCreated, SiloID: int(siloID), ActorID: creatorID, PageID: int(pageID), RevisionID: int(revisionID)})
+	return nil
 }
@@ -0,0 +1,154 @@
+package silo_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"sowing/internal/database/dbtest"
+	"sowing/internal/models"
+	"sowing/internal/page"
+	"sowing/internal/silo"
+)
+
+// setup opens a database with a user, alice, and a silo of hers, docs.
+func setup(t *testing.T) (*sql.DB, *silo.Repository, int, *models.Silo) {
+	t.Helper()
+	db := dbtest.Open(t)
+	var userID int
+	if err := db.QueryRow("INSERT INTO users (username, display_name) VALUES (?, ?) RETURNING id", "alice", "Alice").Scan(&userID); err != nil {
+		t.Fatal(err)
+	}
+	silos := silo.NewRepository(db)
+	if err := silos.Create("Docs", "docs", nil, userID); err != nil {
+		t.Fatal(err)
+	}
+	docs, err := silos.FindBySlug("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, silos, userID, docs
+}
+
+func TestRename(t *testing.T) {
+	_, silos, userID, docs := setup(t)
+	if err := silos.Create("Other", "other", nil, userID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := silos.Rename(docs.ID, "Docs", "other"); err != silo.ErrSlugTaken {
+		t.Errorf("Rename to a taken slug = %v, want ErrSlugTaken", err)
+	}
+
+	if err := silos.Rename(docs.ID, "Handbook", "handbook"); err != nil {
+		t.Fatal(err)
+	}
+	renamed, err := silos.FindBySlug("handbook")
+	if err != nil || renamed.ID != docs.ID || renamed.Name != "Handbook" {
+		t.Fatalf("FindBySlug(handbook) = %+v, %v", renamed, err)
+	}
+	if _, err := silos.FindBySlug("docs"); err != sql.ErrNoRows {
+		t.Errorf("FindBySlug(docs) = %v, want sql.ErrNoRows", err)
+	}
+	if redirected, err := silos.FindRedirect("docs"); err != nil || redirected.ID != docs.ID {
+		t.Errorf("FindRedirect(docs) = %+v, %v", redirected, err)
+	}
+
+	// Taking the old slug back replaces its redirect.
+	if err := silos.Rename(docs.ID, "Docs", "docs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := silos.FindRedirect("docs"); err != sql.ErrNoRows {
+		t.Errorf("FindRedirect(docs) after renaming back = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestSetArchivedAndCoverImage(t *testing.T) {
+	_, silos, _, docs := setup(t)
+
+	cover := "/uploads/cover.png"
+	if err := silos.SetCoverImage(docs.ID, &cover); err != nil {
+		t.Fatal(err)
+	}
+	if err := silos.SetArchived(docs.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	found, err := silos.FindByID(docs.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ArchivedAt == nil || found.CoverImage == nil || *found.CoverImage != cover {
+		t.Errorf("after archiving, silo = %+v", found)
+	}
+
+	if err := silos.SetCoverImage(docs.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := silos.SetArchived(docs.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := silos.FindByID(docs.ID); err != nil || found.ArchivedAt != nil || found.CoverImage != nil {
+		t.Errorf("after unarchiving, silo = %+v, %v", found, err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db, silos, userID, docs := setup(t)
+	cover := "/uploads/cover.png"
+	if err := silos.SetCoverImage(docs.ID, &cover); err != nil {
+		t.Fatal(err)
+	}
+	if err := silos.Rename(docs.ID, "Docs", "handbook"); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := page.NewRepository(db)
+	guide := &models.Page{SiloID: docs.ID, Slug: "guide", Title: "Guide"}
+	if _, err := pages.Create(context.Background(), guide, &models.Revision{AuthorID: userID, Content: "* Guide"}); err != nil {
+		t.Fatal(err)
+	}
+	child := &models.Page{SiloID: docs.ID, ParentID: &guide.ID, Slug: "setup", Title: "Setup"}
+	if _, err := pages.Create(context.Background(), child, &models.Revision{AuthorID: userID, Content: "* Setup"}); err != nil {
+		t.Fatal(err)
+	}
+	found, err := pages.FindByID(child.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revisionID := found.CurrentRevisionID
+
+	exec := func(query string, args ...any) int {
+		t.Helper()
+		var id int
+		if err := db.QueryRow(query+" RETURNING id", args...).Scan(&id); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return id
+	}
+	exec("INSERT INTO attachments (page_id, filename, unique_filename, mime_type, size) VALUES (?, ?, ?, ?, ?)", child.ID, "a.png", "stored.png", "image/png", 1)
+	watchID := exec("INSERT INTO watches (user_id, silo_id, page_id, token) VALUES (?, ?, ?, ?)", userID, docs.ID, child.ID, "token")
+	exec("INSERT INTO watch_emails (user_id, watch_id, revision_id) VALUES (?, ?, ?)", userID, watchID, revisionID)
+	exec("INSERT INTO notifications (user_id, revision_id) VALUES (?, ?)", userID, revisionID)
+	webhookID := exec("INSERT INTO webhooks (silo_id, url, secret) VALUES (?, ?, ?)", docs.ID, "https://example.com/hook", "secret")
+	exec("INSERT INTO webhook_deliveries (webhook_id, event, payload) VALUES (?, ?, ?)", webhookID, "page.created", "{}")
+
+	files, err := silos.Delete(docs.ID)
+	if err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if len(files) != 2 || files[0] != "cover.png" || files[1] != "stored.png" {
+		t.Errorf("Delete returned files %v, want [cover.png stored.png]", files)
+	}
+	if _, err := silos.FindByID(docs.ID); err != sql.ErrNoRows {
+		t.Errorf("FindByID after deleting = %v, want sql.ErrNoRows", err)
+	}
+	for _, table := range []string{"pages", "revisions", "attachments", "watches", "watch_emails", "notifications", "webhooks", "webhook_deliveries", "silo_roles", "silo_redirects"} {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("%d rows left in %s", count, table)
+		}
+	}
+}
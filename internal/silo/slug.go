@@ -0,0 +1,40 @@
+package silo
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+var (
+	// ErrInvalidSlug is returned for slugs that can't be used in a URL path segment.
+	ErrInvalidSlug = errors.New("slugs may only contain lowercase letters, digits, dashes and underscores")
+	// ErrReservedSlug is returned for slugs that would shadow one of Sowing's own pages.
+	ErrReservedSlug = errors.New("that slug is reserved")
+	// ErrSlugTaken is returned when another silo already uses a slug.
+	ErrSlugTaken = errors.New("another silo already uses that slug")
+)
+
+// ReservedSlugs are the first path segments of Sowing's own routes, which a
+// silo can't use as its slug.
+var ReservedSlugs = []string{
+	"admin", "api", "changes", "dav", "feeds", "login", "logout",
+	"notifications", "preview", "register", "reset-password", "settings",
+	"static", "unsubscribe", "upload", "uploads", "users",
+}
+
+// ValidateSlug checks that a slug can be used for a silo.
+func ValidateSlug(slug string) error {
+	if slug == "" {
+		return ErrInvalidSlug
+	}
+	for _, c := range slug {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return ErrInvalidSlug
+		}
+	}
+	if slices.Contains(ReservedSlugs, strings.ToLower(slug)) {
+		return ErrReservedSlug
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+// Package watch emails users about new revisions of the silos and pages they
+// watch. Revisions are queued in the database as they are saved and sent
+// together, a few minutes later or in an hourly or daily digest as each user
+// prefers.
+package watch
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+
+	"sowing/internal/events"
+	"sowing/internal/mailer"
+	"sowing/internal/models"
+	"sowing/internal/page"
+)
+
+// diffLines is how many changed lines an email shows for each revision.
+const diffLines = 40
+
+// SMTPConfig is the mail server emails are sent through.
+type SMTPConfig = mailer.Config
+
+// Notifier queues new revisions for the users watching them and emails them.
+type Notifier struct {
+	Watches *Repository
+	Pages   *page.Repository
+	DB      *sql.DB
+	SMTP    SMTPConfig
+	// BaseURL is the address users reach Sowing at, for the links in emails.
+	BaseURL string
+	// Batch is how long emails wait for more revisions to be sent with them,
+	// for users who are emailed immediately.
+	Batch time.Duration
+
+	wake chan struct{}
+	// retryAt is when to try again after the mail server failed.
+	retryAt time.Time
+}
+
+// NewNotifier creates a notifier. Its Handle method is subscribed to an event
+// bus, and Run sends what it queues.
+func NewNotifier(db *sql.DB, config SMTPConfig, baseURL string, batch time.Duration) *Notifier {
+	return &Notifier{
+		Watches: NewRepository(db),
+		Pages:   page.NewRepository(db),
+		DB:      db,
+		SMTP:    config,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Batch:   batch,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Handle queues new revisions for the users watching their pages.
+func (n *Notifier) Handle(e events.Event) {
+	if e.Type != events.PageCreated && e.Type != events.PageRevised {
+		return
+	}
+	queued, err := n.Watches.enqueue(e.SiloID, e.PageID, e.RevisionID, e.ActorID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if queued > 0 {
+		n.Notify()
+	}
+}
+
+// Notify wakes Run up to check for emails that are due.
+func (n *Notifier) Notify() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends queued emails until ctx is done, as they become due.
+func (n *Notifier) Run(ctx context.Context) {
+	for {
+		wait := n.sendDue(time.Now())
+
+		timer := time.NewTimer(min(max(wait, time.Second), time.Minute))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-n.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// delay is how long a user's emails wait after the first is queued.
+func (n *Notifier) delay(digest string) time.Duration {
+	switch digest {
+	case models.DigestHourly:
+		return time.Hour
+	case models.DigestDaily:
+		return 24 * time.Hour
+	}
+	return n.Batch
+}
+
+// sendDue emails the users whose emails are due, returning how long until
+// the next are.
+func (n *Notifier) sendDue(now time.Time) time.Duration {
+	if now.Before(n.retryAt) {
+		return n.retryAt.Sub(now)
+	}
+	users, err := n.Watches.queuedUsers()
+	if err != nil {
+		log.Printf("Error listing queued emails: %v", err)
+		return time.Minute
+	}
+
+	wait := time.Minute
+	for _, u := range users {
+		due := u.Oldest.Add(n.delay(u.Digest))
+		if due.After(now) {
+			wait = min(wait, due.Sub(now))
+			continue
+		}
+		if err := n.sendTo(u.UserID); err != nil {
+			log.Printf("Error emailing user %d: %v", u.UserID, err)
+			n.retryAt = now.Add(time.Minute)
+			return time.Minute
+		}
+	}
+	return wait
+}
+
+// sendTo emails a user the revisions queued for them, in one email.
+func (n *Notifier) sendTo(userID int) error {
+	emails, err := n.Watches.queuedEmails(userID)
+	if err != nil {
+		return err
+	}
+	ids := make([]int, len(emails))
+	for i, e := range emails {
+		ids[i] = e.ID
+	}
+
+	var recipient models.User
+	err = n.DB.QueryRow("SELECT id, display_name, email, status FROM users WHERE id = ?", userID).
+		Scan(&recipient.ID, &recipient.DisplayName, &recipient.Email, &recipient.Status)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	// Users who have removed their address, or can no longer sign in, since
+	// the revisions were queued aren't sent them.
+	if err == nil && recipient.Email != "" && recipient.Status == models.UserStatusActive && len(emails) > 0 {
+		msg, err := n.compose(&recipient, emails)
+		if err != nil {
+			return err
+		}
+		if err := n.SMTP.Deliver(recipient.Email, msg); err != nil {
+			// An email the server refuses would be refused every time, and
+			// retrying it would hold up everyone else's, so it is dropped.
+			var rejected *mailer.RejectedError
+			if !errors.As(err, &rejected) {
+				return err
+			}
+			log.Printf("Dropping %d emails to user %d: %v", len(emails), userID, err)
+		}
+	}
+	return n.Watches.dequeue(ids)
+}
+
+// compose writes the email telling a user about queued revisions.
+func (n *Notifier) compose(recipient *models.User, emails []queuedEmail) ([]byte, error) {
+	var body strings.Builder
+	fmt.Fprintf(&body, "Hello %s,\n", recipient.DisplayName)
+
+	var watches []models.Watch
+	for _, e := range emails {
+		verb := "edited"
+		link := fmt.Sprintf("%s/%s/diff/%s?from=%d&to=%d", n.BaseURL, e.Watch.SiloSlug, e.PagePath, e.PreviousRevisionID, e.RevisionID)
+		if e.PreviousRevisionID == 0 {
+			verb = "created"
+			link = n.BaseURL + "/" + e.Watch.SiloSlug + "/wiki/" + e.PagePath
+		}
+		fmt.Fprintf(&body, "\n%s %s %s in %s on %s:\n", e.Author, verb, e.PageTitle, e.Watch.SiloName, e.CreatedAt.UTC().Format("2 January 2006 at 15:04 MST"))
+		if e.Comment != "" {
+			fmt.Fprintf(&body, "\n    %s\n", e.Comment)
+		}
+
+		var previous string
+		if e.PreviousRevisionID != 0 {
+			var err error
+			if previous, err = n.Pages.GetRevisionContent(e.PreviousRevisionID); err != nil {
+				return nil, fmt.Errorf("error getting revision %d: %w", e.PreviousRevisionID, err)
+			}
+		}
+		content, err := n.Pages.GetRevisionContent(e.RevisionID)
+		if err != nil {
+			return nil, fmt.Errorf("error getting revision %d: %w", e.RevisionID, err)
+		}
+		if summary := page.SummariseDiff(previous, content, diffLines); len(summary.Lines) > 0 {
+			body.WriteString("\n" + strings.Join(summary.Lines, "\n") + "\n")
+		}
+		fmt.Fprintf(&body, "\n%s\n", link)
+
+		if !slices.ContainsFunc(watches, func(w models.Watch) bool { return w.ID == e.Watch.ID }) {
+			watches = append(watches, e.Watch)
+		}
+	}
+
+	body.WriteString("\n-- \n")
+	for _, w := range watches {
+		fmt.Fprintf(&body, "You are watching %s. To stop, visit:\n%s/unsubscribe/%s\n", w.Description(), n.BaseURL, w.Token)
+	}
+	fmt.Fprintf(&body, "To manage your watches and how often you're emailed, visit:\n%s/settings/watches\n", n.BaseURL)
+
+	subject := fmt.Sprintf("%d changes to pages you watch", len(emails))
+	if len(emails) == 1 {
+		e := emails[0]
+		verb := "edited"
+		if e.PreviousRevisionID == 0 {
+			verb = "created"
+		}
+		subject = fmt.Sprintf("[%s] %s was %s by %s", e.Watch.SiloName, e.PageTitle, verb, e.Author)
+	}
+
+	var headers [][2]string
+	if len(watches) == 1 {
+		headers = append(headers, [2]string{"List-Unsubscribe", "<" + n.BaseURL + "/unsubscribe/" + watches[0].Token + ">"})
+	}
+	return n.SMTP.Compose(mailer.Message{
+		To:      mail.Address{Name: recipient.DisplayName, Address: recipient.Email},
+		Subject: subject,
+		Body:    body.String(),
+		Headers: headers,
+	})
+}
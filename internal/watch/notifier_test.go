@@ -0,0 +1,157 @@
+package watch
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sowing/internal/database/dbtest"
+	"sowing/internal/models"
+	"sowing/internal/silo"
+)
+
+// smtpSink is a mail server that accepts messages for some recipients and
+// refuses others with the reply given for them.
+type smtpSink struct {
+	listener net.Listener
+	replies  map[string]string // RCPT replies by address; 250 if not given
+
+	mu       sync.Mutex
+	received map[string]string // Messages by recipient
+}
+
+func newSMTPSink(t *testing.T, replies map[string]string) *smtpSink {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	s := &smtpSink{listener: listener, replies: replies, received: map[string]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	c := textproto.NewConn(conn)
+	defer c.Close()
+	c.PrintfLine("220 sink ready")
+	var to string
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO", "MAIL", "RSET", "NOOP":
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			to = strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if reply, ok := s.replies[to]; ok {
+				c.PrintfLine("%s", reply)
+				to = ""
+				continue
+			}
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 Go ahead")
+			msg, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.received[to] = string(msg)
+			s.mu.Unlock()
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("502 Unknown command")
+		}
+	}
+}
+
+func TestSendDueSkipsRejectedRecipients(t *testing.T) {
+	db := dbtest.Open(t)
+	users := map[string]int{}
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		var id int
+		err := db.QueryRow("INSERT INTO users (username, display_name, email, status) VALUES (?, ?, ?, ?) RETURNING id",
+			name, name, name+"@example.com", models.UserStatusActive).Scan(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[name] = id
+	}
+	silos := silo.NewRepository(db)
+	if err := silos.Create("Docs", "docs", nil, users["alice"]); err != nil {
+		t.Fatal(err)
+	}
+	docs, err := silos.FindBySlug("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := newSMTPSink(t, map[string]string{
+		"carol@example.com": "550 No such user",
+		"dave@example.com":  "451 Try again later",
+	})
+	n := NewNotifier(db, SMTPConfig{Addr: sink.listener.Addr().String(), From: "Sowing <wiki@example.com>"}, "http://wiki.example", 0)
+
+	for _, name := range []string{"bob", "carol", "dave"} {
+		if _, err := n.Watches.Watch(users[name], docs.ID, nil, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pageID, err := n.Pages.Create(context.Background(), &models.Page{SiloID: docs.ID, Slug: "home", Title: "Home"},
+		&models.Revision{AuthorID: users["alice"], Content: "* Welcome"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	home, err := n.Pages.FindByID(int(pageID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Watches.enqueue(docs.ID, home.ID, home.CurrentRevisionID, users["alice"]); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Add(time.Minute)
+	n.sendDue(now)
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if msg := sink.received["bob@example.com"]; !strings.Contains(msg, "Home was created by alice") {
+		t.Errorf("bob was sent %q, want an email about Home", msg)
+	}
+	if len(sink.received) != 1 {
+		t.Errorf("emails were sent to %d addresses, want only bob's", len(sink.received))
+	}
+
+	// Carol's email was refused for good, so it is dropped, but Dave's server
+	// may accept it later.
+	queued, err := n.Watches.queuedUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 1 || queued[0].UserID != users["dave"] {
+		t.Errorf("queued users = %v, want only dave (%d)", queued, users["dave"])
+	}
+	if !n.retryAt.After(now) {
+		t.Errorf("retryAt = %v, want a retry after the temporary failure", n.retryAt)
+	}
+}
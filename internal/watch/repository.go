@@ -0,0 +1,356 @@
+package watch
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sowing/internal/models"
+	"sowing/internal/page"
+	"strings"
+	"time"
+)
+
+// Repository provides access to the watch storage.
+type Repository struct {
+	DB    *sql.DB
+	Pages *page.Repository
+}
+
+// NewRepository creates a new watch repository.
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{DB: db, Pages: page.NewRepository(db)}
+}
+
+const watchColumns = "w.id, w.user_id, w.silo_id, w.page_id, w.subtree, w.token, w.created_at, s.slug, s.name, COALESCE(p.title, '')"
+
+const watchJoins = "FROM watches w JOIN silos s ON s.id = w.silo_id LEFT JOIN pages p ON p.id = w.page_id"
+
+// Watch makes a user watch a silo, or a page if pageID isn't nil. A user has
+// one watch of each silo and page, so watching a page again only changes
+// whether the pages below it are watched too.
+func (r *Repository) Watch(userID, siloID int, pageID *int, subtree bool) (*models.Watch, error) {
+	if pageID == nil {
+		subtree = false
+	}
+	existing, err := r.Find(userID, siloID, pageID)
+	if err == nil {
+		if existing.Subtree != subtree {
+			if _, err := r.DB.Exec("UPDATE watches SET subtree = ? WHERE id = ?", subtree, existing.ID); err != nil {
+				return nil, fmt.Errorf("error updating watch: %w", err)
+			}
+			existing.Subtree = subtree
+		}
+		return existing, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	var id int
+	err = r.DB.QueryRow("INSERT INTO watches (user_id, silo_id, page_id, subtree, token, created_at) VALUES (?, ?, ?, ?, ?, ?) RETURNING id",
+		userID, siloID, pageID, subtree, hex.EncodeToString(b), time.Now()).Scan(&id)
+	if err != nil {
+		return nil, fmt.Errorf("error creating watch: %w", err)
+	}
+	return r.FindByID(id)
+}
+
+// FindByID finds a watch by its ID.
+func (r *Repository) FindByID(id int) (*models.Watch, error) {
+	return r.findOne("w.id = ?", id)
+}
+
+// FindByToken finds a watch by the token in its unsubscribe links.
+func (r *Repository) FindByToken(token string) (*models.Watch, error) {
+	return r.findOne("w.token = ?", token)
+}
+
+// Find finds a user's watch of a silo, or of a page if pageID isn't nil.
+func (r *Repository) Find(userID, siloID int, pageID *int) (*models.Watch, error) {
+	if pageID == nil {
+		return r.findOne("w.user_id = ? AND w.silo_id = ? AND w.page_id IS NULL", userID, siloID)
+	}
+	return r.findOne("w.user_id = ? AND w.silo_id = ? AND w.page_id = ?", userID, siloID, *pageID)
+}
+
+func (r *Repository) findOne(where string, args ...any) (*models.Watch, error) {
+	w, err := scanWatch(r.DB.QueryRow("SELECT "+watchColumns+" "+watchJoins+" WHERE "+where, args...))
+	if err != nil {
+		return nil, err
+	}
+	if err := r.findPath(w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// ListByUser lists a user's watches, by silo and then page.
+func (r *Repository) ListByUser(userID int) ([]models.Watch, error) {
+	rows, err := r.DB.Query("SELECT "+watchColumns+" "+watchJoins+" WHERE w.user_id = ? ORDER BY s.name, w.page_id IS NOT NULL, p.title", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var watches []models.Watch
+	for rows.Next() {
+		w, err := scanWatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		watches = append(watches, *w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range watches {
+		if err := r.findPath(&watches[i]); err != nil {
+			return nil, err
+		}
+	}
+	return watches, nil
+}
+
+// Delete deletes a watch and the emails queued for it.
+func (r *Repository) Delete(id int) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM watch_emails WHERE watch_id = ?", id); err != nil {
+		return fmt.Errorf("error deleting queued emails: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM watches WHERE id = ?", id); err != nil {
+		return fmt.Errorf("error deleting watch: %w", err)
+	}
+	return tx.Commit()
+}
+
+// Digest returns how often a user wants to be emailed.
+func (r *Repository) Digest(userID int) (string, error) {
+	var digest string
+	err := r.DB.QueryRow("SELECT digest FROM watch_preferences WHERE user_id = ?", userID).Scan(&digest)
+	if err == sql.ErrNoRows {
+		return models.DigestImmediate, nil
+	}
+	return digest, err
+}
+
+// SetDigest sets how often a user wants to be emailed.
+func (r *Repository) SetDigest(userID int, digest string) error {
+	_, err := r.DB.Exec(`
+		INSERT INTO watch_preferences (user_id, digest) VALUES (?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET digest = excluded.digest`, userID, digest)
+	if err != nil {
+		return fmt.Errorf("error saving digest setting: %w", err)
+	}
+	return nil
+}
+
+// enqueue queues a revision to be emailed to the users watching its page,
+// other than its author. Users without an email address, or who can't sign
+// in, aren't sent anything. Users watching the page in more than one way are
+// sent it once, for their closest watch.
+func (r *Repository) enqueue(siloID, pageID, revisionID, authorID int) (int, error) {
+	rows, err := r.DB.Query(`
+		WITH RECURSIVE ancestors (id, parent_id) AS (
+			SELECT id, parent_id FROM pages WHERE id = ?
+			UNION ALL
+			SELECT p.id, p.parent_id FROM pages p JOIN ancestors a ON p.id = a.parent_id
+		)
+		SELECT w.id, w.user_id
+		FROM watches w
+		JOIN users u ON u.id = w.user_id
+		WHERE w.silo_id = ? AND w.user_id != ? AND u.status = ? AND u.email != ''
+			AND (w.page_id IS NULL OR w.page_id = ? OR w.subtree AND w.page_id IN (SELECT id FROM ancestors))
+		ORDER BY w.page_id IS NULL, w.page_id != ?, w.id`,
+		pageID, siloID, authorID, models.UserStatusActive, pageID, pageID)
+	if err != nil {
+		return 0, fmt.Errorf("error finding watchers: %w", err)
+	}
+	type recipient struct{ watchID, userID int }
+	var recipients []recipient
+	seen := map[int]bool{}
+	for rows.Next() {
+		var rec recipient
+		if err := rows.Scan(&rec.watchID, &rec.userID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !seen[rec.userID] {
+			seen[rec.userID] = true
+			recipients = append(recipients, rec)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	for _, rec := range recipients {
+		_, err := r.DB.Exec("INSERT INTO watch_emails (user_id, watch_id, revision_id, created_at) VALUES (?, ?, ?, ?)",
+			rec.userID, rec.watchID, revisionID, now)
+		if err != nil {
+			return 0, fmt.Errorf("error queueing email: %w", err)
+		}
+	}
+	return len(recipients), nil
+}
+
+// queuedUser is a user with emails waiting to be sent.
+type queuedUser struct {
+	UserID int
+	Digest string
+	Oldest time.Time // When the first of their emails was queued
+}
+
+// queuedUsers lists the users with emails waiting to be sent.
+func (r *Repository) queuedUsers() ([]queuedUser, error) {
+	rows, err := r.DB.Query(`
+		SELECT e.user_id, COALESCE(p.digest, ?), e.created_at
+		FROM watch_emails e
+		LEFT JOIN watch_preferences p ON p.user_id = e.user_id
+		ORDER BY e.user_id, e.created_at`, models.DigestImmediate)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []queuedUser
+	for rows.Next() {
+		var u queuedUser
+		if err := rows.Scan(&u.UserID, &u.Digest, &u.Oldest); err != nil {
+			return nil, err
+		}
+		if len(users) == 0 || users[len(users)-1].UserID != u.UserID {
+			users = append(users, u)
+		}
+	}
+	return users, rows.Err()
+}
+
+// queuedEmail is a revision waiting to be emailed to a user.
+type queuedEmail struct {
+	ID                 int
+	Watch              models.Watch
+	RevisionID         int
+	PreviousRevisionID int // 0 if the revision created the page
+	PageTitle          string
+	PagePath           string
+	Author             string
+	Comment            string
+	CreatedAt          time.Time
+}
+
+// queuedEmails lists the revisions waiting to be emailed to a user, oldest
+// first.
+func (r *Repository) queuedEmails(userID int) ([]queuedEmail, error) {
+	rows, err := r.DB.Query(`
+		SELECT e.id, `+watchColumns+`,
+			e.revision_id, (SELECT MAX(id) FROM revisions WHERE page_id = rev.page_id AND id < rev.id),
+			rev.page_id, rp.title, u.display_name, COALESCE(rev.comment, ''), rev.created_at
+		`+watchJoins+`
+		JOIN watch_emails e ON e.watch_id = w.id
+		JOIN revisions rev ON rev.id = e.revision_id
+		JOIN pages rp ON rp.id = rev.page_id
+		JOIN users u ON u.id = rev.author_id
+		WHERE e.user_id = ?
+		ORDER BY rev.created_at, rev.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []queuedEmail
+	var pageIDs []int
+	for rows.Next() {
+		var e queuedEmail
+		var watchPageID sql.NullInt64
+		var previous sql.NullInt64
+		var pageID int
+		err := rows.Scan(&e.ID, &e.Watch.ID, &e.Watch.UserID, &e.Watch.SiloID, &watchPageID, &e.Watch.Subtree, &e.Watch.Token,
+			&e.Watch.CreatedAt, &e.Watch.SiloSlug, &e.Watch.SiloName, &e.Watch.PageTitle,
+			&e.RevisionID, &previous, &pageID, &e.PageTitle, &e.Author, &e.Comment, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if watchPageID.Valid {
+			id := int(watchPageID.Int64)
+			e.Watch.PageID = &id
+		}
+		e.PreviousRevisionID = int(previous.Int64)
+		emails = append(emails, e)
+		pageIDs = append(pageIDs, pageID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range emails {
+		if emails[i].PagePath, err = r.Pages.GetPathByID(pageIDs[i]); err != nil {
+			return nil, err
+		}
+		if err := r.findPath(&emails[i].Watch); err != nil {
+			return nil, err
+		}
+	}
+	return emails, nil
+}
+
+// dequeue removes emails that have been sent.
+func (r *Repository) dequeue(ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	_, err := r.DB.Exec("DELETE FROM watch_emails WHERE id IN ("+placeholders+")", args...)
+	return err
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanWatch(row scanner) (*models.Watch, error) {
+	var w models.Watch
+	var pageID sql.NullInt64
+	err := row.Scan(&w.ID, &w.UserID, &w.SiloID, &pageID, &w.Subtree, &w.Token, &w.CreatedAt, &w.SiloSlug, &w.SiloName, &w.PageTitle)
+	if err != nil {
+		return nil, err
+	}
+	if pageID.Valid {
+		id := int(pageID.Int64)
+		w.PageID = &id
+	}
+	return &w, nil
+}
+
+// findPath sets the path of a watched page. It isn't scanned with the watch
+// because finding it takes more queries.
+func (r *Repository) findPath(w *models.Watch) error {
+	if w.PageID == nil {
+		return nil
+	}
+	path, err := r.Pages.GetPathByID(*w.PageID)
+	if err != nil {
+		return fmt.Errorf("error finding watched page: %w", err)
+	}
+	w.PagePath = path
+	return nil
+}
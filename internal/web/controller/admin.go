@@ -0,0 +1,453 @@
+package controller
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sowing/internal/attachment"
+	"sowing/internal/audit"
+	"sowing/internal/auth"
+	"sowing/internal/models"
+	"sowing/internal/page"
+	"sowing/internal/silo"
+	"sowing/internal/web/viewmodels"
+)
+
+// adminResetValidFor is how long password reset links issued from the admin
+// console can be used.
+const adminResetValidFor = 24 * time.Hour
+
+// Admin provides handlers for site administration. All of its routes are
+// served behind the admin middleware, so handlers can assume the current
+// user is an administrator.
+type Admin struct {
+	AuthService    *auth.Service
+	SiloRepo       *silo.Repository
+	PageRepo       *page.Repository
+	AttachmentRepo *attachment.Repository
+	AuditRepo      *audit.Repository
+	DB             *sql.DB
+	// BaseURL is the address users reach Sowing at, for password reset links.
+	BaseURL   string
+	Templates map[string]*template.Template
+}
+
+// Register registers the admin routes
+func (a *Admin) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/{$}", a.index)
+
+	mux.HandleFunc("GET /admin/users", a.users)
+	mux.HandleFunc("GET /admin/users/{userID}", a.user)
+	mux.HandleFunc("POST /admin/users/{userID}/disable", a.disableUser)
+	mux.HandleFunc("POST /admin/users/{userID}/enable", a.enableUser)
+	mux.HandleFunc("POST /admin/users/{userID}/admin", a.setUserAdmin)
+	mux.HandleFunc("POST /admin/users/{userID}/delete", a.deleteUser)
+	mux.HandleFunc("POST /admin/users/{userID}/reset-password", a.resetPassword)
+	mux.HandleFunc("POST /admin/users/{userID}/reset-2fa", a.resetTwoFactor)
+	mux.HandleFunc("POST /admin/users/{userID}/unlock", a.unlockUser)
+	mux.HandleFunc("POST /admin/users/{userID}/revoke-sessions", a.revokeUserSessions)
+	mux.HandleFunc("POST /admin/users/{userID}/approve", a.approveUser)
+	mux.HandleFunc("POST /admin/users/{userID}/reject", a.rejectUser)
+
+	mux.HandleFunc("GET /admin/silos", a.silos)
+	mux.HandleFunc("POST /admin/silos/{siloID}/rename", a.renameSilo)
+	mux.HandleFunc("POST /admin/silos/{siloID}/archive", a.archiveSilo)
+	mux.HandleFunc("POST /admin/silos/{siloID}/unarchive", a.unarchiveSilo)
+	mux.HandleFunc("POST /admin/silos/{siloID}/owners", a.addSiloOwner)
+	mux.HandleFunc("POST /admin/silos/{siloID}/owners/{userID}/revoke", a.revokeSiloOwner)
+
+	mux.HandleFunc("GET /admin/sessions", a.sessions)
+	mux.HandleFunc("POST /admin/sessions/{sessionID}/revoke", a.revokeSession)
+	mux.HandleFunc("GET /admin/storage", a.storage)
+	mux.HandleFunc("GET /admin/audit", a.audit)
+
+	mux.HandleFunc("GET /admin/registrations", a.registrations)
+	mux.HandleFunc("POST /admin/registrations/policy", a.updatePolicy)
+}
+
+func (a *Admin) index(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+func (a *Admin) users(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+
+	users, err := a.AuthService.Repo.ListUsers()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	data := viewmodels.PageData{
+		Users:       users,
+		ShowSidebar: false,
+		CurrentUser: user,
+		IsLoggedIn:  true,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = a.Templates["admin_users.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Admin) user(w http.ResponseWriter, r *http.Request) {
+	target, ok := a.findUser(w, r)
+	if !ok {
+		return
+	}
+	a.renderUser(w, r, target, "", "")
+}
+
+func (a *Admin) disableUser(w http.ResponseWriter, r *http.Request) {
+	target, ok := a.findUser(w, r)
+	if !ok || a.refuseSelf(w, r, target, "You cannot disable your own account.") {
+		return
+	}
+
+	if err := a.AuthService.DisableUser(target.ID); err != nil {
+		log.Printf("Error disabling user: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	a.AuditRepo.RecordRequest(r, "user.disable", target.Username, "")
+
+	http.Redirect(w, r, userAdminURL(target), http.StatusSeeOther)
+}
+
+func (a *Admin) enableUser(w http.ResponseWriter, r *http.Request) {
+	target, ok := a.findUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.AuthService.EnableUser(target.ID); err != nil {
+		log.Printf("Error enabling user: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	a.AuditRepo.RecordRequest(r, "user.enable", target.Username, "")
+
+	http.Redirect(w, r, userAdminURL(target), http.StatusSeeOther)
+}
+
+func (a *Admin) setUserAdmin(w http.ResponseWriter, r *http.Request) {
+	target, ok := a.findUser(w, r)
+	if !ok {
+		return
+	}
+	grant := r.FormValue("grant") == "true"
+	if !grant && a.refuseSelf(w, r, target, "You cannot remove your own administrator rights.") {
+		return
+	}
+
+	if err := a.AuthService.Repo.SetUserAdmin(target.ID, grant); err != nil {
+		log.Printf("Error changing administrator rights: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	action := "user.grant_admin"
+	if !grant {
+		action = "user.revoke_admin"
+	}
+	a.AuditRepo.RecordRequest(r, action, target.Username, "")
+
+	http.Redirect(w, r, userAdminURL(target), http.StatusSeeOther)
+}
+
+func (a *Admin) deleteUser(w http.ResponseWriter, r *http.Request) {
+	target, ok := a.findUser(w, r)
+	if !ok || a.refuseSelf(w, r, target, "You cannot delete your own account.") {
+		return
+	}
+
+	heir, err := a.AuthService.Repo.FindUserByUsername(strings.TrimSpace(r.FormValue("reassign_to")))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		a.renderUser(w, r, target, "", "Choose an existing user to take over the revisions and invitations of the deleted user.")
+		return
+	}
+	if heir.ID == target.ID {
+		w.WriteHeader(http.StatusBadRequest)
+		a.renderUser(w, r, target, "", "Revisions cannot be reassigned to the user being deleted.")
+		return
+	}
+
+	if err := a.AuthService.Repo.DeleteUser(target.ID, heir.ID); err != nil {
+		log.Printf("Error deleting user: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	a.AuditRepo.RecordRequest(r, "user.delete", target.Username, "reassigned to "+heir.Username)
+
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+func (a *Admin) resetPassword(w http.ResponseWriter, r *http.Request) {
+	target, ok := a.findUser(w, r)
+	if !ok {
+		return
+	}
+
+	token, err := a.AuthService.CreatePasswordReset(target.ID, adminResetValidFor)
+	if err != nil {
+		log.Printf("Error creating password reset: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	a.AuditRepo.RecordRequest(r, "user.reset_password", target.Username, "")
+
+	a.renderUser(w, r, target, a.BaseURL+"/reset-password?token="+token, "")
+}
+
+func (a *Admin) resetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	target, ok := a.findUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.AuthService.Repo.DeleteTOTP(target.ID); err != nil {
+		log.Printf("Error resetting two-factor authentication: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	a.AuditRepo.RecordRequest(r, "user.reset_2fa", target.Username, "")
+
+	http.Redirect(w, r, userAdminURL(target), http.StatusSeeOther)
+}
+
+func (a *Admin) unlockUser(w http.ResponseWriter, r *http.Request) {
+	target, ok := a.findUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.AuthService.Repo.DeleteLockout(target.Username); err != nil {
+		log.Printf("Error unlocking user: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	a.AuditRepo.RecordRequest(r, "user.unlock", target.Username, "")
+
+	http.Redirect(w, r, userAdminURL(target), http.StatusSeeOther)
+}
+
+func (a *Admin) revokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	target, ok := a.findUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Keep the admin's own session when they sign themselves out elsewhere.
+	revoked, err := a.AuthService.Repo.DeleteUserSessions(target.ID, a.AuthService.CurrentSessionHash(r))
+	if err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	a.AuditRepo.RecordRequest(r, "user.revoke_sessions", target.Username, fmt.Sprintf("%d sessions", revoked))
+
+	http.Redirect(w, r, userAdminURL(target), http.StatusSeeOther)
+}
+
+func (a *Admin) approveUser(w http.ResponseWriter, r *http.Request) {
+	target, ok := a.findUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.AuthService.EnableUser(target.ID); err != nil {
+		log.Printf("Error approving user: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	a.AuditRepo.RecordRequest(r, "user.approve", target.Username, "")
+
+	http.Redirect(w, r, "/admin/registrations", http.StatusSeeOther)
+}
+
+func (a *Admin) rejectUser(w http.ResponseWriter, r *http.Request) {
+	target, ok := a.findUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.AuthService.Repo.DeletePendingUser(target.ID); err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Error rejecting user: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	a.AuditRepo.RecordRequest(r, "user.reject", target.Username, "")
+
+	http.Redirect(w, r, "/admin/registrations", http.StatusSeeOther)
+}
+
+func (a *Admin) registrations(w http.ResponseWriter, r *http.Request) {
+	a.renderRegistrations(w, r, "")
+}
+
+func (a *Admin) updatePolicy(w http.ResponseWriter, r *http.Request) {
+	policy := auth.RegistrationPolicy{
+		Mode:           r.FormValue("mode"),
+		AllowedDomains: auth.ParseDomains(r.FormValue("allowed_domains")),
+	}
+	if err := a.AuthService.SetRegistrationPolicy(policy); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		a.renderRegistrations(w, r, err.Error())
+		return
+	}
+	a.AuditRepo.RecordRequest(r, "registration.policy", policy.Mode, strings.Join(policy.AllowedDomains, ", "))
+
+	http.Redirect(w, r, "/admin/registrations", http.StatusSeeOther)
+}
+
+// renderRegistrations shows the registration policy and the queue of users
+// awaiting approval.
+func (a *Admin) renderRegistrations(w http.ResponseWriter, r *http.Request, errMsg string) {
+	user, _ := r.Context().Value("user").(*models.User)
+
+	policy, err := a.AuthService.RegistrationPolicy()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	pending, err := a.AuthService.Repo.ListUsersByStatus(models.UserStatusPending)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	data := viewmodels.PageData{
+		Registration: viewmodels.RegistrationViewModel{
+			Mode:           policy.Mode,
+			Modes:          auth.RegistrationModes,
+			AllowedDomains: strings.Join(policy.AllowedDomains, ", "),
+		},
+		PendingUsers: pending,
+		Error:        errMsg,
+		ShowSidebar:  false,
+		CurrentUser:  user,
+		IsLoggedIn:   true,
+		CSRFToken:    csrfToken(r),
+	}
+
+	err = a.Templates["admin_registrations.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// renderUser shows everything known about a user, along with the actions an
+// administrator can take on the account.
+func (a *Admin) renderUser(w http.ResponseWriter, r *http.Request, target *models.User, resetURL, errMsg string) {
+	user, _ := r.Context().Value("user").(*models.User)
+
+	vm := viewmodels.AdminUserViewModel{
+		User:      *target,
+		TwoFactor: a.AuthService.TOTPEnabled(target.ID),
+	}
+
+	var err error
+	if vm.Identities, err = a.AuthService.Repo.ListIdentitiesByUser(target.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if vm.Sessions, err = a.AuthService.Repo.ListSessionsByUser(target.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if vm.Tokens, err = a.AuthService.Repo.ListAPITokensByUser(target.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if lockout, err := a.AuthService.Repo.FindLockout(target.Username); err == nil {
+		vm.Lockout = lockout
+	}
+
+	roles, err := a.SiloRepo.ListRolesByUser(target.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	for _, role := range roles {
+		s, err := a.SiloRepo.FindByID(role.SiloID)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		vm.Roles = append(vm.Roles, viewmodels.SiloRoleViewModel{Silo: *s, UserID: target.ID, Username: target.Username, Role: role.Role})
+	}
+
+	data := viewmodels.PageData{
+		AdminUser:   vm,
+		ResetURL:    resetURL,
+		Error:       errMsg,
+		ShowSidebar: false,
+		CurrentUser: user,
+		IsLoggedIn:  true,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = a.Templates["admin_user.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// findUser looks up the user named by the request path, responding with 404
+// Not Found if there is no such user.
+func (a *Admin) findUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	userID, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	target, err := a.AuthService.Repo.FindUserByID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return nil, false
+		}
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return nil, false
+	}
+	return target, true
+}
+
+// refuseSelf responds with the given message and returns true when the target
+// is the administrator making the request. This keeps admins from locking
+// themselves out.
+func (a *Admin) refuseSelf(w http.ResponseWriter, r *http.Request, target *models.User, msg string) bool {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil || user.ID != target.ID {
+		return false
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	a.renderUser(w, r, target, "", msg)
+	return true
+}
+
+func userAdminURL(user *models.User) string {
+	return fmt.Sprintf("/admin/users/%d", user.ID)
+}
@@ -0,0 +1,213 @@
+package controller
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"sowing/internal/models"
+	"sowing/internal/silo"
+	"sowing/internal/web/viewmodels"
+)
+
+func (a *Admin) silos(w http.ResponseWriter, r *http.Request) {
+	a.renderSilos(w, r, "")
+}
+
+func (a *Admin) renameSilo(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.findSilo(w, r)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	slug := strings.TrimSpace(r.FormValue("slug"))
+	if name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		a.renderSilos(w, r, "Name is required.")
+		return
+	}
+	if err := silo.ValidateSlug(slug); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		a.renderSilos(w, r, err.Error())
+		return
+	}
+
+	if err := a.SiloRepo.Rename(s.ID, name, slug); err != nil {
+		if err == silo.ErrSlugTaken {
+			w.WriteHeader(http.StatusBadRequest)
+			a.renderSilos(w, r, err.Error())
+			return
+		}
+		log.Printf("Error renaming silo: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	a.AuditRepo.RecordRequest(r, "silo.rename", s.Slug, name+" ("+slug+")")
+
+	http.Redirect(w, r, "/admin/silos", http.StatusSeeOther)
+}
+
+func (a *Admin) archiveSilo(w http.ResponseWriter, r *http.Request) {
+	a.setSiloArchived(w, r, true)
+}
+
+func (a *Admin) unarchiveSilo(w http.ResponseWriter, r *http.Request) {
+	a.setSiloArchived(w, r, false)
+}
+
+func (a *Admin) setSiloArchived(w http.ResponseWriter, r *http.Request, archived bool) {
+	s, ok := a.findSilo(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.SiloRepo.SetArchived(s.ID, archived); err != nil {
+		log.Printf("Error archiving silo: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	action := "silo.archive"
+	if !archived {
+		action = "silo.unarchive"
+	}
+	a.AuditRepo.RecordRequest(r, action, s.Slug, "")
+
+	http.Redirect(w, r, "/admin/silos", http.StatusSeeOther)
+}
+
+func (a *Admin) addSiloOwner(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.findSilo(w, r)
+	if !ok {
+		return
+	}
+
+	owner, err := a.AuthService.Repo.FindUserByUsername(strings.TrimSpace(r.FormValue("username")))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		a.renderSilos(w, r, "There is no user with that username.")
+		return
+	}
+
+	if err := a.SiloRepo.GrantRole(s.ID, owner.ID, models.RoleOwner); err != nil {
+		log.Printf("Error granting silo role: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	a.AuditRepo.RecordRequest(r, "silo.grant_owner", s.Slug, owner.Username)
+
+	http.Redirect(w, r, "/admin/silos", http.StatusSeeOther)
+}
+
+func (a *Admin) revokeSiloOwner(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.findSilo(w, r)
+	if !ok {
+		return
+	}
+	owner, ok := a.findUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := a.SiloRepo.RevokeRole(s.ID, owner.ID); err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Error revoking silo role: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	a.AuditRepo.RecordRequest(r, "silo.revoke_owner", s.Slug, owner.Username)
+
+	http.Redirect(w, r, "/admin/silos", http.StatusSeeOther)
+}
+
+// renderSilos lists every silo, archived or not, with its owners and size.
+func (a *Admin) renderSilos(w http.ResponseWriter, r *http.Request, errMsg string) {
+	user, _ := r.Context().Value("user").(*models.User)
+
+	silos, err := a.adminSilos()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	data := viewmodels.PageData{
+		AdminSilos:  silos,
+		Error:       errMsg,
+		ShowSidebar: false,
+		CurrentUser: user,
+		IsLoggedIn:  true,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = a.Templates["admin_silos.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// adminSilos gathers the owners and page counts of all silos.
+func (a *Admin) adminSilos() ([]viewmodels.AdminSiloViewModel, error) {
+	silos, err := a.SiloRepo.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	usage, err := a.PageRepo.UsageBySilo()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []viewmodels.AdminSiloViewModel
+	for _, s := range silos {
+		vm := viewmodels.AdminSiloViewModel{
+			Silo:         s,
+			Pages:        usage[s.ID].Pages,
+			Revisions:    usage[s.ID].Revisions,
+			ContentBytes: usage[s.ID].ContentBytes,
+		}
+
+		roles, err := a.SiloRepo.ListRoles(s.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, role := range roles {
+			if role.Role != models.RoleOwner {
+				continue
+			}
+			owner, err := a.AuthService.Repo.FindUserByID(role.UserID)
+			if err != nil {
+				continue
+			}
+			vm.Owners = append(vm.Owners, viewmodels.SiloRoleViewModel{Silo: s, UserID: owner.ID, Username: owner.Username, Role: role.Role})
+		}
+		result = append(result, vm)
+	}
+	return result, nil
+}
+
+// findSilo looks up the silo named by the request path, responding with 404
+// Not Found if there is no such silo.
+func (a *Admin) findSilo(w http.ResponseWriter, r *http.Request) (*models.Silo, bool) {
+	siloID, err := strconv.Atoi(r.PathValue("siloID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	s, err := a.SiloRepo.FindByID(siloID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return nil, false
+		}
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return nil, false
+	}
+	return s, true
+}
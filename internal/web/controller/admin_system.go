@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"database/sql"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"sowing/internal/database"
+	"sowing/internal/models"
+	"sowing/internal/web/viewmodels"
+)
+
+// adminLogLimit is how many audit and login entries the audit page shows.
+const adminLogLimit = 200
+
+func (a *Admin) sessions(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+
+	sessions, err := a.AuthService.Repo.ListSessions()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	current := a.AuthService.CurrentSessionHash(r)
+	usernames := make(map[int]string)
+	var vms []viewmodels.SessionViewModel
+	for _, session := range sessions {
+		vm := viewmodels.SessionViewModel{Session: session, Current: session.TokenHash == current}
+		if session.UserID != nil {
+			if _, ok := usernames[*session.UserID]; !ok {
+				if owner, err := a.AuthService.Repo.FindUserByID(*session.UserID); err == nil {
+					usernames[owner.ID] = owner.Username
+				}
+			}
+			vm.Username = usernames[*session.UserID]
+		}
+		vms = append(vms, vm)
+	}
+
+	data := viewmodels.PageData{
+		Sessions:    vms,
+		ShowSidebar: false,
+		CurrentUser: user,
+		IsLoggedIn:  true,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = a.Templates["admin_sessions.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Admin) revokeSession(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := strconv.Atoi(r.PathValue("sessionID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := a.AuthService.Repo.DeleteSession(sessionID); err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Error revoking session: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	a.AuditRepo.RecordRequest(r, "session.revoke", strconv.Itoa(sessionID), "")
+
+	http.Redirect(w, r, "/admin/sessions", http.StatusSeeOther)
+}
+
+func (a *Admin) storage(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+
+	var storage viewmodels.StorageViewModel
+	var err error
+	if storage.DatabaseBytes, err = database.Size(a.DB); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if storage.Attachments, storage.AttachmentBytes, err = a.AttachmentRepo.Usage(); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if storage.Silos, err = a.adminSilos(); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	// Attachments are only recorded for uploads made from the editor, so the
+	// uploads directory is measured as well to include cover images.
+	err = filepath.WalkDir("uploads", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			storage.UploadFiles++
+			storage.UploadBytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error measuring uploads: %v", err)
+	}
+
+	data := viewmodels.PageData{
+		Storage:     storage,
+		ShowSidebar: false,
+		CurrentUser: user,
+		IsLoggedIn:  true,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = a.Templates["admin_storage.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Admin) audit(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+
+	entries, err := a.AuditRepo.List(adminLogLimit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	attempts, err := a.AuthService.Repo.ListLoginAttempts("", adminLogLimit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	data := viewmodels.PageData{
+		AuditLog:    entries,
+		LoginLog:    attempts,
+		ShowSidebar: false,
+		CurrentUser: user,
+		IsLoggedIn:  true,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = a.Templates["admin_audit.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
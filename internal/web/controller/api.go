@@ -0,0 +1,653 @@
+package controller
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sowing/internal/attachment"
+	"sowing/internal/models"
+	"sowing/internal/page"
+	"sowing/internal/silo"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// API provides the JSON API under /api/v1. It works on the same repositories
+// as the HTML handlers, and describes itself with an OpenAPI document
+// generated from its endpoints.
+type API struct {
+	SiloRepo       *silo.Repository
+	PageRepo       *page.Repository
+	AttachmentRepo *attachment.Repository
+}
+
+// apiEndpoint is a route of the API, and what the OpenAPI document says about it.
+type apiEndpoint struct {
+	method  string
+	pattern string
+	summary string
+	query   []string // Query parameters, all optional
+	request any      // The type of the JSON body, if it takes one
+	upload  bool     // Whether it takes a multipart form with a file instead
+	status  int      // The status of a successful response
+	// response is the type of a successful response's body, if it has one.
+	response any
+	handler  http.HandlerFunc
+}
+
+func (a *API) endpoints() []apiEndpoint {
+	return []apiEndpoint{
+		{method: "GET", pattern: "/api/v1/silos", summary: "List silos",
+			status: http.StatusOK, response: []apiSilo{}, handler: a.listSilos},
+		{method: "POST", pattern: "/api/v1/silos", summary: "Create a silo",
+			request: apiCreateSilo{}, status: http.StatusCreated, response: apiSilo{}, handler: a.createSilo},
+		{method: "GET", pattern: "/api/v1/silos/{siloSlug}/pages", summary: "Get a silo's page tree",
+			status: http.StatusOK, response: []apiPageNode{}, handler: a.pageTree},
+		{method: "POST", pattern: "/api/v1/silos/{siloSlug}/pages", summary: "Create a page",
+			request: apiCreatePage{}, status: http.StatusCreated, response: apiPage{}, handler: a.createPage},
+		{method: "GET", pattern: "/api/v1/silos/{siloSlug}/pages/{pagePath...}", summary: "Get a page by its path",
+			status: http.StatusOK, response: apiPage{}, handler: a.getPageByPath},
+		{method: "GET", pattern: "/api/v1/pages/{pageID}", summary: "Get a page",
+			status: http.StatusOK, response: apiPage{}, handler: a.getPage},
+		{method: "PUT", pattern: "/api/v1/pages/{pageID}", summary: "Save a new revision of a page",
+			request: apiUpdatePage{}, status: http.StatusOK, response: apiPage{}, handler: a.updatePage},
+		{method: "POST", pattern: "/api/v1/pages/{pageID}/move", summary: "Move or rename a page",
+			request: apiMovePage{}, status: http.StatusOK, response: apiPage{}, handler: a.movePage},
+		{method: "DELETE", pattern: "/api/v1/pages/{pageID}", summary: "Archive a page",
+			status: http.StatusNoContent, handler: a.archivePage},
+		{method: "GET", pattern: "/api/v1/pages/{pageID}/revisions", summary: "List a page's revisions, newest first",
+			status: http.StatusOK, response: []apiRevisionSummary{}, handler: a.listRevisions},
+		{method: "GET", pattern: "/api/v1/pages/{pageID}/diff", summary: "Diff two revisions of a page",
+			query: []string{"from", "to"}, status: http.StatusOK, response: []apiDiffChunk{}, handler: a.diff},
+		{method: "GET", pattern: "/api/v1/revisions/{revisionID}", summary: "Get a revision",
+			status: http.StatusOK, response: apiRevision{}, handler: a.getRevision},
+		{method: "POST", pattern: "/api/v1/attachments", summary: "Upload an attachment",
+			upload: true, status: http.StatusCreated, response: apiAttachment{}, handler: a.uploadAttachment},
+	}
+}
+
+// Register registers the API routes. The OpenAPI document is public; every
+// other route needs a signed-in user or an API token.
+func (a *API) Register(mux *http.ServeMux) {
+	for _, e := range a.endpoints() {
+		mux.HandleFunc(e.method+" "+e.pattern, requireAPIUser(e.handler))
+	}
+	mux.HandleFunc("GET /api/v1/openapi.json", a.openAPI)
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+	})
+}
+
+type apiSilo struct {
+	ID         int     `json:"id"`
+	Slug       string  `json:"slug"`
+	Name       string  `json:"name"`
+	CoverImage *string `json:"cover_image"`
+	HomePageID *int    `json:"home_page_id"`
+}
+
+type apiCreateSilo struct {
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
+type apiPageNode struct {
+	ID       int           `json:"id"`
+	Slug     string        `json:"slug"`
+	Title    string        `json:"title"`
+	Path     string        `json:"path"`
+	Children []apiPageNode `json:"children"`
+}
+
+type apiPage struct {
+	ID         int    `json:"id"`
+	Silo       string `json:"silo"`
+	ParentID   *int   `json:"parent_id"`
+	Slug       string `json:"slug"`
+	Title      string `json:"title"`
+	Path       string `json:"path"`
+	RevisionID int    `json:"revision_id"`
+	Content    string `json:"content"`
+}
+
+type apiCreatePage struct {
+	Slug     string `json:"slug"`
+	Title    string `json:"title"`
+	ParentID *int   `json:"parent_id"`
+	Content  string `json:"content"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type apiUpdatePage struct {
+	Content string `json:"content"`
+	Comment string `json:"comment,omitempty"`
+	// BaseRevisionID is the revision the content was edited from. If the
+	// page has changed since, the update fails rather than overwriting.
+	BaseRevisionID int `json:"base_revision_id,omitempty"`
+}
+
+type apiMovePage struct {
+	ParentID *int   `json:"parent_id"`
+	Slug     string `json:"slug"`
+}
+
+type apiRevisionSummary struct {
+	ID        int       `json:"id"`
+	Author    string    `json:"author"`
+	Comment   *string   `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type apiRevision struct {
+	ID        int       `json:"id"`
+	PageID    int       `json:"page_id"`
+	AuthorID  int       `json:"author_id"`
+	Comment   *string   `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+	Content   string    `json:"content"`
+}
+
+type apiDiffChunk struct {
+	Op   string `json:"op"` // "equal", "insert" or "delete"
+	Text string `json:"text"`
+}
+
+type apiAttachment struct {
+	Filename string `json:"filename"`
+	URL      string `json:"url"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func (a *API) listSilos(w http.ResponseWriter, r *http.Request) {
+	silos, err := a.SiloRepo.List()
+	if err != nil {
+		apiInternalError(w, err)
+		return
+	}
+	result := []apiSilo{}
+	for _, s := range silos {
+		result = append(result, newAPISilo(&s))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (a *API) createSilo(w http.ResponseWriter, r *http.Request) {
+	var req apiCreateSilo
+	if !readJSON(w, r, &req) {
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		writeAPIError(w, http.StatusBadRequest, "Name is required")
+		return
+	}
+	if err := silo.ValidateSlug(req.Slug); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, _ := r.Context().Value("user").(*models.User)
+	if err := a.SiloRepo.Create(req.Name, req.Slug, nil, user.ID); err != nil {
+		if err == silo.ErrSlugTaken {
+			writeAPIError(w, http.StatusConflict, err.Error())
+			return
+		}
+		apiInternalError(w, err)
+		return
+	}
+
+	created, err := a.SiloRepo.FindBySlug(req.Slug)
+	if err != nil {
+		apiInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAPISilo(created))
+}
+
+func (a *API) pageTree(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.findSilo(w, r)
+	if !ok {
+		return
+	}
+	pages, err := a.PageRepo.ListBySilo(s.ID)
+	if err != nil {
+		apiInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIPageNodes(page.BuildTree(pages)))
+}
+
+func (a *API) createPage(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.findSilo(w, r)
+	if !ok {
+		return
+	}
+	var req apiCreatePage
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Slug == "" || req.Slug != page.Slugify(req.Slug) {
+		writeAPIError(w, http.StatusBadRequest, "The slug must be lowercase letters, digits and dashes")
+		return
+	}
+	if strings.TrimSpace(req.Title) == "" {
+		req.Title = req.Slug
+	}
+
+	siblings, ok := a.checkDestination(w, s.ID, req.ParentID, req.Slug)
+	if !ok {
+		return
+	}
+	p := &models.Page{SiloID: s.ID, ParentID: req.ParentID, Slug: req.Slug, Title: req.Title}
+	for _, sibling := range siblings {
+		p.Position = max(p.Position, sibling.Position+1)
+	}
+
+	user, _ := r.Context().Value("user").(*models.User)
+	revision := &models.Revision{AuthorID: user.ID, Comment: &req.Comment, Content: req.Content}
+	id, err := a.PageRepo.Create(r.Context(), p, revision)
+	if err != nil {
+		apiInternalError(w, err)
+		return
+	}
+	a.writePage(w, http.StatusCreated, int(id))
+}
+
+func (a *API) getPageByPath(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.findSilo(w, r)
+	if !ok {
+		return
+	}
+	pg, err := a.PageRepo.FindByPath(s.ID, strings.Split(r.PathValue("pagePath"), "/"))
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusNotFound, "Page not found")
+		return
+	}
+	if err != nil {
+		apiInternalError(w, err)
+		return
+	}
+	a.writePage(w, http.StatusOK, pg.ID)
+}
+
+func (a *API) getPage(w http.ResponseWriter, r *http.Request) {
+	pg, ok := a.findPage(w, r)
+	if !ok {
+		return
+	}
+	a.writePage(w, http.StatusOK, pg.ID)
+}
+
+func (a *API) updatePage(w http.ResponseWriter, r *http.Request) {
+	pg, ok := a.findPage(w, r)
+	if !ok {
+		return
+	}
+	var req apiUpdatePage
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	user, _ := r.Context().Value("user").(*models.User)
+	revision := &models.Revision{AuthorID: user.ID, Comment: &req.Comment, Content: req.Content}
+	var err error
+	if req.BaseRevisionID != 0 {
+		err = a.PageRepo.CreateRevisionIf(r.Context(), revision, pg.ID, req.BaseRevisionID)
+	} else {
+		err = a.PageRepo.CreateRevision(r.Context(), revision, pg.ID)
+	}
+	if errors.Is(err, page.ErrStaleRevision) {
+		writeAPIError(w, http.StatusConflict, "The page has changed since that revision")
+		return
+	}
+	if err != nil {
+		apiInternalError(w, err)
+		return
+	}
+	a.writePage(w, http.StatusOK, pg.ID)
+}
+
+func (a *API) movePage(w http.ResponseWriter, r *http.Request) {
+	pg, ok := a.findPage(w, r)
+	if !ok {
+		return
+	}
+	var req apiMovePage
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Slug == "" {
+		req.Slug = pg.Slug
+	}
+	if req.Slug != page.Slugify(req.Slug) {
+		writeAPIError(w, http.StatusBadRequest, "The slug must be lowercase letters, digits and dashes")
+		return
+	}
+
+	// A page can't be moved below itself.
+	for id := req.ParentID; id != nil; {
+		if *id == pg.ID {
+			writeAPIError(w, http.StatusBadRequest, "A page can't be moved below itself")
+			return
+		}
+		ancestor, err := a.PageRepo.FindByID(*id)
+		if err != nil {
+			break
+		}
+		id = ancestor.ParentID
+	}
+
+	samePlace := req.Slug == pg.Slug && (req.ParentID == nil && pg.ParentID == nil ||
+		req.ParentID != nil && pg.ParentID != nil && *req.ParentID == *pg.ParentID)
+	if !samePlace {
+		if _, ok := a.checkDestination(w, pg.SiloID, req.ParentID, req.Slug); !ok {
+			return
+		}
+		user, _ := r.Context().Value("user").(*models.User)
+		if err := a.PageRepo.Move(pg.ID, req.ParentID, req.Slug, user.ID); err != nil {
+			apiInternalError(w, err)
+			return
+		}
+	}
+	a.writePage(w, http.StatusOK, pg.ID)
+}
+
+func (a *API) archivePage(w http.ResponseWriter, r *http.Request) {
+	pg, ok := a.findPage(w, r)
+	if !ok {
+		return
+	}
+	user, _ := r.Context().Value("user").(*models.User)
+	if err := a.PageRepo.Delete(pg.ID, user.ID); err != nil {
+		apiInternalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) listRevisions(w http.ResponseWriter, r *http.Request) {
+	pg, ok := a.findPage(w, r)
+	if !ok {
+		return
+	}
+	revisions, err := a.PageRepo.ListRevisionsByPage(pg.ID)
+	if err != nil {
+		apiInternalError(w, err)
+		return
+	}
+	result := []apiRevisionSummary{}
+	for _, rev := range revisions {
+		result = append(result, apiRevisionSummary{ID: rev.ID, Author: rev.Author, Comment: rev.Comment, CreatedAt: rev.CreatedAt})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (a *API) diff(w http.ResponseWriter, r *http.Request) {
+	pg, ok := a.findPage(w, r)
+	if !ok {
+		return
+	}
+
+	// Both revisions default to the current one, so that "from" alone
+	// shows what changed since a revision.
+	var contents [2]string
+	for i, param := range []string{"from", "to"} {
+		revisionID := pg.CurrentRevisionID
+		if value := r.URL.Query().Get(param); value != "" {
+			var err error
+			if revisionID, err = strconv.Atoi(value); err != nil {
+				writeAPIError(w, http.StatusBadRequest, "Invalid '"+param+"' revision")
+				return
+			}
+		}
+		rev, err := a.PageRepo.GetRevision(revisionID)
+		if err == sql.ErrNoRows || err == nil && rev.PageID != pg.ID {
+			writeAPIError(w, http.StatusNotFound, "The page has no revision "+strconv.Itoa(revisionID))
+			return
+		}
+		if err != nil {
+			apiInternalError(w, err)
+			return
+		}
+		contents[i] = rev.Content
+	}
+
+	dmp := diffmatchpatch.New()
+	diffs := dmp.DiffCleanupSemantic(dmp.DiffMain(contents[0], contents[1], true))
+	result := []apiDiffChunk{}
+	for _, d := range diffs {
+		op := "equal"
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			op = "insert"
+		case diffmatchpatch.DiffDelete:
+			op = "delete"
+		}
+		result = append(result, apiDiffChunk{Op: op, Text: d.Text})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (a *API) getRevision(w http.ResponseWriter, r *http.Request) {
+	revisionID, err := strconv.Atoi(r.PathValue("revisionID"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Revision not found")
+		return
+	}
+	rev, err := a.PageRepo.GetRevision(revisionID)
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusNotFound, "Revision not found")
+		return
+	}
+	if err != nil {
+		apiInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiRevision{
+		ID:        rev.ID,
+		PageID:    rev.PageID,
+		AuthorID:  rev.AuthorID,
+		Comment:   rev.Comment,
+		CreatedAt: rev.CreatedAt,
+		Content:   rev.Content,
+	})
+}
+
+func (a *API) uploadAttachment(w http.ResponseWriter, r *http.Request) {
+	saved, status, err := saveAttachment(r, a.AttachmentRepo)
+	if err != nil {
+		writeAPIError(w, status, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, apiAttachment{
+		Filename: saved.Filename,
+		URL:      "/uploads/" + saved.UniqueFilename,
+		MimeType: saved.MimeType,
+		Size:     saved.Size,
+	})
+}
+
+// findSilo looks up the silo named by the request path.
+func (a *API) findSilo(w http.ResponseWriter, r *http.Request) (*models.Silo, bool) {
+	s, err := a.SiloRepo.FindBySlug(r.PathValue("siloSlug"))
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusNotFound, "Silo not found")
+		return nil, false
+	}
+	if err != nil {
+		apiInternalError(w, err)
+		return nil, false
+	}
+	return s, true
+}
+
+// findPage looks up the page whose ID is in the request path.
+func (a *API) findPage(w http.ResponseWriter, r *http.Request) (*models.Page, bool) {
+	pageID, err := strconv.Atoi(r.PathValue("pageID"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "Page not found")
+		return nil, false
+	}
+	pg, err := a.PageRepo.FindByID(pageID)
+	if err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusNotFound, "Page not found")
+		return nil, false
+	}
+	if err != nil {
+		apiInternalError(w, err)
+		return nil, false
+	}
+	return &pg, true
+}
+
+// checkDestination checks that a page can be put under parentID with slug,
+// and returns the pages already there.
+func (a *API) checkDestination(w http.ResponseWriter, siloID int, parentID *int, slug string) ([]*models.Page, bool) {
+	pages, err := a.PageRepo.ListBySilo(siloID)
+	if err != nil {
+		apiInternalError(w, err)
+		return nil, false
+	}
+	siblings := page.BuildTree(pages)
+	path := slug
+	if parentID != nil {
+		parent, err := a.PageRepo.FindByID(*parentID)
+		if err != nil || parent.SiloID != siloID {
+			writeAPIError(w, http.StatusBadRequest, "The parent page isn't part of this silo")
+			return nil, false
+		}
+		parentPath, err := a.PageRepo.GetPathByID(parent.ID)
+		if err != nil {
+			apiInternalError(w, err)
+			return nil, false
+		}
+		// Pages below a deleted page are deleted too, and aren't in the tree.
+		node := findPageNode(siblings, parent.ID)
+		if node == nil {
+			writeAPIError(w, http.StatusBadRequest, "The parent page isn't part of this silo")
+			return nil, false
+		}
+		path = parentPath + "/" + slug
+		siblings = node.Children
+	}
+
+	// Archived pages keep their slugs, so this looks for any page at all.
+	if _, err := a.PageRepo.FindByPath(siloID, strings.Split(path, "/")); err != sql.ErrNoRows {
+		if err != nil {
+			apiInternalError(w, err)
+			return nil, false
+		}
+		writeAPIError(w, http.StatusConflict, "There is already a page at "+path)
+		return nil, false
+	}
+	return siblings, true
+}
+
+// writePage responds with a page as it is now.
+func (a *API) writePage(w http.ResponseWriter, status int, pageID int) {
+	pg, err := a.PageRepo.FindByID(pageID)
+	if err != nil {
+		apiInternalError(w, err)
+		return
+	}
+	s, err := a.SiloRepo.FindByID(pg.SiloID)
+	if err != nil {
+		apiInternalError(w, err)
+		return
+	}
+	path, err := a.PageRepo.GetPathByID(pg.ID)
+	if err != nil {
+		apiInternalError(w, err)
+		return
+	}
+	content, err := a.PageRepo.GetRevisionContent(pg.CurrentRevisionID)
+	if err != nil {
+		apiInternalError(w, err)
+		return
+	}
+	writeJSON(w, status, apiPage{
+		ID:         pg.ID,
+		Silo:       s.Slug,
+		ParentID:   pg.ParentID,
+		Slug:       pg.Slug,
+		Title:      pg.Title,
+		Path:       path,
+		RevisionID: pg.CurrentRevisionID,
+		Content:    content,
+	})
+}
+
+func findPageNode(pages []*models.Page, id int) *models.Page {
+	for _, p := range pages {
+		if p.ID == id {
+			return p
+		}
+		if found := findPageNode(p.Children, id); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func newAPISilo(s *models.Silo) apiSilo {
+	return apiSilo{ID: s.ID, Slug: s.Slug, Name: s.Name, CoverImage: s.CoverImage, HomePageID: s.HomePageID}
+}
+
+func newAPIPageNodes(pages []*models.Page) []apiPageNode {
+	nodes := []apiPageNode{}
+	for _, p := range pages {
+		nodes = append(nodes, apiPageNode{ID: p.ID, Slug: p.Slug, Title: p.Title, Path: p.Path, Children: newAPIPageNodes(p.Children)})
+	}
+	return nodes
+}
+
+// requireAPIUser refuses requests without a signed-in user or an API token.
+func requireAPIUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if user, _ := r.Context().Value("user").(*models.User); user == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, "Sign in or send an API token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// readJSON decodes a request's JSON body, responding with an error if it
+// can't.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRawSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, apiError{Error: message})
+}
+
+func apiInternalError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	writeAPIError(w, http.StatusInternalServerError, "Internal Server Error")
+}
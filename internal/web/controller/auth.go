@@ -1,39 +1,91 @@
 package controller
 
 import (
+	"errors"
+	"fmt"
 	"html/template"
 	"log"
+	"math"
 	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"time"
 
 	"sowing/internal/auth"
+	"sowing/internal/mailer"
+	"sowing/internal/models"
+	"sowing/internal/web/viewmodels"
 )
 
 // Auth provides auth handlers
 type Auth struct {
 	AuthService *auth.Service
-	Templates   map[string]*template.Template
+	// BaseURL is the address users reach Sowing at, for links in emails.
+	BaseURL string
+	// Mail sends email confirmation links. It is nil if Sowing can't send
+	// email, and then nobody can register by the domain of their address.
+	Mail      *mailer.Config
+	Templates map[string]*template.Template
 }
 
 // Register registers the auth routes
 func (a *Auth) Register(mux *http.ServeMux) {
 	mux.HandleFunc("GET /login", a.loginGet)
 	mux.HandleFunc("POST /login", a.loginPost)
-	mux.HandleFunc("GET /logout", a.logout)
+	mux.HandleFunc("GET /login/2fa", a.secondFactorGet)
+	mux.HandleFunc("POST /login/2fa", a.secondFactorPost)
+	mux.HandleFunc("POST /logout", a.logout)
 	mux.HandleFunc("GET /register", a.registerGet)
 	mux.HandleFunc("POST /register", a.registerPost)
+	mux.HandleFunc("GET /verify-email", a.verifyEmail)
+	mux.HandleFunc("GET /reset-password", a.resetPasswordGet)
+	mux.HandleFunc("POST /reset-password", a.resetPasswordPost)
 }
 
 func (a *Auth) loginGet(w http.ResponseWriter, r *http.Request) {
-	err := a.Templates["login.html"].ExecuteTemplate(w, "layout.html", nil)
-	if err != nil {
-		log.Println(err)
-	}
+	a.renderLogin(w, r, "", "")
 }
 
 func (a *Auth) loginPost(w http.ResponseWriter, r *http.Request) {
 	username := r.FormValue("username")
 	password := r.FormValue("password")
-	_, err := a.AuthService.Login(w, r, username, password)
+	user, err := a.AuthService.Login(w, r, username, password)
+	if errors.Is(err, auth.ErrSecondFactorRequired) {
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return
+	}
+	var throttled *auth.ThrottledError
+	if errors.As(err, &throttled) {
+		tooManyAttempts(w, throttled)
+		return
+	}
+	if errors.Is(err, auth.ErrAccountPending) {
+		http.Error(w, "Your account is awaiting approval by an administrator.", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, auth.ErrAccountDisabled) {
+		http.Error(w, "Your account has been disabled.", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, auth.ErrEmailNotVerified) {
+		// The user has proven who they are, so they may be sent a new link
+		// in case the last one expired or never arrived.
+		errMsg := "Confirm your email address with the link emailed to you before logging in."
+		if err := a.sendVerification(user); err != nil {
+			log.Printf("Error sending email confirmation: %v", err)
+		} else {
+			errMsg += " A new link has been sent to " + user.Email + "."
+		}
+		w.WriteHeader(http.StatusForbidden)
+		a.renderLogin(w, r, "", errMsg)
+		return
+	}
+	if errors.Is(err, auth.ErrSessionNotSaved) {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
@@ -41,28 +93,269 @@ func (a *Auth) loginPost(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
+func (a *Auth) renderLogin(w http.ResponseWriter, r *http.Request, notice, errMsg string) {
+	data := viewmodels.PageData{
+		Notice:    notice,
+		Error:     errMsg,
+		CSRFToken: csrfToken(r),
+	}
+
+	err := a.Templates["login.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Auth) secondFactorGet(w http.ResponseWriter, r *http.Request) {
+	if !a.AuthService.HasPendingSecondFactor(r) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	err := a.Templates["login_2fa.html"].ExecuteTemplate(w, "layout.html", viewmodels.PageData{CSRFToken: csrfToken(r)})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Auth) secondFactorPost(w http.ResponseWriter, r *http.Request) {
+	if !a.AuthService.HasPendingSecondFactor(r) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	_, err := a.AuthService.CompleteSecondFactor(w, r, r.FormValue("code"))
+	var throttled *auth.ThrottledError
+	if errors.As(err, &throttled) {
+		tooManyAttempts(w, throttled)
+		return
+	}
+	if errors.Is(err, auth.ErrSessionNotSaved) {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		err = a.Templates["login_2fa.html"].ExecuteTemplate(w, "layout.html", viewmodels.PageData{CSRFToken: csrfToken(r), Error: "Invalid authentication code"})
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
 func (a *Auth) logout(w http.ResponseWriter, r *http.Request) {
 	a.AuthService.Logout(w, r)
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func (a *Auth) registerGet(w http.ResponseWriter, r *http.Request) {
-	err := a.Templates["register.html"].ExecuteTemplate(w, "layout.html", nil)
+	a.renderRegister(w, r, r.URL.Query().Get("invite"), false, "")
+}
+
+func (a *Auth) registerPost(w http.ResponseWriter, r *http.Request) {
+	invitation := r.FormValue("invite")
+
+	// Addresses on an allowed domain only let people in once they are
+	// confirmed, which takes an email.
+	if invitation == "" && a.Mail == nil {
+		policy, err := a.AuthService.RegistrationPolicy()
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		if policy.Mode == auth.RegistrationDomain {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			a.renderRegister(w, r, "", false, "Registration is unavailable because Sowing can't send email. Ask an administrator to create an account for you.")
+			return
+		}
+	}
+
+	user, err := a.AuthService.RegisterUser(auth.Registration{
+		Username:    r.FormValue("username"),
+		DisplayName: r.FormValue("display_name"),
+		Email:       r.FormValue("email"),
+		Password:    r.FormValue("password"),
+		Invitation:  invitation,
+	})
+	switch {
+	case errors.Is(err, auth.ErrRegistrationClosed),
+		errors.Is(err, auth.ErrInvitationRequired),
+		errors.Is(err, auth.ErrEmailNotAllowed):
+		w.WriteHeader(http.StatusForbidden)
+		a.renderRegister(w, r, invitation, false, err.Error())
+		return
+	case errors.Is(err, auth.ErrUserExists),
+		errors.Is(err, auth.ErrInvalidRegistration),
+		errors.Is(err, auth.ErrWeakPassword),
+		errors.Is(err, auth.ErrInvalidEmail),
+		errors.Is(err, auth.ErrInvalidInvitation):
+		w.WriteHeader(http.StatusBadRequest)
+		a.renderRegister(w, r, invitation, false, err.Error())
+		return
+	case err != nil:
+		log.Printf("Error registering user: %v", err)
+		http.Error(w, "Registration failed", http.StatusInternalServerError)
+		return
+	}
+
+	if user.Status == models.UserStatusPending {
+		a.renderRegister(w, r, "", true, "")
+		return
+	}
+
+	if user.Status == models.UserStatusUnverified {
+		errMsg := ""
+		if err := a.sendVerification(user); err != nil {
+			log.Printf("Error sending email confirmation: %v", err)
+			errMsg = "Your account was created, but the email confirming your address couldn't be sent. Log in to send it again."
+		}
+		a.renderVerificationSent(w, r, user.Email, errMsg)
+		return
+	}
+
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+// sendVerification emails a new link confirming an unverified user's address.
+func (a *Auth) sendVerification(user *models.User) error {
+	if a.Mail == nil {
+		return errors.New("email is not set up")
+	}
+	raw, err := a.AuthService.CreateEmailVerification(user.ID)
+	if err != nil {
+		return err
+	}
+	return a.Mail.Send(mailer.Message{
+		To:      mail.Address{Name: user.DisplayName, Address: user.Email},
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nTo finish registering as %s, confirm your email address by visiting:\n%s/verify-email?token=%s\n\nThe link works for two days. If you didn't register, ignore this email.\n",
+			user.DisplayName, user.Username, a.BaseURL, url.QueryEscape(raw)),
+	})
+}
+
+// renderVerificationSent tells a new user to follow the link emailed to them.
+func (a *Auth) renderVerificationSent(w http.ResponseWriter, r *http.Request, email, errMsg string) {
+	data := viewmodels.PageData{
+		Registration: viewmodels.RegistrationViewModel{VerificationSentTo: email},
+		Error:        errMsg,
+	}
+
+	err := a.Templates["register.html"].ExecuteTemplate(w, "layout.html", data)
 	if err != nil {
 		log.Println(err)
 	}
 }
 
-func (a *Auth) registerPost(w http.ResponseWriter, r *http.Request) {
-	username := r.FormValue("username")
-	displayName := r.FormValue("display_name")
+func (a *Auth) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	err := a.AuthService.VerifyEmail(r.URL.Query().Get("token"))
+	if errors.Is(err, auth.ErrInvalidEmailVerification) {
+		w.WriteHeader(http.StatusBadRequest)
+		a.renderLogin(w, r, "", "The confirmation link is invalid, expired or already used. Log in to be sent a new one.")
+		return
+	}
+	if err != nil {
+		log.Printf("Error confirming email address: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	a.renderLogin(w, r, "Your email address is confirmed. You can log in now.", "")
+}
+
+// renderRegister shows the registration form as allowed by the registration
+// policy and the invitation, if any.
+func (a *Auth) renderRegister(w http.ResponseWriter, r *http.Request, invitation string, pending bool, errMsg string) {
+	policy, err := a.AuthService.RegistrationPolicy()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	registration := viewmodels.RegistrationViewModel{
+		Mode:    policy.Mode,
+		Pending: pending,
+	}
+	if invitation != "" && policy.Mode != auth.RegistrationDisabled {
+		found, err := a.AuthService.FindInvitation(invitation)
+		if err != nil {
+			errMsg = err.Error()
+		} else {
+			registration.Invitation = invitation
+			registration.InvitationEmail = found.Email
+		}
+	}
+
+	data := viewmodels.PageData{
+		Registration: registration,
+		Error:        errMsg,
+		CSRFToken:    csrfToken(r),
+	}
+
+	err = a.Templates["register.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *Auth) resetPasswordGet(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	errMsg := ""
+	if _, err := a.AuthService.FindPasswordReset(token); err != nil {
+		errMsg = err.Error()
+		token = ""
+	}
+	a.renderResetPassword(w, r, token, errMsg)
+}
+
+func (a *Auth) resetPasswordPost(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
 	password := r.FormValue("password")
+	if password != r.FormValue("confirm_password") {
+		w.WriteHeader(http.StatusBadRequest)
+		a.renderResetPassword(w, r, token, "The passwords do not match.")
+		return
+	}
 
-	_, err := a.AuthService.RegisterUser(w, r, username, displayName, password)
+	err := a.AuthService.ResetPassword(token, password)
+	if errors.Is(err, auth.ErrInvalidPasswordReset) {
+		w.WriteHeader(http.StatusBadRequest)
+		a.renderResetPassword(w, r, "", err.Error())
+		return
+	}
+	if errors.Is(err, auth.ErrWeakPassword) {
+		w.WriteHeader(http.StatusBadRequest)
+		a.renderResetPassword(w, r, token, err.Error())
+		return
+	}
 	if err != nil {
-		http.Error(w, "Registration failed", http.StatusInternalServerError)
+		log.Printf("Error resetting password: %v", err)
+		http.Error(w, "Internal Server Error", 500)
 		return
 	}
 
 	http.Redirect(w, r, "/login", http.StatusFound)
 }
+
+func (a *Auth) renderResetPassword(w http.ResponseWriter, r *http.Request, token, errMsg string) {
+	data := viewmodels.PageData{
+		ResetToken: token,
+		Error:      errMsg,
+		CSRFToken:  csrfToken(r),
+	}
+
+	err := a.Templates["reset_password.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// tooManyAttempts tells a throttled client when it may try to log in again.
+func tooManyAttempts(w http.ResponseWriter, throttled *auth.ThrottledError) {
+	seconds := int(math.Ceil(throttled.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("Too many failed login attempts. Try again in %s.", throttled.RetryAfter.Round(time.Second)), http.StatusTooManyRequests)
+}
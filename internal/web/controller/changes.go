@@ -0,0 +1,294 @@
+package controller
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"sowing/internal/models"
+	"sowing/internal/page"
+	"sowing/internal/silo"
+	"sowing/internal/web/viewmodels"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// changesLimit is how many revisions the recent changes pages list.
+	changesLimit = 100
+	// feedLimit is how many revisions a feed has.
+	feedLimit = 50
+	// feedDiffLines is how many changed lines a feed entry shows.
+	feedDiffLines = 20
+)
+
+// Changes provides the recent changes pages and the Atom feeds of changes
+type Changes struct {
+	PageRepo  *page.Repository
+	SiloRepo  *silo.Repository
+	Templates map[string]*template.Template
+	// BaseURL is the address users reach Sowing at, for links in feeds.
+	BaseURL string
+}
+
+// Register registers the recent changes pages
+func (c *Changes) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /changes", c.siteChanges)
+	mux.HandleFunc("GET /{siloSlug}/changes", c.siloChanges)
+}
+
+// RegisterFeeds registers the feeds, which are served under /feeds/ so that
+// feed readers can sign in with an API token.
+func (c *Changes) RegisterFeeds(mux *http.ServeMux) {
+	mux.HandleFunc("GET /feeds/changes.atom", c.siteFeed)
+	mux.HandleFunc("GET /feeds/{siloSlug}/changes.atom", c.siloFeed)
+	mux.HandleFunc("GET /feeds/{siloSlug}/history/{pagePath...}", c.pageFeed)
+}
+
+func (c *Changes) siteChanges(w http.ResponseWriter, r *http.Request) {
+	changes, err := c.PageRepo.RecentChanges(0, 0, changesLimit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(*models.User)
+	data := viewmodels.PageData{
+		Changes:     changes,
+		FeedURL:     "/feeds/changes.atom",
+		CurrentUser: user,
+		IsLoggedIn:  user != nil,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = c.Templates["changes.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (c *Changes) siloChanges(w http.ResponseWriter, r *http.Request) {
+	silo, err := c.SiloRepo.FindBySlug(r.PathValue("siloSlug"))
+	if err != nil {
+		siloNotFound(w, r, c.SiloRepo)
+		return
+	}
+
+	allSiloPages, err := c.PageRepo.ListBySilo(silo.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	changes, err := c.PageRepo.RecentChanges(silo.ID, 0, changesLimit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(*models.User)
+	data := viewmodels.PageData{
+		Silo:        *silo,
+		Changes:     changes,
+		FeedURL:     "/feeds/" + silo.Slug + "/changes.atom",
+		SiloPages:   buildPageTree(allSiloPages),
+		ShowSidebar: true,
+		CanManage:   canManageSilo(c.SiloRepo, user, silo),
+		CurrentUser: user,
+		IsLoggedIn:  user != nil,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = c.Templates["changes.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (c *Changes) siteFeed(w http.ResponseWriter, r *http.Request) {
+	changes, err := c.PageRepo.RecentChanges(0, 0, feedLimit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	c.writeFeed(w, r, "Sowing: Recent changes", "/changes", changes, true)
+}
+
+func (c *Changes) siloFeed(w http.ResponseWriter, r *http.Request) {
+	silo, err := c.SiloRepo.FindBySlug(r.PathValue("siloSlug"))
+	if err != nil || silo.ArchivedAt != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	changes, err := c.PageRepo.RecentChanges(silo.ID, 0, feedLimit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	c.writeFeed(w, r, silo.Name+": Recent changes", "/"+silo.Slug+"/changes", changes, false)
+}
+
+func (c *Changes) pageFeed(w http.ResponseWriter, r *http.Request) {
+	silo, err := c.SiloRepo.FindBySlug(r.PathValue("siloSlug"))
+	if err != nil || silo.ArchivedAt != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	pagePath := r.PathValue("pagePath")
+	page, err := c.PageRepo.FindByPath(silo.ID, strings.Split(pagePath, "/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	changes, err := c.PageRepo.RecentChanges(silo.ID, page.ID, feedLimit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	// Every page has a revision, so none means the page is archived.
+	if len(changes) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	c.writeFeed(w, r, silo.Name+": "+page.Title, "/"+silo.Slug+"/history/"+pagePath, changes, false)
+}
+
+// atomFeed is an Atom feed document, as described by RFC 4287.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Link    atomLink    `xml:"link"`
+	Content atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// writeFeed writes changes as an Atom feed. The page at htmlPath shows the
+// same changes. Entries are titled with their silo's name as well as their
+// page's if withSilo is set.
+func (c *Changes) writeFeed(w http.ResponseWriter, r *http.Request, title, htmlPath string, changes []viewmodels.ChangeViewModel, withSilo bool) {
+	base := c.BaseURL
+	feed := atomFeed{
+		ID:      base + r.URL.Path,
+		Title:   title,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: base + r.URL.Path},
+			{Rel: "alternate", Type: "text/html", Href: base + htmlPath},
+		},
+	}
+	if len(changes) > 0 {
+		feed.Updated = changes[0].CreatedAt.UTC().Format(time.RFC3339)
+	}
+
+	var revisionIDs []int
+	for _, change := range changes {
+		revisionIDs = append(revisionIDs, change.RevisionID)
+		if change.PreviousRevisionID != 0 {
+			revisionIDs = append(revisionIDs, change.PreviousRevisionID)
+		}
+	}
+	contents, err := c.PageRepo.GetRevisionContents(revisionIDs)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	for _, change := range changes {
+		feed.Entries = append(feed.Entries, feedEntry(base, change, contents, withSilo))
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		log.Println(err)
+	}
+}
+
+// feedEntry describes a revision in a feed, summarising what it changed.
+// contents holds the content of the revision and the one before it.
+func feedEntry(base string, change viewmodels.ChangeViewModel, contents map[int]string, withSilo bool) atomEntry {
+	pageURL := base + "/" + change.SiloSlug + "/wiki/" + change.Path
+	link := pageURL
+
+	content := contents[change.RevisionID]
+	var previous string
+	if change.PreviousRevisionID != 0 {
+		previous = contents[change.PreviousRevisionID]
+		link = fmt.Sprintf("%s/%s/diff/%s?from=%d&to=%d", base, change.SiloSlug, change.Path, change.PreviousRevisionID, change.RevisionID)
+	}
+	summary := page.SummariseDiff(previous, content, feedDiffLines)
+
+	var body strings.Builder
+	if change.Comment != nil && *change.Comment != "" {
+		fmt.Fprintf(&body, "<p>%s</p>", html.EscapeString(*change.Comment))
+	}
+	if change.PreviousRevisionID == 0 {
+		fmt.Fprintf(&body, "<p>Created <a href=\"%s\">%s</a> with %s.</p>", html.EscapeString(pageURL), html.EscapeString(change.Title), plural(summary.Added, "line"))
+	} else {
+		fmt.Fprintf(&body, "<p>%s added, %s removed. <a href=\"%s\">View the diff</a>.</p>", plural(summary.Added, "line"), plural(summary.Removed, "line"), html.EscapeString(link))
+	}
+	if len(summary.Lines) > 0 {
+		fmt.Fprintf(&body, "<pre>%s</pre>", html.EscapeString(strings.Join(summary.Lines, "\n")))
+	}
+
+	title := change.Title
+	if withSilo {
+		title = change.SiloName + ": " + title
+	}
+	return atomEntry{
+		// The API's address for the revision, which never changes.
+		ID:      base + "/api/v1/revisions/" + strconv.Itoa(change.RevisionID),
+		Title:   title,
+		Updated: change.CreatedAt.UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: change.Author},
+		Link:    atomLink{Rel: "alternate", Type: "text/html", Href: link},
+		Content: atomContent{Type: "html", Body: body.String()},
+	}
+}
+
+// plural formats a count of things, such as "1 line" or "3 lines".
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return strconv.Itoa(n) + " " + noun + "s"
+}
@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"sowing/internal/export"
+)
+
+// exportZip downloads a silo as a zip of .org files. The archive is built in
+// memory first so that a failure halfway through is reported as an error
+// rather than as a truncated download.
+func (p *Page) exportZip(w http.ResponseWriter, r *http.Request) {
+	silo, err := p.SiloRepo.FindBySlug(r.PathValue("siloSlug"))
+	if err != nil {
+		siloNotFound(w, r, p.SiloRepo)
+		return
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	now := time.Now()
+	_, err = export.Silo(p.PageRepo, silo, "uploads", func(name string, data []byte) error {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: path.Join(silo.Slug, name), Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Printf("Error exporting silo: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, silo.Slug))
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,193 @@
+package controller
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"sowing/internal/auth"
+	"sowing/internal/models"
+	"sowing/internal/silo"
+	"sowing/internal/web/viewmodels"
+)
+
+// Invitations provides handlers for inviting people to register.
+// Admins and silo owners may invite people.
+type Invitations struct {
+	AuthService *auth.Service
+	SiloRepo    *silo.Repository
+	// BaseURL is the address users reach Sowing at, for invitation links.
+	BaseURL   string
+	Templates map[string]*template.Template
+}
+
+// Register registers the invitation routes
+func (i *Invitations) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /settings/invitations", i.list)
+	mux.HandleFunc("POST /settings/invitations", i.create)
+	mux.HandleFunc("POST /settings/invitations/{invitationID}/revoke", i.revoke)
+}
+
+func (i *Invitations) list(w http.ResponseWriter, r *http.Request) {
+	i.render(w, r, "", "")
+}
+
+func (i *Invitations) create(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil || usedAPIToken(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	silos, err := i.invitableSilos(user)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if !user.IsAdmin && len(silos) == 0 {
+		http.Error(w, "Only administrators and silo owners can invite people", http.StatusForbidden)
+		return
+	}
+
+	// Silo owners invite people on behalf of one of their silos.
+	var siloID *int
+	if id, err := strconv.Atoi(r.FormValue("silo_id")); err == nil {
+		if !slices.ContainsFunc(silos, func(s models.Silo) bool { return s.ID == id }) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		siloID = &id
+	} else if !user.IsAdmin {
+		siloID = &silos[0].ID
+	}
+
+	days, _ := strconv.Atoi(r.FormValue("expires_in"))
+	if days <= 0 || days > 30 {
+		days = 7
+	}
+
+	raw, _, err := i.AuthService.CreateInvitation(user.ID, r.FormValue("email"), siloID, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		i.render(w, r, "", err.Error())
+		return
+	}
+
+	i.render(w, r, i.BaseURL+"/register?invite="+url.QueryEscape(raw), "")
+}
+
+func (i *Invitations) revoke(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil || usedAPIToken(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	invitationID, err := strconv.Atoi(r.PathValue("invitationID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Admins may revoke anyone's invitations.
+	createdBy := user.ID
+	if user.IsAdmin {
+		createdBy = 0
+	}
+	if err := i.AuthService.Repo.DeleteInvitation(invitationID, createdBy); err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Error revoking invitation: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/invitations", http.StatusSeeOther)
+}
+
+// render lists the user's invitations, or everyone's for admins.
+func (i *Invitations) render(w http.ResponseWriter, r *http.Request, inviteURL, errMsg string) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	silos, err := i.invitableSilos(user)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	createdBy := user.ID
+	if user.IsAdmin {
+		createdBy = 0
+	}
+	invitations, err := i.AuthService.Repo.ListInvitations(createdBy)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	siloNames := make(map[int]string)
+	for _, s := range silos {
+		siloNames[s.ID] = s.Name
+	}
+	usernames := make(map[int]string)
+	now := time.Now()
+	var invitationViewModels []viewmodels.InvitationViewModel
+	for _, invitation := range invitations {
+		vm := viewmodels.InvitationViewModel{Invitation: invitation, Status: "pending"}
+		if invitation.UsedAt != nil {
+			vm.Status = "used"
+		} else if now.After(invitation.ExpiresAt) {
+			vm.Status = "expired"
+		}
+		if invitation.SiloID != nil {
+			vm.SiloName = siloNames[*invitation.SiloID]
+		}
+		if _, ok := usernames[invitation.CreatedBy]; !ok {
+			if creator, err := i.AuthService.Repo.FindUserByID(invitation.CreatedBy); err == nil {
+				usernames[invitation.CreatedBy] = creator.Username
+			}
+		}
+		vm.CreatedByName = usernames[invitation.CreatedBy]
+		invitationViewModels = append(invitationViewModels, vm)
+	}
+
+	data := viewmodels.PageData{
+		Silos:       silos,
+		Invitations: invitationViewModels,
+		InviteURL:   inviteURL,
+		CanInvite:   user.IsAdmin || len(silos) > 0,
+		Error:       errMsg,
+		ShowSidebar: false,
+		CurrentUser: user,
+		IsLoggedIn:  true,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = i.Templates["invitations.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// invitableSilos returns the silos a user may invite people on behalf of:
+// every silo for admins, and the silos they own for everyone else.
+func (i *Invitations) invitableSilos(user *models.User) ([]models.Silo, error) {
+	if user.IsAdmin {
+		return i.SiloRepo.List()
+	}
+	return i.SiloRepo.ListOwnedBy(user.ID)
+}
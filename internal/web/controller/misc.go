@@ -1,8 +1,8 @@
 package controller
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,16 +11,18 @@ import (
 	"path/filepath"
 	"sowing/internal/attachment"
 	"sowing/internal/models"
+	"sowing/internal/notification"
 	"sowing/internal/web/renderer"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/niklasfasching/go-org/org"
 )
 
 // Misc provides miscellaneous handlers
 type Misc struct {
-	AttachmentRepo *attachment.Repository
+	AttachmentRepo   *attachment.Repository
+	NotificationRepo *notification.Repository
 }
 
 // Register registers the misc routes
@@ -37,7 +39,14 @@ func (m *Misc) preview(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	htmlContentString, err := org.New().Parse(strings.NewReader(string(body)), "").Write(renderer.NewHTMLWriterWithChroma())
+	mentioned, err := m.NotificationRepo.MentionedUsers(string(body))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	htmlContentString, err := org.New().Parse(strings.NewReader(string(body)), "").Write(renderer.NewHTMLWriterWithMentions(mentioned))
 	if err != nil {
 		log.Printf("Error converting org-mode content to HTML: %v", err)
 		http.Error(w, "Internal Server Error", 500)
@@ -49,50 +58,75 @@ func (m *Misc) preview(w http.ResponseWriter, r *http.Request) {
 }
 
 func (m *Misc) upload(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		http.Error(w, "The uploaded file is too big.", http.StatusBadRequest)
+	attachment, status, err := saveAttachment(r, m.AttachmentRepo)
+	if err != nil {
+		http.Error(w, err.Error(), status)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"url": "/uploads/%s"}`, attachment.UniqueFilename)
+}
+
+// saveAttachment stores the file uploaded in a request's "file" field and
+// records it as an attachment, for the page in the optional "page_id" field. On failure it returns an error to show the
+// user and the status to respond with.
+func saveAttachment(r *http.Request, repo *attachment.Repository) (*models.Attachment, int, error) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		return nil, http.StatusBadRequest, errors.New("The uploaded file is too big.")
+	}
+
 	file, handler, err := r.FormFile("file")
 	if err != nil {
-		http.Error(w, "Error retrieving the file", http.StatusBadRequest)
-		return
+		return nil, http.StatusBadRequest, errors.New("Error retrieving the file")
 	}
 	defer file.Close()
 
 	fileBytes, _ := io.ReadAll(file)
-	hash := sha256.Sum256(fileBytes)
-	uniqueFilename := fmt.Sprintf("%s-%d%s",
-		hex.EncodeToString(hash[:16]),
-		time.Now().Unix(),
-		filepath.Ext(handler.Filename))
+	uniqueFilename := attachment.UniqueFilename(fileBytes, handler.Filename)
 
 	dst, err := os.Create(filepath.Join("uploads", uniqueFilename))
 	if err != nil {
-		http.Error(w, "Error saving the file", http.StatusInternalServerError)
-		return
+		return nil, http.StatusInternalServerError, errors.New("Error saving the file")
 	}
 	defer dst.Close()
 
 	if _, err := dst.Write(fileBytes); err != nil {
-		http.Error(w, "Error writing the file", http.StatusInternalServerError)
-		return
+		return nil, http.StatusInternalServerError, errors.New("Error writing the file")
 	}
 
-	attachment := &models.Attachment{
+	saved := &models.Attachment{
 		Filename:       handler.Filename,
 		UniqueFilename: uniqueFilename,
 		MimeType:       handler.Header.Get("Content-Type"),
 		Size:           handler.Size,
 	}
-	err = m.AttachmentRepo.Create(attachment)
+	if value := r.FormValue("page_id"); value != "" {
+		pageID, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("Invalid page")
+		}
+		saved.PageID = &pageID
+	}
+	user, _ := r.Context().Value("user").(*models.User)
+	err = repo.Create(saved, user.ID)
+	if err == sql.ErrNoRows {
+		os.Remove(filepath.Join("uploads", uniqueFilename))
+		return nil, http.StatusBadRequest, errors.New("The page doesn't exist")
+	}
 	if err != nil {
 		log.Printf("Error saving attachment to database: %v", err)
-		http.Error(w, "Error saving file metadata", http.StatusInternalServerError)
-		return
+		return nil, http.StatusInternalServerError, errors.New("Error saving file metadata")
 	}
+	return saved, http.StatusOK, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"url": "/uploads/%s"}`, uniqueFilename)
+// csrfToken returns the request's CSRF token, which the CSRF middleware
+// creates the first time it is asked for.
+func csrfToken(r *http.Request) string {
+	token, _ := r.Context().Value("csrf_token").(func() string)
+	if token == nil {
+		return ""
+	}
+	return token()
 }
@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"sowing/internal/models"
+	"sowing/internal/notification"
+	"sowing/internal/web/viewmodels"
+	"strconv"
+)
+
+// notificationsLimit is how many notifications the notifications page lists.
+const notificationsLimit = 100
+
+// Notifications provides the handlers for the current user's notifications
+type Notifications struct {
+	NotificationRepo *notification.Repository
+	Templates        map[string]*template.Template
+}
+
+// Register registers the notification routes
+func (n *Notifications) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /notifications", n.list)
+	mux.HandleFunc("POST /notifications/read", n.markAllRead)
+	mux.HandleFunc("GET /notifications/{notificationID}", n.open)
+}
+
+func (n *Notifications) list(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	notifications, err := n.NotificationRepo.ListByUser(user.ID, notificationsLimit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	data := viewmodels.PageData{
+		Mentions:    notifications,
+		CurrentUser: user,
+		IsLoggedIn:  true,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = n.Templates["notifications.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (n *Notifications) markAllRead(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if err := n.NotificationRepo.MarkAllRead(user.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+}
+
+// open marks a notification as read and goes to what it is about: the page
+// for a mention in it, or its history for a mention in a revision comment.
+func (n *Notifications) open(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	notificationID, _ := strconv.Atoi(r.PathValue("notificationID"))
+	found, err := n.NotificationRepo.FindByID(notificationID)
+	if err != nil || found.UserID != user.ID {
+		http.NotFound(w, r)
+		return
+	}
+	if err := n.NotificationRepo.MarkRead(found.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	if found.InComment {
+		http.Redirect(w, r, "/"+found.SiloSlug+"/history/"+found.PagePath, http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/"+found.SiloSlug+"/wiki/"+found.PagePath, http.StatusSeeOther)
+}
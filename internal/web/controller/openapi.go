@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPI serves an OpenAPI 3.0 document describing the API, generated from
+// its endpoints and the types of their bodies, so that it can't fall out of
+// date.
+func (a *API) openAPI(w http.ResponseWriter, r *http.Request) {
+	schemas := openAPISchemas{}
+	errorResponse := map[string]any{
+		"description": "Error",
+		"content":     map[string]any{"application/json": map[string]any{"schema": schemas.of(reflect.TypeOf(apiError{}))}},
+	}
+
+	paths := map[string]map[string]any{}
+	for _, e := range a.endpoints() {
+		path := strings.ReplaceAll(e.pattern, "...}", "}")
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+
+		var parameters []any
+		for _, segment := range strings.Split(path, "/") {
+			name, ok := strings.CutPrefix(segment, "{")
+			if !ok {
+				continue
+			}
+			name = strings.TrimSuffix(name, "}")
+			schema := map[string]any{"type": "string"}
+			if strings.HasSuffix(name, "ID") {
+				schema = map[string]any{"type": "integer"}
+			}
+			parameters = append(parameters, map[string]any{"name": name, "in": "path", "required": true, "schema": schema})
+		}
+		for _, name := range e.query {
+			parameters = append(parameters, map[string]any{"name": name, "in": "query", "schema": map[string]any{"type": "integer"}})
+		}
+
+		success := map[string]any{"description": http.StatusText(e.status)}
+		if e.response != nil {
+			success["content"] = map[string]any{"application/json": map[string]any{"schema": schemas.of(reflect.TypeOf(e.response))}}
+		}
+		operation := map[string]any{
+			"summary":   e.summary,
+			"responses": map[string]any{strconv.Itoa(e.status): success, "default": errorResponse},
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+		switch {
+		case e.request != nil:
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": schemas.of(reflect.TypeOf(e.request))}},
+			}
+		case e.upload:
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{"multipart/form-data": map[string]any{"schema": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"file":    map[string]any{"type": "string", "format": "binary"},
+						"page_id": map[string]any{"type": "integer", "description": "The page the file is for"},
+					},
+					"required": []string{"file"},
+				}}},
+			}
+		}
+		paths[path][strings.ToLower(e.method)] = operation
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "Sowing API",
+			"version":     "1",
+			"description": "Send an API token from your settings as a bearer token. Tokens with the read scope can only use GET requests.",
+		},
+		"servers":    []any{map[string]any{"url": "/"}},
+		"paths":      paths,
+		"security":   []any{map[string]any{"bearer": []string{}}},
+		"components": map[string]any{"schemas": schemas, "securitySchemes": map[string]any{"bearer": map[string]any{"type": "http", "scheme": "bearer"}}},
+	})
+}
+
+// openAPISchemas collects the schemas of the API's named types, so that they
+// are described once and referred to elsewhere.
+type openAPISchemas map[string]any
+
+// of returns the schema of a type, adding the structs it uses to the
+// collection and referring to them by name.
+func (s openAPISchemas) of(t reflect.Type) map[string]any {
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		schema := s.of(t.Elem())
+		schema["nullable"] = true
+		return schema
+	case t.Kind() == reflect.Slice:
+		return map[string]any{"type": "array", "items": s.of(t.Elem())}
+	case t.Kind() == reflect.String:
+		return map[string]any{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case t.Kind() != reflect.Struct:
+		return map[string]any{}
+	}
+
+	// apiPage is described as Page, and so on.
+	name := strings.TrimPrefix(t.Name(), "api")
+	ref := map[string]any{"$ref": "#/components/schemas/" + name}
+	if _, ok := s[name]; ok {
+		return ref
+	}
+	s[name] = nil // Types can refer to themselves
+
+	properties := map[string]any{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		properties[tag] = s.of(field.Type)
+		if opts != "omitempty" && field.Type.Kind() != reflect.Pointer {
+			required = append(required, tag)
+		}
+	}
+	schema := map[string]any{"type": "object", "properties": properties}
+	if required != nil {
+		schema["required"] = required
+	}
+	s[name] = schema
+	return ref
+}
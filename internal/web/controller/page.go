@@ -9,8 +9,10 @@ import (
 	"net/http"
 	"strconv"
 	"sowing/internal/models"
+	"sowing/internal/notification"
 	"sowing/internal/page"
 	"sowing/internal/silo"
+	"sowing/internal/watch"
 	"sowing/internal/web/renderer"
 	"sowing/internal/web/viewmodels"
 	"strings"
@@ -21,13 +23,18 @@ import (
 
 // Page provides page handlers
 type Page struct {
-	PageRepo  *page.Repository
-	SiloRepo  *silo.Repository
-	Templates map[string]*template.Template
+	PageRepo         *page.Repository
+	SiloRepo         *silo.Repository
+	WatchRepo        *watch.Repository
+	NotificationRepo *notification.Repository
+	Templates        map[string]*template.Template
 }
 
 // Register registers the page routes
 func (p *Page) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /{siloSlug}", p.landing)
+	mux.HandleFunc("GET /{siloSlug}/{$}", p.landing)
+	mux.HandleFunc("GET /{siloSlug}/wiki/{$}", p.landing)
 	mux.HandleFunc("GET /{siloSlug}/wiki/{pagePath...}", p.view)
 	mux.HandleFunc("GET /{siloSlug}/new", p.new)
 	mux.HandleFunc("POST /{siloSlug}/new", p.create)
@@ -36,6 +43,43 @@ func (p *Page) Register(mux *http.ServeMux) {
 	mux.HandleFunc("POST /{siloSlug}/delete/{pagePath...}", p.delete)
 	mux.HandleFunc("GET /{siloSlug}/diff/{pagePath...}", p.diff)
 	mux.HandleFunc("GET /{siloSlug}/history/{pagePath...}", p.history)
+	mux.HandleFunc("GET /{siloSlug}/search", p.search)
+	mux.HandleFunc("GET /{siloSlug}/export.zip", p.exportZip)
+	mux.HandleFunc("GET /{siloSlug}/raw/{pagePath...}", p.raw)
+	mux.HandleFunc("PUT /{siloSlug}/raw/{pagePath...}", p.putRaw)
+}
+
+// searchLimit is how many results the search page shows.
+const searchLimit = 50
+
+// landing redirects to the silo's landing page.
+func (p *Page) landing(w http.ResponseWriter, r *http.Request) {
+	siloSlug := r.PathValue("siloSlug")
+
+	silo, err := p.SiloRepo.FindBySlug(siloSlug)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			siloNotFound(w, r, p.SiloRepo)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	path, err := p.PageRepo.LandingPath(silo)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// A silo without any pages starts with a new one.
+			http.Redirect(w, r, fmt.Sprintf("/%s/new", siloSlug), http.StatusSeeOther)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/%s/wiki/%s", siloSlug, path), http.StatusSeeOther)
 }
 
 func (p *Page) history(w http.ResponseWriter, r *http.Request) {
@@ -44,7 +88,7 @@ func (p *Page) history(w http.ResponseWriter, r *http.Request) {
 
 	silo, err := p.SiloRepo.FindBySlug(siloSlug)
 	if err != nil {
-		http.NotFound(w, r)
+		siloNotFound(w, r, p.SiloRepo)
 		return
 	}
 
@@ -75,10 +119,13 @@ func (p *Page) history(w http.ResponseWriter, r *http.Request) {
 		Silo:        *silo,
 		Page:        page,
 		Revisions:   revisions,
+		FeedURL:     "/feeds/" + silo.Slug + "/history/" + pagePath,
 		SiloPages:   pageTree,
 		ShowSidebar: true,
+		CanManage:   canManageSilo(p.SiloRepo, user, silo),
 		CurrentUser: user,
 		IsLoggedIn:  user != nil,
+		CSRFToken:   csrfToken(r),
 	}
 
 	err = p.Templates["history.html"].ExecuteTemplate(w, "layout.html", data)
@@ -87,6 +134,50 @@ func (p *Page) history(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (p *Page) search(w http.ResponseWriter, r *http.Request) {
+	siloSlug := r.PathValue("siloSlug")
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	silo, err := p.SiloRepo.FindBySlug(siloSlug)
+	if err != nil {
+		siloNotFound(w, r, p.SiloRepo)
+		return
+	}
+
+	allSiloPages, err := p.PageRepo.ListBySilo(silo.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	pageTree := buildPageTree(allSiloPages)
+
+	results, err := p.PageRepo.Search(silo.ID, query, searchLimit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(*models.User)
+	data := viewmodels.PageData{
+		Silo:        *silo,
+		Query:       query,
+		Results:     results,
+		SiloPages:   pageTree,
+		ShowSidebar: true,
+		CanManage:   canManageSilo(p.SiloRepo, user, silo),
+		CurrentUser: user,
+		IsLoggedIn:  user != nil,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = p.Templates["search.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
 func (p *Page) diff(w http.ResponseWriter, r *http.Request) {
 	siloSlug := r.PathValue("siloSlug")
 	pagePath := r.PathValue("pagePath")
@@ -107,7 +198,7 @@ func (p *Page) diff(w http.ResponseWriter, r *http.Request) {
 
 	silo, err := p.SiloRepo.FindBySlug(siloSlug)
 	if err != nil {
-		http.NotFound(w, r)
+		siloNotFound(w, r, p.SiloRepo)
 		return
 	}
 
@@ -167,8 +258,10 @@ func (p *Page) diff(w http.ResponseWriter, r *http.Request) {
 		Content:     template.HTML(buff.String()),
 		SiloPages:   pageTree,
 		ShowSidebar: true,
+		CanManage:   canManageSilo(p.SiloRepo, user, silo),
 		CurrentUser: user,
 		IsLoggedIn:  user != nil,
+		CSRFToken:   csrfToken(r),
 	}
 
 	err = p.Templates["diff.html"].ExecuteTemplate(w, "layout.html", data)
@@ -184,7 +277,7 @@ func (p *Page) view(w http.ResponseWriter, r *http.Request) {
 	silo, err := p.SiloRepo.FindBySlug(siloSlug)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			http.NotFound(w, r)
+			siloNotFound(w, r, p.SiloRepo)
 			return
 		}
 		log.Println(err)
@@ -227,7 +320,14 @@ func (p *Page) view(w http.ResponseWriter, r *http.Request) {
 
 	pageTree := buildPageTree(allSiloPages)
 
-	htmlContentString, err := org.New().Parse(strings.NewReader(content), "").Write(renderer.NewHTMLWriterWithChroma())
+	mentioned, err := p.NotificationRepo.MentionedUsers(content)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	htmlContentString, err := org.New().Parse(strings.NewReader(content), "").Write(renderer.NewHTMLWriterWithMentions(mentioned))
 	if err != nil {
 		log.Printf("Error converting org-mode content to HTML: %v", err)
 		http.Error(w, "Internal Server Error", 500)
@@ -235,15 +335,28 @@ func (p *Page) view(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user, _ := r.Context().Value("user").(*models.User)
+	var watches viewmodels.WatchesViewModel
+	if user != nil {
+		if watches.Page, err = p.WatchRepo.Find(user.ID, silo.ID, &page.ID); err != nil && err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		if watches.Silo, err = p.WatchRepo.Find(user.ID, silo.ID, nil); err != nil && err != sql.ErrNoRows {
+			log.Println(err)
+		}
+	}
+
 	data := viewmodels.PageData{
 		Silo:        *silo,
 		Page:        page,
 		Revisions:   revisions,
 		SiloPages:   pageTree,
 		Content:     template.HTML(htmlContentString),
+		Watches:     watches,
 		ShowSidebar: true,
+		CanManage:   canManageSilo(p.SiloRepo, user, silo),
 		CurrentUser: user,
 		IsLoggedIn:  user != nil,
+		CSRFToken:   csrfToken(r),
 	}
 
 	err = p.Templates["view.html"].ExecuteTemplate(w, "layout.html", data)
@@ -258,7 +371,7 @@ func (p *Page) new(w http.ResponseWriter, r *http.Request) {
 	silo, err := p.SiloRepo.FindBySlug(siloSlug)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			http.NotFound(w, r)
+			siloNotFound(w, r, p.SiloRepo)
 			return
 		}
 		log.Println(err)
@@ -288,8 +401,10 @@ func (p *Page) new(w http.ResponseWriter, r *http.Request) {
 		AllSiloPages: allSiloPages,
 		ParentID:     parentID,
 		ShowSidebar:  true,
+		CanManage:    canManageSilo(p.SiloRepo, user, silo),
 		CurrentUser:  user,
 		IsLoggedIn:   user != nil,
+		CSRFToken:    csrfToken(r),
 	}
 
 	err = p.Templates["new.html"].ExecuteTemplate(w, "layout.html", data)
@@ -303,7 +418,7 @@ func (p *Page) create(w http.ResponseWriter, r *http.Request) {
 
 	silo, err := p.SiloRepo.FindBySlug(siloSlug)
 	if err != nil {
-		http.NotFound(w, r)
+		siloNotFound(w, r, p.SiloRepo)
 		return
 	}
 
@@ -369,7 +484,7 @@ func (p *Page) edit(w http.ResponseWriter, r *http.Request) {
 	silo, err := p.SiloRepo.FindBySlug(siloSlug)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			http.NotFound(w, r)
+			siloNotFound(w, r, p.SiloRepo)
 			return
 		}
 		log.Println(err)
@@ -412,8 +527,10 @@ func (p *Page) edit(w http.ResponseWriter, r *http.Request) {
 		SiloPages:   pageTree,
 		Content:     template.HTML(content),
 		ShowSidebar: true,
+		CanManage:   canManageSilo(p.SiloRepo, user, silo),
 		CurrentUser: user,
 		IsLoggedIn:  user != nil,
+		CSRFToken:   csrfToken(r),
 	}
 
 	err = p.Templates["edit.html"].ExecuteTemplate(w, "layout.html", data)
@@ -428,7 +545,7 @@ func (p *Page) save(w http.ResponseWriter, r *http.Request) {
 
 	silo, err := p.SiloRepo.FindBySlug(siloSlug)
 	if err != nil {
-		http.NotFound(w, r)
+		siloNotFound(w, r, p.SiloRepo)
 		return
 	}
 
@@ -473,7 +590,7 @@ func (p *Page) delete(w http.ResponseWriter, r *http.Request) {
 
 	silo, err := p.SiloRepo.FindBySlug(siloSlug)
 	if err != nil {
-		http.NotFound(w, r)
+		siloNotFound(w, r, p.SiloRepo)
 		return
 	}
 
@@ -483,53 +600,23 @@ func (p *Page) delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = p.PageRepo.Delete(page.ID)
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err = p.PageRepo.Delete(page.ID, user.ID)
 	if err != nil {
 		log.Printf("Error archiving page: %v", err)
 		http.Error(w, "Internal Server Error", 500)
 		return
 	}
 
-	http.Redirect(w, r, fmt.Sprintf("/%s/wiki/home", siloSlug), http.StatusSeeOther)
+	http.Redirect(w, r, fmt.Sprintf("/%s/", siloSlug), http.StatusSeeOther)
 }
 
-// buildPageTree takes a flat list of pages (already sorted by position)
-// and organizes them into a hierarchical tree.
+// buildPageTree arranges a silo's pages into the tree shown in the sidebar.
 func buildPageTree(pages []models.Page) []*models.Page {
-	pageMap := make(map[int]*models.Page)
-	for i := range pages {
-		p := pages[i]
-		pageMap[p.ID] = &p
-	}
-
-	var rootPages []*models.Page
-	for _, p := range pages {
-		pageNode := pageMap[p.ID]
-		if pageNode.ParentID == nil {
-			rootPages = append(rootPages, pageNode)
-		} else {
-			parent, ok := pageMap[*pageNode.ParentID]
-			if ok {
-				parent.Children = append(parent.Children, pageNode)
-			}
-		}
-	}
-
-	var constructPath func(pages []*models.Page, basePath string)
-	constructPath = func(pages []*models.Page, basePath string) {
-		for _, page := range pages {
-			if basePath == "" {
-				page.Path = page.Slug
-			} else {
-				page.Path = basePath + "/" + page.Slug
-			}
-			if len(page.Children) > 0 {
-				constructPath(page.Children, page.Path)
-			}
-		}
-	}
-
-	constructPath(rootPages, "")
-
-	return rootPages
+	return page.BuildTree(pages)
 }
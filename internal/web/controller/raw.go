@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"sowing/internal/models"
+	"sowing/internal/page"
+)
+
+// maxRawSize is the largest page source PUT accepts.
+const maxRawSize = 10 << 20
+
+// revisionETag is the ETag of a page's source: the ID of its revision.
+func revisionETag(revisionID int) string {
+	return `"` + strconv.Itoa(revisionID) + `"`
+}
+
+// raw serves the org source of a page's current revision, so that editors
+// and scripts can fetch it, edit it and PUT it back.
+func (p *Page) raw(w http.ResponseWriter, r *http.Request) {
+	silo, err := p.SiloRepo.FindBySlug(r.PathValue("siloSlug"))
+	if err != nil {
+		siloNotFound(w, r, p.SiloRepo)
+		return
+	}
+
+	page, err := p.PageRepo.FindByPath(silo.ID, strings.Split(r.PathValue("pagePath"), "/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	etag := revisionETag(page.CurrentRevisionID)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	content, err := p.PageRepo.GetRevisionContent(page.CurrentRevisionID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, content)
+}
+
+// putRaw saves the request body as a new revision of a page. The request
+// must say which revision it is based on with If-Match, so that an edit made
+// in the meantime is never overwritten; If-Match: * overwrites regardless.
+// The revision's comment can be given in the "comment" query parameter.
+func (p *Page) putRaw(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	silo, err := p.SiloRepo.FindBySlug(r.PathValue("siloSlug"))
+	if err != nil {
+		siloNotFound(w, r, p.SiloRepo)
+		return
+	}
+
+	pg, err := p.PageRepo.FindByPath(silo.ID, strings.Split(r.PathValue("pagePath"), "/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" {
+		http.Error(w, "If-Match is required: send the ETag of the revision you edited", http.StatusPreconditionRequired)
+		return
+	}
+	if ifMatch != "*" && ifMatch != revisionETag(pg.CurrentRevisionID) {
+		w.Header().Set("ETag", revisionETag(pg.CurrentRevisionID))
+		http.Error(w, "The page has changed since that revision", http.StatusPreconditionFailed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRawSize))
+	if err != nil {
+		http.Error(w, "The page is too big.", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !utf8.Valid(body) {
+		http.Error(w, "The page must be UTF-8 text.", http.StatusBadRequest)
+		return
+	}
+
+	// Saving without changes, as editors tend to, doesn't add a revision.
+	current, err := p.PageRepo.GetRevisionContent(pg.CurrentRevisionID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if string(body) == current {
+		w.Header().Set("ETag", revisionETag(pg.CurrentRevisionID))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	comment := r.URL.Query().Get("comment")
+	revision := &models.Revision{
+		AuthorID: user.ID,
+		Comment:  &comment,
+		Content:  string(body),
+	}
+	err = p.PageRepo.CreateRevisionIf(r.Context(), revision, pg.ID, pg.CurrentRevisionID)
+	if errors.Is(err, page.ErrStaleRevision) {
+		http.Error(w, "The page has changed since that revision", http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating revision: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	w.Header().Set("ETag", revisionETag(revision.ID))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,428 @@
+package controller
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"sowing/internal/auth"
+	"sowing/internal/models"
+	"sowing/internal/web/viewmodels"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// Settings provides handlers for a user's account settings
+type Settings struct {
+	AuthService *auth.Service
+	Templates   map[string]*template.Template
+}
+
+// Register registers the settings routes
+func (s *Settings) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /settings/profile", s.profile)
+	mux.HandleFunc("POST /settings/profile", s.updateProfile)
+	mux.HandleFunc("POST /settings/password", s.changePassword)
+	mux.HandleFunc("GET /settings/tokens", s.tokens)
+	mux.HandleFunc("POST /settings/tokens", s.createToken)
+	mux.HandleFunc("POST /settings/tokens/{tokenID}/revoke", s.revokeToken)
+	mux.HandleFunc("GET /settings/2fa", s.twoFactor)
+	mux.HandleFunc("POST /settings/2fa/enable", s.enableTwoFactor)
+	mux.HandleFunc("POST /settings/2fa/disable", s.disableTwoFactor)
+	mux.HandleFunc("POST /settings/2fa/recovery-codes", s.regenerateRecoveryCodes)
+	mux.HandleFunc("GET /settings/sessions", s.sessions)
+	mux.HandleFunc("POST /settings/sessions/{sessionID}/revoke", s.revokeSession)
+	mux.HandleFunc("POST /settings/sessions/revoke-others", s.revokeOtherSessions)
+}
+
+func (s *Settings) profile(w http.ResponseWriter, r *http.Request) {
+	s.renderProfile(w, r, "", "")
+}
+
+func (s *Settings) updateProfile(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil || usedAPIToken(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	displayName := strings.TrimSpace(r.FormValue("display_name"))
+	email := strings.TrimSpace(r.FormValue("email"))
+	if displayName == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		s.renderProfile(w, r, "", "Display name is required.")
+		return
+	}
+	if email != "" {
+		if _, err := mail.ParseAddress(email); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			s.renderProfile(w, r, "", auth.ErrInvalidEmail.Error())
+			return
+		}
+	}
+
+	if err := s.AuthService.Repo.UpdateProfile(user.ID, displayName, email); err != nil {
+		log.Printf("Error updating profile: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	// The user in the context was loaded before the change.
+	user.DisplayName = displayName
+	user.Email = email
+	s.renderProfile(w, r, "Your profile has been updated.", "")
+}
+
+func (s *Settings) changePassword(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil || usedAPIToken(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	newPassword := r.FormValue("new_password")
+	if newPassword != r.FormValue("confirm_password") {
+		w.WriteHeader(http.StatusBadRequest)
+		s.renderProfile(w, r, "", "The new passwords do not match.")
+		return
+	}
+
+	revokeTokens := r.FormValue("revoke_tokens") != ""
+	err := s.AuthService.ChangePassword(user.ID, r.FormValue("current_password"), newPassword, s.AuthService.CurrentSessionHash(r), auth.ClientIP(r), revokeTokens)
+	var throttled *auth.ThrottledError
+	if errors.As(err, &throttled) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		s.renderProfile(w, r, "", fmt.Sprintf("Too many wrong passwords. Try again in %s.", throttled.RetryAfter.Round(time.Second)))
+		return
+	}
+	if errors.Is(err, auth.ErrWrongPassword) || errors.Is(err, auth.ErrWeakPassword) {
+		w.WriteHeader(http.StatusBadRequest)
+		s.renderProfile(w, r, "", err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error changing password: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	notice := "Your password has been changed and your other sessions have been logged out."
+	if revokeTokens {
+		notice = "Your password has been changed, your other sessions have been logged out and your API tokens have been revoked."
+	}
+	s.renderProfile(w, r, notice, "")
+}
+
+func (s *Settings) renderProfile(w http.ResponseWriter, r *http.Request, notice, errMsg string) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	data := viewmodels.PageData{
+		Notice:      notice,
+		Error:       errMsg,
+		ShowSidebar: false,
+		CurrentUser: user,
+		IsLoggedIn:  true,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err := s.Templates["profile.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *Settings) tokens(w http.ResponseWriter, r *http.Request) {
+	s.renderTokens(w, r, "", "")
+}
+
+func (s *Settings) createToken(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil || usedAPIToken(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	var expiresAt *time.Time
+	if days, _ := strconv.Atoi(r.PostFormValue("expires_in")); days > 0 {
+		t := time.Now().AddDate(0, 0, days)
+		expiresAt = &t
+	}
+
+	raw, _, err := s.AuthService.CreateAPIToken(user.ID, r.PostFormValue("name"), r.PostForm["scopes"], expiresAt)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		s.renderTokens(w, r, "", err.Error())
+		return
+	}
+
+	s.renderTokens(w, r, raw, "")
+}
+
+func (s *Settings) revokeToken(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil || usedAPIToken(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	tokenID, err := strconv.Atoi(r.PathValue("tokenID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := s.AuthService.Repo.DeleteAPIToken(user.ID, tokenID); err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Error revoking API token: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/tokens", http.StatusSeeOther)
+}
+
+func (s *Settings) renderTokens(w http.ResponseWriter, r *http.Request, newToken, errMsg string) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	tokens, err := s.AuthService.Repo.ListAPITokensByUser(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	data := viewmodels.PageData{
+		APITokens:   tokens,
+		NewAPIToken: newToken,
+		Error:       errMsg,
+		ShowSidebar: false,
+		CurrentUser: user,
+		IsLoggedIn:  true,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = s.Templates["tokens.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *Settings) twoFactor(w http.ResponseWriter, r *http.Request) {
+	s.renderTwoFactor(w, r, nil, "")
+}
+
+func (s *Settings) enableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil || usedAPIToken(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	codes, err := s.AuthService.EnableTOTP(user.ID, r.FormValue("code"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		s.renderTwoFactor(w, r, nil, err.Error())
+		return
+	}
+	s.renderTwoFactor(w, r, codes, "")
+}
+
+func (s *Settings) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil || usedAPIToken(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := s.AuthService.DisableTOTP(user.ID, r.FormValue("code")); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		s.renderTwoFactor(w, r, nil, err.Error())
+		return
+	}
+	http.Redirect(w, r, "/settings/2fa", http.StatusSeeOther)
+}
+
+func (s *Settings) regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil || usedAPIToken(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	codes, err := s.AuthService.RegenerateRecoveryCodes(user.ID, r.FormValue("code"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		s.renderTwoFactor(w, r, nil, err.Error())
+		return
+	}
+	s.renderTwoFactor(w, r, codes, "")
+}
+
+// renderTwoFactor shows the current two-factor status. Users who have not
+// enabled it yet get a fresh secret to enrol with.
+func (s *Settings) renderTwoFactor(w http.ResponseWriter, r *http.Request, recoveryCodes []string, errMsg string) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	twoFactor := viewmodels.TwoFactorViewModel{
+		Enabled:       s.AuthService.TOTPEnabled(user.ID),
+		RecoveryCodes: recoveryCodes,
+	}
+
+	if twoFactor.Enabled {
+		left, err := s.AuthService.Repo.CountRecoveryCodes(user.ID)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		twoFactor.RecoveryCodesLeft = left
+	} else {
+		secret, err := s.AuthService.BeginTOTPEnrolment(user)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		twoFactor.Secret = secret
+		twoFactor.ProvisioningURI = auth.TOTPProvisioningURI(user.Username, secret)
+
+		png, err := qrcode.Encode(twoFactor.ProvisioningURI, qrcode.Medium, 256)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal Server Error", 500)
+			return
+		}
+		twoFactor.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+
+	data := viewmodels.PageData{
+		TwoFactor:   twoFactor,
+		Error:       errMsg,
+		ShowSidebar: false,
+		CurrentUser: user,
+		IsLoggedIn:  true,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err := s.Templates["two_factor.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *Settings) sessions(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	sessions, err := s.AuthService.Repo.ListSessionsByUser(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	current := s.AuthService.CurrentSessionHash(r)
+	var sessionViewModels []viewmodels.SessionViewModel
+	for _, session := range sessions {
+		sessionViewModels = append(sessionViewModels, viewmodels.SessionViewModel{
+			Session: session,
+			Current: session.TokenHash == current,
+		})
+	}
+
+	data := viewmodels.PageData{
+		Sessions:    sessionViewModels,
+		ShowSidebar: false,
+		CurrentUser: user,
+		IsLoggedIn:  true,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = s.Templates["sessions.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *Settings) revokeSession(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil || usedAPIToken(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	sessionID, err := strconv.Atoi(r.PathValue("sessionID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := s.AuthService.Repo.DeleteUserSession(user.ID, sessionID); err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Error revoking session: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/sessions", http.StatusSeeOther)
+}
+
+func (s *Settings) revokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil || usedAPIToken(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if _, err := s.AuthService.Repo.DeleteUserSessions(user.ID, s.AuthService.CurrentSessionHash(r)); err != nil {
+		log.Printf("Error revoking sessions: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	http.Redirect(w, r, "/settings/sessions", http.StatusSeeOther)
+}
+
+// usedAPIToken reports whether the request was authenticated with an API token
+// rather than an interactive session. Tokens may not be used to change the
+// account's security settings.
+func usedAPIToken(r *http.Request) bool {
+	_, ok := r.Context().Value("api_token").(*models.APIToken)
+	return ok
+}
@@ -2,7 +2,9 @@ package controller
 
 import (
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -10,15 +12,21 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sowing/internal/audit"
 	"sowing/internal/models"
+	"sowing/internal/page"
 	"sowing/internal/silo"
 	"sowing/internal/web/viewmodels"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // Silo provides silo handlers
 type Silo struct {
 	SiloRepo  *silo.Repository
+	PageRepo  *page.Repository
+	AuditRepo *audit.Repository
 	Templates map[string]*template.Template
 }
 
@@ -26,6 +34,13 @@ type Silo struct {
 func (s *Silo) Register(mux *http.ServeMux) {
 	mux.HandleFunc("GET /", s.list)
 	mux.HandleFunc("POST /", s.create)
+	mux.HandleFunc("GET /{siloSlug}/settings", s.settings)
+	mux.HandleFunc("POST /{siloSlug}/settings/rename", s.rename)
+	mux.HandleFunc("POST /{siloSlug}/settings/home-page", s.setHomePage)
+	mux.HandleFunc("POST /{siloSlug}/settings/cover", s.updateCover)
+	mux.HandleFunc("POST /{siloSlug}/settings/archive", s.archive)
+	mux.HandleFunc("POST /{siloSlug}/settings/unarchive", s.unarchive)
+	mux.HandleFunc("POST /{siloSlug}/settings/delete", s.delete)
 }
 
 func (s *Silo) list(w http.ResponseWriter, r *http.Request) {
@@ -42,6 +57,7 @@ func (s *Silo) list(w http.ResponseWriter, r *http.Request) {
 		ShowSidebar: false,
 		CurrentUser: user,
 		IsLoggedIn:  user != nil,
+		CSRFToken:   csrfToken(r),
 	}
 
 	err = s.Templates["index.html"].ExecuteTemplate(w, "layout.html", data)
@@ -62,43 +78,332 @@ func (s *Silo) create(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Name and slug are required", http.StatusBadRequest)
 		return
 	}
+	if err := silo.ValidateSlug(slug); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	var coverImageURL *string
+	coverImageURL, err := saveCoverImage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	file, handler, err := r.FormFile("cover_image")
-	if err != nil && err != http.ErrMissingFile {
-		http.Error(w, "Error retrieving the file", http.StatusBadRequest)
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	if err != http.ErrMissingFile {
-		defer file.Close()
-		fileBytes, _ := io.ReadAll(file)
-		hash := sha256.Sum256(fileBytes)
-		uniqueFilename := fmt.Sprintf("%s-%d%s", hex.EncodeToString(hash[:16]), time.Now().Unix(), filepath.Ext(handler.Filename))
+	err = s.SiloRepo.Create(name, slug, coverImageURL, user.ID)
+	if err != nil {
+		if err == silo.ErrSlugTaken {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error creating silo: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
 
-		dst, err := os.Create(filepath.Join("uploads", uniqueFilename))
-		if err != nil {
-			http.Error(w, "Error saving the file", http.StatusInternalServerError)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (s *Silo) settings(w http.ResponseWriter, r *http.Request) {
+	current, ok := s.findManagedSilo(w, r)
+	if !ok {
+		return
+	}
+	s.renderSettings(w, r, current, "")
+}
+
+func (s *Silo) rename(w http.ResponseWriter, r *http.Request) {
+	current, ok := s.findManagedSilo(w, r)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	slug := strings.TrimSpace(r.FormValue("slug"))
+	if name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		s.renderSettings(w, r, current, "Name is required.")
+		return
+	}
+	if err := silo.ValidateSlug(slug); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		s.renderSettings(w, r, current, err.Error())
+		return
+	}
+
+	if err := s.SiloRepo.Rename(current.ID, name, slug); err != nil {
+		if err == silo.ErrSlugTaken {
+			w.WriteHeader(http.StatusBadRequest)
+			s.renderSettings(w, r, current, err.Error())
+			return
+		}
+		log.Printf("Error renaming silo: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	s.AuditRepo.RecordRequest(r, "silo.rename", current.Slug, name+" ("+slug+")")
+
+	http.Redirect(w, r, "/"+slug+"/settings", http.StatusSeeOther)
+}
+
+func (s *Silo) setHomePage(w http.ResponseWriter, r *http.Request) {
+	current, ok := s.findManagedSilo(w, r)
+	if !ok {
+		return
+	}
+
+	pageID, err := strconv.Atoi(r.FormValue("page_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		s.renderSettings(w, r, current, "Choose a page.")
+		return
+	}
+
+	if err := s.SiloRepo.SetHomePage(current.ID, pageID); err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusBadRequest)
+			s.renderSettings(w, r, current, "That page is not part of this silo.")
 			return
 		}
-		defer dst.Close()
+		log.Printf("Error setting home page: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	s.AuditRepo.RecordRequest(r, "silo.home_page", current.Slug, strconv.Itoa(pageID))
 
-		if _, err := dst.Write(fileBytes); err != nil {
-			http.Error(w, "Error writing the file", http.StatusInternalServerError)
+	http.Redirect(w, r, "/"+current.Slug+"/settings", http.StatusSeeOther)
+}
+
+func (s *Silo) updateCover(w http.ResponseWriter, r *http.Request) {
+	current, ok := s.findManagedSilo(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		s.renderSettings(w, r, current, "The uploaded file is too big.")
+		return
+	}
+
+	var coverImageURL *string
+	if r.PostFormValue("remove") == "" {
+		url, err := saveCoverImage(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			s.renderSettings(w, r, current, err.Error())
+			return
+		}
+		if url == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			s.renderSettings(w, r, current, "Choose an image to upload.")
 			return
 		}
+		coverImageURL = url
+	}
+
+	if err := s.SiloRepo.SetCoverImage(current.ID, coverImageURL); err != nil {
+		log.Printf("Error updating cover image: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	if current.CoverImage != nil {
+		removeUpload(strings.TrimPrefix(*current.CoverImage, "/uploads/"))
+	}
 
-		url := "/uploads/" + uniqueFilename
-		coverImageURL = &url
+	action := "silo.cover"
+	if coverImageURL == nil {
+		action = "silo.remove_cover"
 	}
+	s.AuditRepo.RecordRequest(r, action, current.Slug, "")
 
-	err = s.SiloRepo.Create(name, slug, coverImageURL)
+	http.Redirect(w, r, "/"+current.Slug+"/settings", http.StatusSeeOther)
+}
+
+func (s *Silo) archive(w http.ResponseWriter, r *http.Request) {
+	s.setArchived(w, r, true)
+}
+
+func (s *Silo) unarchive(w http.ResponseWriter, r *http.Request) {
+	s.setArchived(w, r, false)
+}
+
+func (s *Silo) setArchived(w http.ResponseWriter, r *http.Request, archived bool) {
+	current, ok := s.findManagedSilo(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.SiloRepo.SetArchived(current.ID, archived); err != nil {
+		log.Printf("Error archiving silo: %v", err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	action := "silo.archive"
+	if !archived {
+		action = "silo.unarchive"
+	}
+	s.AuditRepo.RecordRequest(r, action, current.Slug, "")
+
+	http.Redirect(w, r, "/"+current.Slug+"/settings", http.StatusSeeOther)
+}
+
+func (s *Silo) delete(w http.ResponseWriter, r *http.Request) {
+	current, ok := s.findManagedSilo(w, r)
+	if !ok {
+		return
+	}
+
+	if r.FormValue("confirm_slug") != current.Slug {
+		w.WriteHeader(http.StatusBadRequest)
+		s.renderSettings(w, r, current, "Type the silo's slug to confirm that it should be deleted.")
+		return
+	}
+
+	files, err := s.SiloRepo.Delete(current.ID)
 	if err != nil {
-		log.Printf("Error creating silo: %v", err)
+		log.Printf("Error deleting silo: %v", err)
 		http.Error(w, "Internal Server Error", 500)
 		return
 	}
+	for _, name := range files {
+		removeUpload(name)
+	}
+	s.AuditRepo.RecordRequest(r, "silo.delete", current.Slug, current.Name)
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
+
+// renderSettings shows the settings page of a silo.
+func (s *Silo) renderSettings(w http.ResponseWriter, r *http.Request, current *models.Silo, errMsg string) {
+	pages, err := s.PageRepo.ListBySilo(current.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(*models.User)
+	data := viewmodels.PageData{
+		Silo:         *current,
+		AllSiloPages: pages,
+		Error:        errMsg,
+		ShowSidebar:  false,
+		CurrentUser:  user,
+		IsLoggedIn:   user != nil,
+		CSRFToken:    csrfToken(r),
+	}
+	if current.HomePageID != nil {
+		data.HomePageID = *current.HomePageID
+	}
+
+	err = s.Templates["silo_settings.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// findManagedSilo looks up the silo named by the request path and checks that
+// the current user may change its settings, which silo owners and site
+// administrators can.
+func (s *Silo) findManagedSilo(w http.ResponseWriter, r *http.Request) (*models.Silo, bool) {
+	return findManagedSilo(w, r, s.SiloRepo)
+}
+
+// findManagedSilo is Silo.findManagedSilo, for the other controllers of a
+// silo's settings.
+func findManagedSilo(w http.ResponseWriter, r *http.Request, repo *silo.Repository) (*models.Silo, bool) {
+	current, err := repo.FindBySlug(r.PathValue("siloSlug"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			siloNotFound(w, r, repo)
+			return nil, false
+		}
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return nil, false
+	}
+
+	user, _ := r.Context().Value("user").(*models.User)
+	if !canManageSilo(repo, user, current) || usedAPIToken(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return current, true
+}
+
+// canManageSilo reports whether a user may change a silo's settings.
+func canManageSilo(repo *silo.Repository, user *models.User, s *models.Silo) bool {
+	if user == nil {
+		return false
+	}
+	if user.IsAdmin {
+		return true
+	}
+	owner, err := repo.HasRole(s.ID, user.ID, models.RoleOwner)
+	if err != nil {
+		log.Printf("Error checking silo role: %v", err)
+	}
+	return owner
+}
+
+// siloNotFound responds to a request for a silo slug that doesn't exist. If
+// the slug belonged to a silo that has since been renamed, GET requests are
+// redirected to the same path under the new slug.
+func siloNotFound(w http.ResponseWriter, r *http.Request, repo *silo.Repository) {
+	oldSlug := r.PathValue("siloSlug")
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		if moved, err := repo.FindRedirect(oldSlug); err == nil {
+			target := "/" + moved.Slug + strings.TrimPrefix(r.URL.Path, "/"+oldSlug)
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// saveCoverImage stores the cover image uploaded with a silo form and returns
+// its URL, or nil if no image was uploaded.
+func saveCoverImage(r *http.Request) (*string, error) {
+	file, handler, err := r.FormFile("cover_image")
+	if err == http.ErrMissingFile {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New("Error retrieving the file")
+	}
+	defer file.Close()
+
+	fileBytes, err := io.ReadAll(file)
+	if err != nil {
+		return nil, errors.New("Error retrieving the file")
+	}
+	hash := sha256.Sum256(fileBytes)
+	uniqueFilename := fmt.Sprintf("%s-%d%s", hex.EncodeToString(hash[:16]), time.Now().Unix(), filepath.Ext(handler.Filename))
+
+	if err := os.WriteFile(filepath.Join("uploads", uniqueFilename), fileBytes, 0644); err != nil {
+		log.Printf("Error saving cover image: %v", err)
+		return nil, errors.New("Error saving the file")
+	}
+
+	url := "/uploads/" + uniqueFilename
+	return &url, nil
+}
+
+// removeUpload deletes a file from the uploads directory. Failures are only
+// logged, since the database no longer refers to the file.
+func removeUpload(name string) {
+	if name == "" || strings.Contains(name, "/") || strings.Contains(name, "..") {
+		return
+	}
+	if err := os.Remove(filepath.Join("uploads", name)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing upload: %v", err)
+	}
+}
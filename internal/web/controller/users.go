@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"sowing/internal/auth"
+	"sowing/internal/models"
+	"sowing/internal/page"
+	"sowing/internal/web/viewmodels"
+)
+
+// profileChangesLimit is how many of a user's revisions their profile lists.
+const profileChangesLimit = 50
+
+// Users provides the user profile pages, which @mentions link to
+type Users struct {
+	AuthService *auth.Service
+	PageRepo    *page.Repository
+	Templates   map[string]*template.Template
+}
+
+// Register registers the user profile routes
+func (u *Users) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /users/{username}", u.profile)
+}
+
+func (u *Users) profile(w http.ResponseWriter, r *http.Request) {
+	profile, err := u.AuthService.Repo.FindUserByUsername(r.PathValue("username"))
+	// Users awaiting approval or email confirmation don't have profiles yet.
+	if err == sql.ErrNoRows || err == nil && (profile.Status == models.UserStatusPending || profile.Status == models.UserStatusUnverified) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	changes, err := u.PageRepo.RecentChangesByAuthor(profile.ID, profileChangesLimit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(*models.User)
+	data := viewmodels.PageData{
+		Profile:     profile,
+		Changes:     changes,
+		CurrentUser: user,
+		IsLoggedIn:  user != nil,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = u.Templates["user.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
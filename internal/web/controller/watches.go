@@ -0,0 +1,226 @@
+package controller
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"sowing/internal/models"
+	"sowing/internal/page"
+	"sowing/internal/silo"
+	"sowing/internal/watch"
+	"sowing/internal/web/viewmodels"
+	"strconv"
+)
+
+// Watches provides the handlers for watching silos and pages
+type Watches struct {
+	SiloRepo  *silo.Repository
+	PageRepo  *page.Repository
+	WatchRepo *watch.Repository
+	// EmailEnabled is whether the site is set up to send email.
+	EmailEnabled bool
+	Templates    map[string]*template.Template
+}
+
+// Register registers the routes for managing watches
+func (h *Watches) Register(mux *http.ServeMux) {
+	mux.HandleFunc("POST /{siloSlug}/watch", h.watch)
+	mux.HandleFunc("POST /{siloSlug}/unwatch", h.unwatch)
+	mux.HandleFunc("GET /settings/watches", h.settings)
+	mux.HandleFunc("POST /settings/watches", h.setDigest)
+	mux.HandleFunc("POST /settings/watches/{watchID}/delete", h.delete)
+}
+
+// RegisterUnsubscribe registers the unsubscribe links sent in emails, which
+// work without signing in.
+func (h *Watches) RegisterUnsubscribe(mux *http.ServeMux) {
+	mux.HandleFunc("GET /unsubscribe/{token}", h.unsubscribeForm)
+	mux.HandleFunc("POST /unsubscribe/{token}", h.unsubscribe)
+}
+
+// watch watches the silo, or the page given by page_id and, if subtree is
+// set, the pages below it.
+func (h *Watches) watch(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	silo, err := h.SiloRepo.FindBySlug(r.PathValue("siloSlug"))
+	if err != nil {
+		siloNotFound(w, r, h.SiloRepo)
+		return
+	}
+
+	var pageID *int
+	if raw := r.PostFormValue("page_id"); raw != "" {
+		id, err := strconv.Atoi(raw)
+		if err != nil {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+		page, err := h.PageRepo.FindByID(id)
+		if err != nil || page.SiloID != silo.ID {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+		pageID = &page.ID
+	}
+
+	if _, err := h.WatchRepo.Watch(user.ID, silo.ID, pageID, r.PostFormValue("subtree") == "1"); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	h.redirectBack(w, r, silo)
+}
+
+// unwatch stops the watch given by watch_id.
+func (h *Watches) unwatch(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	silo, err := h.SiloRepo.FindBySlug(r.PathValue("siloSlug"))
+	if err != nil {
+		siloNotFound(w, r, h.SiloRepo)
+		return
+	}
+
+	watchID, _ := strconv.Atoi(r.PostFormValue("watch_id"))
+	existing, err := h.WatchRepo.FindByID(watchID)
+	if err != nil || existing.UserID != user.ID || existing.SiloID != silo.ID {
+		http.NotFound(w, r)
+		return
+	}
+	if err := h.WatchRepo.Delete(existing.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	h.redirectBack(w, r, silo)
+}
+
+// redirectBack returns to the page given by return_page_id, which the watch
+// was changed from, or else to the silo.
+func (h *Watches) redirectBack(w http.ResponseWriter, r *http.Request, silo *models.Silo) {
+	if pageID, err := strconv.Atoi(r.PostFormValue("return_page_id")); err == nil {
+		if page, err := h.PageRepo.FindByID(pageID); err == nil && page.SiloID == silo.ID {
+			if path, err := h.PageRepo.GetPathByID(page.ID); err == nil {
+				http.Redirect(w, r, "/"+silo.Slug+"/wiki/"+path, http.StatusSeeOther)
+				return
+			}
+		}
+	}
+	http.Redirect(w, r, "/"+silo.Slug+"/", http.StatusSeeOther)
+}
+
+func (h *Watches) settings(w http.ResponseWriter, r *http.Request) {
+	h.renderSettings(w, r, "")
+}
+
+func (h *Watches) setDigest(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	digest := r.PostFormValue("digest")
+	if !slices.Contains(models.Digests, digest) {
+		http.Error(w, "Invalid digest setting", http.StatusBadRequest)
+		return
+	}
+	if err := h.WatchRepo.SetDigest(user.ID, digest); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	h.renderSettings(w, r, "Your email settings were saved.")
+}
+
+func (h *Watches) delete(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(*models.User)
+	watchID, _ := strconv.Atoi(r.PathValue("watchID"))
+	existing, err := h.WatchRepo.FindByID(watchID)
+	if err != nil || existing.UserID != user.ID {
+		http.NotFound(w, r)
+		return
+	}
+	if err := h.WatchRepo.Delete(existing.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	http.Redirect(w, r, "/settings/watches", http.StatusSeeOther)
+}
+
+// renderSettings shows the user's watches and how often they are emailed.
+func (h *Watches) renderSettings(w http.ResponseWriter, r *http.Request, notice string) {
+	user, _ := r.Context().Value("user").(*models.User)
+	watches, err := h.WatchRepo.ListByUser(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	digest, err := h.WatchRepo.Digest(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	data := viewmodels.PageData{
+		Watches: viewmodels.WatchesViewModel{
+			Watches:      watches,
+			Digest:       digest,
+			Digests:      models.Digests,
+			EmailEnabled: h.EmailEnabled,
+		},
+		Notice:      notice,
+		CurrentUser: user,
+		IsLoggedIn:  true,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = h.Templates["watches.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (h *Watches) unsubscribeForm(w http.ResponseWriter, r *http.Request) {
+	existing, err := h.WatchRepo.FindByToken(r.PathValue("token"))
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	h.renderUnsubscribe(w, r, existing, "")
+}
+
+func (h *Watches) unsubscribe(w http.ResponseWriter, r *http.Request) {
+	existing, err := h.WatchRepo.FindByToken(r.PathValue("token"))
+	if err == sql.ErrNoRows {
+		h.renderUnsubscribe(w, r, nil, "")
+		return
+	}
+	if err == nil {
+		err = h.WatchRepo.Delete(existing.ID)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	h.renderUnsubscribe(w, r, nil, "You will no longer be emailed about "+existing.Description()+".")
+}
+
+// renderUnsubscribe asks to confirm stopping a watch, or says that it has
+// stopped. The watch is nil once it has.
+func (h *Watches) renderUnsubscribe(w http.ResponseWriter, r *http.Request, existing *models.Watch, notice string) {
+	user, _ := r.Context().Value("user").(*models.User)
+	data := viewmodels.PageData{
+		Watches:     viewmodels.WatchesViewModel{Page: existing},
+		Notice:      notice,
+		CurrentUser: user,
+		IsLoggedIn:  user != nil,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err := h.Templates["unsubscribe.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
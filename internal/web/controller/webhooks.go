@@ -0,0 +1,263 @@
+package controller
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sowing/internal/audit"
+	"sowing/internal/models"
+	"sowing/internal/silo"
+	"sowing/internal/web/viewmodels"
+	"sowing/internal/webhook"
+	"strconv"
+	"strings"
+)
+
+// deliveryLogLimit is how many deliveries a webhook's page shows.
+const deliveryLogLimit = 50
+
+// Webhooks provides the handlers for managing a silo's webhooks
+type Webhooks struct {
+	SiloRepo   *silo.Repository
+	Hooks      *webhook.Repository
+	Dispatcher *webhook.Dispatcher
+	AuditRepo  *audit.Repository
+	Templates  map[string]*template.Template
+}
+
+// Register registers the webhook routes
+func (h *Webhooks) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /{siloSlug}/settings/webhooks", h.list)
+	mux.HandleFunc("POST /{siloSlug}/settings/webhooks", h.create)
+	mux.HandleFunc("GET /{siloSlug}/settings/webhooks/{webhookID}", h.view)
+	mux.HandleFunc("POST /{siloSlug}/settings/webhooks/{webhookID}/active", h.setActive)
+	mux.HandleFunc("POST /{siloSlug}/settings/webhooks/{webhookID}/ping", h.ping)
+	mux.HandleFunc("POST /{siloSlug}/settings/webhooks/{webhookID}/delete", h.delete)
+	mux.HandleFunc("POST /{siloSlug}/settings/webhooks/{webhookID}/deliveries/{deliveryID}/redeliver", h.redeliver)
+}
+
+func (h *Webhooks) list(w http.ResponseWriter, r *http.Request) {
+	current, ok := findManagedSilo(w, r, h.SiloRepo)
+	if !ok {
+		return
+	}
+	h.renderList(w, r, current, "")
+}
+
+func (h *Webhooks) create(w http.ResponseWriter, r *http.Request) {
+	current, ok := findManagedSilo(w, r, h.SiloRepo)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	target := strings.TrimSpace(r.PostFormValue("url"))
+	if err := h.Dispatcher.Guard.CheckURL(r.Context(), target); err != nil {
+		errMsg := "The webhook's host can't be found."
+		if errors.Is(err, webhook.ErrInvalidURL) {
+			errMsg = "Enter an http:// or https:// URL."
+		} else if errors.Is(err, webhook.ErrForbiddenAddress) {
+			errMsg = "Webhooks can't be sent to local or private network addresses."
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		h.renderList(w, r, current, errMsg)
+		return
+	}
+	var selected []string
+	for _, eventType := range r.PostForm["events"] {
+		if !slices.Contains(webhook.Events, eventType) {
+			w.WriteHeader(http.StatusBadRequest)
+			h.renderList(w, r, current, "Unknown event: "+eventType)
+			return
+		}
+		selected = append(selected, eventType)
+	}
+	// Every event is the same as none, which also gets events added later.
+	if len(selected) == len(webhook.Events) {
+		selected = nil
+	}
+
+	secret, err := webhook.NewSecret()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	hook := &models.Webhook{SiloID: current.ID, URL: target, Secret: secret, Events: selected, Active: true}
+	if err := h.Hooks.Create(hook); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	h.AuditRepo.RecordRequest(r, "silo.webhook_create", current.Slug, target)
+
+	http.Redirect(w, r, h.hookURL(current, hook.ID), http.StatusSeeOther)
+}
+
+func (h *Webhooks) view(w http.ResponseWriter, r *http.Request) {
+	current, hook, ok := h.findHook(w, r)
+	if !ok {
+		return
+	}
+
+	deliveries, err := h.Hooks.ListDeliveries(hook.ID, deliveryLogLimit)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	// Responses can hold whatever the webhook's server answered with, so
+	// only admins, who choose which addresses webhooks can reach, see them.
+	user, _ := r.Context().Value("user").(*models.User)
+	if user == nil || !user.IsAdmin {
+		for i := range deliveries {
+			deliveries[i].ResponseBody = ""
+		}
+	}
+	data := viewmodels.PageData{
+		Silo:        *current,
+		Webhooks:    viewmodels.WebhooksViewModel{Hook: hook, Deliveries: deliveries},
+		Notice:      r.URL.Query().Get("notice"),
+		CurrentUser: user,
+		IsLoggedIn:  user != nil,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = h.Templates["silo_webhook.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (h *Webhooks) setActive(w http.ResponseWriter, r *http.Request) {
+	current, hook, ok := h.findHook(w, r)
+	if !ok {
+		return
+	}
+
+	active := r.FormValue("active") == "1"
+	if err := h.Hooks.SetActive(hook.ID, active); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	action := "silo.webhook_resume"
+	if !active {
+		action = "silo.webhook_pause"
+	}
+	h.AuditRepo.RecordRequest(r, action, current.Slug, hook.URL)
+
+	http.Redirect(w, r, h.hookURL(current, hook.ID), http.StatusSeeOther)
+}
+
+func (h *Webhooks) ping(w http.ResponseWriter, r *http.Request) {
+	current, hook, ok := h.findHook(w, r)
+	if !ok {
+		return
+	}
+
+	user, _ := r.Context().Value("user").(*models.User)
+	if err := h.Dispatcher.Ping(hook, user.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	http.Redirect(w, r, h.hookURL(current, hook.ID)+"?notice="+url.QueryEscape("A ping event was queued."), http.StatusSeeOther)
+}
+
+func (h *Webhooks) delete(w http.ResponseWriter, r *http.Request) {
+	current, hook, ok := h.findHook(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.Hooks.Delete(hook.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	h.AuditRepo.RecordRequest(r, "silo.webhook_delete", current.Slug, hook.URL)
+
+	http.Redirect(w, r, "/"+current.Slug+"/settings/webhooks", http.StatusSeeOther)
+}
+
+func (h *Webhooks) redeliver(w http.ResponseWriter, r *http.Request) {
+	current, hook, ok := h.findHook(w, r)
+	if !ok {
+		return
+	}
+
+	deliveryID, _ := strconv.Atoi(r.PathValue("deliveryID"))
+	delivery, err := h.Hooks.FindDelivery(deliveryID)
+	if err != nil || delivery.WebhookID != hook.ID {
+		http.NotFound(w, r)
+		return
+	}
+	if err := h.Dispatcher.Redeliver(delivery); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	http.Redirect(w, r, h.hookURL(current, hook.ID)+"?notice="+url.QueryEscape("Delivery "+strconv.Itoa(delivery.ID)+" was queued again."), http.StatusSeeOther)
+}
+
+// renderList shows a silo's webhooks and the form to add one.
+func (h *Webhooks) renderList(w http.ResponseWriter, r *http.Request, current *models.Silo, errMsg string) {
+	hooks, err := h.Hooks.ListBySilo(current.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(*models.User)
+	data := viewmodels.PageData{
+		Silo:        *current,
+		Webhooks:    viewmodels.WebhooksViewModel{Hooks: hooks, EventTypes: webhook.Events},
+		Error:       errMsg,
+		CurrentUser: user,
+		IsLoggedIn:  user != nil,
+		CSRFToken:   csrfToken(r),
+	}
+
+	err = h.Templates["silo_webhooks.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// findHook looks up the silo and webhook named by the request path, checking
+// that the current user may manage the silo.
+func (h *Webhooks) findHook(w http.ResponseWriter, r *http.Request) (*models.Silo, *models.Webhook, bool) {
+	current, ok := findManagedSilo(w, r, h.SiloRepo)
+	if !ok {
+		return nil, nil, false
+	}
+
+	webhookID, _ := strconv.Atoi(r.PathValue("webhookID"))
+	hook, err := h.Hooks.FindByID(webhookID)
+	if err == sql.ErrNoRows || err == nil && hook.SiloID != current.ID {
+		http.NotFound(w, r)
+		return nil, nil, false
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", 500)
+		return nil, nil, false
+	}
+	return current, hook, true
+}
+
+func (h *Webhooks) hookURL(current *models.Silo, webhookID int) string {
+	return "/" + current.Slug + "/settings/webhooks/" + strconv.Itoa(webhookID)
+}
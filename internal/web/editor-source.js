@@ -1,6 +1,11 @@
 import { EditorView, basicSetup } from "codemirror"
 import { EditorState } from "@codemirror/state"
 
+// --- CSRF ---
+
+// The server requires this token on every state-changing request.
+const csrfToken = document.querySelector('meta[name="csrf-token"]')?.content ?? '';
+
 // --- Preview Logic ---
 
 // Debounce function to limit how often the preview is updated
@@ -22,6 +27,7 @@ async function updatePreview(docText) {
             method: 'POST',
             headers: {
                 'Content-Type': 'text/plain; charset=utf-8',
+                'X-CSRF-Token': csrfToken,
             },
             body: docText
         });
@@ -64,6 +70,9 @@ function createUploadButton(view) {
             try {
                 const response = await fetch('/upload', {
                     method: 'POST',
+                    headers: {
+                        'X-CSRF-Token': csrfToken,
+                    },
                     body: formData
                 });
                 if (response.ok) {
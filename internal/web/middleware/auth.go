@@ -15,3 +15,23 @@ func Auth(authService *auth.Service) func(http.Handler) http.Handler {
 func WithUser(authService *auth.Service) func(http.Handler) http.Handler {
 	return authService.WithUser
 }
+
+// APIToken returns a new bearer token middleware
+func APIToken(authService *auth.Service) func(http.Handler) http.Handler {
+	return authService.WithAPIToken
+}
+
+// Admin returns a new middleware restricting routes to site administrators
+func Admin(authService *auth.Service) func(http.Handler) http.Handler {
+	return authService.RequireAdmin
+}
+
+// BasicToken returns a new middleware requiring an API token as a basic auth password
+func BasicToken(authService *auth.Service, readMethods ...string) func(http.Handler) http.Handler {
+	return authService.RequireBasicToken(readMethods...)
+}
+
+// LoginOrBasicToken returns a new middleware requiring a signed-in user or an API token as a basic auth password
+func LoginOrBasicToken(authService *auth.Service, readMethods ...string) func(http.Handler) http.Handler {
+	return authService.RequireLoginOrBasicToken(readMethods...)
+}
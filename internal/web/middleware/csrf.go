@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"context"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"sowing/internal/auth"
+	"sowing/internal/web/viewmodels"
+)
+
+// CSRF returns a new middleware that protects state-changing requests with a
+// synchronizer token. The token is stored in the session of signed-in users,
+// and in the "sowing-csrf" cookie of visitors without a session, and must be
+// sent back in a "csrf_token" form field or an X-CSRF-Token header. Handlers
+// get it with a func() string from the request context, which creates it on
+// first use. Requests using an API token are exempt, since browsers never
+// attach those on their own.
+func CSRF(authService *auth.Service, templates map[string]*template.Template) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				token := r.Header.Get("X-CSRF-Token")
+				if token == "" {
+					token = r.PostFormValue("csrf_token")
+				}
+				if !authService.ValidCSRFToken(r, token) {
+					forbidden(w, r, authService, templates)
+					return
+				}
+			}
+
+			// The token is only created when a handler asks for it to put in
+			// a page, so that feeds, files and redirects don't store sessions.
+			var once sync.Once
+			var token string
+			lazyToken := func() string {
+				once.Do(func() {
+					var err error
+					if token, err = authService.CSRFToken(w, r); err != nil {
+						log.Printf("Error creating CSRF token: %v", err)
+					}
+				})
+				return token
+			}
+
+			ctx := context.WithValue(r.Context(), "csrf_token", lazyToken)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// forbidden renders the page shown when a request fails the CSRF check.
+func forbidden(w http.ResponseWriter, r *http.Request, authService *auth.Service, templates map[string]*template.Template) {
+	user := authService.GetCurrentUser(r)
+	token, _ := authService.CSRFToken(w, r)
+	data := viewmodels.PageData{
+		CSRFToken:   token,
+		ShowSidebar: false,
+		CurrentUser: user,
+		IsLoggedIn:  user != nil,
+	}
+
+	w.WriteHeader(http.StatusForbidden)
+	err := templates["forbidden.html"].ExecuteTemplate(w, "layout.html", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,130 @@
+package renderer
+
+import (
+	"html"
+	"html/template"
+	"net/url"
+	"strings"
+
+	"github.com/niklasfasching/go-org/org"
+
+	"sowing/internal/mention"
+)
+
+// NewHTMLWriterWithMentions is NewHTMLWriterWithChroma, also linking the
+// @username mentions of the given usernames to their users' profiles. Other
+// mentions are left as text.
+func NewHTMLWriterWithMentions(usernames map[string]bool) *org.HTMLWriter {
+	w := NewHTMLWriterWithChroma()
+	w.ExtendingWriter = &mentionWriter{HTMLWriter: w, usernames: usernames}
+	return w
+}
+
+// Mentions returns the usernames mentioned in org content, each once, in the
+// order they are first mentioned. Only the mentions that would be linked
+// count, so ones in code, examples, LaTeX and link descriptions are left out.
+func Mentions(content string) ([]string, error) {
+	w := &mentionWriter{HTMLWriter: org.NewHTMLWriter()}
+	w.ExtendingWriter = w
+	if _, err := org.New().Parse(strings.NewReader(content), "").Write(w.HTMLWriter); err != nil {
+		return nil, err
+	}
+	return w.mentioned, nil
+}
+
+// mentionWriter writes text with its mentions linked.
+type mentionWriter struct {
+	*org.HTMLWriter
+	usernames map[string]bool
+	// verbatim counts the code blocks and links being written, whose text is
+	// left as it is.
+	verbatim int
+	// mentioned lists the usernames mentioned outside them, each once.
+	mentioned []string
+	seen      map[string]bool
+}
+
+func (w *mentionWriter) WriteText(t org.Text) {
+	if w.verbatim > 0 || t.IsRaw {
+		w.HTMLWriter.WriteText(t)
+		return
+	}
+	last := 0
+	for _, m := range mention.FindAll(t.Content) {
+		if !w.seen[m.Username] {
+			if w.seen == nil {
+				w.seen = make(map[string]bool)
+			}
+			w.seen[m.Username] = true
+			w.mentioned = append(w.mentioned, m.Username)
+		}
+		if !w.usernames[m.Username] {
+			continue
+		}
+		w.HTMLWriter.WriteText(org.Text{Content: t.Content[last:m.Start]})
+		w.WriteString(mentionLink(m.Username))
+		last = m.End
+	}
+	w.HTMLWriter.WriteText(org.Text{Content: t.Content[last:]})
+}
+
+func (w *mentionWriter) WriteBlock(b org.Block) {
+	if b.Name == "SRC" || b.Name == "EXAMPLE" || b.Name == "EXPORT" {
+		w.verbatim++
+		defer func() { w.verbatim-- }()
+	}
+	w.HTMLWriter.WriteBlock(b)
+}
+
+func (w *mentionWriter) WriteExample(e org.Example) {
+	w.verbatim++
+	defer func() { w.verbatim-- }()
+	w.HTMLWriter.WriteExample(e)
+}
+
+func (w *mentionWriter) WriteInlineBlock(b org.InlineBlock) {
+	w.verbatim++
+	defer func() { w.verbatim-- }()
+	w.HTMLWriter.WriteInlineBlock(b)
+}
+
+func (w *mentionWriter) WriteLatexBlock(b org.LatexBlock) {
+	w.verbatim++
+	defer func() { w.verbatim-- }()
+	w.HTMLWriter.WriteLatexBlock(b)
+}
+
+func (w *mentionWriter) WriteLatexFragment(l org.LatexFragment) {
+	w.verbatim++
+	defer func() { w.verbatim-- }()
+	w.HTMLWriter.WriteLatexFragment(l)
+}
+
+// Links can't hold other links.
+func (w *mentionWriter) WriteRegularLink(l org.RegularLink) {
+	w.verbatim++
+	defer func() { w.verbatim-- }()
+	w.HTMLWriter.WriteRegularLink(l)
+}
+
+// LinkMentions escapes plain text, such as a revision comment, for HTML,
+// linking the @username mentions of the given usernames to their users'
+// profiles.
+func LinkMentions(text string, usernames map[string]bool) template.HTML {
+	var b strings.Builder
+	last := 0
+	for _, m := range mention.FindAll(text) {
+		if !usernames[m.Username] {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[last:m.Start]))
+		b.WriteString(mentionLink(m.Username))
+		last = m.End
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return template.HTML(b.String())
+}
+
+func mentionLink(username string) string {
+	return `<a class="mention" href="/users/` + html.EscapeString(url.PathEscape(username)) + `">@` + html.EscapeString(username) + `</a>`
+}
@@ -0,0 +1,35 @@
+package renderer
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMentions(t *testing.T) {
+	content := `* Ask @alice
+Or @bob, but not [[https://example.com/@carol][@carol]] or src_go{@dave}.
+
+#+BEGIN_SRC go
+// @erin
+#+END_SRC
+
+#+BEGIN_EXAMPLE
+@frank
+#+END_EXAMPLE
+
+: @grace
+
+#+BEGIN_QUOTE
+@heidi and @alice again
+#+END_QUOTE
+
+$@ivan$
+`
+	got, err := Mentions(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice", "bob", "heidi"}; !slices.Equal(got, want) {
+		t.Errorf("Mentions() = %v, want %v", got, want)
+	}
+}
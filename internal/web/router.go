@@ -1,8 +1,14 @@
 package web
 
 import (
+	"errors"
+	"io/fs"
+	"log"
 	"net/http"
 
+	"golang.org/x/net/webdav"
+
+	"sowing/internal/dav"
 	"sowing/internal/web/controller"
 	"sowing/internal/web/middleware"
 )
@@ -12,20 +18,103 @@ func (s *Server) routes() http.Handler {
 	mux.Handle("/static/", http.StripPrefix("/static/", StaticFileServer()))
 	mux.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir("uploads"))))
 
-	authController := controller.Auth{AuthService: s.authService, Templates: s.templates}
-	authController.Register(mux)
+	appMux := http.NewServeMux()
+	authController := controller.Auth{AuthService: s.authService, BaseURL: s.baseURL, Mail: s.mail, Templates: s.templates}
+	authController.Register(appMux)
 
 	authenticatedMux := http.NewServeMux()
-	siloController := controller.Silo{SiloRepo: s.siloRepo, Templates: s.templates}
+	siloController := controller.Silo{SiloRepo: s.siloRepo, PageRepo: s.pageRepo, AuditRepo: s.auditRepo, Templates: s.templates}
 	siloController.Register(authenticatedMux)
 
-	pageController := controller.Page{PageRepo: s.pageRepo, SiloRepo: s.siloRepo, Templates: s.templates}
+	webhooksController := controller.Webhooks{SiloRepo: s.siloRepo, Hooks: s.webhookRepo, Dispatcher: s.dispatcher, AuditRepo: s.auditRepo, Templates: s.templates}
+	webhooksController.Register(authenticatedMux)
+
+	pageController := controller.Page{PageRepo: s.pageRepo, SiloRepo: s.siloRepo, WatchRepo: s.watchRepo, NotificationRepo: s.notificationRepo, Templates: s.templates}
 	pageController.Register(authenticatedMux)
 
-	miscController := controller.Misc{AttachmentRepo: s.attachmentRepo}
+	changesController := controller.Changes{PageRepo: s.pageRepo, SiloRepo: s.siloRepo, Templates: s.templates, BaseURL: s.baseURL}
+	changesController.Register(authenticatedMux)
+
+	watchesController := controller.Watches{SiloRepo: s.siloRepo, PageRepo: s.pageRepo, WatchRepo: s.watchRepo, EmailEnabled: s.mail != nil, Templates: s.templates}
+	watchesController.Register(authenticatedMux)
+
+	miscController := controller.Misc{AttachmentRepo: s.attachmentRepo, NotificationRepo: s.notificationRepo}
 	miscController.Register(authenticatedMux)
 
-	mux.Handle("/", middleware.WithUser(s.authService)(middleware.Auth(s.authService)(authenticatedMux)))
+	settingsController := controller.Settings{AuthService: s.authService, Templates: s.templates}
+	settingsController.Register(authenticatedMux)
+
+	invitationsController := controller.Invitations{AuthService: s.authService, SiloRepo: s.siloRepo, BaseURL: s.baseURL, Templates: s.templates}
+	invitationsController.Register(authenticatedMux)
+
+	appMux.Handle("/", middleware.APIToken(s.authService)(middleware.WithUser(s.authService)(middleware.Auth(s.authService)(authenticatedMux))))
+
+	// Profiles and notifications have their own mux, as their paths would
+	// otherwise clash with silo routes such as /{siloSlug}/settings.
+	peopleMux := http.NewServeMux()
+	usersController := controller.Users{AuthService: s.authService, PageRepo: s.pageRepo, Templates: s.templates}
+	usersController.Register(peopleMux)
+	notificationsController := controller.Notifications{NotificationRepo: s.notificationRepo, Templates: s.templates}
+	notificationsController.Register(peopleMux)
+
+	people := middleware.APIToken(s.authService)(middleware.WithUser(s.authService)(middleware.Auth(s.authService)(peopleMux)))
+	appMux.Handle("/users/", people)
+	appMux.Handle("/notifications", people)
+	appMux.Handle("/notifications/", people)
+
+	// Unsubscribe links in emails work without signing in, so that they can be
+	// followed from any device.
+	unsubscribeMux := http.NewServeMux()
+	watchesController.RegisterUnsubscribe(unsubscribeMux)
+
+	appMux.Handle("/unsubscribe/", middleware.WithUser(s.authService)(unsubscribeMux))
+
+	// Feed readers can't sign in with a form, so feeds also accept an API
+	// token as a basic auth password.
+	feedsMux := http.NewServeMux()
+	changesController.RegisterFeeds(feedsMux)
+
+	appMux.Handle("/feeds/", middleware.APIToken(s.authService)(middleware.WithUser(s.authService)(middleware.LoginOrBasicToken(s.authService, http.MethodGet, http.MethodHead)(feedsMux))))
+
+	// The API answers with JSON rather than redirecting to the login page.
+	apiMux := http.NewServeMux()
+	apiController := controller.API{SiloRepo: s.siloRepo, PageRepo: s.pageRepo, AttachmentRepo: s.attachmentRepo}
+	apiController.Register(apiMux)
+
+	appMux.Handle("/api/", middleware.APIToken(s.authService)(middleware.WithUser(s.authService)(apiMux)))
+
+	// The admin console has its own mux so that every route in it passes the admin check.
+	adminMux := http.NewServeMux()
+	adminController := controller.Admin{
+		AuthService:    s.authService,
+		SiloRepo:       s.siloRepo,
+		PageRepo:       s.pageRepo,
+		AttachmentRepo: s.attachmentRepo,
+		AuditRepo:      s.auditRepo,
+		DB:             s.db,
+		BaseURL:        s.baseURL,
+		Templates:      s.templates,
+	}
+	adminController.Register(adminMux)
+
+	appMux.Handle("/admin/", middleware.APIToken(s.authService)(middleware.WithUser(s.authService)(middleware.Auth(s.authService)(middleware.Admin(s.authService)(adminMux)))))
+
+	// WebDAV clients authenticate with an API token on every request, so they
+	// have no session to forge requests with.
+	davHandler := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: &dav.FileSystem{Pages: s.pageRepo, Silos: s.siloRepo},
+		LockSystem: s.davLocks,
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission) {
+				log.Printf("WebDAV %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	mux.Handle("/dav/", middleware.BasicToken(s.authService, http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND")(davHandler))
+
+	// Everything except static files is protected against cross-site request forgery.
+	mux.Handle("/", middleware.CSRF(s.authService, s.templates)(appMux))
 
 	return mux
 }
@@ -4,38 +4,76 @@ import (
 	"database/sql"
 	"html/template"
 	"net/http"
+	"strings"
+
+	"golang.org/x/net/webdav"
 
 	"sowing/internal/attachment"
+	"sowing/internal/audit"
 	"sowing/internal/auth"
+	"sowing/internal/events"
+	"sowing/internal/mailer"
+	"sowing/internal/notification"
 	"sowing/internal/page"
+	"sowing/internal/settings"
 	"sowing/internal/silo"
+	"sowing/internal/watch"
+	"sowing/internal/webhook"
 )
 
 // Server holds the dependencies for the web server.
 type Server struct {
-	db             *sql.DB
-	templates      map[string]*template.Template
-	authService    *auth.Service
-	attachmentRepo *attachment.Repository
-	pageRepo       *page.Repository
-	siloRepo       *silo.Repository
+	db               *sql.DB
+	templates        map[string]*template.Template
+	authService      *auth.Service
+	attachmentRepo   *attachment.Repository
+	pageRepo         *page.Repository
+	siloRepo         *silo.Repository
+	auditRepo        *audit.Repository
+	webhookRepo      *webhook.Repository
+	dispatcher       *webhook.Dispatcher
+	watchRepo        *watch.Repository
+	notificationRepo *notification.Repository
+	// baseURL is the address users reach Sowing at, for links that are
+	// shown to be copied or sent by email.
+	baseURL string
+	// mail is the mail server, or nil if Sowing can't send email.
+	mail *mailer.Config
+	// davLocks holds WebDAV locks, which must outlive a request.
+	davLocks webdav.LockSystem
 }
 
-// NewServer creates a new server with the given dependencies.
-func NewServer(db *sql.DB, templates map[string]*template.Template) *Server {
+// NewServer creates a new server with the given dependencies. Changes made
+// through it are published on the bus, and the dispatcher sends the webhooks
+// that are tested or redelivered from a silo's settings. Links sent outside
+// the site start with baseURL, and email is sent through mail unless it is nil.
+func NewServer(db *sql.DB, templates map[string]*template.Template, bus *events.Bus, dispatcher *webhook.Dispatcher, baseURL string, mail *mailer.Config) *Server {
 	authRepo := auth.NewRepository(db)
-	authService := auth.NewService(authRepo)
+	settingsRepo := settings.NewRepository(db)
+	authService := auth.NewService(authRepo, settingsRepo)
 	attachmentRepo := attachment.NewRepository(db)
+	attachmentRepo.Events = bus
 	pageRepo := page.NewRepository(db)
+	pageRepo.Events = bus
 	siloRepo := silo.NewRepository(db)
+	siloRepo.Events = bus
+	auditRepo := audit.NewRepository(db)
 
 	return &Server{
-		db:             db,
-		templates:      templates,
-		authService:    authService,
-		attachmentRepo: attachmentRepo,
-		pageRepo:       pageRepo,
-		siloRepo:       siloRepo,
+		db:               db,
+		templates:        templates,
+		authService:      authService,
+		attachmentRepo:   attachmentRepo,
+		pageRepo:         pageRepo,
+		siloRepo:         siloRepo,
+		auditRepo:        auditRepo,
+		webhookRepo:      webhook.NewRepository(db),
+		dispatcher:       dispatcher,
+		watchRepo:        watch.NewRepository(db),
+		notificationRepo: notification.NewRepository(db),
+		baseURL:          strings.TrimSuffix(baseURL, "/"),
+		mail:             mail,
+		davLocks:         webdav.NewMemLS(),
 	}
 }
 
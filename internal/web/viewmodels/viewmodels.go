@@ -8,10 +8,129 @@ import (
 
 // RevisionViewModel combines revision and user information for display.
 type RevisionViewModel struct {
-	ID        int
-	CreatedAt time.Time
-	Author    string
-	Comment   *string
+	ID             int
+	CreatedAt      time.Time
+	Author         string
+	AuthorUsername string
+	Comment        *string
+}
+
+// ChangeViewModel is a revision listed among recent changes.
+type ChangeViewModel struct {
+	RevisionID         int
+	PreviousRevisionID int // 0 if the revision created the page
+	PageID             int
+	Title              string
+	Path               string
+	SiloSlug           string
+	SiloName           string
+	Author             string
+	AuthorUsername     string
+	Comment            *string
+	CreatedAt          time.Time
+}
+
+// WatchesViewModel is what the current user watches.
+type WatchesViewModel struct {
+	Page         *models.Watch  // Their watch of the page being viewed
+	Silo         *models.Watch  // Their watch of the silo being viewed
+	Watches      []models.Watch // All their watches, on the settings page
+	Digest       string         // How often they are emailed
+	Digests      []string
+	EmailEnabled bool // Whether the site is set up to send email
+}
+
+// SearchResultViewModel is a page found by a search.
+type SearchResultViewModel struct {
+	PageID  int
+	Title   string
+	Path    string
+	Snippet string // Content around the first match
+}
+
+// TwoFactorViewModel holds the state shown on the two-factor settings page.
+type TwoFactorViewModel struct {
+	Enabled           bool
+	Secret            string       // The pending secret, for manual entry
+	ProvisioningURI   string       // The otpauth:// URI encoded in the QR code
+	QRCode            template.URL // A data: URL of the QR code image
+	RecoveryCodes     []string     // Freshly generated codes, shown once
+	RecoveryCodesLeft int
+}
+
+// SessionViewModel describes one of a user's active sessions.
+type SessionViewModel struct {
+	models.Session
+	Current  bool   // Whether this is the session making the request
+	Username string // The session's user, on the admin sessions page
+}
+
+// RegistrationViewModel holds the registration policy and the state of the
+// registration form.
+type RegistrationViewModel struct {
+	Mode            string
+	Modes           []string // All modes, for the admin settings form
+	AllowedDomains  string   // Comma separated, as entered by an admin
+	Invitation      string   // The invitation token carried by the form
+	InvitationEmail string   // The address the invitation was sent to, if any
+	Pending         bool     // Set after registering while approval is required
+	// VerificationSentTo is the address a confirmation link is sent to after
+	// registering with an email address on an allowed domain.
+	VerificationSentTo string
+}
+
+// InvitationViewModel describes an invitation in the list of invitations.
+type InvitationViewModel struct {
+	models.Invitation
+	CreatedByName string
+	SiloName      string
+	Status        string // "pending", "used" or "expired"
+}
+
+// AdminUserViewModel holds everything the admin user page shows about a user.
+type AdminUserViewModel struct {
+	models.User
+	Identities []models.Identity
+	Sessions   []models.Session
+	Tokens     []models.APIToken
+	TwoFactor  bool
+	Lockout    *models.AccountLockout // nil if the user has no failed logins
+	Roles      []SiloRoleViewModel
+}
+
+// SiloRoleViewModel describes a role held in a silo.
+type SiloRoleViewModel struct {
+	Silo     models.Silo
+	UserID   int
+	Username string
+	Role     string
+}
+
+// AdminSiloViewModel describes a silo on the admin pages.
+type AdminSiloViewModel struct {
+	models.Silo
+	Owners       []SiloRoleViewModel
+	Pages        int
+	Revisions    int
+	ContentBytes int64
+}
+
+// StorageViewModel summarises the disk space used by the site.
+type StorageViewModel struct {
+	DatabaseBytes   int64
+	UploadFiles     int
+	UploadBytes     int64
+	Attachments     int
+	AttachmentBytes int64
+	Silos           []AdminSiloViewModel
+}
+
+// WebhooksViewModel holds what the webhook settings pages of a silo show.
+type WebhooksViewModel struct {
+	Hooks      []models.Webhook
+	Hook       *models.Webhook          // The webhook being viewed
+	Deliveries []models.WebhookDelivery // Its most recent deliveries
+	EventTypes []string                 // For the event checkboxes
 }
 
 // PageData is a unified struct to hold all possible data for any page.
@@ -20,12 +139,42 @@ type PageData struct {
 	ShowSidebar  bool
 	Silos        []models.Silo
 	Silo         models.Silo
-	Page         models.Page    // The current page being viewed
+	Page         models.Page // The current page being viewed
 	Revisions    []RevisionViewModel
 	SiloPages    []*models.Page // The page tree for the sidebar
 	Content      template.HTML
 	AllSiloPages []models.Page // For the parent dropdown on the new page
 	ParentID     int           // The pre-selected parent on the new page
+	HomePageID   int           // The landing page chosen on the silo settings page
+	Query        string        // The search query on the search page
+	Results      []SearchResultViewModel
+	Changes      []ChangeViewModel // The revisions on a recent changes page or a user's profile
+	Profile      *models.User      // The user whose profile is shown
+	FeedURL      string            // An Atom feed of the page's changes, linked from its head
 	CurrentUser  *models.User
 	IsLoggedIn   bool
+	CSRFToken    string            // Must be included in every state-changing form
+	APITokens    []models.APIToken // The current user's tokens on the settings page
+	NewAPIToken  string            // Plaintext of a freshly created token, shown once
+	TwoFactor    TwoFactorViewModel
+	Sessions     []SessionViewModel
+	Registration RegistrationViewModel
+	PendingUsers []models.User // Users awaiting approval on the admin page
+	Invitations  []InvitationViewModel
+	InviteURL    string // Link of a freshly created invitation, shown once
+	CanInvite    bool
+	CanManage    bool   // Whether the current user may change the silo's settings
+	ResetToken   string // The token carried by the password reset form
+	ResetURL     string // A freshly issued password reset link, shown once
+	Users        []models.User
+	AdminUser    AdminUserViewModel
+	AdminSilos   []AdminSiloViewModel
+	Storage      StorageViewModel
+	AuditLog     []models.AuditEntry
+	LoginLog     []models.LoginAttempt
+	Webhooks     WebhooksViewModel
+	Watches      WatchesViewModel
+	Mentions     []models.Notification // The current user's notifications of being mentioned
+	Notice       string                // A confirmation shown after a successful change
+	Error        string
 }
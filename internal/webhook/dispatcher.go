@@ -0,0 +1,362 @@
+// Package webhook sends a silo's events to the URLs its managers configure,
+// as JSON payloads signed with each webhook's secret. Deliveries are queued
+// in the database and retried with backoff until they succeed or run out of
+// attempts.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sowing/internal/events"
+	"sowing/internal/models"
+	"sowing/internal/page"
+)
+
+const (
+	// MaxAttempts is how many times a delivery is attempted before it fails.
+	MaxAttempts = 6
+	// firstRetry is how long to wait before the first retry. Each retry after
+	// waits twice as long as the one before, so the last is 16 minutes later.
+	firstRetry = time.Minute
+	// timeout is how long a webhook has to respond.
+	timeout = 10 * time.Second
+	// maxResponseBody is how much of a response is kept in the delivery log.
+	maxResponseBody = 1024
+)
+
+// Ping is the event sent to test a webhook.
+const Ping = "ping"
+
+// Events lists the events a webhook can be sent. A silo has no webhooks yet
+// when it is created, so silo.created is never sent.
+var Events = []string{events.PageCreated, events.PageRevised, events.PageMoved, events.PageArchived, events.AttachmentUploaded}
+
+// Dispatcher queues events for the webhooks that want them and sends them.
+type Dispatcher struct {
+	Hooks  *Repository
+	Pages  *page.Repository
+	DB     *sql.DB
+	Client *http.Client
+	// Guard decides which addresses webhooks may be sent to. Client only
+	// connects to those.
+	Guard Guard
+	// BaseURL is the address users reach Sowing at, used to make the links
+	// in payloads absolute. If it is empty they are relative.
+	BaseURL string
+
+	wake chan struct{}
+}
+
+// NewDispatcher creates a dispatcher. Its Handle method is subscribed to an
+// event bus, and Run sends what it queues.
+func NewDispatcher(db *sql.DB, baseURL string, guard Guard) *Dispatcher {
+	return &Dispatcher{
+		Hooks:   NewRepository(db),
+		Pages:   page.NewRepository(db),
+		DB:      db,
+		Client:  guard.Client(),
+		Guard:   guard,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// NewSecret generates a secret for signing a webhook's payloads.
+func NewSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Sign returns the signature of a payload, sent in the X-Sowing-Signature
+// header so that receivers can check that it came from Sowing: the hex HMAC
+// SHA-256 of the body, keyed with the webhook's secret, after "sha256=".
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Handle queues an event for every active webhook of its silo that wants it.
+func (d *Dispatcher) Handle(e events.Event) {
+	if e.SiloID == 0 {
+		return
+	}
+	hooks, err := d.Hooks.ListBySilo(e.SiloID)
+	if err != nil {
+		log.Printf("Error listing webhooks: %v", err)
+		return
+	}
+
+	var body []byte
+	for _, hook := range hooks {
+		if !hook.Active || !hook.Wants(e.Type) {
+			continue
+		}
+		if body == nil {
+			if body, err = d.payload(e); err != nil {
+				log.Printf("Error building %s webhook payload: %v", e.Type, err)
+				return
+			}
+		}
+		if _, err := d.Hooks.Enqueue(hook.ID, e.Type, string(body)); err != nil {
+			log.Println(err)
+		}
+	}
+	if body != nil {
+		d.Notify()
+	}
+}
+
+// Ping queues a ping event for a webhook, whether or not it is active, to
+// check that it is set up correctly.
+func (d *Dispatcher) Ping(hook *models.Webhook, actorID int) error {
+	body, err := d.payload(events.Event{Type: Ping, Time: time.Now(), SiloID: hook.SiloID, ActorID: actorID})
+	if err != nil {
+		return err
+	}
+	if _, err := d.Hooks.Enqueue(hook.ID, Ping, string(body)); err != nil {
+		return err
+	}
+	d.Notify()
+	return nil
+}
+
+// Redeliver queues a delivery's payload to be sent again, as a new delivery.
+func (d *Dispatcher) Redeliver(delivery *models.WebhookDelivery) error {
+	if _, err := d.Hooks.Enqueue(delivery.WebhookID, delivery.Event, delivery.Payload); err != nil {
+		return err
+	}
+	d.Notify()
+	return nil
+}
+
+// Notify wakes Run up to send what has been queued.
+func (d *Dispatcher) Notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends queued deliveries until ctx is done, as they are queued and when
+// their retries are due.
+func (d *Dispatcher) Run(ctx context.Context) {
+	for {
+		d.sendDue()
+
+		wait := time.Minute
+		if next, err := d.Hooks.nextDue(); err != nil {
+			log.Printf("Error checking webhook deliveries: %v", err)
+		} else if next != nil {
+			wait = min(wait, max(time.Until(*next), time.Second))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-d.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// sendDue attempts the deliveries that are due.
+func (d *Dispatcher) sendDue() {
+	for {
+		due, err := d.Hooks.due(time.Now(), 50)
+		if err != nil {
+			log.Printf("Error listing webhook deliveries: %v", err)
+			return
+		}
+		if len(due) == 0 {
+			return
+		}
+		for _, delivery := range due {
+			if err := d.send(&delivery); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+	}
+}
+
+// send makes an attempt to send a delivery and records how it went.
+func (d *Dispatcher) send(delivery *models.WebhookDelivery) error {
+	hook, err := d.Hooks.FindByID(delivery.WebhookID)
+	if err != nil {
+		return fmt.Errorf("error finding webhook %d: %w", delivery.WebhookID, err)
+	}
+
+	now := time.Now()
+	delivery.Attempts++
+	delivery.DeliveredAt = &now
+	delivery.ResponseCode, delivery.ResponseBody, delivery.Error = nil, "", ""
+
+	code, body, err := d.post(hook, delivery)
+	if err != nil {
+		delivery.Error = err.Error()
+	} else {
+		delivery.ResponseCode, delivery.ResponseBody = &code, body
+		if code < 200 || code > 299 {
+			delivery.Error = "the webhook responded with " + strconv.Itoa(code) + " " + http.StatusText(code)
+		}
+	}
+
+	switch {
+	case delivery.Error == "":
+		delivery.Status, delivery.NextAttemptAt = models.DeliverySucceeded, nil
+	case delivery.Attempts >= MaxAttempts:
+		delivery.Status, delivery.NextAttemptAt = models.DeliveryFailed, nil
+	default:
+		next := now.Add(firstRetry << (delivery.Attempts - 1))
+		delivery.NextAttemptAt = &next
+	}
+	return d.Hooks.recordAttempt(delivery)
+}
+
+// post sends a delivery's payload, returning the status and the start of the
+// body of the response.
+func (d *Dispatcher) post(hook *models.Webhook, delivery *models.WebhookDelivery) (int, string, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Sowing-Webhook")
+	req.Header.Set("X-Sowing-Event", delivery.Event)
+	req.Header.Set("X-Sowing-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-Sowing-Signature", Sign(hook.Secret, body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	start, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	return resp.StatusCode, string(start), nil
+}
+
+// payload is the JSON body sent to webhooks. Only the parts relevant to the
+// event are set.
+type payload struct {
+	Event      string             `json:"event"`
+	Time       time.Time          `json:"time"`
+	Silo       *payloadSilo       `json:"silo"`
+	Actor      *payloadUser       `json:"actor,omitempty"`
+	Page       *payloadPage       `json:"page,omitempty"`
+	Revision   *payloadRevision   `json:"revision,omitempty"`
+	Attachment *payloadAttachment `json:"attachment,omitempty"`
+}
+
+type payloadSilo struct {
+	ID   int    `json:"id"`
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type payloadUser struct {
+	ID          int    `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+}
+
+type payloadPage struct {
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+	Path  string `json:"path"`
+	URL   string `json:"url"`
+}
+
+type payloadRevision struct {
+	ID      int    `json:"id"`
+	Comment string `json:"comment"`
+	DiffURL string `json:"diff_url,omitempty"`
+}
+
+type payloadAttachment struct {
+	ID       int    `json:"id"`
+	Filename string `json:"filename"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size"`
+	URL      string `json:"url"`
+}
+
+// payload builds the body sent to webhooks for an event, describing things
+// as they are when it is queued.
+func (d *Dispatcher) payload(e events.Event) ([]byte, error) {
+	p := payload{Event: e.Type, Time: e.Time, Silo: &payloadSilo{ID: e.SiloID}}
+	err := d.DB.QueryRow("SELECT slug, name FROM silos WHERE id = ?", e.SiloID).Scan(&p.Silo.Slug, &p.Silo.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error finding silo: %w", err)
+	}
+	p.Silo.URL = d.BaseURL + "/" + p.Silo.Slug + "/"
+
+	if e.ActorID != 0 {
+		p.Actor = &payloadUser{ID: e.ActorID}
+		err := d.DB.QueryRow("SELECT username, display_name FROM users WHERE id = ?", e.ActorID).Scan(&p.Actor.Username, &p.Actor.DisplayName)
+		if err != nil {
+			return nil, fmt.Errorf("error finding user: %w", err)
+		}
+	}
+
+	if e.PageID != 0 {
+		p.Page = &payloadPage{ID: e.PageID}
+		if err := d.DB.QueryRow("SELECT title FROM pages WHERE id = ?", e.PageID).Scan(&p.Page.Title); err != nil {
+			return nil, fmt.Errorf("error finding page: %w", err)
+		}
+		if p.Page.Path, err = d.Pages.GetPathByID(e.PageID); err != nil {
+			return nil, err
+		}
+		p.Page.URL = d.BaseURL + "/" + p.Silo.Slug + "/wiki/" + p.Page.Path
+	}
+
+	if e.RevisionID != 0 {
+		p.Revision = &payloadRevision{ID: e.RevisionID}
+		var comment sql.NullString
+		var previous sql.NullInt64
+		err := d.DB.QueryRow("SELECT comment, (SELECT MAX(id) FROM revisions WHERE page_id = r.page_id AND id < r.id) FROM revisions r WHERE id = ?", e.RevisionID).
+			Scan(&comment, &previous)
+		if err != nil {
+			return nil, fmt.Errorf("error finding revision: %w", err)
+		}
+		p.Revision.Comment = comment.String
+		if previous.Valid && p.Page != nil {
+			p.Revision.DiffURL = fmt.Sprintf("%s/%s/diff/%s?from=%d&to=%d", d.BaseURL, p.Silo.Slug, p.Page.Path, previous.Int64, e.RevisionID)
+		}
+	}
+
+	if e.AttachmentID != 0 {
+		p.Attachment = &payloadAttachment{ID: e.AttachmentID}
+		var uniqueFilename string
+		err := d.DB.QueryRow("SELECT filename, unique_filename, mime_type, size FROM attachments WHERE id = ?", e.AttachmentID).
+			Scan(&p.Attachment.Filename, &uniqueFilename, &p.Attachment.MimeType, &p.Attachment.Size)
+		if err != nil {
+			return nil, fmt.Errorf("error finding attachment: %w", err)
+		}
+		p.Attachment.URL = d.BaseURL + "/uploads/" + uniqueFilename
+	}
+
+	return json.Marshal(p)
+}
@@ -0,0 +1,132 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrInvalidURL is returned for webhook URLs that aren't http or https.
+	ErrInvalidURL = errors.New("webhook URLs must be http:// or https:// URLs")
+	// ErrForbiddenAddress is returned for webhook URLs that point inside the
+	// network Sowing runs in, which its users mustn't reach through it.
+	ErrForbiddenAddress = errors.New("webhooks can't be sent to local, private or link-local addresses")
+)
+
+// reservedNetworks are ranges that aren't covered by the net.IP methods but
+// don't lead to the public internet either.
+var reservedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",       // This network
+	"100.64.0.0/10",   // Carrier-grade NAT
+	"192.0.0.0/24",    // IETF protocol assignments
+	"198.18.0.0/15",   // Benchmarking
+	"240.0.0.0/4",     // Reserved, and the broadcast address
+	"64:ff9b::/96",    // NAT64, which can embed any IPv4 address
+	"64:ff9b:1::/48",  // Local-use NAT64
+	"2001::/32",       // Teredo, which can too
+	"2002::/16",       // 6to4, which can too
+	"fec0::/10",       // Deprecated site-local
+	"100::/64",        // Discard-only
+	"2001:db8::/32",   // Documentation
+	"192.0.2.0/24",    // Documentation
+	"198.51.100.0/24", // Documentation
+	"203.0.113.0/24",  // Documentation
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// Guard decides which addresses webhooks may be sent to. Loopback and private
+// addresses are refused unless AllowPrivate is set, for sites whose webhooks
+// go to services on their own network. Link-local addresses, which include
+// cloud metadata services, are always refused.
+type Guard struct {
+	AllowPrivate bool
+}
+
+// allowed reports whether a webhook may be sent to an IP address.
+func (g Guard) allowed(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	switch {
+	case ip.IsUnspecified(), ip.IsMulticast(), ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return false
+	case ip.IsLoopback(), ip.IsPrivate():
+		return g.AllowPrivate
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckURL checks that a webhook URL is http or https and that its host only
+// resolves to addresses webhooks may be sent to. The addresses are checked
+// again when connecting, as DNS answers can change.
+func (g Guard) CheckURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return ErrInvalidURL
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("error looking up %s: %w", u.Hostname(), err)
+	}
+	for _, addr := range addrs {
+		if !g.allowed(addr.IP) {
+			return ErrForbiddenAddress
+		}
+	}
+	return nil
+}
+
+// control refuses connections to addresses webhooks may not be sent to. It
+// runs after the host has been resolved, so it sees the address actually used.
+func (g Guard) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !g.allowed(ip) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// Client returns an HTTP client for sending webhooks that only connects to
+// allowed addresses, ignores proxy settings, which would hide the address
+// connected to, and doesn't follow redirects, which could lead anywhere.
+func (g Guard) Client() *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: g.control}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     time.Minute,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
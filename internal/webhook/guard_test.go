@@ -0,0 +1,87 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGuardAllowed(t *testing.T) {
+	tests := []struct {
+		ip                     string
+		allowed, allowedIfOpen bool
+	}{
+		{"93.184.215.14", true, true},
+		{"2606:2800:21f:cb07:6820:80da:af6b:8b2c", true, true},
+		{"127.0.0.1", false, true},
+		{"::1", false, true},
+		{"10.1.2.3", false, true},
+		{"172.16.0.1", false, true},
+		{"192.168.1.1", false, true},
+		{"fd00::1", false, true},
+		{"::ffff:10.0.0.1", false, true},
+		{"169.254.169.254", false, false},
+		{"fe80::1", false, false},
+		{"0.0.0.0", false, false},
+		{"::", false, false},
+		{"100.64.0.1", false, false},
+		{"224.0.0.1", false, false},
+		{"255.255.255.255", false, false},
+		{"64:ff9b::a00:1", false, false},
+	}
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		if got := (Guard{}).allowed(ip); got != tt.allowed {
+			t.Errorf("allowed(%s) = %v, want %v", tt.ip, got, tt.allowed)
+		}
+		if got := (Guard{AllowPrivate: true}).allowed(ip); got != tt.allowedIfOpen {
+			t.Errorf("allowed(%s) with AllowPrivate = %v, want %v", tt.ip, got, tt.allowedIfOpen)
+		}
+	}
+}
+
+func TestGuardCheckURL(t *testing.T) {
+	ctx := context.Background()
+	for _, rawURL := range []string{"ftp://example.com/", "http://", "not a url"} {
+		if err := (Guard{}).CheckURL(ctx, rawURL); !errors.Is(err, ErrInvalidURL) {
+			t.Errorf("CheckURL(%q) = %v, want ErrInvalidURL", rawURL, err)
+		}
+	}
+	for _, rawURL := range []string{"http://127.0.0.1:8080/", "http://localhost/", "http://[::1]/", "http://169.254.169.254/latest/meta-data/"} {
+		if err := (Guard{}).CheckURL(ctx, rawURL); !errors.Is(err, ErrForbiddenAddress) {
+			t.Errorf("CheckURL(%q) = %v, want ErrForbiddenAddress", rawURL, err)
+		}
+	}
+	if err := (Guard{AllowPrivate: true}).CheckURL(ctx, "http://127.0.0.1:8080/"); err != nil {
+		t.Errorf("CheckURL of loopback with AllowPrivate = %v", err)
+	}
+}
+
+func TestGuardClient(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret"))
+	}))
+	defer target.Close()
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusFound)
+	}))
+	defer redirect.Close()
+
+	// The check made when connecting catches addresses that weren't checked
+	// before, or that a host name resolves to now.
+	if _, err := (Guard{}).Client().Get(target.URL); !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("getting a loopback address = %v, want ErrForbiddenAddress", err)
+	}
+
+	resp, err := (Guard{AllowPrivate: true}).Client().Get(redirect.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("status = %d, want the redirect itself", resp.StatusCode)
+	}
+}
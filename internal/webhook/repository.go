@@ -0,0 +1,174 @@
+package webhook
+
+import (
+	"database/sql"
+	"fmt"
+	"sowing/internal/models"
+	"strings"
+	"time"
+)
+
+// Repository provides access to the webhook storage.
+type Repository struct {
+	DB *sql.DB
+}
+
+// NewRepository creates a new webhook repository.
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{DB: db}
+}
+
+const webhookColumns = "id, silo_id, url, secret, events, active, created_at"
+
+const deliveryColumns = "id, webhook_id, event, payload, status, attempts, next_attempt_at, response_code, response_body, error, created_at, delivered_at"
+
+// Create adds a webhook to a silo.
+func (r *Repository) Create(hook *models.Webhook) error {
+	err := r.DB.QueryRow("INSERT INTO webhooks (silo_id, url, secret, events, active, created_at) VALUES (?, ?, ?, ?, ?, ?) RETURNING id",
+		hook.SiloID, hook.URL, hook.Secret, strings.Join(hook.Events, ","), hook.Active, time.Now()).Scan(&hook.ID)
+	if err != nil {
+		return fmt.Errorf("error creating webhook: %w", err)
+	}
+	return nil
+}
+
+// FindByID finds a webhook by its ID.
+func (r *Repository) FindByID(id int) (*models.Webhook, error) {
+	return scanWebhook(r.DB.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE id = ?", id))
+}
+
+// ListBySilo lists a silo's webhooks, oldest first.
+func (r *Repository) ListBySilo(siloID int) ([]models.Webhook, error) {
+	rows, err := r.DB.Query("SELECT "+webhookColumns+" FROM webhooks WHERE silo_id = ? ORDER BY id", siloID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []models.Webhook
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, *hook)
+	}
+	return hooks, rows.Err()
+}
+
+// SetActive pauses or resumes a webhook. Paused webhooks aren't sent new
+// events, but deliveries already queued are still attempted.
+func (r *Repository) SetActive(id int, active bool) error {
+	_, err := r.DB.Exec("UPDATE webhooks SET active = ? WHERE id = ?", active, id)
+	return err
+}
+
+// Delete deletes a webhook and its deliveries.
+func (r *Repository) Delete(id int) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ?", id); err != nil {
+		return fmt.Errorf("error deleting webhook deliveries: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM webhooks WHERE id = ?", id); err != nil {
+		return fmt.Errorf("error deleting webhook: %w", err)
+	}
+	return tx.Commit()
+}
+
+// Enqueue queues an event's payload for delivery to a webhook, returning the
+// delivery's ID.
+func (r *Repository) Enqueue(webhookID int, event, payload string) (int, error) {
+	var id int
+	now := time.Now()
+	err := r.DB.QueryRow("INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, ?) RETURNING id",
+		webhookID, event, payload, models.DeliveryPending, now, now).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("error queueing webhook delivery: %w", err)
+	}
+	return id, nil
+}
+
+// FindDelivery finds a delivery by its ID.
+func (r *Repository) FindDelivery(id int) (*models.WebhookDelivery, error) {
+	return scanDelivery(r.DB.QueryRow("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE id = ?", id))
+}
+
+// ListDeliveries lists a webhook's most recent deliveries, newest first.
+func (r *Repository) ListDeliveries(webhookID, limit int) ([]models.WebhookDelivery, error) {
+	return r.listDeliveries("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ?", webhookID, limit)
+}
+
+// due lists the pending deliveries whose next attempt is due, oldest first.
+func (r *Repository) due(now time.Time, limit int) ([]models.WebhookDelivery, error) {
+	return r.listDeliveries("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE status = ? AND next_attempt_at <= ? ORDER BY id LIMIT ?", models.DeliveryPending, now, limit)
+}
+
+// nextDue returns when the next pending delivery is due, or nil if none is.
+func (r *Repository) nextDue() (*time.Time, error) {
+	var next *time.Time
+	err := r.DB.QueryRow("SELECT next_attempt_at FROM webhook_deliveries WHERE status = ? ORDER BY next_attempt_at LIMIT 1", models.DeliveryPending).Scan(&next)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return next, err
+}
+
+// recordAttempt saves the outcome of an attempt to send a delivery.
+func (r *Repository) recordAttempt(d *models.WebhookDelivery) error {
+	_, err := r.DB.Exec("UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, response_code = ?, response_body = ?, error = ?, delivered_at = ? WHERE id = ?",
+		d.Status, d.Attempts, d.NextAttemptAt, d.ResponseCode, d.ResponseBody, d.Error, d.DeliveredAt, d.ID)
+	if err != nil {
+		return fmt.Errorf("error recording webhook delivery: %w", err)
+	}
+	return nil
+}
+
+func (r *Repository) listDeliveries(query string, args ...any) ([]models.WebhookDelivery, error) {
+	rows, err := r.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []models.WebhookDelivery
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, rows.Err()
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanWebhook(row scanner) (*models.Webhook, error) {
+	var hook models.Webhook
+	var events string
+	if err := row.Scan(&hook.ID, &hook.SiloID, &hook.URL, &hook.Secret, &events, &hook.Active, &hook.CreatedAt); err != nil {
+		return nil, err
+	}
+	if events != "" {
+		hook.Events = strings.Split(events, ",")
+	}
+	return &hook, nil
+}
+
+func scanDelivery(row scanner) (*models.WebhookDelivery, error) {
+	var d models.WebhookDelivery
+	err := row.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttemptAt,
+		&d.ResponseCode, &d.ResponseBody, &d.Error, &d.CreatedAt, &d.DeliveredAt)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}